@@ -0,0 +1,111 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Access log middleware writing Common/Combined Log Format or custom templates
+
+package gojiutil
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+	"github.com/zenazn/goji/web/mutil"
+)
+
+// Access log formats for AccessLog, as text/template templates over an AccessLogEntry
+const (
+	CommonLogFormat = `{{dash .Host}} - {{dash .User}} [{{clftime .Time}}] ` +
+		`"{{esc .Method}} {{esc .URI}} {{esc .Proto}}" {{.Status}} {{dash .Bytes}}`
+	CombinedLogFormat = CommonLogFormat + ` "{{dash .Referer}}" "{{dash .UserAgent}}"`
+)
+
+// AccessLogEntry is the data available to AccessLog templates
+type AccessLogEntry struct {
+	Time      time.Time // when the request started
+	Host      string    // client IP address
+	User      string    // authenticated user, see ContextUser
+	Method    string
+	URI       string
+	Proto     string
+	Status    int
+	Bytes     int // response body size
+	Referer   string
+	UserAgent string
+	Duration  time.Duration
+	RequestID string
+}
+
+// accessLogFuncs are the functions available to AccessLog templates: dash escapes a value
+// and prints "-" if it's empty or zero, esc only escapes it, and clftime formats a time as
+// in the Common Log Format
+var accessLogFuncs = template.FuncMap{
+	"dash": func(v interface{}) string {
+		if s := fmt.Sprint(v); s != "" && s != "0" {
+			return clfEscape(s)
+		}
+		return "-"
+	},
+	"esc":     func(v interface{}) string { return clfEscape(fmt.Sprint(v)) },
+	"clftime": func(t time.Time) string { return t.Format("02/Jan/2006:15:04:05 -0700") },
+}
+
+// clfEscape escapes quotes, backslashes and control characters the way Apache does, so
+// clients can't forge log lines
+func clfEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; {
+		case ch == '"' || ch == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(ch)
+		case ch < 0x20 || ch == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", ch)
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	return b.String()
+}
+
+// AccessLog creates a middleware that writes a line for each request to w once it completes,
+// formatted using format, e.g. CombinedLogFormat, or a custom text/template over an
+// AccessLogEntry. It panics if format doesn't parse. Writes are serialized, so w doesn't have
+// to be safe for concurrent use. This is meant for log pipelines ingesting access logs, use it
+// alongside or instead of Logger15.
+func AccessLog(w io.Writer, format string) web.MiddlewareType {
+	tmpl := template.Must(template.New("accesslog").Funcs(accessLogFuncs).Parse(format))
+	var mu sync.Mutex
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			wp := mutil.WrapWriter(rw)
+			h.ServeHTTP(wp, r)
+			e := AccessLogEntry{Time: start, Host: clientIP(*c, r), Method: r.Method,
+				URI: r.RequestURI, Proto: r.Proto, Status: wp.Status(),
+				Bytes: wp.BytesWritten(), Referer: r.Referer(), UserAgent: r.UserAgent(),
+				Duration: time.Since(start), RequestID: middleware.GetReqID(*c)}
+			if e.URI == "" {
+				e.URI = r.URL.RequestURI()
+			}
+			if user, ok := c.Env[ContextUser].(string); ok {
+				e.User = user
+			}
+			var buf bytes.Buffer
+			if err := tmpl.Execute(&buf, e); err != nil {
+				contextLogger(*c).Error("cannot format access log", "err", err)
+				return
+			}
+			buf.WriteByte('\n')
+			mu.Lock()
+			w.Write(buf.Bytes())
+			mu.Unlock()
+		})
+	}
+}
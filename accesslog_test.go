@@ -0,0 +1,51 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("AccessLog", func() {
+
+	serve := func(format string, req *http.Request) string {
+		var out bytes.Buffer
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(AccessLog(&out, format))
+		mx.Get("/widgets", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			c.Env[ContextUser] = "frank"
+			rw.Write([]byte("hello"))
+		})
+		mx.ServeHTTP(httptest.NewRecorder(), req)
+		return out.String()
+	}
+
+	It("writes the combined log format", func() {
+		req, _ := http.NewRequest("GET", "/widgets?page=2", nil)
+		req.RemoteAddr = "10.0.0.1:5123"
+		req.Header.Set("User-Agent", `curl "8.0"`)
+		Ω(serve(CombinedLogFormat, req)).Should(MatchRegexp(
+			`^10\.0\.0\.1 - frank \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [-+]\d{4}\] ` +
+				`"GET /widgets\?page=2 HTTP/1\.1" 200 5 "-" "curl \\"8\.0\\""\n$`))
+	})
+
+	It("writes the common log format with dashes for missing values", func() {
+		req, _ := http.NewRequest("GET", "/missing", nil)
+		Ω(serve(CommonLogFormat, req)).Should(MatchRegexp(
+			`^- - - \[.+\] "GET /missing HTTP/1\.1" 404 \d+\n$`))
+	})
+
+	It("supports custom templates", func() {
+		req, _ := http.NewRequest("GET", "/widgets", nil)
+		Ω(serve(`{{.Method}} {{.URI}} {{.Status}} {{.Bytes}}`, req)).Should(
+			Equal("GET /widgets 200 5\n"))
+	})
+})
@@ -0,0 +1,75 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Adapters between goji and standard net/http middlewares
+
+package gojiutil
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/zenazn/goji/web"
+)
+
+// Wrap adapts a standard net/http middleware, e.g. from gorilla/handlers or nosurf, to goji so
+// it can be used in mx.Use like the gojiutil middlewares
+func Wrap(std func(http.Handler) http.Handler) web.MiddlewareType {
+	return func(c *web.C, h http.Handler) http.Handler {
+		return std(h)
+	}
+}
+
+// Unwrap adapts a goji middleware, such as most gojiutil middlewares, to a standard net/http
+// middleware, e.g. to use gojiutil with goji.io (goji v2) or a plain http.ServeMux. The web.C
+// Env of the request is kept in r.Context() (see BridgeContext) so all the unwrapped
+// middlewares of a request share it and handlers can reach it using CFromRequest, e.g.
+//
+//	mux := goji.NewMux()
+//	mux.Use(gojiutil.Chain(gojiutil.RequestID, gojiutil.Logger15(log), gojiutil.Recoverer))
+//	mux.HandleFunc(pat.Get("/x"), func(rw http.ResponseWriter, r *http.Request) {
+//	    gojiutil.ErrorString(gojiutil.CFromRequest(r), rw, 404, "Not found")
+//	})
+//
+// The URLParams of the web.C are empty, goji.io handlers use pat.Param instead. Unwrap panics
+// if mw is of an unsupported type.
+func Unwrap(mw web.MiddlewareType) func(http.Handler) http.Handler {
+	switch f := mw.(type) {
+	case func(http.Handler) http.Handler:
+		return f
+	case func(*web.C, http.Handler) http.Handler:
+		return func(h http.Handler) http.Handler {
+			return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				c := web.C{Env: EnvFromContext(r.Context())}
+				if c.Env == nil {
+					c.Env = make(map[interface{}]interface{})
+					r = r.WithContext(context.WithValue(r.Context(), envKey{}, c.Env))
+				}
+				f(&c, h).ServeHTTP(rw, r)
+			})
+		}
+	}
+	panic(fmt.Sprintf("gojiutil.Unwrap: unsupported middleware type %T", mw))
+}
+
+// Chain unwraps the goji middlewares mws into a single standard net/http middleware, the
+// first one being the outermost
+func Chain(mws ...web.MiddlewareType) func(http.Handler) http.Handler {
+	std := make([]func(http.Handler) http.Handler, len(mws))
+	for i, mw := range mws {
+		std[i] = Unwrap(mw)
+	}
+	return func(h http.Handler) http.Handler {
+		for i := len(std) - 1; i >= 0; i-- {
+			h = std[i](h)
+		}
+		return h
+	}
+}
+
+// CFromRequest returns a web.C holding the Env of a request served through middlewares
+// adapted by Unwrap or BridgeContext, for use with the gojiutil helpers taking a web.C. The
+// Env is nil if there's none.
+func CFromRequest(r *http.Request) web.C {
+	return web.C{Env: EnvFromContext(r.Context())}
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("Wrap", func() {
+
+	It("adapts standard middlewares to goji", func() {
+		std := func(h http.Handler) http.Handler {
+			return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				rw.Header().Set("X-Std", "1")
+				h.ServeHTTP(rw, r)
+			})
+		}
+		mx := web.New()
+		mx.Use(Wrap(std))
+		mx.Get("/", func(rw http.ResponseWriter, r *http.Request) {})
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		Ω(resp.Header().Get("X-Std")).Should(Equal("1"))
+	})
+})
+
+var _ = Describe("Unwrap", func() {
+
+	It("adapts goji middlewares to net/http", func() {
+		sm := http.NewServeMux()
+		sm.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte("ok"))
+		})
+		h := Unwrap(RequestID)(Unwrap(Recoverer)(sm))
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		Ω(resp.Body.String()).Should(Equal("ok"))
+		Ω(resp.Header().Get(RequestIDHeader)).ShouldNot(BeEmpty())
+
+		Ω(func() { Unwrap(42) }).Should(Panic())
+	})
+	It("shares the Env across a chain like goji.io's", func() {
+		var logs []string
+		sm := http.NewServeMux()
+		sm.HandleFunc("/missing", func(rw http.ResponseWriter, r *http.Request) {
+			c := CFromRequest(r)
+			Ω(middleware.GetReqID(c)).ShouldNot(BeEmpty())
+			ErrorString(c, rw, 404, "Not found")
+		})
+		h := Chain(RequestID, Logger15(testLogger(&logs)), Recoverer)(sm)
+		req, _ := http.NewRequest("GET", "/missing", nil)
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		Ω(resp.Code).Should(Equal(404))
+		Ω(logs).Should(HaveLen(1))
+		Ω(logs[0]).Should(ContainSubstring("err Not found"))
+		Ω(logs[0]).Should(ContainSubstring("req " + resp.Header().Get(RequestIDHeader)))
+	})
+})
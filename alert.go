@@ -0,0 +1,215 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Alerting on error-rate thresholds
+
+package gojiutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// statusObservers are called by Logger15 with the outcome of every request
+var statusObservers []func(c web.C, status int, d time.Duration)
+
+// AddStatusObserver registers fn to be called by Logger15 with the status and duration of
+// every request it logs, c.Env["stack"] is set if the request panicked. Use GetRoute(c) rather
+// than the path to label metrics. Observers must be registered before serving and must be
+// fast, they run on the request's goroutine.
+func AddStatusObserver(fn func(c web.C, status int, d time.Duration)) {
+	statusObservers = append(statusObservers, fn)
+}
+
+// AlertCondition triggers an alert when, within the sliding window, at least MinCount
+// requests matched and they make up at least MinRate of all requests
+type AlertCondition struct {
+	Name     string
+	Match    func(status int, panicked bool) bool
+	Window   time.Duration // default 1 minute
+	MinCount int
+	MinRate  float64       // 0..1, 0 to only consider the count
+	Cooldown time.Duration // min time between two alerts for the condition, default 10 min
+}
+
+// ErrorRateCondition triggers when 5xx responses exceed rate with at least min of them
+func ErrorRateCondition(rate float64, min int, window time.Duration) AlertCondition {
+	return AlertCondition{Name: "5xx rate", Window: window, MinCount: min, MinRate: rate,
+		Match: func(status int, panicked bool) bool { return status >= 500 }}
+}
+
+// ThrottledCondition triggers on sustained 429 Too Many Requests responses
+func ThrottledCondition(min int, window time.Duration) AlertCondition {
+	return AlertCondition{Name: "sustained 429s", Window: window, MinCount: min,
+		Match: func(status int, panicked bool) bool { return status == 429 }}
+}
+
+// PanicCondition triggers when at least min handlers panicked within the window
+func PanicCondition(min int, window time.Duration) AlertCondition {
+	return AlertCondition{Name: "panics", Window: window, MinCount: min,
+		Match: func(status int, panicked bool) bool { return panicked }}
+}
+
+// Alert is passed to the hooks when a condition triggers
+type Alert struct {
+	Condition string    `json:"condition"`
+	Count     int       `json:"count"` // matching requests in the window
+	Total     int       `json:"total"` // all requests in the window
+	Window    string    `json:"window"`
+	Time      time.Time `json:"time"`
+}
+
+// String summarizes the alert
+func (a Alert) String() string {
+	return fmt.Sprintf("%s: %d of %d requests in the last %s", a.Condition, a.Count, a.Total,
+		a.Window)
+}
+
+// AlertHook is called, in its own goroutine, when an alert triggers
+type AlertHook func(Alert)
+
+// AlertEvaluator counts request outcomes against the conditions, register its Observe
+// method using AddStatusObserver
+type AlertEvaluator struct {
+	hooks []AlertHook
+	mu    sync.Mutex
+	conds []*alertState
+}
+
+type alertState struct {
+	AlertCondition
+	buckets   []alertBucket // one per second of the window
+	lastAlert time.Time
+}
+
+type alertBucket struct {
+	sec          int64
+	match, total int
+}
+
+// NewAlertEvaluator creates an evaluator of the conditions that calls the hooks
+func NewAlertEvaluator(conds []AlertCondition, hooks ...AlertHook) *AlertEvaluator {
+	e := &AlertEvaluator{hooks: hooks}
+	for _, c := range conds {
+		if c.Window < time.Second {
+			c.Window = time.Minute
+		}
+		if c.Cooldown <= 0 {
+			c.Cooldown = 10 * time.Minute
+		}
+		e.conds = append(e.conds, &alertState{AlertCondition: c,
+			buckets: make([]alertBucket, int(c.Window/time.Second))})
+	}
+	return e
+}
+
+// Observe records the outcome of a request and evaluates the conditions
+func (e *AlertEvaluator) Observe(c web.C, status int, d time.Duration) {
+	_, panicked := c.Env["stack"]
+	e.observe(time.Now(), status, panicked)
+}
+
+func (e *AlertEvaluator) observe(now time.Time, status int, panicked bool) {
+	sec := now.Unix()
+	var alerts []Alert
+	e.mu.Lock()
+	for _, s := range e.conds {
+		b := &s.buckets[sec%int64(len(s.buckets))]
+		if b.sec != sec {
+			*b = alertBucket{sec: sec}
+		}
+		b.total++
+		if !s.Match(status, panicked) {
+			continue
+		}
+		b.match++
+		if now.Sub(s.lastAlert) < s.Cooldown {
+			continue // deduplicate
+		}
+		match, total := 0, 0
+		for _, b := range s.buckets {
+			if sec-b.sec < int64(len(s.buckets)) {
+				match += b.match
+				total += b.total
+			}
+		}
+		if match >= s.MinCount && float64(match) >= s.MinRate*float64(total) {
+			s.lastAlert = now
+			alerts = append(alerts, Alert{Condition: s.Name, Count: match, Total: total,
+				Window: s.Window.String(), Time: now})
+		}
+	}
+	e.mu.Unlock()
+	for _, a := range alerts {
+		for _, h := range e.hooks {
+			go h(a)
+		}
+	}
+}
+
+// LogAlertHook logs alerts at the crit level
+func LogAlertHook(log Logger) AlertHook {
+	return func(a Alert) {
+		log.Crit("alert triggered", "condition", a.Condition, "count", a.Count,
+			"total", a.Total, "window", a.Window)
+	}
+}
+
+// WebhookAlertHook posts alerts as JSON to url, the payload is produced by format, or is the
+// Alert itself if format is nil
+func WebhookAlertHook(url string, format func(Alert) interface{}) AlertHook {
+	client := &http.Client{Timeout: 10 * time.Second}
+	return func(a Alert) {
+		var payload interface{} = a
+		if format != nil {
+			payload = format(a)
+		}
+		buf, err := json.Marshal(payload)
+		if err != nil {
+			log15.Error("alert webhook: cannot encode payload", "err", err)
+			return
+		}
+		resp, err := client.Post(url, ApplicationJSON, bytes.NewReader(buf))
+		if err != nil {
+			log15.Error("alert webhook failed", "err", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log15.Error("alert webhook failed", "status", resp.Status)
+		}
+	}
+}
+
+// SlackAlertHook posts alerts to a Slack incoming webhook URL
+func SlackAlertHook(webhookURL string) AlertHook {
+	return WebhookAlertHook(webhookURL, func(a Alert) interface{} {
+		return map[string]string{"text": ":rotating_light: " + a.String()}
+	})
+}
+
+// PagerDutyAlertHook triggers PagerDuty incidents using the Events API v2, alerts for the
+// same condition are grouped into one incident by their dedup key
+func PagerDutyAlertHook(routingKey, source string) AlertHook {
+	return WebhookAlertHook("https://events.pagerduty.com/v2/enqueue",
+		func(a Alert) interface{} {
+			return map[string]interface{}{
+				"routing_key":  routingKey,
+				"event_action": "trigger",
+				"dedup_key":    source + "/" + a.Condition,
+				"payload": map[string]interface{}{
+					"summary":        a.String(),
+					"source":         source,
+					"severity":       "critical",
+					"timestamp":      a.Time.Format(time.RFC3339),
+					"custom_details": a,
+				},
+			}
+		})
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("AlertEvaluator", func() {
+
+	It("triggers once per cool-down", func() {
+		alerts := make(chan Alert, 10)
+		e := NewAlertEvaluator([]AlertCondition{ErrorRateCondition(0.5, 3, time.Minute)},
+			func(a Alert) { alerts <- a })
+		now := time.Now()
+		for i := 0; i < 5; i++ {
+			e.observe(now, 200, false)
+		}
+		e.observe(now, 500, false)
+		e.observe(now, 503, false)
+		e.observe(now, 500, false) // 3 of 8: below the rate
+		Consistently(alerts, 20*time.Millisecond).ShouldNot(Receive())
+		e.observe(now, 500, false)
+		e.observe(now, 500, false) // 5 of 10
+		var a Alert
+		Eventually(alerts).Should(Receive(&a))
+		Ω(a.Count).Should(Equal(5))
+		Ω(a.Total).Should(Equal(10))
+		e.observe(now.Add(time.Second), 500, false)
+		Consistently(alerts, 20*time.Millisecond).ShouldNot(Receive())
+	})
+})
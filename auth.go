@@ -0,0 +1,310 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Authentication middlewares
+
+package gojiutil
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // register the hashes used by jwtHashes
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// ContextClaims is the hash key in which JWTAuth places the token's JWTClaims
+var ContextClaims string = "claims"
+
+// JWTClaims are the claims of a JSON web token
+type JWTClaims map[string]interface{}
+
+// Subject returns the "sub" claim
+func (cl JWTClaims) Subject() string {
+	s, _ := cl["sub"].(string)
+	return s
+}
+
+// time returns a NumericDate claim, ok is false if it's absent
+func (cl JWTClaims) time(name string) (t time.Time, ok bool, err error) {
+	v, present := cl[name]
+	if !present {
+		return t, false, nil
+	}
+	secs, isNum := v.(float64)
+	if !isNum {
+		return t, false, fmt.Errorf("invalid %q claim", name)
+	}
+	return time.Unix(int64(secs), 0), true, nil
+}
+
+// audience returns the "aud" claim, which is either a string or an array of strings
+func (cl JWTClaims) audience() []string {
+	switch aud := cl["aud"].(type) {
+	case string:
+		return []string{aud}
+	case []interface{}:
+		var auds []string
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				auds = append(auds, s)
+			}
+		}
+		return auds
+	}
+	return nil
+}
+
+// JWTKeyFunc returns the key verifying tokens signed with the algorithm alg by the key
+// identified by kid (which may be empty): a []byte secret for HS256/384/512, an
+// *rsa.PublicKey for RS256/384/512, or an *ecdsa.PublicKey for ES256/384/512. The key type
+// must match the algorithm, which prevents algorithm confusion attacks.
+type JWTKeyFunc func(alg, kid string) (interface{}, error)
+
+// JWTOptions configures JWT validation
+type JWTOptions struct {
+	Algorithms []string      // accepted algorithms, default all supported ones
+	Issuer     string        // required "iss" claim, if set
+	Audience   string        // audience that must be in the "aud" claim, if set
+	Leeway     time.Duration // clock skew tolerated on "exp" and "nbf"
+	Optional   bool          // let requests without an Authorization header through
+}
+
+// JWTAuth creates a middleware validating the JSON web token in the Authorization: Bearer
+// header, placing its claims into c.Env[ContextClaims]. Requests with a missing or invalid
+// token get a 401 Unauthorized with a WWW-Authenticate header.
+func JWTAuth(keyfunc JWTKeyFunc, opts JWTOptions) web.MiddlewareType {
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			auth := r.Header.Get("Authorization")
+			if auth == "" && opts.Optional {
+				h.ServeHTTP(rw, r)
+				return
+			}
+			if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+				rw.Header().Set("WWW-Authenticate", "Bearer")
+				ErrorString(*c, rw, 401, "Missing bearer token")
+				return
+			}
+			claims, err := ParseJWT(strings.TrimSpace(auth[7:]), keyfunc, opts)
+			if err != nil {
+				rw.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				ErrorString(*c, rw, 401, "Invalid bearer token: "+err.Error())
+				return
+			}
+			c.Env[ContextClaims] = claims
+			h.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// GetClaims returns the claims placed into c.Env by JWTAuth or nil
+func GetClaims(c web.C) JWTClaims {
+	cl, _ := c.Env[ContextClaims].(JWTClaims)
+	return cl
+}
+
+// ParseJWT verifies the signature and the registered claims of a compact JWT and returns its
+// claims
+func ParseJWT(token string, keyfunc JWTKeyFunc, opts JWTOptions) (JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if !jwtAlgAllowed(header.Alg, opts.Algorithms) {
+		return nil, fmt.Errorf("algorithm %q not allowed", header.Alg)
+	}
+	key, err := keyfunc(header.Alg, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	if err := verifyJWT(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+	var claims JWTClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if exp, ok, err := claims.time("exp"); err != nil {
+		return nil, err
+	} else if ok && !now.Before(exp.Add(opts.Leeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok, err := claims.time("nbf"); err != nil {
+		return nil, err
+	} else if ok && now.Add(opts.Leeway).Before(nbf) {
+		return nil, errors.New("token not valid yet")
+	}
+	if opts.Issuer != "" && claims["iss"] != opts.Issuer {
+		return nil, errors.New("wrong issuer")
+	}
+	if opts.Audience != "" {
+		found := false
+		for _, a := range claims.audience() {
+			found = found || a == opts.Audience
+		}
+		if !found {
+			return nil, errors.New("wrong audience")
+		}
+	}
+	return claims, nil
+}
+
+// decodeJWTPart decodes the base64url JSON of a token's header or payload
+func decodeJWTPart(part string, v interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(buf, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+// jwtHashes maps the supported algorithms' size suffix to their hash
+var jwtHashes = map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384,
+	"512": crypto.SHA512}
+
+func jwtAlgAllowed(alg string, allowed []string) bool {
+	if len(alg) != 5 || jwtHashes[alg[2:]] == 0 ||
+		(alg[:2] != "HS" && alg[:2] != "RS" && alg[:2] != "ES") {
+		return false // notably rejects "none"
+	}
+	if allowed == nil {
+		return true
+	}
+	for _, a := range allowed {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyJWT checks the signature of the signing input with the key
+func verifyJWT(alg string, key interface{}, input string, sig []byte) error {
+	hashAlg := jwtHashes[alg[2:]]
+	invalid := errors.New("invalid signature")
+	switch k := key.(type) {
+	case []byte:
+		if alg[:2] != "HS" {
+			break
+		}
+		mac := hmac.New(hashAlg.New, k)
+		mac.Write([]byte(input))
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return invalid
+		}
+		return nil
+	case *rsa.PublicKey:
+		if alg[:2] != "RS" {
+			break
+		}
+		h := hashAlg.New()
+		h.Write([]byte(input))
+		if rsa.VerifyPKCS1v15(k, hashAlg, h.Sum(nil), sig) != nil {
+			return invalid
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(sig) != 2*size {
+			break
+		}
+		h := hashAlg.New()
+		h.Write([]byte(input))
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, h.Sum(nil), r, s) {
+			return invalid
+		}
+		return nil
+	}
+	return invalid
+}
+
+// ContextUser is the hash key in which authentication middlewares place the authenticated
+// user name, Logger15 logs it
+var ContextUser string = "user"
+
+// BasicAuth creates a middleware requiring HTTP basic authentication, validate checks the
+// credentials and the user name is placed into c.Env[ContextUser]. Requests with missing or
+// invalid credentials get a 401 Unauthorized challenging the client for the realm. Basic
+// credentials are sent in the clear so only use it over TLS.
+func BasicAuth(realm string, validate func(user, pass string) bool) web.MiddlewareType {
+	challenge := `Basic realm="` + strings.Replace(realm, `"`, `\"`, -1) + `", charset="UTF-8"`
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			user, pass, ok := r.BasicAuth()
+			if !ok || !validate(user, pass) {
+				rw.Header().Set("WWW-Authenticate", challenge)
+				if ok {
+					ErrorKV(*c, rw, 401, "Invalid credentials", "auth_user", user)
+				} else {
+					ErrorString(*c, rw, 401, "Authentication required")
+				}
+				return
+			}
+			c.Env[ContextUser] = user
+			h.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// ContextPrincipal is the hash key in which APIKeyAuth places the principal owning the key
+var ContextPrincipal string = "principal"
+
+// APIKeyAuth creates a middleware authenticating requests by the API key found in the given
+// request header, lookup returns the principal owning a key, e.g. a service account, and is
+// best implemented using HashAPIKey so keys needn't be stored in the clear. Requests without
+// a key get a 401 Unauthorized and those with an unknown key a 403 Forbidden. The principal is
+// placed into c.Env[ContextPrincipal] and, if it's a string or a fmt.Stringer, also into
+// c.Env[ContextUser] for Logger15.
+func APIKeyAuth(header string,
+	lookup func(key string) (principal interface{}, ok bool)) web.MiddlewareType {
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			key := strings.TrimSpace(r.Header.Get(header))
+			if key == "" {
+				ErrorString(*c, rw, 401, "Missing API key in "+header+" header")
+				return
+			}
+			principal, ok := lookup(key)
+			if !ok {
+				ErrorString(*c, rw, 403, "Invalid API key")
+				return
+			}
+			c.Env[ContextPrincipal] = principal
+			switch p := principal.(type) {
+			case string:
+				c.Env[ContextUser] = p
+			case fmt.Stringer:
+				c.Env[ContextUser] = p.String()
+			}
+			h.ServeHTTP(rw, r)
+		})
+	}
+}
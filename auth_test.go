@@ -0,0 +1,168 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+// signHS256 produces a test JWT
+func signHS256(secret []byte, claims map[string]interface{}) string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	payload, _ := json.Marshal(claims)
+	input := b64([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + b64(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(input))
+	return input + "." + b64(mac.Sum(nil))
+}
+
+var _ = Describe("JWTAuth", func() {
+
+	secret := []byte("s3cret")
+	keyfunc := func(alg, kid string) (interface{}, error) { return secret, nil }
+	var mx *web.Mux
+	var claims JWTClaims
+
+	BeforeEach(func() {
+		claims = nil
+		mx = web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(JWTAuth(keyfunc, JWTOptions{Audience: "api"}))
+		mx.Get("/", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			claims = GetClaims(c)
+		})
+	})
+
+	get := func(auth string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		return resp
+	}
+
+	It("accepts valid tokens", func() {
+		tok := signHS256(secret, map[string]interface{}{"sub": "bob", "aud": []string{"api"},
+			"exp": time.Now().Add(time.Minute).Unix()})
+		Ω(get("Bearer " + tok).Code).Should(Equal(200))
+		Ω(claims.Subject()).Should(Equal("bob"))
+	})
+
+	It("rejects missing, expired, and forged tokens", func() {
+		resp := get("")
+		Ω(resp.Code).Should(Equal(401))
+		Ω(resp.Header().Get("WWW-Authenticate")).Should(Equal("Bearer"))
+		expired := signHS256(secret, map[string]interface{}{"aud": "api",
+			"exp": time.Now().Add(-time.Minute).Unix()})
+		Ω(get("Bearer " + expired).Code).Should(Equal(401))
+		forged := signHS256([]byte("other"), map[string]interface{}{"aud": "api"})
+		Ω(get("Bearer " + forged).Code).Should(Equal(401))
+		Ω(get("Bearer " + signHS256(secret, nil)).Code).Should(Equal(401)) // no audience
+		Ω(claims).Should(BeNil())
+	})
+
+	It("verifies ES256 signatures and rejects key type confusion", func() {
+		priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		b64 := base64.RawURLEncoding.EncodeToString
+		input := b64([]byte(`{"alg":"ES256"}`)) + "." + b64([]byte(`{"sub":"x"}`))
+		h := sha256.Sum256([]byte(input))
+		r, s, _ := ecdsa.Sign(rand.Reader, priv, h[:])
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		tok := input + "." + b64(sig)
+		ecKey := func(alg, kid string) (interface{}, error) { return &priv.PublicKey, nil }
+		cl, err := ParseJWT(tok, ecKey, JWTOptions{})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(cl.Subject()).Should(Equal("x"))
+		_, err = ParseJWT(tok, keyfunc, JWTOptions{})
+		Ω(err).Should(HaveOccurred())
+	})
+})
+
+var _ = Describe("BasicAuth", func() {
+
+	var mx *web.Mux
+	var user interface{}
+
+	BeforeEach(func() {
+		user = nil
+		mx = web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(BasicAuth("admin", func(u, p string) bool {
+			return SecureCompare(u, "root") && SecureCompare(p, "pw")
+		}))
+		mx.Get("/", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			user = c.Env[ContextUser]
+		})
+	})
+
+	It("challenges clients without valid credentials", func() {
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		Ω(resp.Code).Should(Equal(401))
+		Ω(resp.Header().Get("WWW-Authenticate")).
+			Should(Equal(`Basic realm="admin", charset="UTF-8"`))
+		req.SetBasicAuth("root", "nope")
+		resp = httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		Ω(resp.Code).Should(Equal(401))
+		Ω(user).Should(BeNil())
+	})
+
+	It("records the authenticated user", func() {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.SetBasicAuth("root", "pw")
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		Ω(resp.Code).Should(Equal(200))
+		Ω(user).Should(Equal("root"))
+	})
+})
+
+var _ = Describe("APIKeyAuth", func() {
+
+	It("looks up the principal of the key", func() {
+		var env map[interface{}]interface{}
+		keys := map[string]string{HashAPIKey("k1"): "billing-svc"}
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(APIKeyAuth("X-Api-Key", func(key string) (interface{}, bool) {
+			p, ok := keys[HashAPIKey(key)]
+			return p, ok
+		}))
+		mx.Get("/", func(c web.C, rw http.ResponseWriter, r *http.Request) { env = c.Env })
+		get := func(key string) int {
+			req, _ := http.NewRequest("GET", "/", nil)
+			if key != "" {
+				req.Header.Set("X-Api-Key", key)
+			}
+			resp := httptest.NewRecorder()
+			mx.ServeHTTP(resp, req)
+			return resp.Code
+		}
+		Ω(get("")).Should(Equal(401))
+		Ω(get("k2")).Should(Equal(403))
+		Ω(env).Should(BeNil())
+		Ω(get("k1")).Should(Equal(200))
+		Ω(env[ContextPrincipal]).Should(Equal("billing-svc"))
+		Ω(env[ContextUser]).Should(Equal("billing-svc"))
+	})
+})
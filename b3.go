@@ -0,0 +1,217 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Zipkin B3 trace propagation
+
+package gojiutil
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+)
+
+// ContextB3 is the hash key in which the B3 middleware places the request's B3Context
+var ContextB3 string = "b3"
+
+// B3 propagation headers, see https://github.com/openzipkin/b3-propagation
+const (
+	B3Header             = "B3"
+	B3TraceIDHeader      = "X-B3-Traceid"
+	B3SpanIDHeader       = "X-B3-Spanid"
+	B3ParentSpanIDHeader = "X-B3-Parentspanid"
+	B3SampledHeader      = "X-B3-Sampled"
+	B3FlagsHeader        = "X-B3-Flags"
+)
+
+// B3Context is the trace context carried by B3 headers, IDs are lower-hex strings (16 or 32
+// characters for trace IDs, 16 for span IDs)
+type B3Context struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Sampled      *bool // nil means the sampling decision is deferred
+	Debug        bool
+}
+
+// ExtractB3 parses the single b3 header, falling back to the multi-header X-B3-* form. It
+// returns false if no valid trace context is present.
+func ExtractB3(h http.Header) (B3Context, bool) {
+	if single := h.Get(B3Header); single != "" {
+		return parseB3Single(single)
+	}
+
+	var ctx B3Context
+	ctx.TraceID = strings.ToLower(h.Get(B3TraceIDHeader))
+	ctx.SpanID = strings.ToLower(h.Get(B3SpanIDHeader))
+	ctx.ParentSpanID = strings.ToLower(h.Get(B3ParentSpanIDHeader))
+	switch h.Get(B3SampledHeader) {
+	case "1", "true":
+		ctx.Sampled = boolPtr(true)
+	case "0", "false":
+		ctx.Sampled = boolPtr(false)
+	}
+	if h.Get(B3FlagsHeader) == "1" {
+		ctx.Debug = true
+		ctx.Sampled = boolPtr(true)
+	}
+	if !validTraceID(ctx.TraceID) || !validSpanID(ctx.SpanID) ||
+		(ctx.ParentSpanID != "" && !validSpanID(ctx.ParentSpanID)) {
+		return B3Context{}, false
+	}
+	return ctx, true
+}
+
+// parseB3Single parses {TraceId}-{SpanId}-{SamplingState}-{ParentSpanId}, where the last two
+// are optional. A lone sampling state (e.g. "0") carries no trace context and yields false.
+func parseB3Single(v string) (B3Context, bool) {
+	var ctx B3Context
+	parts := strings.Split(strings.ToLower(v), "-")
+	if len(parts) < 2 || len(parts) > 4 {
+		return ctx, false
+	}
+	ctx.TraceID, ctx.SpanID = parts[0], parts[1]
+	if !validTraceID(ctx.TraceID) || !validSpanID(ctx.SpanID) {
+		return B3Context{}, false
+	}
+	if len(parts) > 2 {
+		switch parts[2] {
+		case "1":
+			ctx.Sampled = boolPtr(true)
+		case "0":
+			ctx.Sampled = boolPtr(false)
+		case "d":
+			ctx.Debug = true
+			ctx.Sampled = boolPtr(true)
+		default:
+			return B3Context{}, false
+		}
+	}
+	if len(parts) > 3 {
+		if !validSpanID(parts[3]) {
+			return B3Context{}, false
+		}
+		ctx.ParentSpanID = parts[3]
+	}
+	return ctx, true
+}
+
+// InjectB3 sets the B3 headers for ctx, either the single b3 header or the X-B3-* headers
+func InjectB3(h http.Header, ctx B3Context, single bool) {
+	if single {
+		v := ctx.TraceID + "-" + ctx.SpanID
+		switch {
+		case ctx.Debug:
+			v += "-d"
+		case ctx.Sampled != nil && *ctx.Sampled:
+			v += "-1"
+		case ctx.Sampled != nil:
+			v += "-0"
+		}
+		if ctx.ParentSpanID != "" && (ctx.Debug || ctx.Sampled != nil) {
+			v += "-" + ctx.ParentSpanID
+		}
+		h.Set(B3Header, v)
+		return
+	}
+
+	h.Set(B3TraceIDHeader, ctx.TraceID)
+	h.Set(B3SpanIDHeader, ctx.SpanID)
+	if ctx.ParentSpanID != "" {
+		h.Set(B3ParentSpanIDHeader, ctx.ParentSpanID)
+	}
+	if ctx.Debug {
+		h.Set(B3FlagsHeader, "1")
+	} else if ctx.Sampled != nil {
+		if *ctx.Sampled {
+			h.Set(B3SampledHeader, "1")
+		} else {
+			h.Set(B3SampledHeader, "0")
+		}
+	}
+}
+
+// B3 is a middleware that joins the incoming B3 trace, or starts a new one, and places the
+// context of the span representing this request into c.Env[ContextB3]. Use B3Headers to
+// propagate it to downstream calls.
+func B3(c *web.C, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ctx, ok := ExtractB3(r.Header)
+		if ok {
+			// we're a child of the caller's span
+			ctx.ParentSpanID = ctx.SpanID
+		} else {
+			ctx = B3Context{TraceID: randomHex(16)}
+		}
+		ctx.SpanID = randomHex(8)
+		c.Env[ContextB3] = ctx
+
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// B3Headers injects the request's B3 context into the headers of a downstream request, the
+// downstream span becomes a child of the request's span. It does nothing if the B3 middleware
+// isn't installed.
+func B3Headers(c web.C, h http.Header, single bool) {
+	if ctx, ok := c.Env[ContextB3].(B3Context); ok {
+		ctx.ParentSpanID = ctx.SpanID
+		ctx.SpanID = randomHex(8)
+		InjectB3(h, ctx, single)
+	}
+}
+
+func validTraceID(id string) bool { return (len(id) == 16 || len(id) == 32) && isHex(id) }
+func validSpanID(id string) bool  { return len(id) == 16 && isHex(id) }
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// randomHex returns n random bytes as lower-hex string
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func boolPtr(b bool) *bool { return &b }
+
+// B3Tracer returns a propagation-only Tracer: spans carry B3 identifiers so the service
+// participates in Zipkin traces, but nothing is reported, tags are discarded
+func B3Tracer(single bool) Tracer {
+	return b3Tracer{single: single}
+}
+
+type b3Tracer struct{ single bool }
+
+func (t b3Tracer) StartSpan(name string, parent Span, carrier http.Header) Span {
+	var ctx B3Context
+	if p, ok := parent.(*b3Span); ok {
+		ctx = p.ctx
+		ctx.ParentSpanID = ctx.SpanID
+	} else if in, ok := ExtractB3(carrier); ok {
+		ctx = in
+		ctx.ParentSpanID = ctx.SpanID
+	} else {
+		ctx = B3Context{TraceID: randomHex(16)}
+	}
+	ctx.SpanID = randomHex(8)
+	return &b3Span{ctx: ctx, single: t.single}
+}
+
+type b3Span struct {
+	ctx    B3Context
+	single bool
+}
+
+func (s *b3Span) SetTag(key string, value interface{}) {}
+func (s *b3Span) Finish(err error)                     {}
+func (s *b3Span) Inject(h http.Header)                 { InjectB3(h, s.ctx, s.single) }
@@ -0,0 +1,60 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("B3", func() {
+	const traceID = "80f198ee56343ba864fe8b2a57d3eff7"
+	const spanID = "e457b5a2e4d86bd1"
+	const parentID = "05e3ac9a4f6e3b90"
+
+	It("parses the single header", func() {
+		h := http.Header{}
+		h.Set("b3", traceID+"-"+spanID+"-1-"+parentID)
+		ctx, ok := ExtractB3(h)
+		Ω(ok).Should(BeTrue())
+		Ω(ctx.TraceID).Should(Equal(traceID))
+		Ω(ctx.SpanID).Should(Equal(spanID))
+		Ω(ctx.ParentSpanID).Should(Equal(parentID))
+		Ω(*ctx.Sampled).Should(BeTrue())
+	})
+
+	It("parses the multi headers", func() {
+		h := http.Header{}
+		h.Set("X-B3-TraceId", traceID)
+		h.Set("X-B3-SpanId", spanID)
+		h.Set("X-B3-Sampled", "0")
+		ctx, ok := ExtractB3(h)
+		Ω(ok).Should(BeTrue())
+		Ω(ctx.TraceID).Should(Equal(traceID))
+		Ω(*ctx.Sampled).Should(BeFalse())
+	})
+
+	It("rejects garbage", func() {
+		h := http.Header{}
+		h.Set("b3", "0")
+		_, ok := ExtractB3(h)
+		Ω(ok).Should(BeFalse())
+		h.Set("b3", "xyz-"+spanID)
+		_, ok = ExtractB3(h)
+		Ω(ok).Should(BeFalse())
+	})
+
+	It("round-trips through inject", func() {
+		in := B3Context{TraceID: traceID, SpanID: spanID, ParentSpanID: parentID,
+			Sampled: boolPtr(true)}
+		for _, single := range []bool{true, false} {
+			h := http.Header{}
+			InjectB3(h, in, single)
+			out, ok := ExtractB3(h)
+			Ω(ok).Should(BeTrue())
+			Ω(out).Should(Equal(in))
+		}
+	})
+})
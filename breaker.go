@@ -0,0 +1,344 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Circuit breakers
+
+package gojiutil
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/mutil"
+)
+
+// BreakerOptions configures a circuit breaker, it is shared by the inbound middleware and the
+// outbound transport so both can be tuned the same way
+type BreakerOptions struct {
+	ErrorRate     float64       // trip when the failure rate in a window exceeds this, default 0.5
+	MinRequests   int           // don't trip with fewer requests in the window, default 20
+	Window        time.Duration // length of the counting window, default 10s
+	OpenTimeout   time.Duration // how long to fail fast before probing, default 30s
+	Probes        int           // number of concurrent probes when half-open, default 1
+	SlowThreshold time.Duration // if non-zero, slower calls count as failures
+}
+
+func (o *BreakerOptions) setDefaults() {
+	if o.ErrorRate <= 0 {
+		o.ErrorRate = 0.5
+	}
+	if o.MinRequests <= 0 {
+		o.MinRequests = 20
+	}
+	if o.Window <= 0 {
+		o.Window = 10 * time.Second
+	}
+	if o.OpenTimeout <= 0 {
+		o.OpenTimeout = 30 * time.Second
+	}
+	if o.Probes <= 0 {
+		o.Probes = 1
+	}
+}
+
+// BreakerState is the state of a circuit breaker
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // calls flow normally
+	BreakerOpen                         // calls fail fast
+	BreakerHalfOpen                     // a limited number of probes test the waters
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// Breaker is a circuit breaker counting successes and failures in fixed windows. Callers ask
+// Allow before a call and report its outcome with Done. It is safe for concurrent use.
+//
+// Every state change starts a new generation, the outcome of a call admitted in an earlier
+// generation is ignored, e.g. a slow call admitted while closed can't close the breaker while
+// its probe is still running.
+type Breaker struct {
+	opts     BreakerOptions
+	mu       sync.Mutex
+	state    BreakerState
+	winStart time.Time
+	total    int
+	failures int
+	openedAt time.Time
+	probes   int    // probes in flight when half-open
+	gen      uint64 // incremented on each state change
+}
+
+// NewBreaker creates a closed breaker
+func NewBreaker(opts BreakerOptions) *Breaker {
+	opts.setDefaults()
+	return &Breaker{opts: opts, winStart: time.Now()}
+}
+
+// State returns the breaker's current state
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(time.Now())
+	return b.state
+}
+
+// advance moves an open breaker to half-open once the timeout expires, the caller holds the
+// lock
+func (b *Breaker) advance(now time.Time) {
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= b.opts.OpenTimeout {
+		b.setState(BreakerHalfOpen, now)
+	}
+}
+
+// setState moves the breaker to state, starting a new generation, the caller holds the lock
+func (b *Breaker) setState(state BreakerState, now time.Time) {
+	b.state = state
+	b.gen++
+	switch state {
+	case BreakerOpen:
+		b.openedAt = now
+	case BreakerHalfOpen:
+		b.probes = 0
+	case BreakerClosed:
+		b.winStart, b.total, b.failures = now, 0, 0
+	}
+}
+
+// Allow returns whether a call may proceed and, if not, how long until the breaker will
+// probe again. Each allowed call must be followed by a call to Done passing the returned
+// generation.
+func (b *Breaker) Allow() (ok bool, retryIn time.Duration, gen uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.advance(now)
+	switch b.state {
+	case BreakerOpen:
+		return false, b.opts.OpenTimeout - now.Sub(b.openedAt), b.gen
+	case BreakerHalfOpen:
+		if b.probes >= b.opts.Probes {
+			return false, time.Second, b.gen
+		}
+		b.probes++
+	}
+	return true, 0, b.gen
+}
+
+// Done reports the outcome of a call allowed by Allow in generation gen, d is the call's
+// duration
+func (b *Breaker) Done(gen uint64, success bool, d time.Duration) {
+	if b.opts.SlowThreshold > 0 && d > b.opts.SlowThreshold {
+		success = false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if gen != b.gen {
+		return // a straggler from before the last state change
+	}
+	now := time.Now()
+
+	if b.state == BreakerHalfOpen {
+		b.probes--
+		if success {
+			b.setState(BreakerClosed, now)
+		} else {
+			b.setState(BreakerOpen, now)
+		}
+		return
+	}
+
+	if now.Sub(b.winStart) >= b.opts.Window {
+		b.winStart, b.total, b.failures = now, 0, 0
+	}
+	b.total++
+	if !success {
+		b.failures++
+	}
+	if b.total >= b.opts.MinRequests &&
+		float64(b.failures) > b.opts.ErrorRate*float64(b.total) {
+		b.setState(BreakerOpen, now)
+	}
+}
+
+// CircuitOpenError is returned when a breaker fails a call fast, WriteError renders it as a
+// 503 with a Retry-After header
+type CircuitOpenError struct {
+	Name       string // what the breaker protects, e.g. the upstream host
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker for %s is open", e.Name)
+}
+
+// StatusCode implements StatusCoder
+func (e *CircuitOpenError) StatusCode() int { return http.StatusServiceUnavailable }
+
+// BreakerTransport is an http.RoundTripper that keeps a circuit breaker per upstream host.
+// Transport errors and 5xx responses count as failures, when a host's breaker is open calls
+// fail fast with a *CircuitOpenError.
+type BreakerTransport struct {
+	Next     http.RoundTripper // defaults to http.DefaultTransport
+	Opts     BreakerOptions
+	mu       sync.Mutex
+	breakers map[string]*Breaker
+}
+
+// NewBreakerTransport creates a BreakerTransport wrapping next
+func NewBreakerTransport(next http.RoundTripper, opts BreakerOptions) *BreakerTransport {
+	return &BreakerTransport{Next: next, Opts: opts}
+}
+
+// Breaker returns the breaker for a host, creating it if necessary
+func (t *BreakerTransport) Breaker(host string) *Breaker {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.breakers == nil {
+		t.breakers = make(map[string]*Breaker)
+	}
+	b, ok := t.breakers[host]
+	if !ok {
+		b = NewBreaker(t.Opts)
+		t.breakers[host] = b
+	}
+	return b
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *BreakerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	next := t.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	b := t.Breaker(r.URL.Host)
+	ok, retry, gen := b.Allow()
+	if !ok {
+		if r.Body != nil {
+			r.Body.Close()
+		}
+		return nil, &CircuitOpenError{Name: r.URL.Host, RetryAfter: retry}
+	}
+	start := time.Now()
+	resp, err := next.RoundTrip(r)
+	b.Done(gen, err == nil && resp.StatusCode < 500, time.Since(start))
+	return resp, err
+}
+
+// ContextBreaker is the hash key in which the CircuitBreaker middleware places the *Breaker
+// of the request's group
+var ContextBreaker string = "breaker"
+
+// BreakerGroup keeps a circuit breaker per name, e.g. per route group, it is safe for
+// concurrent use
+type BreakerGroup struct {
+	opts     BreakerOptions
+	mu       sync.Mutex
+	breakers map[string]*Breaker
+}
+
+// NewBreakerGroup creates a group whose breakers are configured by opts
+func NewBreakerGroup(opts BreakerOptions) *BreakerGroup {
+	return &BreakerGroup{opts: opts, breakers: make(map[string]*Breaker)}
+}
+
+// Breaker returns the breaker for a name, creating it if necessary
+func (g *BreakerGroup) Breaker(name string) *Breaker {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	b, ok := g.breakers[name]
+	if !ok {
+		b = NewBreaker(g.opts)
+		g.breakers[name] = b
+	}
+	return b
+}
+
+// States returns the state of each breaker of the group
+func (g *BreakerGroup) States() map[string]string {
+	g.mu.Lock()
+	breakers := make(map[string]*Breaker, len(g.breakers))
+	for name, b := range g.breakers {
+		breakers[name] = b
+	}
+	g.mu.Unlock()
+	states := make(map[string]string, len(breakers))
+	for name, b := range breakers {
+		states[name] = b.State().String()
+	}
+	return states
+}
+
+// StatusHandler returns a handler that renders the states of the group's breakers as JSON,
+// typically mounted on the admin mux
+func (g *BreakerGroup) StatusHandler() web.HandlerFunc {
+	return func(c web.C, rw http.ResponseWriter, r *http.Request) {
+		WriteJSON(c, rw, http.StatusOK, g.States())
+	}
+}
+
+// CircuitBreakerOptions configures the CircuitBreaker middleware
+type CircuitBreakerOptions struct {
+	BreakerOptions
+	// Group returns the name of the breaker a request counts towards, by default all
+	// requests passing through the middleware share one breaker, so install it on the
+	// sub-mux of the routes depending on a downstream service
+	Group func(c web.C, r *http.Request) string
+	// Breakers holds the breakers, set it to expose their states using StatusHandler, by
+	// default a new group is created using BreakerOptions
+	Breakers *BreakerGroup
+}
+
+// CircuitBreaker creates a middleware that counts 5xx responses and panics, and optionally
+// slow responses, as failures towards the breaker of the request's group. Once it trips the
+// group's requests fail fast with a 503 and a Retry-After header until the breaker lets probes
+// through, see BreakerOptions. Breaker state changes are logged through the context logger.
+func CircuitBreaker(opts CircuitBreakerOptions) web.MiddlewareType {
+	if opts.Breakers == nil {
+		opts.Breakers = NewBreakerGroup(opts.BreakerOptions)
+	}
+	if opts.Group == nil {
+		opts.Group = func(web.C, *http.Request) string { return "default" }
+	}
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			name := opts.Group(*c, r)
+			b := opts.Breakers.Breaker(name)
+			if c.Env != nil {
+				c.Env[ContextBreaker] = b
+			}
+			ok, retry, gen := b.Allow()
+			if !ok {
+				WriteError(*c, rw, &CircuitOpenError{Name: name, RetryAfter: retry})
+				return
+			}
+			before := b.State()
+			wp := mutil.WrapWriter(rw)
+			start := time.Now()
+			success := false
+			defer func() {
+				b.Done(gen, success, time.Since(start))
+				if after := b.State(); after != before {
+					contextLogger(*c).Warn("circuit breaker state changed", "breaker", name,
+						"from", before.String(), "to", after.String())
+				}
+			}()
+			h.ServeHTTP(wp, r)
+			// panics skip this and count as failures
+			success = wp.Status() < 500
+		})
+	}
+}
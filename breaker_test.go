@@ -0,0 +1,128 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("Breaker", func() {
+	var b *Breaker
+
+	BeforeEach(func() {
+		b = NewBreaker(BreakerOptions{MinRequests: 4, OpenTimeout: 20 * time.Millisecond})
+	})
+
+	It("trips, probes, and recovers", func() {
+		for i := 0; i < 4; i++ {
+			ok, _, gen := b.Allow()
+			Ω(ok).Should(BeTrue())
+			b.Done(gen, i == 0, 0)
+		}
+		Ω(b.State()).Should(Equal(BreakerOpen))
+		ok, _, _ := b.Allow()
+		Ω(ok).Should(BeFalse())
+
+		time.Sleep(25 * time.Millisecond)
+		Ω(b.State()).Should(Equal(BreakerHalfOpen))
+		ok, _, gen := b.Allow()
+		Ω(ok).Should(BeTrue())
+		ok, _, _ = b.Allow()
+		Ω(ok).Should(BeFalse()) // only one probe at a time
+		b.Done(gen, true, 0)
+		Ω(b.State()).Should(Equal(BreakerClosed))
+	})
+
+	It("ignores the outcome of calls admitted before a state change", func() {
+		_, _, stale := b.Allow() // a slow call admitted while closed
+		for i := 0; i < 4; i++ {
+			_, _, gen := b.Allow()
+			b.Done(gen, false, 0)
+		}
+		time.Sleep(25 * time.Millisecond)
+		ok, _, probe := b.Allow()
+		Ω(ok).Should(BeTrue())
+		Ω(b.State()).Should(Equal(BreakerHalfOpen))
+
+		b.Done(stale, true, 0)
+		Ω(b.State()).Should(Equal(BreakerHalfOpen)) // the probe is still running
+		ok, _, _ = b.Allow()
+		Ω(ok).Should(BeFalse())
+		b.Done(probe, false, 0)
+		Ω(b.State()).Should(Equal(BreakerOpen))
+	})
+
+	It("fails outbound calls fast and renders a 503", func() {
+		upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(500)
+		}))
+		defer upstream.Close()
+		client := &http.Client{Transport: NewBreakerTransport(nil,
+			BreakerOptions{MinRequests: 2, OpenTimeout: time.Minute})}
+		for i := 0; i < 2; i++ {
+			resp, err := client.Get(upstream.URL)
+			Ω(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+		}
+		_, err := client.Get(upstream.URL)
+		Ω(err).Should(HaveOccurred())
+
+		c := web.C{Env: map[interface{}]interface{}{}}
+		rw := httptest.NewRecorder()
+		WriteError(c, rw, err)
+		Ω(rw.Code).Should(Equal(503))
+		Ω(rw.Header().Get("Retry-After")).Should(Equal("60"))
+	})
+})
+
+var _ = Describe("CircuitBreaker", func() {
+
+	It("fails fast once the group's error rate is exceeded, then probes", func() {
+		var logStr []string
+		group := NewBreakerGroup(BreakerOptions{MinRequests: 2,
+			OpenTimeout: 30 * time.Millisecond})
+		fail := true
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(func(c *web.C, h http.Handler) http.Handler {
+			return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				c.Env[ContextLog] = testLogger(&logStr)
+				h.ServeHTTP(rw, r)
+			})
+		})
+		mx.Use(CircuitBreaker(CircuitBreakerOptions{Breakers: group,
+			Group: func(c web.C, r *http.Request) string { return "reports" }}))
+		mx.Get("/", func(rw http.ResponseWriter, r *http.Request) {
+			if fail {
+				rw.WriteHeader(502)
+			}
+		})
+		serve := func() *httptest.ResponseRecorder {
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/", nil)
+			mx.ServeHTTP(rw, req)
+			return rw
+		}
+
+		Ω(serve().Code).Should(Equal(502))
+		Ω(serve().Code).Should(Equal(502))
+		Ω(logStr).Should(HaveLen(1))
+		Ω(logStr[0]).Should(ContainSubstring("breaker reports from closed to open"))
+		Ω(group.States()).Should(Equal(map[string]string{"reports": "open"}))
+		rw := serve()
+		Ω(rw.Code).Should(Equal(503))
+		Ω(rw.Header().Get("Retry-After")).Should(Equal("1"))
+
+		time.Sleep(40 * time.Millisecond)
+		fail = false
+		Ω(serve().Code).Should(Equal(200))
+		Ω(group.States()).Should(Equal(map[string]string{"reports": "closed"}))
+	})
+})
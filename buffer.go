@@ -0,0 +1,128 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Response buffering
+
+package gojiutil
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+
+	"github.com/zenazn/goji/web"
+)
+
+// BufferResponses creates an opt-in middleware that buffers up to maxBytes of the handler's
+// output so that:
+//   - Content-Length is always set on responses that fit in the buffer,
+//   - an error status written after part of the body (e.g. by ErrorString when encoding fails
+//     half-way) replaces the partial body instead of being appended to it,
+//   - HEAD requests, which goji routes to the GET handlers, get the Content-Length the GET
+//     would produce without sending any body.
+//
+// Output beyond maxBytes, or flushed by the handler, spills into regular streaming.
+func BufferResponses(maxBytes int) web.MiddlewareType {
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			bw := &bufferWriter{ResponseWriter: rw, max: maxBytes, head: r.Method == "HEAD"}
+			h.ServeHTTP(bw, r)
+			if !upgraded(c) {
+				bw.finish()
+			}
+		})
+	}
+}
+
+// bufferWriter is the http.ResponseWriter used by BufferResponses and ETag, it buffers up to
+// max bytes of the response and spills into regular streaming beyond that
+type bufferWriter struct {
+	http.ResponseWriter
+	max  int
+	head bool // the body isn't sent, for HEAD requests
+	// stream, if set, is called with the status and streams the response right away if it
+	// returns true
+	stream  func(code int) bool
+	status  int
+	buf     bytes.Buffer
+	spilled bool
+}
+
+func (bw *bufferWriter) WriteHeader(code int) {
+	switch {
+	case bw.spilled:
+		bw.ResponseWriter.WriteHeader(code) // superfluous, let net/http complain
+	case bw.status == 0:
+		bw.status = code
+		if bw.stream != nil && bw.stream(code) {
+			bw.spill()
+		}
+	case code >= 400 && bw.status < 400:
+		// late error: discard what was produced so far
+		bw.status = code
+		bw.buf.Reset()
+	}
+}
+
+func (bw *bufferWriter) Write(p []byte) (int, error) {
+	if bw.status == 0 {
+		bw.WriteHeader(http.StatusOK)
+	}
+	if !bw.spilled && bw.buf.Len()+len(p) > bw.max {
+		bw.spill()
+	}
+	if bw.spilled {
+		if bw.head {
+			return len(p), nil
+		}
+		return bw.ResponseWriter.Write(p)
+	}
+	return bw.buf.Write(p)
+}
+
+// Flush implements http.Flusher, flushing ends the buffering
+func (bw *bufferWriter) Flush() {
+	if bw.status == 0 {
+		bw.WriteHeader(http.StatusOK)
+	}
+	if !bw.spilled {
+		bw.spill()
+	}
+	if f, ok := bw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter
+func (bw *bufferWriter) Unwrap() http.ResponseWriter { return bw.ResponseWriter }
+
+// spill switches to streaming, writing out the header and what has been buffered
+func (bw *bufferWriter) spill() {
+	bw.spilled = true
+	bw.ResponseWriter.WriteHeader(bw.status)
+	if !bw.head {
+		bw.ResponseWriter.Write(bw.buf.Bytes())
+	}
+	bw.buf.Reset()
+}
+
+// finish writes the buffered response
+func (bw *bufferWriter) finish() {
+	if bw.spilled {
+		return
+	}
+	if bw.status == 0 {
+		bw.status = http.StatusOK
+	}
+	if bodyAllowed(bw.status) {
+		bw.Header().Set("Content-Length", strconv.Itoa(bw.buf.Len()))
+	}
+	bw.ResponseWriter.WriteHeader(bw.status)
+	if !bw.head {
+		bw.ResponseWriter.Write(bw.buf.Bytes())
+	}
+}
+
+// bodyAllowed reports whether a response with the status may have a body
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("BufferResponses", func() {
+	var mx *web.Mux
+
+	BeforeEach(func() {
+		mx = web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(BufferResponses(10))
+		mx.Get("/ok", func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte("hello"))
+		})
+		mx.Get("/late", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte("[1,2,"))
+			ErrorString(c, rw, 422, "oops")
+		})
+		mx.Get("/big", func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte("0123456789abcdef"))
+		})
+	})
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, nil)
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		return resp
+	}
+
+	It("sets Content-Length", func() {
+		resp := serve("GET", "/ok")
+		Ω(resp.Header().Get("Content-Length")).Should(Equal("5"))
+		Ω(resp.Body.String()).Should(Equal("hello"))
+		resp = serve("HEAD", "/ok")
+		Ω(resp.Header().Get("Content-Length")).Should(Equal("5"))
+		Ω(resp.Body.String()).Should(BeEmpty())
+	})
+
+	It("replaces the body on late errors", func() {
+		resp := serve("GET", "/late")
+		Ω(resp.Code).Should(Equal(422))
+		Ω(resp.Body.String()).Should(Equal("oops\n"))
+	})
+
+	It("spills beyond the cap", func() {
+		resp := serve("GET", "/big")
+		Ω(resp.Header().Get("Content-Length")).Should(BeEmpty())
+		Ω(resp.Body.String()).Should(Equal("0123456789abcdef"))
+	})
+})
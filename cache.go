@@ -0,0 +1,192 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Declarative Cache-Control policies
+
+package gojiutil
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// ContextCachePolicy is the hash key in which handlers can place a CachePolicy that overrides
+// the one selected by CacheControl
+var ContextCachePolicy string = "cachePolicy"
+
+// CachePolicy describes a Cache-Control header
+type CachePolicy struct {
+	NoStore        bool
+	NoCache        bool // caches must revalidate before each use
+	Public         bool
+	Private        bool
+	MaxAge         time.Duration
+	SMaxAge        time.Duration // max-age for shared caches
+	MustRevalidate bool
+	Immutable      bool
+}
+
+// String produces the Cache-Control header value
+func (p CachePolicy) String() string {
+	if p.NoStore {
+		return "no-store"
+	}
+	var d []string
+	switch {
+	case p.Private:
+		d = append(d, "private")
+	case p.Public:
+		d = append(d, "public")
+	}
+	if p.NoCache {
+		d = append(d, "no-cache")
+	}
+	if p.MaxAge > 0 || (!p.NoCache && len(d) > 0) {
+		d = append(d, "max-age="+strconv.Itoa(int(p.MaxAge/time.Second)))
+	}
+	if p.SMaxAge > 0 && !p.Private {
+		d = append(d, "s-maxage="+strconv.Itoa(int(p.SMaxAge/time.Second)))
+	}
+	if p.MustRevalidate {
+		d = append(d, "must-revalidate")
+	}
+	if p.Immutable {
+		d = append(d, "immutable")
+	}
+	if len(d) == 0 {
+		return "no-cache"
+	}
+	return strings.Join(d, ", ")
+}
+
+// CacheRule maps a path pattern to a policy. Patterns use path.Match syntax, and a trailing
+// "/*" matches everything below the prefix, e.g. "/assets/*".
+type CacheRule struct {
+	Pattern string
+	Policy  CachePolicy
+}
+
+// CacheControl creates a middleware that sets Cache-Control and Expires on responses using
+// the policy of the first rule matching the request path, or of c.Env[ContextCachePolicy] if
+// the handler placed one there. Public policies are downgraded to private on requests
+// carrying credentials (Authorization or Cookie), 5xx responses are never stored, and
+// responses where the handler set Cache-Control itself are left alone.
+func CacheControl(rules ...CacheRule) web.MiddlewareType {
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			var policy *CachePolicy
+			for i := range rules {
+				if cachePatternMatch(rules[i].Pattern, r.URL.Path) {
+					policy = &rules[i].Policy
+					break
+				}
+			}
+			authed := r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != ""
+			cw := &cacheWriter{ResponseWriter: rw, c: c, policy: policy, authed: authed}
+			h.ServeHTTP(cw, r)
+			if !cw.wroteHeader && !upgraded(c) {
+				cw.WriteHeader(http.StatusOK)
+			}
+		})
+	}
+}
+
+// cachePatternMatch matches a path against a CacheRule pattern
+func cachePatternMatch(pattern, p string) bool {
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(p, pattern[:len(pattern)-1]) || p == pattern[:len(pattern)-2]
+	}
+	ok, _ := path.Match(pattern, p)
+	return ok
+}
+
+// cacheWriter sets the caching headers just before the response header is written so the
+// handler's override is taken into account
+type cacheWriter struct {
+	http.ResponseWriter
+	c           *web.C
+	policy      *CachePolicy
+	authed      bool
+	wroteHeader bool
+}
+
+func (cw *cacheWriter) WriteHeader(code int) {
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+		cw.setHeaders(code)
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *cacheWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher
+func (cw *cacheWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter
+func (cw *cacheWriter) Unwrap() http.ResponseWriter { return cw.ResponseWriter }
+
+func (cw *cacheWriter) setHeaders(code int) {
+	hdr := cw.Header()
+	if hdr.Get("Cache-Control") != "" {
+		return
+	}
+	policy := cw.policy
+	if p, ok := cw.c.Env[ContextCachePolicy].(CachePolicy); ok {
+		policy = &p
+	}
+	if code >= 500 {
+		policy = &CachePolicy{NoStore: true}
+	}
+	if policy == nil {
+		return
+	}
+	p := *policy
+	if p.Public {
+		// the policy depends on the credentials, which caches must take into account
+		AddVary(hdr, "Authorization", "Cookie")
+		if cw.authed {
+			p.Public, p.Private = false, true
+		}
+	}
+	setCachePolicy(hdr, p)
+}
+
+// setCachePolicy sets the Cache-Control header and the matching Expires header for HTTP/1.0
+// caches
+func setCachePolicy(hdr http.Header, p CachePolicy) {
+	hdr.Set("Cache-Control", p.String())
+	if p.NoStore || p.NoCache || p.MaxAge <= 0 {
+		hdr.Set("Expires", "Thu, 01 Jan 1970 00:00:00 GMT")
+	} else {
+		hdr.Set("Expires", time.Now().Add(p.MaxAge).UTC().Format(http.TimeFormat))
+	}
+}
+
+// CacheFor lets clients and caches reuse the response for d, setting Cache-Control and Expires.
+// It overrides the CacheControl middleware's policy.
+func CacheFor(rw http.ResponseWriter, d time.Duration) {
+	setCachePolicy(rw.Header(), CachePolicy{MaxAge: d})
+}
+
+// NoCache forbids clients and caches from storing the response, setting Cache-Control and
+// Expires. It overrides the CacheControl middleware's policy.
+func NoCache(rw http.ResponseWriter) {
+	setCachePolicy(rw.Header(), CachePolicy{NoStore: true})
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("CacheControl", func() {
+	var mx *web.Mux
+
+	BeforeEach(func() {
+		mx = web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(CacheControl(
+			CacheRule{"/api/*", CachePolicy{NoStore: true}},
+			CacheRule{"/assets/*", CachePolicy{Public: true, MaxAge: time.Hour}},
+		))
+		mx.Get("/*", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api/special" {
+				c.Env[ContextCachePolicy] = CachePolicy{Private: true, MaxAge: time.Minute}
+			}
+			rw.Write([]byte("ok"))
+		})
+	})
+
+	serve := func(path string, auth bool) http.Header {
+		req, _ := http.NewRequest("GET", path, nil)
+		if auth {
+			req.Header.Set("Authorization", "Bearer x")
+		}
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		return resp.Header()
+	}
+
+	It("applies the matching policy", func() {
+		Ω(serve("/api/foo", false).Get("Cache-Control")).Should(Equal("no-store"))
+		Ω(serve("/assets/app.js", false).Get("Cache-Control")).Should(Equal("public, max-age=3600"))
+		Ω(serve("/assets/app.js", true).Get("Cache-Control")).Should(Equal("private, max-age=3600"))
+		Ω(serve("/other", false).Get("Cache-Control")).Should(BeEmpty())
+	})
+
+	It("lets handlers override the policy", func() {
+		Ω(serve("/api/special", false).Get("Cache-Control")).Should(Equal("private, max-age=60"))
+	})
+
+	It("lets handlers set the headers with CacheFor and NoCache", func() {
+		mx = web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(CacheControl(CacheRule{"/*", CachePolicy{NoCache: true}}))
+		mx.Get("/api/for", func(rw http.ResponseWriter, r *http.Request) {
+			CacheFor(rw, 5*time.Minute)
+		})
+		mx.Get("/api/none", func(rw http.ResponseWriter, r *http.Request) {
+			NoCache(rw)
+		})
+		hdr := serve("/api/for", false)
+		Ω(hdr.Get("Cache-Control")).Should(Equal("max-age=300"))
+		exp, err := http.ParseTime(hdr.Get("Expires"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(exp).Should(BeTemporally("~", time.Now().Add(5*time.Minute), 2*time.Second))
+		hdr = serve("/api/none", false)
+		Ω(hdr.Get("Cache-Control")).Should(Equal("no-store"))
+		Ω(hdr.Get("Expires")).Should(Equal("Thu, 01 Jan 1970 00:00:00 GMT"))
+	})
+})
@@ -0,0 +1,64 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Outbound HTTP client propagating the request's correlation headers
+
+package gojiutil
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+// PropagatingTransport is an http.RoundTripper for the outbound calls made while handling a
+// request: it copies the request ID (in RequestIDHeader) and the trace headers of the Trace,
+// TraceContext, and B3 middlewares, whichever are installed, into each outbound request, and
+// logs it through the context logger. Transports further down, e.g. RetryTransport, also log
+// through the context logger.
+type PropagatingTransport struct {
+	Next http.RoundTripper // defaults to http.DefaultTransport
+	c    web.C
+}
+
+// NewPropagatingTransport creates a PropagatingTransport for the request c wrapping next
+func NewPropagatingTransport(c web.C, next http.RoundTripper) *PropagatingTransport {
+	return &PropagatingTransport{Next: next, c: c}
+}
+
+// ClientFor returns an http.Client whose calls propagate the correlation headers of the
+// request c, see PropagatingTransport
+func ClientFor(c web.C) *http.Client {
+	return &http.Client{Transport: NewPropagatingTransport(c, nil)}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *PropagatingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	next := t.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	// RoundTrippers must not modify the request
+	r = WithRequestLogger(t.c, r)
+	r.Header = cloneHeader(r.Header)
+	if id := middleware.GetReqID(t.c); id != "" && r.Header.Get(RequestIDHeader) == "" {
+		r.Header.Set(RequestIDHeader, id)
+	}
+	TraceHeaders(t.c, r.Header)
+	TraceContextHeaders(t.c, r.Header)
+	B3Headers(t.c, r.Header, false)
+
+	start := time.Now()
+	resp, err := next.RoundTrip(r)
+	ctx := []interface{}{"verb", r.Method, "url", r.URL.String(),
+		"time", time.Since(start).String()}
+	log := contextLogger(t.c)
+	if err != nil {
+		log.Warn("outbound request", append(ctx, "err", err.Error())...)
+	} else {
+		log.Info("outbound request", append(ctx, "status", strconv.Itoa(resp.StatusCode))...)
+	}
+	return resp, err
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("ClientFor", func() {
+
+	It("propagates the request ID and trace headers and logs", func() {
+		var got http.Header
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			got = r.Header
+			rw.WriteHeader(204)
+		}))
+		defer srv.Close()
+
+		var logs []string
+		sc := SpanContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7",
+			Sampled: true}
+		c := web.C{Env: map[interface{}]interface{}{middleware.RequestIDKey: "abc-1",
+			ContextTrace: sc, ContextLog: testLogger(&logs)}}
+		req, _ := http.NewRequest("GET", srv.URL+"/x", nil)
+		resp, err := ClientFor(c).Do(req)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(resp.StatusCode).Should(Equal(204))
+
+		Ω(got.Get(RequestIDHeader)).Should(Equal("abc-1"))
+		Ω(got.Get("Traceparent")).Should(Equal("00-" + sc.TraceID + "-" + sc.SpanID + "-01"))
+		Ω(req.Header).Should(BeEmpty()) // the caller's request is left alone
+		Ω(logs).Should(HaveLen(1))
+		Ω(logs[0]).Should(ContainSubstring("outbound request"))
+		Ω(logs[0]).Should(ContainSubstring("status 204"))
+	})
+})
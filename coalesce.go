@@ -0,0 +1,108 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Coalescing of concurrent identical requests
+
+package gojiutil
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+
+	"github.com/zenazn/goji/web"
+)
+
+// coalescedCall is a handler execution whose response is shared with the identical requests
+// that arrived while it ran
+type coalescedCall struct {
+	done chan struct{}
+	resp *capturedResponse // nil if the handler panicked
+}
+
+// capturedResponse is an http.ResponseWriter holding the response in memory
+type capturedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *capturedResponse) Header() http.Header { return w.header }
+
+func (w *capturedResponse) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *capturedResponse) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+// writeTo replays the response onto rw
+func (w *capturedResponse) writeTo(rw http.ResponseWriter) {
+	for k, v := range w.header {
+		rw.Header()[k] = append([]string(nil), v...)
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	rw.WriteHeader(w.status)
+	rw.Write(w.body.Bytes())
+}
+
+// Coalesce creates a middleware that executes the handler once for concurrent GET requests
+// with the same key and sends its response to all of them, e.g. to avoid stampedes on
+// expensive endpoints when their cache expires. keyFunc defaults to the request URI; the key
+// must cover everything the response depends on, e.g. the user for personalized responses.
+// Requests with an empty key aren't coalesced. Responses are buffered in memory, so don't use
+// it for streaming or large responses. If the handler panics the waiting requests execute
+// it themselves.
+func Coalesce(keyFunc func(*http.Request) string) web.MiddlewareType {
+	if keyFunc == nil {
+		keyFunc = func(r *http.Request) string { return r.URL.RequestURI() }
+	}
+	var mu sync.Mutex
+	calls := make(map[string]*coalescedCall)
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			key := ""
+			if r.Method == "GET" {
+				key = keyFunc(r)
+			}
+			if key == "" {
+				h.ServeHTTP(rw, r)
+				return
+			}
+			mu.Lock()
+			if call, ok := calls[key]; ok {
+				mu.Unlock()
+				select {
+				case <-call.done:
+				case <-r.Context().Done():
+					return // the client is gone
+				}
+				if call.resp == nil {
+					h.ServeHTTP(rw, r)
+				} else {
+					call.resp.writeTo(rw)
+				}
+				return
+			}
+			call := &coalescedCall{done: make(chan struct{})}
+			calls[key] = call
+			mu.Unlock()
+
+			resp := &capturedResponse{header: make(http.Header)}
+			defer func() {
+				mu.Lock()
+				delete(calls, key)
+				mu.Unlock()
+				close(call.done)
+			}()
+			h.ServeHTTP(resp, r)
+			call.resp = resp
+			resp.writeTo(rw)
+		})
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+)
+
+var _ = Describe("Coalesce", func() {
+
+	It("shares one handler execution among concurrent identical GETs", func() {
+		var calls int32
+		mx := web.New()
+		mx.Use(Coalesce(nil))
+		mx.Get("/report", func(rw http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(30 * time.Millisecond)
+			rw.Header().Set("X-Report", "1")
+			rw.WriteHeader(201)
+			rw.Write([]byte("expensive"))
+		})
+
+		var wg sync.WaitGroup
+		resps := make([]*httptest.ResponseRecorder, 5)
+		for i := range resps {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				resps[i] = httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", "/report", nil)
+				mx.ServeHTTP(resps[i], req)
+			}(i)
+		}
+		wg.Wait()
+		Ω(atomic.LoadInt32(&calls)).Should(BeEquivalentTo(1))
+		for _, rw := range resps {
+			Ω(rw.Code).Should(Equal(201))
+			Ω(rw.Header().Get("X-Report")).Should(Equal("1"))
+			Ω(rw.Body.String()).Should(Equal("expensive"))
+		}
+
+		// later requests execute the handler again
+		req, _ := http.NewRequest("GET", "/report", nil)
+		mx.ServeHTTP(httptest.NewRecorder(), req)
+		Ω(atomic.LoadInt32(&calls)).Should(BeEquivalentTo(2))
+	})
+})
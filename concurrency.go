@@ -0,0 +1,70 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Concurrency limiting and load shedding
+
+package gojiutil
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// MaxInFlight creates a middleware that lets at most n requests execute the handlers at once.
+// Up to queue more wait for up to queueTimeout for their turn, the time waited is recorded
+// as the "queue" timing (see AddTiming). Requests beyond that, or that waited too long, are
+// shed with a 503 and Retry-After: 1, and Logger15 logs them with the number of requests
+// shed so far by this middleware as shed_total. This keeps goroutines and memory from piling
+// up when a spike exceeds what the service can handle. MaxInFlight panics if n isn't
+// positive.
+func MaxInFlight(n int, queue int, queueTimeout time.Duration) web.MiddlewareType {
+	if n <= 0 {
+		panic(fmt.Sprintf("gojiutil.MaxInFlight: limit must be positive, got %d", n))
+	}
+	sem := make(chan struct{}, n)
+	var queued int32
+	var shed uint64
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			select {
+			case sem <- struct{}{}:
+			default:
+				if !waitTurn(*c, r, sem, &queued, queue, queueTimeout) {
+					total := atomic.AddUint64(&shed, 1)
+					rw.Header().Set("Retry-After", "1")
+					ErrorKV(*c, rw, http.StatusServiceUnavailable,
+						"Server overloaded, please retry", "shed_total", total)
+					return
+				}
+			}
+			defer func() { <-sem }()
+			h.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// waitTurn queues the request for a slot in sem if there's room in the queue, it returns
+// false if there's no room or no slot freed up in time
+func waitTurn(c web.C, r *http.Request, sem chan struct{}, queued *int32, queue int,
+	timeout time.Duration) bool {
+
+	if int(atomic.AddInt32(queued, 1)) > queue {
+		atomic.AddInt32(queued, -1)
+		return false
+	}
+	defer atomic.AddInt32(queued, -1)
+	start := time.Now()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case sem <- struct{}{}:
+		AddTiming(c, "queue", time.Since(start))
+		return true
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("MaxInFlight", func() {
+
+	serve := func(mx *web.Mux, path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		mx.ServeHTTP(rw, req)
+		return rw
+	}
+
+	It("queues then sheds requests beyond the limit", func() {
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(MaxInFlight(1, 1, 20*time.Millisecond))
+		started, release := make(chan struct{}), make(chan struct{})
+		mx.Get("/block", func(rw http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		})
+		mx.Get("/quick", func(rw http.ResponseWriter, r *http.Request) {})
+
+		done := make(chan int)
+		go func() { done <- serve(mx, "/block").Code }()
+		<-started
+		// the first waits in the queue until it times out, the second finds the queue full
+		queued := make(chan int)
+		go func() { queued <- serve(mx, "/quick").Code }()
+		time.Sleep(5 * time.Millisecond)
+		rw := serve(mx, "/quick")
+		Ω(rw.Code).Should(Equal(503))
+		Ω(rw.Header().Get("Retry-After")).Should(Equal("1"))
+		Eventually(queued).Should(Receive(Equal(503)))
+		close(release)
+		Eventually(done).Should(Receive(Equal(200)))
+		Ω(serve(mx, "/quick").Code).Should(Equal(200))
+	})
+
+	It("logs the number of requests shed", func() {
+		var logStr []string
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(Logger15(testLogger(&logStr)))
+		mx.Use(MaxInFlight(1, 0, 0))
+		started, release := make(chan struct{}), make(chan struct{})
+		mx.Get("/block", func(rw http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		})
+		mx.Get("/", func(rw http.ResponseWriter, r *http.Request) {})
+		done := make(chan struct{})
+		go func() { serve(mx, "/block"); close(done) }()
+		<-started
+		serve(mx, "/")
+		rw := serve(mx, "/")
+		close(release)
+		<-done
+		Ω(rw.Body.String()).Should(Equal("Server overloaded, please retry\n"))
+		Ω(logStr).Should(HaveLen(3))
+		Ω(logStr[1]).Should(ContainSubstring("status 503"))
+		Ω(logStr[1]).Should(HaveSuffix("shed_total 2]\n"))
+	})
+
+	It("rejects a limit that isn't positive", func() {
+		Ω(func() { MaxInFlight(0, 10, time.Second) }).Should(Panic())
+	})
+})
@@ -0,0 +1,230 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Conditional request helpers: ETags and optimistic concurrency
+
+package gojiutil
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// ETagFor computes a strong entity tag from a resource version, typically a revision
+// number or the updated-at time.Time
+func ETagFor(version interface{}) string {
+	var s string
+	if t, ok := version.(time.Time); ok {
+		s = fmt.Sprintf("t%d", t.UnixNano())
+	} else {
+		s = fmt.Sprintf("%T:%v", version, version)
+	}
+	sum := sha256.Sum256([]byte(s))
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// SetETag sets the ETag response header
+func SetETag(rw http.ResponseWriter, etag string) {
+	rw.Header().Set("ETag", etag)
+}
+
+// parseETags splits an If-Match or If-None-Match header value into its entity tags, it
+// returns ["*"] for the wildcard
+func parseETags(h string) []string {
+	var tags []string
+	for h = strings.TrimSpace(h); h != ""; h = strings.TrimLeft(h, " \t,") {
+		if h[0] == '*' {
+			return []string{"*"}
+		}
+		weak := strings.HasPrefix(h, "W/")
+		start := 0
+		if weak {
+			start = 2
+		}
+		if len(h) <= start || h[start] != '"' {
+			return tags // malformed, ignore the rest
+		}
+		end := strings.IndexByte(h[start+1:], '"')
+		if end < 0 {
+			return tags
+		}
+		end += start + 2
+		tags = append(tags, h[:end])
+		h = h[end:]
+	}
+	return tags
+}
+
+// strongMatch implements the strong comparison of RFC 7232 section 2.3.2
+func strongMatch(a, b string) bool {
+	return a == b && !strings.HasPrefix(a, "W/")
+}
+
+// weakMatch implements the weak comparison of RFC 7232 section 2.3.2
+func weakMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// RequireIfMatch enforces optimistic locking on a write: the request must carry an If-Match
+// header (else 428 Precondition Required) that matches the resource's current ETag (else 412
+// Precondition Failed). Pass an empty current ETag if the resource doesn't exist. It writes
+// the error response and returns false if the write must not proceed.
+func RequireIfMatch(c web.C, rw http.ResponseWriter, r *http.Request, current string) bool {
+	h := r.Header.Get("If-Match")
+	if h == "" {
+		ErrorString(c, rw, http.StatusPreconditionRequired,
+			"This request must be conditional, please supply an If-Match header")
+		return false
+	}
+	if !ifMatch(h, current) {
+		if current != "" {
+			rw.Header().Set("ETag", current)
+		}
+		ErrorString(c, rw, http.StatusPreconditionFailed,
+			"The resource has been modified, If-Match does not match its current ETag")
+		return false
+	}
+	return true
+}
+
+// CheckIfMatch is like RequireIfMatch but lets requests without If-Match through
+func CheckIfMatch(c web.C, rw http.ResponseWriter, r *http.Request, current string) bool {
+	if r.Header.Get("If-Match") == "" {
+		return true
+	}
+	return RequireIfMatch(c, rw, r, current)
+}
+
+// ifMatch evaluates an If-Match header against the current ETag
+func ifMatch(h, current string) bool {
+	for _, t := range parseETags(h) {
+		if t == "*" {
+			return current != ""
+		}
+		if strongMatch(t, current) {
+			return true
+		}
+	}
+	return false
+}
+
+// ifNoneMatch evaluates an If-None-Match header against the current ETag, it returns true if
+// one of the tags matches, i.e. the condition is false
+func ifNoneMatch(h, current string) bool {
+	for _, t := range parseETags(h) {
+		if t == "*" {
+			return current != ""
+		}
+		if current != "" && weakMatch(t, current) {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified evaluates If-None-Match, or If-Modified-Since in its absence, per RFC 7232
+// section 6 and returns true if the client's copy is current
+func notModified(r *http.Request, lastModified time.Time, etag string) bool {
+	if h := r.Header.Get("If-None-Match"); h != "" {
+		return ifNoneMatch(h, etag)
+	}
+	if lastModified.IsZero() || (r.Method != "GET" && r.Method != "HEAD") {
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !lastModified.Truncate(time.Second).After(ims)
+}
+
+// WriteJSONConditional writes obj like WriteJSON with a 200 status, but first sets the ETag
+// and Last-Modified headers (either may be omitted by passing a zero value) and evaluates
+// If-None-Match and If-Modified-Since: if the client's copy is current it responds 304 Not
+// Modified to GET and HEAD requests, and 412 Precondition Failed to other methods.
+func WriteJSONConditional(c web.C, rw http.ResponseWriter, r *http.Request, obj interface{},
+	lastModified time.Time, etag string) {
+
+	if etag != "" {
+		rw.Header().Set("ETag", etag)
+	}
+	if !lastModified.IsZero() {
+		rw.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, lastModified, etag) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			rw.WriteHeader(http.StatusNotModified)
+		} else {
+			ErrorString(c, rw, http.StatusPreconditionFailed,
+				"The resource matches the If-None-Match condition")
+		}
+		return
+	}
+	WriteJSON(c, rw, http.StatusOK, obj)
+}
+
+// CheckConditional evaluates If-None-Match, or If-Modified-Since in its absence, against the
+// validators a handler computed for the resource (either may be omitted by passing a zero
+// value) and returns true if the client's copy is current. The handler should then respond
+// 304 Not Modified to GET and HEAD requests and 412 Precondition Failed to other methods, as
+// WriteJSONConditional does.
+func CheckConditional(r *http.Request, etag string, modTime time.Time) bool {
+	return notModified(r, modTime, etag)
+}
+
+// ETag creates a middleware that buffers GET and HEAD responses of up to maxBytes, sets a
+// strong ETag computed by hashing the body on 200 responses and responds 304 Not Modified when
+// If-None-Match matches it, saving the bandwidth of content that rarely changes. Responses
+// that already have an ETag, are larger than maxBytes, or are flushed by the handler pass
+// through unchanged, as do HEAD responses without a body. Like with BufferResponses, an error
+// status written after part of the body replaces it. The handler still produces the full
+// response so use CheckConditional if that's expensive.
+func ETag(maxBytes int) web.MiddlewareType {
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" && r.Method != "HEAD" {
+				h.ServeHTTP(rw, r)
+				return
+			}
+			bw := &bufferWriter{ResponseWriter: rw, max: maxBytes, head: r.Method == "HEAD",
+				stream: func(code int) bool {
+					return code != http.StatusOK || rw.Header().Get("ETag") != ""
+				}}
+			h.ServeHTTP(bw, r)
+			if !upgraded(c) {
+				finishETag(bw, r)
+			}
+		})
+	}
+}
+
+// finishETag sets the ETag of a buffered 200 response and writes it, or a 304
+func finishETag(bw *bufferWriter, r *http.Request) {
+	if bw.spilled {
+		return
+	}
+	if bw.status == 0 {
+		bw.status = http.StatusOK
+	}
+	if bw.head && bw.buf.Len() == 0 {
+		// the handler omitted the body, there's nothing to derive the ETag and length from
+		bw.ResponseWriter.WriteHeader(bw.status)
+		return
+	}
+	if bw.status != http.StatusOK { // late error
+		bw.finish()
+		return
+	}
+	sum := sha256.Sum256(bw.buf.Bytes())
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	bw.Header().Set("ETag", etag)
+	if ifNoneMatch(r.Header.Get("If-None-Match"), etag) {
+		bw.Header().Del("Content-Type")
+		bw.Header().Del("Content-Length")
+		bw.ResponseWriter.WriteHeader(http.StatusNotModified)
+		return
+	}
+	bw.finish()
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("WriteJSONConditional", func() {
+	modified := time.Date(2015, 6, 1, 12, 0, 0, 500, time.UTC)
+	etag := ETagFor(3)
+
+	serve := func(method string, hdr map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/", nil)
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		resp := httptest.NewRecorder()
+		c := web.C{Env: map[interface{}]interface{}{}}
+		WriteJSONConditional(c, resp, req, map[string]int{"a": 1}, modified, etag)
+		return resp
+	}
+
+	It("writes the resource with validators", func() {
+		resp := serve("GET", nil)
+		Ω(resp.Code).Should(Equal(200))
+		Ω(resp.Header().Get("ETag")).Should(Equal(etag))
+		Ω(resp.Header().Get("Last-Modified")).Should(Equal("Mon, 01 Jun 2015 12:00:00 GMT"))
+		Ω(resp.Body.String()).Should(MatchJSON(`{"a":1}`))
+	})
+
+	It("responds 304 when the client is current", func() {
+		Ω(serve("GET", map[string]string{"If-None-Match": `"x", W/` + etag}).Code).
+			Should(Equal(304))
+		Ω(serve("GET", map[string]string{
+			"If-Modified-Since": "Mon, 01 Jun 2015 12:00:00 GMT"}).Code).Should(Equal(304))
+		Ω(serve("GET", map[string]string{
+			"If-Modified-Since": "Mon, 01 Jun 2015 11:59:59 GMT"}).Code).Should(Equal(200))
+		Ω(serve("POST", map[string]string{"If-None-Match": "*"}).Code).Should(Equal(412))
+	})
+})
+
+var _ = Describe("ETag", func() {
+	body := "config blob"
+
+	serve := func(method string, hdr map[string]string, hf web.HandlerFunc) *httptest.ResponseRecorder {
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(ETag(64))
+		mx.Get("/", hf)
+		mx.Post("/", hf)
+		req, _ := http.NewRequest(method, "/", nil)
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		return resp
+	}
+	blob := func(c web.C, rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Write([]byte(body))
+	}
+
+	It("sets a strong ETag from the body", func() {
+		resp := serve("GET", nil, blob)
+		Ω(resp.Code).Should(Equal(200))
+		Ω(resp.Header().Get("ETag")).Should(MatchRegexp(`^"[0-9a-f]{32}"$`))
+		Ω(resp.Header().Get("Content-Length")).Should(Equal("11"))
+		Ω(resp.Body.String()).Should(Equal(body))
+	})
+
+	It("responds 304 when If-None-Match matches", func() {
+		etag := serve("GET", nil, blob).Header().Get("ETag")
+		resp := serve("GET", map[string]string{"If-None-Match": etag}, blob)
+		Ω(resp.Code).Should(Equal(304))
+		Ω(resp.Body.Len()).Should(Equal(0))
+		Ω(resp.Header().Get("ETag")).Should(Equal(etag))
+		Ω(serve("GET", map[string]string{"If-None-Match": `"other"`}, blob).Code).
+			Should(Equal(200))
+	})
+
+	It("passes through errors, large and non-GET responses", func() {
+		resp := serve("GET", nil, func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			ErrorString(c, rw, 404, "nope")
+		})
+		Ω(resp.Code).Should(Equal(404))
+		Ω(resp.Header().Get("ETag")).Should(BeEmpty())
+		resp = serve("GET", nil, func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte("{"))
+			ErrorString(c, rw, 400, "encoding failed")
+		})
+		Ω(resp.Code).Should(Equal(400))
+		Ω(resp.Header().Get("ETag")).Should(BeEmpty())
+		Ω(resp.Body.String()).Should(Equal("encoding failed\n"))
+		resp = serve("GET", nil, func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			rw.Write(make([]byte, 100))
+		})
+		Ω(resp.Header().Get("ETag")).Should(BeEmpty())
+		Ω(resp.Body.Len()).Should(Equal(100))
+		Ω(serve("POST", nil, blob).Header().Get("ETag")).Should(BeEmpty())
+	})
+
+	It("handles HEAD requests with or without a body", func() {
+		etag := serve("GET", nil, blob).Header().Get("ETag")
+		resp := serve("HEAD", nil, blob)
+		Ω(resp.Header().Get("ETag")).Should(Equal(etag))
+		Ω(resp.Header().Get("Content-Length")).Should(Equal("11"))
+		resp = serve("HEAD", nil, func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Content-Length", "11")
+		})
+		Ω(resp.Code).Should(Equal(200))
+		Ω(resp.Header().Get("ETag")).Should(BeEmpty())
+		Ω(resp.Header().Get("Content-Length")).Should(Equal("11"))
+	})
+
+	It("keeps the handler's ETag", func() {
+		resp := serve("GET", nil, func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			SetETag(rw, `"v1"`)
+			rw.Write([]byte(body))
+		})
+		Ω(resp.Header().Get("ETag")).Should(Equal(`"v1"`))
+		Ω(resp.Body.String()).Should(Equal(body))
+	})
+})
+
+var _ = Describe("RequireIfMatch", func() {
+	check := func(f func(web.C, http.ResponseWriter, *http.Request, string) bool,
+		ifMatch, current string) (bool, *httptest.ResponseRecorder) {
+		req, _ := http.NewRequest("PUT", "/", nil)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		resp := httptest.NewRecorder()
+		c := web.C{Env: map[interface{}]interface{}{}}
+		return f(c, resp, req, current), resp
+	}
+
+	It("requires an If-Match header", func() {
+		ok, resp := check(RequireIfMatch, "", `"v1"`)
+		Ω(ok).Should(BeFalse())
+		Ω(resp.Code).Should(Equal(428))
+	})
+
+	It("rejects stale writes with the current ETag", func() {
+		ok, resp := check(RequireIfMatch, `"v0"`, `"v1"`)
+		Ω(ok).Should(BeFalse())
+		Ω(resp.Code).Should(Equal(412))
+		Ω(resp.Header().Get("ETag")).Should(Equal(`"v1"`))
+
+		ok, resp = check(RequireIfMatch, `W/"v1"`, `"v1"`) // weak tags never match
+		Ω(ok).Should(BeFalse())
+		Ω(resp.Code).Should(Equal(412))
+
+		ok, resp = check(RequireIfMatch, "*", "") // the resource doesn't exist
+		Ω(ok).Should(BeFalse())
+		Ω(resp.Code).Should(Equal(412))
+	})
+
+	It("lets matching writes through", func() {
+		ok, resp := check(RequireIfMatch, `"v0", "v1"`, `"v1"`)
+		Ω(ok).Should(BeTrue())
+		Ω(resp.Code).Should(Equal(200))
+		ok, _ = check(RequireIfMatch, "*", `"v1"`)
+		Ω(ok).Should(BeTrue())
+	})
+
+	It("lets unconditional writes through with CheckIfMatch", func() {
+		ok, _ := check(CheckIfMatch, "", `"v1"`)
+		Ω(ok).Should(BeTrue())
+		ok, resp := check(CheckIfMatch, `"v0"`, `"v1"`)
+		Ω(ok).Should(BeFalse())
+		Ω(resp.Code).Should(Equal(412))
+	})
+})
+
+var _ = Describe("CheckConditional", func() {
+	modified := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	It("evaluates the validators", func() {
+		req, _ := http.NewRequest("GET", "/", nil)
+		Ω(CheckConditional(req, `"a"`, modified)).Should(BeFalse())
+		req.Header.Set("If-Modified-Since", modified.Format(http.TimeFormat))
+		Ω(CheckConditional(req, `"a"`, modified)).Should(BeTrue())
+		req.Header.Set("If-None-Match", `"b"`)
+		Ω(CheckConditional(req, `"a"`, modified)).Should(BeFalse())
+		req.Header.Set("If-None-Match", `W/"a"`)
+		Ω(CheckConditional(req, `"a"`, time.Time{})).Should(BeTrue())
+	})
+})
@@ -0,0 +1,200 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Hot-reloadable middleware configuration
+
+package gojiutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Settings holds the tunables of the middlewares that can be reconfigured at run-time, each
+// middleware reads its section on every request through a LiveConfig. Rate limits and IP
+// filters are named so an application can have several, see RateLimitOptions.Live and
+// LiveIPFilter.
+type Settings struct {
+	Maintenance MaintenanceSettings          `json:"maintenance"`
+	RateLimits  map[string]RateLimitSettings `json:"rate_limits"`
+	IPFilters   map[string]IPFilterSettings  `json:"ip_filters"`
+	Logging     LogSettings                  `json:"logging"`
+}
+
+// MaintenanceSettings configures the Maintenance middleware
+type MaintenanceSettings struct {
+	Enabled    bool     `json:"enabled"`
+	Message    string   `json:"message"`
+	RetryAfter int      `json:"retry_after"` // seconds
+	Allow      []string `json:"allow"`       // path prefixes served anyway, e.g. "/health"
+}
+
+// RateLimitSettings configures a RateLimit middleware, see RateLimitOptions
+type RateLimitSettings struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// IPFilterSettings configures a LiveIPFilter middleware, see IPFilter
+type IPFilterSettings struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+
+	allow, deny []*net.IPNet // parsed when the settings are set
+}
+
+// LogSettings configures the request logging middlewares, see Logger15Opts
+type LogSettings struct {
+	SampleRate int `json:"sample_rate"`
+}
+
+// parse parses the IP ranges of the IP filters
+func (s *Settings) parse() error {
+	filters := make(map[string]IPFilterSettings, len(s.IPFilters))
+	for name, f := range s.IPFilters {
+		var err error
+		if f.allow, err = parseCIDRs(f.Allow); err != nil {
+			return fmt.Errorf("ip filter %s: %s", name, err)
+		}
+		if f.deny, err = parseCIDRs(f.Deny); err != nil {
+			return fmt.Errorf("ip filter %s: %s", name, err)
+		}
+		filters[name] = f
+	}
+	s.IPFilters = filters
+	return nil
+}
+
+// LiveConfig holds the current Settings and allows them to be swapped atomically, e.g. when
+// operators edit the config file, without restarting the process
+type LiveConfig struct {
+	v atomic.Value
+}
+
+// NewLiveConfig creates a LiveConfig holding the initial settings
+func NewLiveConfig(initial Settings) *LiveConfig {
+	lc := &LiveConfig{}
+	lc.Set(initial)
+	return lc
+}
+
+// Get returns the current settings, they must not be modified
+func (lc *LiveConfig) Get() *Settings {
+	return lc.v.Load().(*Settings)
+}
+
+// Set replaces the current settings, it panics if an IP range doesn't parse, like IPFilter
+func (lc *LiveConfig) Set(s Settings) {
+	if err := s.parse(); err != nil {
+		panic("gojiutil.LiveConfig: " + err.Error())
+	}
+	lc.v.Store(&s)
+}
+
+// LoadFile replaces the current settings with those read from a JSON file, sections absent
+// from the file get their zero value. The settings are unchanged if the file is invalid.
+func (lc *LiveConfig) LoadFile(path string) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var s Settings
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return err
+	}
+	if err := s.parse(); err != nil {
+		return err
+	}
+	lc.v.Store(&s)
+	return nil
+}
+
+// Watch reloads the settings from the JSON file at path whenever the process receives a
+// SIGHUP or the file's modification time changes, checked every interval (0 disables the
+// polling). Errors are logged and leave the current settings in place. Call the returned
+// function to stop watching.
+func (lc *LiveConfig) Watch(path string, interval time.Duration, log Logger) func() {
+	if log == nil {
+		log = log15.Root()
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker = time.NewTicker(interval)
+		tick = ticker.C
+	}
+	stop := make(chan struct{})
+	var mtime time.Time
+	if fi, err := os.Stat(path); err == nil {
+		mtime = fi.ModTime()
+	}
+	reload := func(why string) {
+		if err := lc.LoadFile(path); err != nil {
+			log.Error("config reload failed", "file", path, "trigger", why, "err", err)
+		} else {
+			log.Info("config reloaded", "file", path, "trigger", why)
+		}
+	}
+	go func() {
+		for {
+			select {
+			case <-stop:
+				signal.Stop(hup)
+				if ticker != nil {
+					ticker.Stop()
+				}
+				return
+			case <-hup:
+				reload("SIGHUP")
+			case <-tick:
+				if fi, err := os.Stat(path); err == nil && !fi.ModTime().Equal(mtime) {
+					mtime = fi.ModTime()
+					reload("modified")
+				}
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// Maintenance creates a middleware that, while enabled in the live settings, responds 503
+// Service Unavailable to all requests except those for the allowed path prefixes
+func Maintenance(lc *LiveConfig) web.MiddlewareType {
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			m := lc.Get().Maintenance
+			if !m.Enabled {
+				h.ServeHTTP(rw, r)
+				return
+			}
+			for _, p := range m.Allow {
+				if strings.HasPrefix(r.URL.Path, p) {
+					h.ServeHTTP(rw, r)
+					return
+				}
+			}
+			if m.RetryAfter > 0 {
+				rw.Header().Set("Retry-After", strconv.Itoa(m.RetryAfter))
+			}
+			msg := m.Message
+			if msg == "" {
+				msg = "Service down for maintenance, please retry later"
+			}
+			ErrorString(*c, rw, http.StatusServiceUnavailable, msg)
+		})
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("LiveConfig", func() {
+
+	It("reloads the file and toggles maintenance", func() {
+		dir, _ := ioutil.TempDir("", "gojiutil")
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "config.json")
+
+		lc := NewLiveConfig(Settings{})
+		stop := lc.Watch(path, 10*time.Millisecond, nil)
+		defer stop()
+
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(Maintenance(lc))
+		mx.Get("/*", func(rw http.ResponseWriter, r *http.Request) {})
+		serve := func(path string) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest("GET", path, nil)
+			resp := httptest.NewRecorder()
+			mx.ServeHTTP(resp, req)
+			return resp
+		}
+		Ω(serve("/foo").Code).Should(Equal(200))
+
+		ioutil.WriteFile(path, []byte(`{"maintenance":{"enabled":true,"retry_after":60,
+			"allow":["/health"]}}`), 0644)
+		Eventually(func() bool { return lc.Get().Maintenance.Enabled }).Should(BeTrue())
+		resp := serve("/foo")
+		Ω(resp.Code).Should(Equal(503))
+		Ω(resp.Header().Get("Retry-After")).Should(Equal("60"))
+		Ω(serve("/health").Code).Should(Equal(200))
+	})
+
+	It("tunes rate limits, IP filters and log sampling", func() {
+		lc := NewLiveConfig(Settings{})
+		var logStr []string
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(RequestLoggerOpts(testLogger(&logStr), Logger15Opts{Live: lc}))
+		mx.Use(LiveIPFilter(lc, "admin"))
+		mx.Use(RateLimit(RateLimitOptions{Rate: 100, Burst: 100, Live: lc, Name: "api"}))
+		mx.Get("/", func(rw http.ResponseWriter, r *http.Request) {})
+		get := func(ip string) int {
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.RemoteAddr = ip + ":1234"
+			resp := httptest.NewRecorder()
+			mx.ServeHTTP(resp, req)
+			return resp.Code
+		}
+		for i := 0; i < 3; i++ {
+			Ω(get("10.0.0.1")).Should(Equal(200))
+		}
+		Ω(logStr).Should(HaveLen(3))
+
+		lc.Set(Settings{
+			RateLimits: map[string]RateLimitSettings{"api": {Rate: 0.01, Burst: 1}},
+			IPFilters:  map[string]IPFilterSettings{"admin": {Deny: []string{"10.0.0.2"}}},
+			Logging:    LogSettings{SampleRate: 100},
+		})
+		logStr = nil
+		Ω(get("10.0.0.3")).Should(Equal(200))
+		Ω(get("10.0.0.3")).Should(Equal(429))
+		Ω(get("10.0.0.2")).Should(Equal(403))
+		Ω(get("10.0.0.4")).Should(Equal(200))
+		Ω(get("10.0.0.5")).Should(Equal(200))
+		Ω(logStr).Should(HaveLen(3)) // the first success and the errors
+
+		Ω(func() {
+			lc.Set(Settings{IPFilters: map[string]IPFilterSettings{"x": {Allow: []string{"nope"}}}})
+		}).Should(Panic())
+	})
+
+	It("rejects files with invalid IP ranges", func() {
+		dir, _ := ioutil.TempDir("", "gojiutil")
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "config.json")
+		ioutil.WriteFile(path, []byte(`{"ip_filters":{"admin":{"allow":["10.0.0.0/33"]}}}`), 0644)
+		lc := NewLiveConfig(Settings{Logging: LogSettings{SampleRate: 5}})
+		Ω(lc.LoadFile(path)).ShouldNot(Succeed())
+		Ω(lc.Get().Logging.SampleRate).Should(Equal(5))
+	})
+
+	It("renders the maintenance response like other errors", func() {
+		JSONErrors = true
+		defer func() { JSONErrors = false }()
+		lc := NewLiveConfig(Settings{Maintenance: MaintenanceSettings{Enabled: true}})
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(Maintenance(lc))
+		mx.Get("/", func(rw http.ResponseWriter, r *http.Request) {})
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		Ω(resp.Code).Should(Equal(503))
+		Ω(resp.Header().Get("Content-Type")).Should(HavePrefix("application/json"))
+		Ω(resp.Body.String()).Should(ContainSubstring(
+			`"message":"Service down for maintenance, please retry later"`))
+	})
+})
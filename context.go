@@ -0,0 +1,58 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Bridging web.C into the request's context.Context
+
+package gojiutil
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// envKey is the context key under which BridgeContext stores c.Env
+type envKey struct{}
+
+// BridgeContext is a middleware that makes c.Env reachable from r.Context(), so library code
+// that only gets a context.Context can log with the request's context logger and correlate
+// with its request ID using LoggerFromContext and ReqIDFromContext. Use it after the
+// middlewares that set these up, e.g. RequestID and ContextLogger.
+func BridgeContext(c *web.C, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if c.Env == nil {
+			c.Env = make(map[interface{}]interface{})
+		}
+		h.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), envKey{}, c.Env)))
+	})
+}
+
+// EnvFromContext returns the c.Env of the request placed into ctx by BridgeContext, or nil.
+// It is the same map, so changes are visible to the request's middlewares and handler.
+func EnvFromContext(ctx context.Context) map[interface{}]interface{} {
+	env, _ := ctx.Value(envKey{}).(map[interface{}]interface{})
+	return env
+}
+
+// LoggerFromContext returns the context logger of the request bridged into ctx, the logger
+// attached by WithRequestLogger, or else the root logger
+func LoggerFromContext(ctx context.Context) Logger {
+	return loggerFromContext(ctx, log15.Root())
+}
+
+func loggerFromContext(ctx context.Context, fallback Logger) Logger {
+	if log, ok := ctx.Value(loggerKey{}).(Logger); ok {
+		return log
+	}
+	if env := EnvFromContext(ctx); env != nil {
+		return contextLogger(web.C{Env: env})
+	}
+	return fallback
+}
+
+// ReqIDFromContext returns the ID of the request bridged into ctx, or ""
+func ReqIDFromContext(ctx context.Context) string {
+	return middleware.GetReqID(web.C{Env: EnvFromContext(ctx)})
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("BridgeContext", func() {
+
+	It("exposes the request ID, logger and env via the context", func() {
+		var logs []string
+		logger := testLogger(&logs)
+		libCode := func(ctx context.Context) string {
+			LoggerFromContext(ctx).Info("in library")
+			EnvFromContext(ctx)["lib"] = true
+			return ReqIDFromContext(ctx)
+		}
+
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(RequestID)
+		mx.Use(EnvAdd(map[string]interface{}{ContextLog: logger}))
+		mx.Use(BridgeContext)
+		var id string
+		var env web.C
+		mx.Get("/", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			id = libCode(r.Context())
+			env = c
+		})
+		req, _ := http.NewRequest("GET", "/", nil)
+		mx.ServeHTTP(httptest.NewRecorder(), req)
+
+		Ω(id).Should(Equal(middleware.GetReqID(env)))
+		Ω(id).ShouldNot(BeEmpty())
+		Ω(logs).Should(HaveLen(1))
+		Ω(env.Env["lib"]).Should(BeTrue())
+	})
+
+	It("falls back without a bridged request", func() {
+		Ω(ReqIDFromContext(context.Background())).Should(BeEmpty())
+		Ω(LoggerFromContext(context.Background())).Should(Equal(log15.Root()))
+	})
+})
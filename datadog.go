@@ -0,0 +1,119 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Datadog APM tracing
+
+package gojiutil
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/zenazn/goji/web"
+)
+
+// Datadog propagation headers
+const (
+	DatadogTraceIDHeader  = "X-Datadog-Trace-Id"
+	DatadogParentIDHeader = "X-Datadog-Parent-Id"
+	DatadogPriorityHeader = "X-Datadog-Sampling-Priority"
+	DatadogOriginHeader   = "X-Datadog-Origin"
+)
+
+// DatadogSpan is what the Datadog tracer adapter needs from a span. A ddtrace.Span
+// (gopkg.in/DataDog/dd-trace-go.v1) is adapted in a few lines, which keeps this package from
+// depending on the tracer.
+type DatadogSpan interface {
+	SetTag(key string, value interface{})
+	Finish(err error)
+	TraceID() uint64
+	SpanID() uint64
+}
+
+// DatadogContext is the trace context carried by the Datadog propagation headers
+type DatadogContext struct {
+	TraceID          uint64
+	ParentID         uint64
+	SamplingPriority *int
+	Origin           string
+}
+
+// DatadogStarter starts a span for the operation and resource, as a child of parent if
+// non-nil
+type DatadogStarter func(operation, resource string, parent *DatadogContext) DatadogSpan
+
+// ExtractDatadog parses the Datadog propagation headers, it returns false if there are none
+// or they are malformed
+func ExtractDatadog(h http.Header) (DatadogContext, bool) {
+	var ctx DatadogContext
+	var err error
+	if ctx.TraceID, err = strconv.ParseUint(h.Get(DatadogTraceIDHeader), 10, 64); err != nil {
+		return ctx, false
+	}
+	if ctx.ParentID, err = strconv.ParseUint(h.Get(DatadogParentIDHeader), 10, 64); err != nil {
+		return ctx, false
+	}
+	if p, err := strconv.Atoi(h.Get(DatadogPriorityHeader)); err == nil {
+		ctx.SamplingPriority = &p
+	}
+	ctx.Origin = h.Get(DatadogOriginHeader)
+	return ctx, true
+}
+
+// InjectDatadog sets the Datadog propagation headers
+func InjectDatadog(h http.Header, ctx DatadogContext) {
+	h.Set(DatadogTraceIDHeader, strconv.FormatUint(ctx.TraceID, 10))
+	h.Set(DatadogParentIDHeader, strconv.FormatUint(ctx.ParentID, 10))
+	if ctx.SamplingPriority != nil {
+		h.Set(DatadogPriorityHeader, strconv.Itoa(*ctx.SamplingPriority))
+	}
+	if ctx.Origin != "" {
+		h.Set(DatadogOriginHeader, ctx.Origin)
+	}
+}
+
+// DatadogTracer adapts a DatadogStarter to the Tracer interface, spans use "http.request" as
+// operation name and the span name (method and route pattern) as resource
+func DatadogTracer(start DatadogStarter) Tracer {
+	return datadogTracer(start)
+}
+
+// Datadog creates a middleware that traces each request in a Datadog span, it is shorthand
+// for Trace(DatadogTracer(start)). Use TraceHeaders to propagate the trace downstream.
+func Datadog(start DatadogStarter) web.MiddlewareType {
+	return Trace(DatadogTracer(start))
+}
+
+type datadogTracer DatadogStarter
+
+func (t datadogTracer) StartSpan(name string, parent Span, carrier http.Header) Span {
+	var pctx *DatadogContext
+	if p, ok := parent.(*datadogSpan); ok {
+		pctx = &DatadogContext{TraceID: p.span.TraceID(), ParentID: p.span.SpanID(),
+			SamplingPriority: p.priority, Origin: p.origin}
+	} else if carrier != nil {
+		if ctx, ok := ExtractDatadog(carrier); ok {
+			pctx = &ctx
+		}
+	}
+	s := &datadogSpan{span: t("http.request", name, pctx)}
+	if pctx != nil {
+		s.priority, s.origin = pctx.SamplingPriority, pctx.Origin
+	}
+	s.span.SetTag("span.type", "web")
+	return s
+}
+
+// datadogSpan remembers the sampling decision and origin so they propagate downstream
+type datadogSpan struct {
+	span     DatadogSpan
+	priority *int
+	origin   string
+}
+
+func (s *datadogSpan) SetTag(key string, value interface{}) { s.span.SetTag(key, value) }
+func (s *datadogSpan) Finish(err error)                     { s.span.Finish(err) }
+
+func (s *datadogSpan) Inject(h http.Header) {
+	InjectDatadog(h, DatadogContext{TraceID: s.span.TraceID(), ParentID: s.span.SpanID(),
+		SamplingPriority: s.priority, Origin: s.origin})
+}
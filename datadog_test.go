@@ -0,0 +1,98 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+// fakeDDSpan is a DatadogSpan continuing the trace of its parent
+type fakeDDSpan struct {
+	resource string
+	parent   *DatadogContext
+	traceID  uint64
+	spanID   uint64
+	tags     map[string]interface{}
+	finished bool
+	err      error
+}
+
+func (s *fakeDDSpan) SetTag(key string, value interface{}) { s.tags[key] = value }
+func (s *fakeDDSpan) Finish(err error)                     { s.finished, s.err = true, err }
+func (s *fakeDDSpan) TraceID() uint64                      { return s.traceID }
+func (s *fakeDDSpan) SpanID() uint64                       { return s.spanID }
+
+var _ = Describe("Datadog", func() {
+
+	It("extracts the headers it injects", func() {
+		prio := 2
+		h := http.Header{}
+		InjectDatadog(h, DatadogContext{TraceID: 1234567890123, ParentID: 42,
+			SamplingPriority: &prio, Origin: "synthetics"})
+		Ω(h.Get("X-Datadog-Trace-Id")).Should(Equal("1234567890123"))
+		Ω(h.Get("X-Datadog-Sampling-Priority")).Should(Equal("2"))
+
+		ctx, ok := ExtractDatadog(h)
+		Ω(ok).Should(BeTrue())
+		Ω(ctx.TraceID).Should(BeEquivalentTo(1234567890123))
+		Ω(ctx.ParentID).Should(BeEquivalentTo(42))
+		Ω(*ctx.SamplingPriority).Should(Equal(2))
+		Ω(ctx.Origin).Should(Equal("synthetics"))
+
+		h.Set("X-Datadog-Parent-Id", "nope")
+		_, ok = ExtractDatadog(h)
+		Ω(ok).Should(BeFalse())
+		_, ok = ExtractDatadog(http.Header{})
+		Ω(ok).Should(BeFalse())
+	})
+
+	It("makes the request span a child of the caller's", func() {
+		var spans []*fakeDDSpan
+		start := func(operation, resource string, parent *DatadogContext) DatadogSpan {
+			s := &fakeDDSpan{resource: resource, parent: parent, traceID: 99,
+				spanID: uint64(100 + len(spans)), tags: map[string]interface{}{}}
+			if parent != nil {
+				s.traceID = parent.TraceID
+			}
+			spans = append(spans, s)
+			return s
+		}
+		downstream := http.Header{}
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(mx.Router)
+		mx.Use(Datadog(start))
+		mx.Get("/items/:id", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			TraceHeaders(c, downstream)
+			Errorf(c, rw, 502, "upstream down")
+		})
+
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/items/42", nil)
+		req.Header.Set("X-Datadog-Trace-Id", "7")
+		req.Header.Set("X-Datadog-Parent-Id", "8")
+		req.Header.Set("X-Datadog-Sampling-Priority", "1")
+		mx.ServeHTTP(rw, req)
+
+		Ω(spans).Should(HaveLen(1))
+		s := spans[0]
+		Ω(s.resource).Should(Equal("GET /items/:id"))
+		Ω(s.parent.TraceID).Should(BeEquivalentTo(7))
+		Ω(s.parent.ParentID).Should(BeEquivalentTo(8))
+		Ω(s.tags).Should(HaveKeyWithValue("span.type", "web"))
+		Ω(s.tags).Should(HaveKeyWithValue("http.status_code", "502"))
+		Ω(s.finished).Should(BeTrue())
+		Ω(s.err).Should(MatchError("upstream down"))
+
+		// the downstream call is a child of the request span, keeping the sampling decision
+		Ω(downstream.Get("X-Datadog-Trace-Id")).Should(Equal("7"))
+		Ω(downstream.Get("X-Datadog-Parent-Id")).Should(Equal("100"))
+		Ω(downstream.Get("X-Datadog-Sampling-Priority")).Should(Equal("1"))
+	})
+})
@@ -0,0 +1,188 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Debug and operational endpoints
+
+package gojiutil
+
+import (
+	"net"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// startTime is used to compute the process uptime reported by the debug endpoints
+var startTime = time.Now()
+
+// ConnCounter keeps track of the number of open connections of an http.Server. Install it
+// using srv.ConnState = counter.ConnState.
+type ConnCounter struct {
+	open int64
+}
+
+// ConnState is suitable as http.Server.ConnState hook
+func (cc *ConnCounter) ConnState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		atomic.AddInt64(&cc.open, 1)
+	case http.StateHijacked, http.StateClosed:
+		atomic.AddInt64(&cc.open, -1)
+	}
+}
+
+// Open returns the number of currently open connections
+func (cc *ConnCounter) Open() int64 {
+	return atomic.LoadInt64(&cc.open)
+}
+
+// RuntimeStats is the JSON document produced by the runtime stats endpoint
+type RuntimeStats struct {
+	Goroutines int      `json:"goroutines"`
+	Uptime     string   `json:"uptime"`
+	UptimeSec  int64    `json:"uptime_sec"`
+	OpenConns  *int64   `json:"open_conns,omitempty"`
+	Memory     MemStats `json:"memory"`
+	GC         GCStats  `json:"gc"`
+}
+
+// MemStats is the subset of runtime.MemStats reported by the runtime stats endpoint
+type MemStats struct {
+	Alloc        uint64 `json:"alloc"`
+	TotalAlloc   uint64 `json:"total_alloc"`
+	Sys          uint64 `json:"sys"`
+	HeapAlloc    uint64 `json:"heap_alloc"`
+	HeapInuse    uint64 `json:"heap_inuse"`
+	HeapIdle     uint64 `json:"heap_idle"`
+	HeapReleased uint64 `json:"heap_released"`
+	HeapObjects  uint64 `json:"heap_objects"`
+	Mallocs      uint64 `json:"mallocs"`
+	Frees        uint64 `json:"frees"`
+}
+
+// GCStats summarizes garbage collection activity, pause times are in microseconds
+type GCStats struct {
+	NumGC      int64  `json:"num_gc"`
+	LastGC     string `json:"last_gc,omitempty"`
+	PauseTotal int64  `json:"pause_total_us"`
+	PauseP50   int64  `json:"pause_p50_us"`
+	PauseP90   int64  `json:"pause_p90_us"`
+	PauseP99   int64  `json:"pause_p99_us"`
+	PauseMax   int64  `json:"pause_max_us"`
+}
+
+// ReadRuntimeStats collects the current runtime stats, conns may be nil
+func ReadRuntimeStats(conns *ConnCounter) RuntimeStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	// ask for 101 quantiles so we can index percentiles directly
+	gc := debug.GCStats{PauseQuantiles: make([]time.Duration, 101)}
+	debug.ReadGCStats(&gc)
+
+	uptime := time.Since(startTime)
+	stats := RuntimeStats{
+		Goroutines: runtime.NumGoroutine(),
+		Uptime:     uptime.String(),
+		UptimeSec:  int64(uptime / time.Second),
+		Memory: MemStats{
+			Alloc:        ms.Alloc,
+			TotalAlloc:   ms.TotalAlloc,
+			Sys:          ms.Sys,
+			HeapAlloc:    ms.HeapAlloc,
+			HeapInuse:    ms.HeapInuse,
+			HeapIdle:     ms.HeapIdle,
+			HeapReleased: ms.HeapReleased,
+			HeapObjects:  ms.HeapObjects,
+			Mallocs:      ms.Mallocs,
+			Frees:        ms.Frees,
+		},
+		GC: GCStats{
+			NumGC:      gc.NumGC,
+			PauseTotal: int64(gc.PauseTotal / time.Microsecond),
+		},
+	}
+	if gc.NumGC > 0 {
+		stats.GC.LastGC = gc.LastGC.UTC().Format(time.RFC3339)
+		stats.GC.PauseP50 = int64(gc.PauseQuantiles[50] / time.Microsecond)
+		stats.GC.PauseP90 = int64(gc.PauseQuantiles[90] / time.Microsecond)
+		stats.GC.PauseP99 = int64(gc.PauseQuantiles[99] / time.Microsecond)
+		stats.GC.PauseMax = int64(gc.PauseQuantiles[100] / time.Microsecond)
+	}
+	if conns != nil {
+		open := conns.Open()
+		stats.OpenConns = &open
+	}
+	return stats
+}
+
+// RuntimeStatsHandler returns a handler that renders the runtime stats as JSON, conns may
+// be nil if open connections are not being tracked
+func RuntimeStatsHandler(conns *ConnCounter) web.HandlerFunc {
+	return func(c web.C, rw http.ResponseWriter, r *http.Request) {
+		WriteJSON(c, rw, http.StatusOK, ReadRuntimeStats(conns))
+	}
+}
+
+// MountRuntimeStats mounts the runtime stats handler onto a mux, typically the admin mux and
+// typically at /debug/runtime
+func MountRuntimeStats(mx *web.Mux, path string, conns *ConnCounter) {
+	mx.Get(path, RuntimeStatsHandler(conns))
+}
+
+// BuildInfo describes the deployed build of a service, typically set using -ldflags -X at
+// build time, fields left empty are filled in by MountVersion from the Go build info
+type BuildInfo struct {
+	Version   string `json:"version"`
+	GitSHA    string `json:"git_sha"`
+	BuildDate string `json:"build_date"`
+	Dirty     bool   `json:"dirty,omitempty"` // built from a modified work tree
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"` // GOOS/GOARCH
+}
+
+// ReadBuildInfo returns the build info embedded by the Go toolchain: the main module's
+// version and the VCS revision and commit time, which are set when building from a checkout
+func ReadBuildInfo() BuildInfo {
+	info := BuildInfo{GoVersion: runtime.Version(), Platform: runtime.GOOS + "/" + runtime.GOARCH}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if v := bi.Main.Version; v != "(devel)" {
+		info.Version = v
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.GitSHA = s.Value
+		case "vcs.time":
+			info.BuildDate = s.Value
+		case "vcs.modified":
+			info.Dirty = s.Value == "true"
+		}
+	}
+	return info
+}
+
+// MountVersion mounts a handler rendering info as JSON onto a mux, e.g. at /version, so ops
+// can verify what's deployed. Empty fields of info are filled in using ReadBuildInfo.
+func MountVersion(mx *web.Mux, path string, info BuildInfo) {
+	auto := ReadBuildInfo()
+	if info.Version == "" {
+		info.Version = auto.Version
+	}
+	if info.GitSHA == "" {
+		info.GitSHA, info.Dirty = auto.GitSHA, info.Dirty || auto.Dirty
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = auto.BuildDate
+	}
+	info.GoVersion, info.Platform = auto.GoVersion, auto.Platform
+	mx.Get(path, func(c web.C, rw http.ResponseWriter, r *http.Request) {
+		WriteJSON(c, rw, http.StatusOK, info)
+	})
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+)
+
+var _ = Describe("RuntimeStats", func() {
+	var mx *web.Mux
+	var conns *ConnCounter
+
+	BeforeEach(func() {
+		mx = web.New()
+		conns = &ConnCounter{}
+		MountRuntimeStats(mx, "/debug/runtime", conns)
+	})
+
+	It("renders runtime stats as JSON", func() {
+		conns.ConnState(nil, http.StateNew)
+		conns.ConnState(nil, http.StateNew)
+		conns.ConnState(nil, http.StateClosed)
+		req, _ := http.NewRequest("GET", "/debug/runtime", nil)
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		Ω(resp.Code).Should(Equal(200))
+		Ω(resp.Header().Get("Content-Type")).Should(HavePrefix("application/json"))
+
+		var stats RuntimeStats
+		Ω(json.Unmarshal(resp.Body.Bytes(), &stats)).Should(Succeed())
+		Ω(stats.Goroutines).Should(BeNumerically(">", 0))
+		Ω(stats.Memory.Sys).Should(BeNumerically(">", 0))
+		Ω(stats.OpenConns).ShouldNot(BeNil())
+		Ω(*stats.OpenConns).Should(BeEquivalentTo(1))
+	})
+})
+
+var _ = Describe("debug endpoints", func() {
+
+	It("aren't registered on http.DefaultServeMux by importing gojiutil", func() {
+		for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/vars"} {
+			req, _ := http.NewRequest("GET", path, nil)
+			_, pattern := http.DefaultServeMux.Handler(req)
+			Ω(pattern).Should(BeEmpty(), path)
+		}
+	})
+})
+
+var _ = Describe("MountVersion", func() {
+
+	It("renders the build info, completed from the Go build info", func() {
+		mx := web.New()
+		MountVersion(mx, "/version", BuildInfo{Version: "v1.2.3", GitSHA: "abc123"})
+		req, _ := http.NewRequest("GET", "/version", nil)
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		Ω(resp.Code).Should(Equal(200))
+		var info BuildInfo
+		Ω(json.Unmarshal(resp.Body.Bytes(), &info)).Should(Succeed())
+		Ω(info.Version).Should(Equal("v1.2.3"))
+		Ω(info.GitSHA).Should(Equal("abc123"))
+		Ω(info.GoVersion).Should(Equal(runtime.Version()))
+		Ω(info.Platform).Should(Equal(runtime.GOOS + "/" + runtime.GOARCH))
+	})
+})
@@ -0,0 +1,133 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Debug response headers for support engineers
+
+package gojiutil
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+// DebugTokenHeader is the request header carrying the token produced by DebugToken
+var DebugTokenHeader = "X-Debug-Token"
+
+// DebugTokenTTL is how long a debug token remains valid
+var DebugTokenTTL = 15 * time.Minute
+
+// DefaultDebugKeys are the c.Env keys echoed by DebugHeaders if none are specified, mapped
+// to the suffix of their X-Debug-* header
+var DefaultDebugKeys = map[string]string{
+	middleware.RequestIDKey: "Request-Id",
+	"cache":                 "Cache",
+	"canary":                "Canary",
+}
+
+// DebugToken produces a token valid for DebugTokenTTL after t, for support engineers to
+// present in the DebugTokenHeader, e.g. using a browser extension
+func DebugToken(secret []byte, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return ts + "." + debugSig(secret, ts)
+}
+
+func debugSig(secret []byte, ts string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validDebugToken checks the signature and the age of a debug token
+func validDebugToken(secret []byte, token string) bool {
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return false
+	}
+	ts, sig := token[:i], token[i+1:]
+	if !SecureCompare(sig, debugSig(secret, ts)) {
+		return false
+	}
+	secs, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(secs, 0))
+	return age > -time.Minute && age < DebugTokenTTL // tolerate some clock skew
+}
+
+// DebugHeaders creates a middleware that, for requests carrying a valid debug token signed
+// with secret, copies the c.Env values listed in keys (DefaultDebugKeys if nil) into
+// X-Debug-<suffix> response headers, along with X-Debug-Route (the route pattern, which
+// requires mx.Router in the middleware stack, else it's the path) and X-Debug-Duration (the
+// handler's time to first byte). Requests without a valid token are unaffected so internal
+// details are not leaked.
+func DebugHeaders(secret []byte, keys map[string]string) web.MiddlewareType {
+	if keys == nil {
+		keys = DefaultDebugKeys
+	}
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			token := r.Header.Get(DebugTokenHeader)
+			if token == "" || !validDebugToken(secret, token) {
+				h.ServeHTTP(rw, r)
+				return
+			}
+			dw := &debugWriter{ResponseWriter: rw, c: c, r: r, keys: keys, start: time.Now()}
+			h.ServeHTTP(dw, r)
+		})
+	}
+}
+
+// debugWriter adds the debug headers just before the response header is written
+type debugWriter struct {
+	http.ResponseWriter
+	c           *web.C
+	r           *http.Request
+	keys        map[string]string
+	start       time.Time
+	wroteHeader bool
+}
+
+func (dw *debugWriter) WriteHeader(code int) {
+	if !dw.wroteHeader {
+		dw.wroteHeader = true
+		hdr := dw.Header()
+		for key, suffix := range dw.keys {
+			if v, ok := dw.c.Env[key]; ok {
+				hdr.Set("X-Debug-"+suffix, fmt.Sprint(v))
+			}
+		}
+		hdr.Set("X-Debug-Route", routeName(*dw.c, dw.r))
+		hdr.Set("X-Debug-Duration", time.Since(dw.start).String())
+		AddVary(hdr, DebugTokenHeader)
+	}
+	dw.ResponseWriter.WriteHeader(code)
+}
+
+func (dw *debugWriter) Write(p []byte) (int, error) {
+	if !dw.wroteHeader {
+		dw.WriteHeader(http.StatusOK)
+	}
+	return dw.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher
+func (dw *debugWriter) Flush() {
+	if !dw.wroteHeader {
+		dw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := dw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter
+func (dw *debugWriter) Unwrap() http.ResponseWriter { return dw.ResponseWriter }
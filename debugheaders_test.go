@@ -0,0 +1,57 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("DebugHeaders", func() {
+	secret := []byte("s3cret")
+	var mx *web.Mux
+
+	BeforeEach(func() {
+		mx = web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(RequestID)
+		mx.Use(DebugHeaders(secret, nil))
+		mx.Use(mx.Router)
+		mx.Get("/items/:id", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			c.Env["cache"] = "miss"
+			rw.Write([]byte("ok"))
+		})
+	})
+
+	serve := func(token string) http.Header {
+		req, _ := http.NewRequest("GET", "/items/1", nil)
+		req.Header.Set(RequestIDHeader, "abc")
+		if token != "" {
+			req.Header.Set(DebugTokenHeader, token)
+		}
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		return resp.Header()
+	}
+
+	It("echoes env values for valid tokens", func() {
+		h := serve(DebugToken(secret, time.Now()))
+		Ω(h.Get("X-Debug-Request-Id")).Should(Equal("abc"))
+		Ω(h.Get("X-Debug-Cache")).Should(Equal("miss"))
+		Ω(h.Get("X-Debug-Route")).Should(Equal("/items/:id"))
+		Ω(h.Get("X-Debug-Duration")).ShouldNot(BeEmpty())
+	})
+
+	It("ignores bad or expired tokens", func() {
+		Ω(serve("").Get("X-Debug-Route")).Should(BeEmpty())
+		Ω(serve(DebugToken([]byte("other"), time.Now())).Get("X-Debug-Route")).Should(BeEmpty())
+		Ω(serve(DebugToken(secret, time.Now().Add(-time.Hour))).Get("X-Debug-Route")).
+			Should(BeEmpty())
+	})
+})
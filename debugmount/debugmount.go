@@ -0,0 +1,48 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Package debugmount mounts the pprof profiling and expvar endpoints onto a goji mux. It is
+// separate from gojiutil because net/http/pprof and expvar register their endpoints on
+// http.DefaultServeMux when imported, which only applications asking for them should get.
+package debugmount
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/rightscale/gojiutil"
+	"github.com/zenazn/goji/web"
+)
+
+// MountDebug mounts the net/http/pprof profiling endpoints at prefix+"/pprof/" and the expvar
+// variables at prefix+"/vars" onto a mux, typically the admin mux with prefix "/debug". Only
+// requests for which authorize returns true are served, others get a 403, so pass e.g. a
+// check of an admin token or of the client's network. Note that the CPU profile and the trace
+// take 30s by default (use ?seconds=N), which must fit within the server's WriteTimeout.
+//
+// As importing this package registers the same endpoints, unprotected, on
+// http.DefaultServeMux, don't serve http.DefaultServeMux (e.g. with goji.Serve) on a public
+// listener in applications that use it.
+func MountDebug(mx *web.Mux, prefix string, authorize func(*http.Request) bool) {
+	guard := func(h http.Handler) web.HandlerFunc {
+		return func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			if authorize == nil || !authorize(r) {
+				gojiutil.ErrorString(c, rw, http.StatusForbidden, "Forbidden")
+				return
+			}
+			h.ServeHTTP(rw, r)
+		}
+	}
+	p := prefix + "/pprof"
+	mx.Get(p, http.RedirectHandler(p+"/", http.StatusMovedPermanently))
+	mx.Get(p+"/", guard(http.HandlerFunc(pprof.Index)))
+	mx.Get(p+"/cmdline", guard(http.HandlerFunc(pprof.Cmdline)))
+	mx.Get(p+"/profile", guard(http.HandlerFunc(pprof.Profile)))
+	mx.Handle(p+"/symbol", guard(http.HandlerFunc(pprof.Symbol))) // GET and POST
+	mx.Get(p+"/trace", guard(http.HandlerFunc(pprof.Trace)))
+	// named profiles, e.g. heap or goroutine, pprof.Index only finds them under /debug/pprof/
+	mx.Get(p+"/:name", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+		guard(pprof.Handler(c.URLParams["name"]))(c, rw, r)
+	})
+	mx.Get(prefix+"/vars", guard(expvar.Handler()))
+}
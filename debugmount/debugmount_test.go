@@ -0,0 +1,54 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package debugmount
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("MountDebug", func() {
+	var mx *web.Mux
+
+	BeforeEach(func() {
+		mx = web.New()
+		mx.Use(middleware.EnvInit)
+		MountDebug(mx, "/admin/debug", func(r *http.Request) bool {
+			return r.Header.Get("X-Admin") == "yes"
+		})
+	})
+
+	get := func(path string, admin bool) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		if admin {
+			req.Header.Set("X-Admin", "yes")
+		}
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		return resp
+	}
+
+	It("serves pprof and expvar to authorized requests", func() {
+		resp := get("/admin/debug/pprof/", true)
+		Ω(resp.Code).Should(Equal(200))
+		Ω(resp.Body.String()).Should(ContainSubstring("goroutine"))
+		resp = get("/admin/debug/pprof/goroutine?debug=1", true)
+		Ω(resp.Code).Should(Equal(200))
+		Ω(resp.Body.String()).Should(HavePrefix("goroutine profile:"))
+		resp = get("/admin/debug/pprof/cmdline", true)
+		Ω(resp.Code).Should(Equal(200))
+		resp = get("/admin/debug/vars", true)
+		Ω(resp.Code).Should(Equal(200))
+		Ω(resp.Body.String()).Should(ContainSubstring(`"memstats"`))
+	})
+
+	It("rejects other requests", func() {
+		Ω(get("/admin/debug/pprof/heap", false).Code).Should(Equal(403))
+		Ω(get("/admin/debug/vars", false).Code).Should(Equal(403))
+	})
+})
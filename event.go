@@ -0,0 +1,139 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Wide events: one structured event per request
+
+package gojiutil
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+	"github.com/zenazn/goji/web/mutil"
+)
+
+// ContextEvent is the hash key in which WideEvent places the request's *Event
+var ContextEvent string = "event"
+
+// Event accumulates the fields of a wide event, handlers and middlewares annotate it during
+// the request and the WideEvent middleware emits it at the end. It is safe for concurrent use.
+type Event struct {
+	mu     sync.Mutex
+	fields map[string]interface{}
+}
+
+// NewEvent creates an empty event
+func NewEvent() *Event {
+	return &Event{fields: make(map[string]interface{})}
+}
+
+// Add sets a field of the event, overwriting any previous value
+func (e *Event) Add(key string, val interface{}) {
+	e.mu.Lock()
+	e.fields[key] = val
+	e.mu.Unlock()
+}
+
+// AddFields sets a number of key/value pairs, as in log15 contexts
+func (e *Event) AddFields(kvs ...interface{}) {
+	e.mu.Lock()
+	for i := 0; i+1 < len(kvs); i += 2 {
+		if k, ok := kvs[i].(string); ok {
+			e.fields[k] = kvs[i+1]
+		}
+	}
+	e.mu.Unlock()
+}
+
+// Timer starts a timer and returns a function that stops it and records the elapsed time in
+// milliseconds in the field <name>_ms, typical use is defer ev.Timer("db")()
+func (e *Event) Timer(name string) func() {
+	start := time.Now()
+	return func() {
+		e.Add(name+"_ms", float64(time.Since(start))/float64(time.Millisecond))
+	}
+}
+
+// Fields returns a copy of the event's fields
+func (e *Event) Fields() map[string]interface{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f := make(map[string]interface{}, len(e.fields))
+	for k, v := range e.fields {
+		f[k] = v
+	}
+	return f
+}
+
+// GetEvent returns the request's event, if the WideEvent middleware isn't installed it
+// returns a detached event so handlers can annotate unconditionally
+func GetEvent(c web.C) *Event {
+	if e, ok := c.Env[ContextEvent].(*Event); ok {
+		return e
+	}
+	return NewEvent()
+}
+
+// EventSink receives the completed events
+type EventSink interface {
+	Emit(fields map[string]interface{})
+}
+
+// EventSinkFunc adapts a function to the EventSink interface
+type EventSinkFunc func(fields map[string]interface{})
+
+// Emit implements EventSink
+func (f EventSinkFunc) Emit(fields map[string]interface{}) { f(fields) }
+
+// LogEventSink emits each event as a single log line with the fields in sorted order
+func LogEventSink(logger Logger) EventSink {
+	return EventSinkFunc(func(fields map[string]interface{}) {
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		ctx := make([]interface{}, 0, 2*len(keys))
+		for _, k := range keys {
+			ctx = append(ctx, k, fields[k])
+		}
+		logger.Info("request", ctx...)
+	})
+}
+
+// WideEvent is a middleware that places an *Event into c.Env[ContextEvent] and emits it to
+// the sink at the end of the request. The event automatically receives the request ID,
+// method, path, client IP, status, duration, and error (as recorded by ErrorString), plus
+// the values of the listed c.Env keys if present (e.g. the authenticated user).
+func WideEvent(sink EventSink, envKeys ...string) web.MiddlewareType {
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			ev := NewEvent()
+			c.Env[ContextEvent] = ev
+			if id := middleware.GetReqID(*c); id != "" {
+				ev.Add("req", id)
+			}
+			ev.AddFields("verb", r.Method, "path", r.URL.Path, "ip", r.RemoteAddr)
+
+			wp := mutil.WrapWriter(rw)
+			start := time.Now()
+			h.ServeHTTP(wp, r)
+
+			ev.Add("duration_ms", float64(time.Since(start))/float64(time.Millisecond))
+			ev.Add("status", wp.Status())
+			ev.Add("bytes_out", wp.BytesWritten())
+			if e, ok := c.Env["err"].(string); ok {
+				ev.Add("err", e)
+			}
+			for _, k := range envKeys {
+				if v, ok := c.Env[k]; ok {
+					ev.Add(k, v)
+				}
+			}
+			sink.Emit(ev.Fields())
+		})
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("WideEvent", func() {
+
+	It("emits the fields added during the request once at the end", func() {
+		var events []map[string]interface{}
+		sink := EventSinkFunc(func(f map[string]interface{}) { events = append(events, f) })
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(WideEvent(sink, "user"))
+		mx.Get("/items", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			ev := GetEvent(c)
+			ev.Add("items", 3)
+			ev.AddFields("cache", "miss", "shard", 7)
+			stop := ev.Timer("db")
+			time.Sleep(time.Millisecond)
+			stop()
+			c.Env["user"] = "alice"
+			Errorf(c, rw, 404, "not here")
+			Ω(events).Should(BeEmpty())
+		})
+
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/items", nil)
+		req.RemoteAddr = "192.0.2.1:5000"
+		mx.ServeHTTP(rw, req)
+
+		Ω(events).Should(HaveLen(1))
+		ev := events[0]
+		Ω(ev).Should(HaveKeyWithValue("items", 3))
+		Ω(ev).Should(HaveKeyWithValue("cache", "miss"))
+		Ω(ev).Should(HaveKeyWithValue("shard", 7))
+		Ω(ev["db_ms"]).Should(BeNumerically(">=", 1))
+		Ω(ev).Should(HaveKeyWithValue("user", "alice"))
+		Ω(ev).Should(HaveKeyWithValue("verb", "GET"))
+		Ω(ev).Should(HaveKeyWithValue("path", "/items"))
+		Ω(ev).Should(HaveKeyWithValue("ip", "192.0.2.1:5000"))
+		Ω(ev).Should(HaveKeyWithValue("status", 404))
+		Ω(ev).Should(HaveKeyWithValue("err", "not here"))
+		Ω(ev["duration_ms"]).Should(BeNumerically(">=", 1))
+	})
+
+	It("returns a detached event without the middleware", func() {
+		ev := GetEvent(web.C{})
+		ev.Add("k", "v")
+		Ω(ev.Fields()).Should(Equal(map[string]interface{}{"k": "v"}))
+	})
+
+	It("logs events as a single line with sorted fields", func() {
+		var logStr []string
+		LogEventSink(testLogger(&logStr)).Emit(map[string]interface{}{
+			"status": 200, "duration_ms": 1.5, "verb": "GET"})
+		Ω(logStr).Should(Equal([]string{
+			"Lvl info, request, [duration_ms 1.5 status 200 verb GET]\n"}))
+
+		var buf bytes.Buffer
+		LogEventSink(SlogLogger(slog.New(slog.NewTextHandler(&buf, nil)))).Emit(
+			map[string]interface{}{"status": 200, "verb": "GET"})
+		Ω(buf.String()).Should(HaveSuffix("msg=request status=200 verb=GET\n"))
+	})
+})
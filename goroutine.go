@@ -0,0 +1,42 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Panic-safe goroutines spawned by handlers
+
+package gojiutil
+
+import (
+	"fmt"
+
+	"github.com/zenazn/goji/web"
+)
+
+// PanicReporter, if set, is called by Recoverer and Go with the recovered value and the call
+// stack of every panic, e.g. to forward it to an error reporting service
+var PanicReporter func(c web.C, err interface{}, stack []Frame)
+
+// Go runs fn in a goroutine, recovering any panic so it doesn't crash the process. A panic
+// is reported like Recoverer does: it is logged with its call stack to the request's context
+// logger and passed to PanicReporter. The handler may return before fn completes, so fn must
+// not write to the response.
+func Go(c *web.C, fn func()) {
+	cc := *c
+	log := contextLogger(cc)
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				reportPanic(cc, log, "panic in goroutine", err)
+			}
+		}()
+		fn()
+	}()
+}
+
+// reportPanic logs a recovered panic with its call stack and passes it to PanicReporter
+func reportPanic(c web.C, log Logger, msg string, err interface{}, ctx ...interface{}) {
+	stack := callers(2) // skip the deferred func calling reportPanic
+	if PanicReporter != nil {
+		PanicReporter(c, err, stack)
+	}
+	ctx = append(ctx, "err", fmt.Sprintf("panic: %v", err))
+	log.Crit(msg, append(ctx, frameFields(stack)...)...)
+}
@@ -0,0 +1,38 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// chanLogger is like testLogger but sends the records to a channel so tests can wait for
+// records logged by other goroutines
+func chanLogger(out chan<- string) log15.Logger {
+	l := log15.New()
+	l.SetHandler(log15.FuncHandler(func(r *log15.Record) error {
+		out <- fmt.Sprintf("Lvl %s, %s, %+v\n", r.Lvl, r.Msg, r.Ctx)
+		return nil
+	}))
+	return l
+}
+
+var _ = Describe("Go", func() {
+
+	It("recovers and reports panics", func() {
+		logged := make(chan string, 1)
+		reported := make(chan interface{}, 1)
+		PanicReporter = func(c web.C, err interface{}, stack []Frame) { reported <- err }
+		defer func() { PanicReporter = nil }()
+
+		c := web.C{Env: map[interface{}]interface{}{ContextLog: chanLogger(logged)}}
+		Go(&c, func() { panic("boom") })
+		Eventually(reported).Should(Receive(Equal("boom")))
+		Eventually(logged).Should(Receive(ContainSubstring("err panic: boom stack0")))
+	})
+})
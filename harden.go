@@ -0,0 +1,104 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Request smuggling and header anomaly defenses
+
+package gojiutil
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+)
+
+// HardenOptions configures Harden, zero values select the defaults
+type HardenOptions struct {
+	MaxHeaders     int // max number of header lines, default 100
+	MaxHeaderBytes int // max total size of the header names and values, default 32KB
+	MaxValueBytes  int // max size of a single header value, default 8KB
+}
+
+// Harden creates a middleware that rejects requests that are either malformed or ambiguous
+// in ways that lenient proxies in front of the service may interpret differently, which is
+// the basis of request smuggling: conflicting or duplicate Transfer-Encoding/Content-Length,
+// absurd header counts or sizes, and obs-fold continuation lines or bare CR/LF in values.
+// Rejected requests get a 400 with Connection: close and the anomaly is logged.
+// Note that net/http already rejects some of these and unfolds obs-fold lines itself, this
+// middleware catches what it lets through as well as what other servers may pass along.
+func Harden(opts HardenOptions) web.MiddlewareType {
+	if opts.MaxHeaders <= 0 {
+		opts.MaxHeaders = 100
+	}
+	if opts.MaxHeaderBytes <= 0 {
+		opts.MaxHeaderBytes = 32 << 10
+	}
+	if opts.MaxValueBytes <= 0 {
+		opts.MaxValueBytes = 8 << 10
+	}
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if anomaly := requestAnomaly(r, opts); anomaly != "" {
+				contextLogger(*c).Warn("rejecting anomalous request", "anomaly", anomaly,
+					"method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+				rw.Header().Set("Connection", "close")
+				ErrorString(*c, rw, http.StatusBadRequest, "Malformed request: "+anomaly)
+				return
+			}
+			h.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// requestAnomaly returns a description of the first anomaly found or ""
+func requestAnomaly(r *http.Request, opts HardenOptions) string {
+	// framing: exactly one way to determine the body length
+	cl := r.Header["Content-Length"]
+	te := r.Header["Transfer-Encoding"]
+	if len(r.TransferEncoding) > 0 || len(te) > 0 {
+		if len(cl) > 0 {
+			return "both Transfer-Encoding and Content-Length"
+		}
+		if len(te) > 1 || len(r.TransferEncoding) > 1 {
+			return "multiple Transfer-Encoding"
+		}
+		enc := r.TransferEncoding
+		if len(enc) == 0 {
+			enc = te
+		}
+		if strings.ToLower(strings.TrimSpace(enc[0])) != "chunked" {
+			return fmt.Sprintf("unsupported Transfer-Encoding %q", enc[0])
+		}
+	}
+	if len(cl) > 1 {
+		return "multiple Content-Length"
+	}
+	if len(cl) == 1 && strings.Contains(cl[0], ",") {
+		return "list-valued Content-Length"
+	}
+
+	// counts and sizes
+	count, size := 0, 0
+	for name, values := range r.Header {
+		count += len(values)
+		for _, v := range values {
+			size += len(name) + len(v)
+			if len(v) > opts.MaxValueBytes {
+				return fmt.Sprintf("header %s value too long", name)
+			}
+			if strings.ContainsAny(v, "\r\n") {
+				return fmt.Sprintf("header %s contains a line break (obs-fold)", name)
+			}
+		}
+		if strings.ContainsAny(name, " \t\r\n") {
+			return fmt.Sprintf("header name %q contains whitespace", name)
+		}
+	}
+	if count > opts.MaxHeaders {
+		return fmt.Sprintf("too many headers (%d)", count)
+	}
+	if size > opts.MaxHeaderBytes {
+		return fmt.Sprintf("headers too large (%d bytes)", size)
+	}
+	return ""
+}
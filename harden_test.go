@@ -0,0 +1,50 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("Harden", func() {
+	var mx *web.Mux
+
+	BeforeEach(func() {
+		mx = web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(Harden(HardenOptions{MaxHeaders: 5}))
+		mx.Post("/", func(rw http.ResponseWriter, r *http.Request) {})
+	})
+
+	serve := func(hdr http.Header) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/", strings.NewReader("x"))
+		req.Header = hdr
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		return resp
+	}
+
+	It("lets normal requests through", func() {
+		resp := serve(http.Header{"Content-Length": {"1"}})
+		Ω(resp.Code).Should(Equal(200))
+	})
+
+	It("rejects ambiguous framing", func() {
+		resp := serve(http.Header{"Content-Length": {"1"}, "Transfer-Encoding": {"chunked"}})
+		Ω(resp.Code).Should(Equal(400))
+		Ω(resp.Header().Get("Connection")).Should(Equal("close"))
+		Ω(serve(http.Header{"Content-Length": {"1", "2"}}).Code).Should(Equal(400))
+	})
+
+	It("rejects header anomalies", func() {
+		Ω(serve(http.Header{"X-Foo": {"a\r\n b"}}).Code).Should(Equal(400))
+		Ω(serve(http.Header{"X-Foo": {"1", "2", "3", "4", "5", "6"}}).Code).Should(Equal(400))
+	})
+})
@@ -0,0 +1,155 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Header validation and canonicalization
+
+package gojiutil
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+)
+
+// DupPolicy says what ValidateHeaders does with a header that appears more than once
+type DupPolicy int
+
+const (
+	DupKeep   DupPolicy = iota // leave all values
+	DupJoin                    // join the values into one, comma-separated
+	DupFirst                   // keep the first value
+	DupLast                    // keep the last value
+	DupReject                  // reject the request with a 400
+)
+
+// HeaderOptions configures ValidateHeaders
+type HeaderOptions struct {
+	MaxValueLen int // max length of a header value, default 8KB
+	// Duplicates sets the policy per header name, headers not listed use DefaultDup. The
+	// default rejects duplicates of headers that must be singletons per RFC 7230/7231.
+	Duplicates map[string]DupPolicy
+	DefaultDup DupPolicy
+}
+
+// singletonHeaders must not be repeated, they're rejected when duplicated by default
+var singletonHeaders = map[string]DupPolicy{
+	"Authorization":       DupReject,
+	"Content-Length":      DupReject,
+	"Content-Type":        DupReject,
+	"Host":                DupReject,
+	"If-Modified-Since":   DupReject,
+	"If-Unmodified-Since": DupReject,
+	"Max-Forwards":        DupReject,
+	"Proxy-Authorization": DupReject,
+	"Range":               DupReject,
+	"Referer":             DupReject,
+	"User-Agent":          DupReject,
+}
+
+// ValidateHeaders creates a middleware that checks the names of the request headers against
+// the RFC 7230 token rules and their values for control characters (other than tab) and
+// excessive length, rejecting offending requests with a 400. Headers are re-keyed into their
+// canonical form and duplicates are normalized according to the policy. Offenders are logged.
+func ValidateHeaders(opts HeaderOptions) web.MiddlewareType {
+	if opts.MaxValueLen <= 0 {
+		opts.MaxValueLen = 8 << 10
+	}
+	if opts.Duplicates == nil {
+		opts.Duplicates = singletonHeaders
+	}
+	dups := make(map[string]DupPolicy, len(opts.Duplicates))
+	for k, v := range opts.Duplicates {
+		dups[textproto.CanonicalMIMEHeaderKey(k)] = v
+	}
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			hdr, err := normalizeHeaders(r.Header, opts, dups)
+			if err != nil {
+				contextLogger(*c).Warn("rejecting invalid header", "err", err,
+					"remote", r.RemoteAddr)
+				ErrorString(*c, rw, http.StatusBadRequest, "Invalid header: "+err.Error())
+				return
+			}
+			r.Header = hdr
+			h.ServeHTTP(rw, r)
+		})
+	}
+}
+
+func normalizeHeaders(in http.Header, opts HeaderOptions,
+	dups map[string]DupPolicy) (http.Header, error) {
+
+	// sort the names so values of differently-cased duplicates merge deterministically
+	names := make([]string, 0, len(in))
+	for name := range in {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := make(http.Header, len(in))
+	for _, name := range names {
+		values := in[name]
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("name %q is not a valid token", name)
+		}
+		key := textproto.CanonicalMIMEHeaderKey(name)
+		for _, v := range values {
+			if len(v) > opts.MaxValueLen {
+				return nil, fmt.Errorf("%s value exceeds %d bytes", key, opts.MaxValueLen)
+			}
+			if !validHeaderValue(v) {
+				return nil, fmt.Errorf("%s value contains control characters", key)
+			}
+		}
+		out[key] = append(out[key], values...)
+	}
+	for key, values := range out {
+		if len(values) < 2 {
+			continue
+		}
+		policy, ok := dups[key]
+		if !ok {
+			policy = opts.DefaultDup
+		}
+		switch policy {
+		case DupJoin:
+			out[key] = []string{strings.Join(values, ", ")}
+		case DupFirst:
+			out[key] = values[:1]
+		case DupLast:
+			out[key] = values[len(values)-1:]
+		case DupReject:
+			return nil, fmt.Errorf("%s must not be repeated", key)
+		}
+	}
+	return out, nil
+}
+
+// validHeaderName checks that name is an RFC 7230 token
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		b := name[i]
+		switch {
+		case b >= 'a' && b <= 'z', b >= 'A' && b <= 'Z', b >= '0' && b <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", b) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validHeaderValue checks that v has no control characters other than horizontal tab
+func validHeaderValue(v string) bool {
+	for i := 0; i < len(v); i++ {
+		if b := v[i]; (b < ' ' && b != '\t') || b == 0x7f {
+			return false
+		}
+	}
+	return true
+}
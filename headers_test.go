@@ -0,0 +1,34 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ValidateHeaders", func() {
+	opts := HeaderOptions{MaxValueLen: 10,
+		Duplicates: map[string]DupPolicy{"accept": DupJoin, "host": DupReject}}
+	dups := map[string]DupPolicy{"Accept": DupJoin, "Host": DupReject}
+
+	It("canonicalizes and joins duplicates", func() {
+		out, err := normalizeHeaders(http.Header{
+			"Accept": {"a/b"}, "accept": {"c/d"}, "x-foo": {"1", "2"}}, opts, dups)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(out).Should(Equal(http.Header{"Accept": {"a/b, c/d"}, "X-Foo": {"1", "2"}}))
+	})
+
+	It("rejects invalid headers", func() {
+		_, err := normalizeHeaders(http.Header{"X Foo": {"1"}}, opts, dups)
+		Ω(err).Should(HaveOccurred())
+		_, err = normalizeHeaders(http.Header{"X-Foo": {"a\x00b"}}, opts, dups)
+		Ω(err).Should(HaveOccurred())
+		_, err = normalizeHeaders(http.Header{"X-Foo": {"0123456789x"}}, opts, dups)
+		Ω(err).Should(HaveOccurred())
+		_, err = normalizeHeaders(http.Header{"Host": {"a", "b"}}, opts, dups)
+		Ω(err).Should(HaveOccurred())
+	})
+})
@@ -0,0 +1,164 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Liveness and readiness checks
+
+package gojiutil
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// ContextSkipLog is the hash key which, when set to true by a handler, keeps Logger15 from
+// logging the request, see SkipLog
+var ContextSkipLog string = "skip_log"
+
+// SkipLog keeps Logger15 from logging the current request, e.g. for successful probes
+func SkipLog(c web.C) {
+	if c.Env != nil {
+		c.Env[ContextSkipLog] = true
+	}
+}
+
+// Health holds the named checks run by the liveness and readiness endpoints of MountHealth
+type Health struct {
+	Timeout     time.Duration // max duration of the checks of a probe, default 5s
+	LogRequests bool          // log successful probes, which are excluded from logging otherwise
+
+	mu    sync.RWMutex
+	live  map[string]func(context.Context) error
+	ready map[string]func(context.Context) error
+}
+
+// NewHealth creates a Health without checks, which always reports being healthy
+func NewHealth() *Health {
+	return &Health{live: map[string]func(context.Context) error{},
+		ready: map[string]func(context.Context) error{}}
+}
+
+// AddLiveness registers a check that fails if the process needs to be restarted, e.g.
+// because it's deadlocked. Keep these cheap and independent of other services.
+func (h *Health) AddLiveness(name string, check func(context.Context) error) {
+	h.mu.Lock()
+	h.live[name] = check
+	h.mu.Unlock()
+}
+
+// AddReadiness registers a check that fails if the process can't serve traffic right now,
+// e.g. because its database is unreachable
+func (h *Health) AddReadiness(name string, check func(context.Context) error) {
+	h.mu.Lock()
+	h.ready[name] = check
+	h.mu.Unlock()
+}
+
+// HealthReport is the JSON body of the health endpoints
+type HealthReport struct {
+	Status string                 `json:"status"` // "ok" or "fail"
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// CheckResult is the outcome of one health check
+type CheckResult struct {
+	Status   string `json:"status"` // "ok" or "fail"
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Live runs the liveness checks concurrently
+func (h *Health) Live(ctx context.Context) HealthReport {
+	return h.run(ctx, h.live)
+}
+
+// Ready runs the readiness checks concurrently, it also fails once shutdown began so the
+// process stops receiving traffic while draining (see BeginShutdown)
+func (h *Health) Ready(ctx context.Context) HealthReport {
+	report := h.run(ctx, h.ready)
+	if ShuttingDown() {
+		report.Status = "fail"
+		report.Checks["shutdown"] = CheckResult{Status: "fail", Error: "shutting down",
+			Duration: "0s"}
+	}
+	return report
+}
+
+// run runs checks concurrently within the timeout, checks that don't complete in time fail
+func (h *Health) run(ctx context.Context,
+	checks map[string]func(context.Context) error) HealthReport {
+
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	h.mu.RLock()
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	results := make([]chan CheckResult, len(names))
+	for i, name := range names {
+		results[i] = make(chan CheckResult, 1)
+		go func(check func(context.Context) error, res chan<- CheckResult) {
+			start := time.Now()
+			r := CheckResult{Status: "ok"}
+			if err := check(ctx); err != nil {
+				r = CheckResult{Status: "fail", Error: err.Error()}
+			}
+			r.Duration = time.Since(start).String()
+			res <- r
+		}(checks[name], results[i])
+	}
+	h.mu.RUnlock()
+
+	report := HealthReport{Status: "ok", Checks: make(map[string]CheckResult, len(names))}
+	for i, name := range names {
+		var r CheckResult
+		select {
+		case r = <-results[i]:
+		case <-ctx.Done():
+			// checks that completed before the timeout still count
+			select {
+			case r = <-results[i]:
+			default:
+				r = CheckResult{Status: "fail", Error: "timed out", Duration: timeout.String()}
+			}
+		}
+		if r.Status != "ok" {
+			report.Status = "fail"
+		}
+		report.Checks[name] = r
+	}
+	return report
+}
+
+// MountHealth mounts the liveness and readiness endpoints of h onto a mux at path+"/healthz"
+// and path+"/readyz", e.g. for Kubernetes probes. They respond with a JSON HealthReport and a
+// 200 status, or 503 if a check failed. Successful probes aren't logged by Logger15 unless
+// h.LogRequests is set.
+func MountHealth(mx *web.Mux, path string, h *Health) {
+	mx.Get(path+"/healthz", h.handler(h.Live))
+	mx.Get(path+"/readyz", h.handler(h.Ready))
+}
+
+func (h *Health) handler(probe func(context.Context) HealthReport) web.HandlerFunc {
+	return func(c web.C, rw http.ResponseWriter, r *http.Request) {
+		report := probe(r.Context())
+		status := http.StatusOK
+		if report.Status != "ok" {
+			status = http.StatusServiceUnavailable
+		} else if !h.LogRequests {
+			SkipLog(c)
+		}
+		NoCache(rw)
+		WriteJSON(c, rw, status, report)
+	}
+}
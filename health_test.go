@@ -0,0 +1,68 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("Health", func() {
+
+	var mx *web.Mux
+	var h *Health
+	var logStr []string
+
+	BeforeEach(func() {
+		logStr = nil
+		h = NewHealth()
+		h.Timeout = 50 * time.Millisecond
+		mx = web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(Logger15(testLogger(&logStr)))
+		MountHealth(mx, "", h)
+	})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		mx.ServeHTTP(rw, req)
+		return rw
+	}
+
+	It("reports healthy without logging the probes", func() {
+		h.AddLiveness("loop", func(ctx context.Context) error { return nil })
+		rw := get("/healthz")
+		Ω(rw.Code).Should(Equal(200))
+		Ω(rw.Body.String()).Should(MatchRegexp(
+			`^{"status":"ok","checks":{"loop":{"status":"ok","duration":"[^"]+"}}}`))
+		Ω(get("/readyz").Code).Should(Equal(200))
+		Ω(logStr).Should(BeEmpty())
+	})
+
+	It("fails with 503 when a check fails or times out", func() {
+		h.AddLiveness("loop", func(ctx context.Context) error { return nil })
+		h.AddReadiness("db", func(ctx context.Context) error { return errors.New("conn refused") })
+		h.AddReadiness("cache", func(ctx context.Context) error {
+			<-ctx.Done()
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		})
+		Ω(get("/healthz").Code).Should(Equal(200))
+		rw := get("/readyz")
+		Ω(rw.Code).Should(Equal(503))
+		Ω(rw.Body.String()).Should(ContainSubstring(`"status":"fail"`))
+		Ω(rw.Body.String()).Should(ContainSubstring(`"db":{"status":"fail","error":"conn refused"`))
+		Ω(rw.Body.String()).Should(ContainSubstring(`"cache":{"status":"fail","error":"timed out"`))
+		Ω(logStr).Should(HaveLen(1))
+		Ω(logStr[0]).Should(HavePrefix("Lvl crit, /readyz"))
+	})
+})
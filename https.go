@@ -0,0 +1,121 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// HTTPS enforcement and scheme detection
+
+package gojiutil
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// ContextScheme is the hash key in which RequireHTTPS places the scheme the client used,
+// "http" or "https", see Scheme
+var ContextScheme string = "scheme"
+
+// XForwardedProtoHeader carries the scheme the client used to reach the proxy
+const XForwardedProtoHeader = "X-Forwarded-Proto"
+
+// HTTPSOptions configures the RequireHTTPS middleware
+type HTTPSOptions struct {
+	// TrustedProxies are the ranges (CIDR notation or single addresses) of the load balancers
+	// whose X-Forwarded-Proto or Forwarded headers are believed, by default none are
+	TrustedProxies []string
+	// AllowHTTP only detects the scheme without redirecting
+	AllowHTTP bool
+	// SkipPaths are served over plain HTTP too, e.g. the health checks of the load balancer,
+	// a path ending in "/*" skips everything below it
+	SkipPaths []string
+	// HSTSMaxAge, if set, adds a Strict-Transport-Security header to HTTPS responses
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	HSTSPreload           bool
+}
+
+// RequireHTTPS creates a middleware that detects the scheme the client used, from the
+// connection or the headers of trusted proxies, places it into c.Env[ContextScheme] for link
+// generation, and permanently redirects plain HTTP requests to the same URL over HTTPS on the
+// default port.
+// Install it before RealIP or RealIPFrom as it checks the proxy against r.RemoteAddr. It
+// panics if a range doesn't parse.
+func RequireHTTPS(opts HTTPSOptions) web.MiddlewareType {
+	trusted, err := parseCIDRs(opts.TrustedProxies)
+	if err != nil {
+		panic("gojiutil.RequireHTTPS: " + err.Error())
+	}
+	hsts := ""
+	if opts.HSTSMaxAge > 0 {
+		hsts = fmt.Sprintf("max-age=%d", int64(opts.HSTSMaxAge/time.Second))
+		if opts.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		if opts.HSTSPreload {
+			hsts += "; preload"
+		}
+	}
+	redirect := redirectHTTPS(":443")
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			scheme := requestScheme(*c, r, trusted)
+			c.Env[ContextScheme] = scheme
+			if scheme == "https" {
+				if hsts != "" {
+					rw.Header().Set("Strict-Transport-Security", hsts)
+				}
+			} else if !opts.AllowHTTP && !pathListed(opts.SkipPaths, r.URL.Path) {
+				redirect.ServeHTTP(rw, r)
+				return
+			}
+			h.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// requestScheme returns the scheme of the connection or, if the peer is a trusted proxy, the
+// one it reports the client used
+func requestScheme(c web.C, r *http.Request, trusted []*net.IPNet) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if peer := net.ParseIP(clientIP(c, r)); peer != nil && ipInNets(peer, trusted) {
+		// the first value is the one of the client-facing proxy
+		proto := r.Header.Get(XForwardedProtoHeader)
+		if proto == "" {
+			proto = forwardedProto(r.Header.Get(ForwardedHeader))
+		}
+		proto = strings.ToLower(strings.TrimSpace(strings.Split(proto, ",")[0]))
+		if proto == "https" || proto == "http" {
+			return proto
+		}
+	}
+	return "http"
+}
+
+// forwardedProto extracts the proto parameter of the first RFC 7239 forwarded-element
+func forwardedProto(v string) string {
+	elem := strings.Split(v, ",")[0]
+	for _, pair := range strings.Split(elem, ";") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], "proto") {
+			return strings.Trim(kv[1], `"`)
+		}
+	}
+	return ""
+}
+
+// Scheme returns the scheme the client used as detected by RequireHTTPS, or else that of the
+// connection, e.g. to build absolute links
+func Scheme(c web.C, r *http.Request) string {
+	if s, ok := c.Env[ContextScheme].(string); ok {
+		return s
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
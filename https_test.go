@@ -0,0 +1,87 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("RequireHTTPS", func() {
+
+	var scheme string
+
+	serve := func(opts HTTPSOptions, req *http.Request) *httptest.ResponseRecorder {
+		scheme = ""
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(RequireHTTPS(opts))
+		mx.Handle("/*", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			scheme = Scheme(c, r)
+		})
+		rw := httptest.NewRecorder()
+		mx.ServeHTTP(rw, req)
+		return rw
+	}
+
+	request := func(method, remoteAddr, proto string) *http.Request {
+		req, _ := http.NewRequest(method, "http://example.com/a?b=c", nil)
+		req.RemoteAddr = remoteAddr
+		if proto != "" {
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+		return req
+	}
+
+	It("redirects plain HTTP requests", func() {
+		rw := serve(HTTPSOptions{}, request("GET", "192.0.2.1:5000", ""))
+		Ω(rw.Code).Should(Equal(301))
+		Ω(rw.Header().Get("Location")).Should(Equal("https://example.com/a?b=c"))
+		Ω(scheme).Should(BeEmpty())
+
+		rw = serve(HTTPSOptions{}, request("POST", "192.0.2.1:5000", ""))
+		Ω(rw.Code).Should(Equal(308))
+	})
+
+	It("believes X-Forwarded-Proto from trusted proxies only", func() {
+		opts := HTTPSOptions{TrustedProxies: []string{"10.0.0.0/8"}}
+		rw := serve(opts, request("GET", "10.0.0.1:5000", "https"))
+		Ω(rw.Code).Should(Equal(200))
+		Ω(scheme).Should(Equal("https"))
+
+		rw = serve(opts, request("GET", "192.0.2.1:5000", "https"))
+		Ω(rw.Code).Should(Equal(301))
+
+		req := request("GET", "10.0.0.1:5000", "")
+		req.Header.Set("Forwarded", `for=192.0.2.1;proto=https, for=10.0.0.2;proto=http`)
+		rw = serve(opts, req)
+		Ω(rw.Code).Should(Equal(200))
+	})
+
+	It("serves TLS requests with HSTS", func() {
+		req := request("GET", "192.0.2.1:5000", "")
+		req.TLS = &tls.ConnectionState{}
+		rw := serve(HTTPSOptions{HSTSMaxAge: 365 * 24 * time.Hour,
+			HSTSIncludeSubdomains: true}, req)
+		Ω(rw.Code).Should(Equal(200))
+		Ω(rw.Header().Get("Strict-Transport-Security")).
+			Should(Equal("max-age=31536000; includeSubDomains"))
+	})
+
+	It("serves skipped paths and detection-only over HTTP", func() {
+		rw := serve(HTTPSOptions{SkipPaths: []string{"/a"}}, request("GET", "192.0.2.1:5000", ""))
+		Ω(rw.Code).Should(Equal(200))
+		Ω(rw.Header().Get("Strict-Transport-Security")).Should(BeEmpty())
+
+		rw = serve(HTTPSOptions{AllowHTTP: true}, request("GET", "192.0.2.1:5000", ""))
+		Ω(rw.Code).Should(Equal(200))
+		Ω(scheme).Should(Equal("http"))
+	})
+})
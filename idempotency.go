@@ -0,0 +1,193 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Idempotency keys
+
+package gojiutil
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// ErrIdempotencyInProgress is returned by IdempotencyStore.Begin when another request with
+// the same key is being processed
+var ErrIdempotencyInProgress = errors.New("request with the same idempotency key in progress")
+
+// StoredResponse is a response kept by an IdempotencyStore, it serializes to JSON for stores
+// backed by Redis or SQL
+type StoredResponse struct {
+	Fingerprint string      `json:"fingerprint"` // hash of the request's method, URI and body
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"body"`
+}
+
+// IdempotencyStore keeps the responses of the requests carrying an idempotency key, implement
+// it on top of a shared store such as Redis so retries can reach any instance of a service
+type IdempotencyStore interface {
+	// Begin reserves key for ttl and returns nil if it's unused. It returns the stored
+	// response if the key's request completed, or ErrIdempotencyInProgress if it's still
+	// being processed.
+	Begin(key string, ttl time.Duration) (*StoredResponse, error)
+	// Complete stores the response of the key's request for ttl
+	Complete(key string, resp *StoredResponse, ttl time.Duration) error
+	// Abort releases the key of a request that failed, so it can be retried
+	Abort(key string) error
+}
+
+// Idempotency creates a middleware that makes the requests carrying an IdempotencyKeyHeader
+// safe to retry, e.g. by RetryTransport: the response of the first request with a key is
+// stored for ttl and replayed to later requests with the same key, with an
+// Idempotent-Replayed: true header, without executing the handler again. Keys are scoped by
+// the authenticated user (see ContextUser) when there is one. Reusing a key for a different
+// request gets a 422, retrying while the first request is in progress a 409. 5xx responses
+// aren't stored so they can be retried. If the store fails the request is processed without
+// the guarantee and the error is logged.
+func Idempotency(store IdempotencyStore, ttl time.Duration) web.MiddlewareType {
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(IdempotencyKeyHeader)
+			if key == "" {
+				h.ServeHTTP(rw, r)
+				return
+			}
+			if user, ok := c.Env[ContextUser].(string); ok {
+				key = user + ":" + key
+			}
+			fp, err := requestFingerprint(r)
+			if err != nil {
+				ErrorString(*c, rw, http.StatusBadRequest, "Cannot read request body")
+				return
+			}
+			stored, err := store.Begin(key, ttl)
+			switch {
+			case err == ErrIdempotencyInProgress:
+				ErrorString(*c, rw, http.StatusConflict,
+					"A request with the same idempotency key is in progress")
+				return
+			case err != nil:
+				contextLogger(*c).Error("idempotency store failed", "err", err)
+				h.ServeHTTP(rw, r)
+				return
+			case stored != nil:
+				if stored.Fingerprint != fp {
+					ErrorString(*c, rw, http.StatusUnprocessableEntity,
+						"Idempotency key reused for a different request")
+					return
+				}
+				resp := &capturedResponse{header: cloneHeader(stored.Header),
+					status: stored.Status}
+				resp.body.Write(stored.Body)
+				resp.header.Set("Idempotent-Replayed", "true")
+				resp.writeTo(rw)
+				return
+			}
+
+			resp := &capturedResponse{header: make(http.Header)}
+			completed := false
+			defer func() {
+				if !completed {
+					store.Abort(key) // the handler panicked
+				}
+			}()
+			h.ServeHTTP(resp, r)
+			if resp.status == 0 {
+				resp.status = http.StatusOK
+			}
+			if resp.status >= 500 {
+				err = store.Abort(key)
+			} else {
+				err = store.Complete(key, &StoredResponse{Fingerprint: fp, Status: resp.status,
+					Header: resp.header, Body: resp.body.Bytes()}, ttl)
+			}
+			completed = true
+			if err != nil {
+				contextLogger(*c).Error("idempotency store failed", "err", err)
+			}
+			resp.writeTo(rw)
+		})
+	}
+}
+
+// requestFingerprint hashes the method, URI and body of r, putting the body back
+func requestFingerprint(r *http.Request) (string, error) {
+	hash := sha256.New()
+	io.WriteString(hash, r.Method+" "+r.URL.RequestURI()+"\n")
+	if r.Body != nil {
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		hash.Write(body)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// MemoryIdempotencyStore is an IdempotencyStore local to the process
+type MemoryIdempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	sweep   time.Time
+}
+
+type idempotencyEntry struct {
+	resp    *StoredResponse // nil while in progress
+	expires time.Time
+}
+
+// NewMemoryIdempotencyStore creates an empty in-memory store
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{entries: make(map[string]*idempotencyEntry),
+		sweep: time.Now()}
+}
+
+// Begin implements IdempotencyStore
+func (s *MemoryIdempotencyStore) Begin(key string, ttl time.Duration) (*StoredResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.sweep) > time.Minute {
+		for k, e := range s.entries {
+			if now.After(e.expires) {
+				delete(s.entries, k)
+			}
+		}
+		s.sweep = now
+	}
+	if e, ok := s.entries[key]; ok && now.Before(e.expires) {
+		if e.resp == nil {
+			return nil, ErrIdempotencyInProgress
+		}
+		return e.resp, nil
+	}
+	s.entries[key] = &idempotencyEntry{expires: now.Add(ttl)}
+	return nil, nil
+}
+
+// Complete implements IdempotencyStore
+func (s *MemoryIdempotencyStore) Complete(key string, resp *StoredResponse,
+	ttl time.Duration) error {
+	s.mu.Lock()
+	s.entries[key] = &idempotencyEntry{resp: resp, expires: time.Now().Add(ttl)}
+	s.mu.Unlock()
+	return nil
+}
+
+// Abort implements IdempotencyStore
+func (s *MemoryIdempotencyStore) Abort(key string) error {
+	s.mu.Lock()
+	delete(s.entries, key)
+	s.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("Idempotency", func() {
+
+	var mx *web.Mux
+	var charges int
+	var status int
+
+	BeforeEach(func() {
+		charges, status = 0, 201
+		mx = web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(Idempotency(NewMemoryIdempotencyStore(), time.Hour))
+		mx.Post("/charges", func(rw http.ResponseWriter, r *http.Request) {
+			charges++
+			rw.Header().Set("Location", "/charges/1")
+			rw.WriteHeader(status)
+			rw.Write([]byte(`{"id":1}`))
+		})
+	})
+
+	post := func(key, body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/charges", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		mx.ServeHTTP(rw, req)
+		return rw
+	}
+
+	It("replays the stored response to retries", func() {
+		Ω(post("k1", "amount=10").Code).Should(Equal(201))
+		rw := post("k1", "amount=10")
+		Ω(rw.Code).Should(Equal(201))
+		Ω(rw.Body.String()).Should(Equal(`{"id":1}`))
+		Ω(rw.Header().Get("Location")).Should(Equal("/charges/1"))
+		Ω(rw.Header().Get("Idempotent-Replayed")).Should(Equal("true"))
+		Ω(charges).Should(Equal(1))
+
+		Ω(post("", "amount=10").Code).Should(Equal(201))
+		Ω(charges).Should(Equal(2))
+	})
+
+	It("rejects a key reused for a different request", func() {
+		post("k1", "amount=10")
+		Ω(post("k1", "amount=99").Code).Should(Equal(422))
+		Ω(charges).Should(Equal(1))
+	})
+
+	It("lets failed requests be retried", func() {
+		status = 503
+		Ω(post("k1", "amount=10").Code).Should(Equal(503))
+		status = 201
+		Ω(post("k1", "amount=10").Code).Should(Equal(201))
+		Ω(charges).Should(Equal(2))
+	})
+
+	It("rejects retries while the request is in progress", func() {
+		store := NewMemoryIdempotencyStore()
+		Ω(store.Begin("k1", time.Hour)).Should(BeNil())
+		_, err := store.Begin("k1", time.Hour)
+		Ω(err).Should(Equal(ErrIdempotencyInProgress))
+	})
+})
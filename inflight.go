@@ -0,0 +1,89 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Tracking of in-flight requests
+
+package gojiutil
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+// InFlightRequest describes a request being processed
+type InFlightRequest struct {
+	ID      string
+	Method  string
+	Path    string
+	Started time.Time
+}
+
+// Age returns how long the request has been processed
+func (r InFlightRequest) Age() time.Duration {
+	return time.Since(r.Started)
+}
+
+// inFlightSet is the registry of the requests passing through TrackInFlight
+type inFlightSet struct {
+	mu   sync.Mutex
+	next uint64
+	reqs map[uint64]InFlightRequest
+}
+
+var inFlight = &inFlightSet{reqs: make(map[uint64]InFlightRequest)}
+
+func (s *inFlightSet) add(r InFlightRequest) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next++
+	s.reqs[s.next] = r
+	return s.next
+}
+
+func (s *inFlightSet) remove(key uint64) {
+	s.mu.Lock()
+	delete(s.reqs, key)
+	s.mu.Unlock()
+}
+
+// InFlight returns the requests currently being processed, oldest first. Requests are tracked
+// by TrackInFlight, so those it doesn't see (e.g. rejected by middleware installed before it)
+// are not included.
+func InFlight() []InFlightRequest {
+	inFlight.mu.Lock()
+	reqs := make([]InFlightRequest, 0, len(inFlight.reqs))
+	for _, r := range inFlight.reqs {
+		reqs = append(reqs, r)
+	}
+	inFlight.mu.Unlock()
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].Started.Before(reqs[j].Started) })
+	return reqs
+}
+
+// TrackInFlight is a middleware that registers the requests it processes so InFlight and
+// Server.Drain can report them, AddCommon installs it. Upgraded websocket connections remain
+// in flight until they close.
+func TrackInFlight(c *web.C, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		key := inFlight.add(InFlightRequest{ID: middleware.GetReqID(*c), Method: r.Method,
+			Path: r.URL.Path, Started: time.Now()})
+		hijacked := false
+		defer func() {
+			if !hijacked {
+				inFlight.remove(key)
+			}
+		}()
+		h.ServeHTTP(rw, r)
+		if ws, ok := c.Env[ContextWebsocket].(*WebSocket); ok {
+			hijacked = true
+			go func() {
+				<-ws.Done()
+				inFlight.remove(key)
+			}()
+		}
+	})
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Client IP address filtering
+
+package gojiutil
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+)
+
+// parseCIDRs parses IP ranges in CIDR notation or single IP addresses
+func parseCIDRs(ranges []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(ranges))
+	for _, s := range ranges {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// ipInNets checks whether ip is in one of nets
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IPFilter creates a middleware that rejects with a 403 the requests from client IPs in the
+// deny ranges or, if allow isn't empty, not in the allow ranges, e.g. to restrict admin routes
+// to the office and VPN. Ranges are in CIDR notation (10.0.0.0/8) or single addresses. The
+// client IP is r.RemoteAddr, so install it after RealIP (or RealIPFrom) behind proxies.
+// Rejections are logged with the client IP. It panics if a range doesn't parse.
+func IPFilter(allow []string, deny []string) web.MiddlewareType {
+	allowNets, err := parseCIDRs(allow)
+	if err != nil {
+		panic("gojiutil.IPFilter: " + err.Error())
+	}
+	denyNets, err := parseCIDRs(deny)
+	if err != nil {
+		panic("gojiutil.IPFilter: " + err.Error())
+	}
+	return ipFilter(func() ([]*net.IPNet, []*net.IPNet) { return allowNets, denyNets })
+}
+
+// LiveIPFilter is IPFilter with the ranges of the IP filter named name in the live settings,
+// all requests are allowed while it isn't present
+func LiveIPFilter(lc *LiveConfig, name string) web.MiddlewareType {
+	return ipFilter(func() ([]*net.IPNet, []*net.IPNet) {
+		f := lc.Get().IPFilters[name]
+		return f.allow, f.deny
+	})
+}
+
+// ipFilter implements IPFilter and LiveIPFilter, nets returns the allowed and denied ranges
+func ipFilter(nets func() (allow, deny []*net.IPNet)) web.MiddlewareType {
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			allowNets, denyNets := nets()
+			if len(allowNets) == 0 && len(denyNets) == 0 {
+				h.ServeHTTP(rw, r)
+				return
+			}
+			addr := clientIP(*c, r)
+			ip := net.ParseIP(addr)
+			if ip == nil || ipInNets(ip, denyNets) ||
+				(len(allowNets) > 0 && !ipInNets(ip, allowNets)) {
+				contextLogger(*c).Warn("client IP rejected", "ip", addr, "path", r.URL.Path)
+				ErrorString(*c, rw, http.StatusForbidden, "Forbidden")
+				return
+			}
+			h.ServeHTTP(rw, r)
+		})
+	}
+}
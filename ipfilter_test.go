@@ -0,0 +1,50 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("IPFilter", func() {
+
+	serve := func(mw web.MiddlewareType, remoteAddr string) int {
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(mw)
+		mx.Get("/", func(rw http.ResponseWriter, r *http.Request) {})
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		mx.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	It("allows only the allowed ranges minus the denied ones", func() {
+		mw := IPFilter([]string{"10.0.0.0/8", "2001:db8::/32", "192.0.2.7"},
+			[]string{"10.6.6.0/24"})
+		Ω(serve(mw, "10.1.2.3:5000")).Should(Equal(200))
+		Ω(serve(mw, "10.1.2.3")).Should(Equal(200)) // as set by RealIP
+		Ω(serve(mw, "[2001:db8::1]:5000")).Should(Equal(200))
+		Ω(serve(mw, "192.0.2.7:5000")).Should(Equal(200))
+		Ω(serve(mw, "192.0.2.8:5000")).Should(Equal(403))
+		Ω(serve(mw, "10.6.6.6:5000")).Should(Equal(403))
+		Ω(serve(mw, "garbage")).Should(Equal(403))
+	})
+
+	It("only denies without allowed ranges", func() {
+		mw := IPFilter(nil, []string{"203.0.113.0/24"})
+		Ω(serve(mw, "198.51.100.1:5000")).Should(Equal(200))
+		Ω(serve(mw, "203.0.113.9:5000")).Should(Equal(403))
+	})
+
+	It("panics on invalid ranges", func() {
+		Ω(func() { IPFilter([]string{"10.0.0.0/33"}, nil) }).Should(Panic())
+	})
+})
@@ -0,0 +1,139 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Locale negotiation and translated error messages
+
+package gojiutil
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+)
+
+// ContextLocale is the hash key in which Locale places the negotiated locale
+var ContextLocale string = "locale"
+
+// Locale creates a middleware that negotiates the locale of the response from the request's
+// Accept-Language header and the supported locales, placing it into c.Env[ContextLocale].
+// The first supported locale is the default, "en" if none are given. Since error messages
+// and other output depend on it, Accept-Language is added to Vary.
+func Locale(supported ...string) web.MiddlewareType {
+	if len(supported) == 0 {
+		supported = []string{"en"}
+	}
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			c.Env[ContextLocale] = negotiateLocale(r.Header.Get("Accept-Language"), supported)
+			AddVary(rw.Header(), "Accept-Language")
+			h.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// GetLocale returns the locale placed into c.Env by Locale, or ""
+func GetLocale(c web.C) string {
+	locale, _ := c.Env[ContextLocale].(string)
+	return locale
+}
+
+// negotiateLocale picks the supported locale best matching an Accept-Language header, a
+// language range matches a locale exactly or as a prefix, e.g. "fr" matches "fr-CA" and
+// "fr-CA" matches "fr" as a last resort
+func negotiateLocale(header string, supported []string) string {
+	type lang struct {
+		tag string
+		q   float64
+	}
+	var langs []lang
+	for _, part := range strings.Split(header, ",") {
+		f := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(f[0]))
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		for _, p := range f[1:] {
+			if p = strings.TrimSpace(p); strings.HasPrefix(p, "q=") {
+				q, _ = strconv.ParseFloat(p[2:], 64)
+			}
+		}
+		if q > 0 {
+			langs = append(langs, lang{tag, q})
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+	for _, l := range langs {
+		if l.tag == "*" {
+			return supported[0]
+		}
+		for _, s := range supported {
+			if ls := strings.ToLower(s); ls == l.tag || strings.HasPrefix(ls, l.tag+"-") {
+				return s
+			}
+		}
+		for _, s := range supported {
+			if strings.HasPrefix(l.tag, strings.ToLower(s)+"-") {
+				return s
+			}
+		}
+	}
+	return supported[0]
+}
+
+// Catalog holds translated messages by locale and then by key, the key being the error code
+// of errors implementing ErrorCoder, or else the English message or format string itself
+type Catalog map[string]map[string]string
+
+// ErrorCatalog translates the messages produced by ErrorString, Errorf, and WriteError into
+// the locale negotiated by Locale. Messages that are not found are rendered in English.
+var ErrorCatalog Catalog
+
+// ErrorCoder is implemented by errors that have an application error code, used to look
+// up their translated message
+type ErrorCoder interface {
+	ErrorCode() string
+}
+
+// Lookup finds the message for key in locale, falling back from e.g. fr-CA to fr
+func (cat Catalog) Lookup(locale, key string) (string, bool) {
+	for locale != "" {
+		if msg, ok := cat[locale][key]; ok {
+			return msg, true
+		}
+		i := strings.LastIndexByte(locale, '-')
+		if i < 0 {
+			break
+		}
+		locale = locale[:i]
+	}
+	return "", false
+}
+
+// translate returns the message for key in the request's locale and that locale, or
+// fallback and "en"
+func translate(c web.C, key, fallback string) (string, string) {
+	locale := GetLocale(c)
+	if ErrorCatalog != nil {
+		if msg, ok := ErrorCatalog.Lookup(locale, key); ok {
+			return msg, locale
+		}
+	}
+	return fallback, "en"
+}
+
+// SetContentLanguage sets the Content-Language of the response to the locale negotiated by
+// Locale, or to lang if not empty, and adds Accept-Language to Vary. It returns the language
+// set, or "" if there is none.
+func SetContentLanguage(c web.C, rw http.ResponseWriter, lang string) string {
+	if lang == "" {
+		lang = GetLocale(c)
+	}
+	if lang != "" {
+		rw.Header().Set("Content-Language", lang)
+		AddVary(rw.Header(), "Accept-Language")
+	}
+	return lang
+}
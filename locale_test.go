@@ -0,0 +1,47 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("Locale", func() {
+
+	It("negotiates the locale", func() {
+		sup := []string{"en", "fr-CA", "de"}
+		Ω(negotiateLocale("", sup)).Should(Equal("en"))
+		Ω(negotiateLocale("de;q=0.5, fr", sup)).Should(Equal("fr-CA"))
+		Ω(negotiateLocale("de-AT, en;q=0.1", sup)).Should(Equal("de"))
+		Ω(negotiateLocale("es, *;q=0.1", sup)).Should(Equal("en"))
+	})
+
+	It("translates error messages", func() {
+		ErrorCatalog = Catalog{"fr": {"Not found: %s": "Introuvable : %s"}}
+		defer func() { ErrorCatalog = nil }()
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(Locale("en", "fr"))
+		mx.Get("/:id", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			Errorf(c, rw, 404, "Not found: %s", c.URLParams["id"])
+		})
+		req, _ := http.NewRequest("GET", "/foo", nil)
+		req.Header.Set("Accept-Language", "fr-FR, en;q=0.5")
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		Ω(resp.Body.String()).Should(Equal("Introuvable : foo\n"))
+		Ω(resp.Header().Get("Content-Language")).Should(Equal("fr"))
+		Ω(resp.Header().Get("Vary")).Should(Equal("Accept-Language"))
+
+		req.Header.Set("Accept-Language", "en")
+		resp = httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		Ω(resp.Body.String()).Should(Equal("Not found: foo\n"))
+	})
+})
@@ -0,0 +1,92 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Per-request buffering of log records
+
+package gojiutil
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/mutil"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// MaxBufferedRecords is the number of records a RequestLogBuffer holds, records beyond it
+// are passed through unbuffered to bound the memory used by chatty requests
+var MaxBufferedRecords = 1000
+
+// RequestLogBuffer is a log15.Handler that holds the records logged while handling a request
+// until Flush passes them on as one block
+type RequestLogBuffer struct {
+	next    log15.Handler
+	flushMu *sync.Mutex // serializes the flushes to next
+	mu      sync.Mutex
+	recs    []*log15.Record
+	flushed bool
+}
+
+// Log implements log15.Handler, records logged after Flush, e.g. by goroutines outliving the
+// request, are passed through
+func (b *RequestLogBuffer) Log(r *log15.Record) error {
+	b.mu.Lock()
+	if !b.flushed && len(b.recs) < MaxBufferedRecords {
+		b.recs = append(b.recs, r)
+		b.mu.Unlock()
+		return nil
+	}
+	b.mu.Unlock()
+	return b.next.Log(r)
+}
+
+// Flush passes the buffered records on, tagged with the request's final status, without
+// letting the records of other requests flushing at the same time interleave
+func (b *RequestLogBuffer) Flush(status int) {
+	b.mu.Lock()
+	recs := b.recs
+	b.recs, b.flushed = nil, true
+	b.mu.Unlock()
+	if len(recs) == 0 {
+		return
+	}
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+	for _, r := range recs {
+		r.Ctx = append(r.Ctx, "status", strconv.Itoa(status))
+		b.next.Log(r)
+	}
+}
+
+// BufferRequestLogs creates a middleware that buffers the records logged through the log15
+// context logger of each request and writes them to next as one block when the request
+// completes, so the lines of concurrent requests don't interleave. Use it after
+// ContextLogger, it does nothing when the context logger isn't a log15.Logger.
+func BufferRequestLogs(next log15.Handler) web.MiddlewareType {
+	flushMu := &sync.Mutex{}
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			log, ok := c.Env[ContextLog].(log15.Logger)
+			if !ok {
+				h.ServeHTTP(rw, r)
+				return
+			}
+			b := &RequestLogBuffer{next: next, flushMu: flushMu}
+			log = log.New()
+			log.SetHandler(b)
+			c.Env[ContextLog] = log
+
+			wp := mutil.WrapWriter(rw)
+			defer func() {
+				if rec := recover(); rec != nil {
+					// flush before the panic goes up the stack to a Recoverer
+					b.Flush(http.StatusInternalServerError)
+					panic(rec)
+				}
+				b.Flush(wp.Status())
+			}()
+			h.ServeHTTP(wp, r)
+		})
+	}
+}
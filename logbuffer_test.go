@@ -0,0 +1,57 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("BufferRequestLogs", func() {
+
+	var out []string
+	var mx *web.Mux
+
+	BeforeEach(func() {
+		out = nil
+		next := testLogger(&out).GetHandler()
+		mx = web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(RequestID)
+		mx.Use(ContextLogger)
+		mx.Use(BufferRequestLogs(next))
+		mx.Get("/", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			log := c.Env[ContextLog].(log15.Logger)
+			log.Info("first")
+			Ω(out).Should(BeEmpty())
+			log.Info("second")
+			rw.WriteHeader(202)
+		})
+	})
+
+	It("flushes the records at the end of the request with its status", func() {
+		req, _ := http.NewRequest("GET", "/", nil)
+		mx.ServeHTTP(httptest.NewRecorder(), req)
+		Ω(out).Should(HaveLen(2))
+		Ω(out[0]).Should(MatchRegexp(`^Lvl info, first, \[req \S+ status 202\]`))
+		Ω(out[1]).Should(MatchRegexp(`^Lvl info, second, \[req \S+ status 202\]`))
+	})
+
+	It("passes records through once flushed", func() {
+		b := &RequestLogBuffer{next: testLogger(&out).GetHandler(), flushMu: new(sync.Mutex)}
+		log := log15.New()
+		log.SetHandler(b)
+		log.Info("held")
+		b.Flush(200)
+		log.Info("late")
+		Ω(out).Should(HaveLen(2))
+		Ω(out[1]).Should(HavePrefix("Lvl info, late, []"))
+	})
+})
@@ -0,0 +1,274 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Rotating log file writer
+
+package gojiutil
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// rotateTimeFormat is appended to the log file name to produce the name of rotated files, it
+// sorts lexicographically in chronological order
+const rotateTimeFormat = "20060102T150405.000"
+
+// RotateOptions controls when a RotatingWriter rotates and what it keeps around
+type RotateOptions struct {
+	MaxSize    int64         // rotate when the file exceeds this many bytes, 0 to disable
+	MaxAge     time.Duration // rotate when the file was opened longer ago than this, 0 to disable
+	MaxBackups int           // number of rotated files to keep, 0 to keep all
+	Compress   bool          // gzip rotated files
+}
+
+// RotatingWriter is an io.WriteCloser that appends to a file and rotates it based on size and
+// age. Rotated files are renamed to <path>.<timestamp> and optionally compressed in the
+// background. It is safe for concurrent use.
+type RotatingWriter struct {
+	path   string
+	opts   RotateOptions
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	closed bool
+	wg     sync.WaitGroup // outstanding compressions
+}
+
+// NewRotatingWriter opens (or creates) the log file at path for appending
+func NewRotatingWriter(path string, opts RotateOptions) (*RotatingWriter, error) {
+	w := &RotatingWriter{path: path, opts: opts}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// RotatingFileHandler returns a log15 handler that writes records formatted with fmtr to a
+// rotating log file
+func RotatingFileHandler(path string, fmtr log15.Format, opts RotateOptions) (log15.Handler, error) {
+	w, err := NewRotatingWriter(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	return log15.StreamHandler(w, fmtr), nil
+}
+
+// open opens the log file, the caller must hold the lock (or be the constructor)
+func (w *RotatingWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = fi.Size()
+	w.opened = time.Now()
+	return nil
+}
+
+// Write appends p to the log file, rotating first if p would push it over the size limit or
+// if the file has become too old
+func (w *RotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	if w.file == nil {
+		// a previous rotation failed to reopen the file
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+	if w.needRotate(int64(len(p))) {
+		// if the rename fails we keep appending to the current file and retry next time
+		if err := w.rotate(); err != nil && w.file == nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *RotatingWriter) needRotate(n int64) bool {
+	if w.size == 0 {
+		return false // never rotate an empty file, even if a single write exceeds MaxSize
+	}
+	if w.opts.MaxSize > 0 && w.size+n > w.opts.MaxSize {
+		return true
+	}
+	return w.opts.MaxAge > 0 && time.Since(w.opened) > w.opts.MaxAge
+}
+
+// Rotate forces a rotation of the log file
+func (w *RotatingWriter) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	return w.rotate()
+}
+
+// rotate closes the current file, renames it, and opens a fresh one, the caller must hold
+// the lock. If the rename fails the current file is reopened, if the file can't be reopened
+// w.file is left nil and Write retries opening it.
+func (w *RotatingWriter) rotate() error {
+	err := w.file.Close()
+	w.file = nil
+	if err != nil {
+		return err
+	}
+	rotated := w.path + "." + time.Now().Format(rotateTimeFormat)
+	for i := 1; fileExists(rotated) || fileExists(rotated+".gz"); i++ {
+		rotated = fmt.Sprintf("%s.%s-%d", w.path, time.Now().Format(rotateTimeFormat), i)
+	}
+	if err := os.Rename(w.path, rotated); err != nil {
+		w.open()
+		return err
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		if w.opts.Compress {
+			if err := gzipFile(rotated); err != nil {
+				fmt.Fprintf(os.Stderr, "gojiutil: cannot compress %s: %s\n", rotated, err)
+			}
+		}
+		w.prune()
+	}()
+	return nil
+}
+
+// prune removes the oldest rotated files beyond MaxBackups
+func (w *RotatingWriter) prune() {
+	if w.opts.MaxBackups <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(w.path + ".*")
+	if err != nil {
+		return
+	}
+	type backup struct {
+		name, stamp string
+		seq         int
+	}
+	backups := make([]backup, 0, len(matches))
+	for _, m := range matches {
+		if stamp, seq, ok := parseBackupName(strings.TrimPrefix(m, w.path+".")); ok {
+			backups = append(backups, backup{m, stamp, seq})
+		}
+	}
+	if len(backups) <= w.opts.MaxBackups {
+		return
+	}
+	// sort by timestamp then by sequence number, as strings "-10" would sort before "-2"
+	sort.Slice(backups, func(i, j int) bool {
+		if backups[i].stamp != backups[j].stamp {
+			return backups[i].stamp < backups[j].stamp
+		}
+		return backups[i].seq < backups[j].seq
+	})
+	for _, b := range backups[:len(backups)-w.opts.MaxBackups] {
+		os.Remove(b.name)
+	}
+}
+
+// parseBackupName parses the suffix of a rotated file, <timestamp>[-<seq>][.gz], other files
+// such as partial compressions are not backups
+func parseBackupName(suffix string) (stamp string, seq int, ok bool) {
+	suffix = strings.TrimSuffix(suffix, ".gz")
+	if len(suffix) < len(rotateTimeFormat) {
+		return "", 0, false
+	}
+	stamp, rest := suffix[:len(rotateTimeFormat)], suffix[len(rotateTimeFormat):]
+	if _, err := time.Parse(rotateTimeFormat, stamp); err != nil {
+		return "", 0, false
+	}
+	if rest != "" {
+		var err error
+		if !strings.HasPrefix(rest, "-") {
+			return "", 0, false
+		}
+		if seq, err = strconv.Atoi(rest[1:]); err != nil {
+			return "", 0, false
+		}
+	}
+	return stamp, seq, true
+}
+
+// Close waits for outstanding compressions and closes the log file
+func (w *RotatingWriter) Close() error {
+	w.mu.Lock()
+	var err error
+	if w.file != nil {
+		err = w.file.Close()
+		w.file = nil
+	}
+	w.closed = true
+	w.mu.Unlock()
+	w.wg.Wait()
+	return err
+}
+
+// gzipFile compresses path into path.gz and removes the original
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// write to a temp file first so a partial .gz never looks like a valid backup
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err = io.Copy(gz, in); err == nil {
+		err = gz.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RotatingWriter", func() {
+	var dir, path string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "gojiutil")
+		Ω(err).ShouldNot(HaveOccurred())
+		path = filepath.Join(dir, "access.log")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("rotates when the size limit is exceeded", func() {
+		w, err := NewRotatingWriter(path, RotateOptions{MaxSize: 10})
+		Ω(err).ShouldNot(HaveOccurred())
+		w.Write([]byte("0123456789"))
+		w.Write([]byte("abc"))
+		Ω(w.Close()).Should(Succeed())
+
+		cur, _ := ioutil.ReadFile(path)
+		Ω(string(cur)).Should(Equal("abc"))
+		backups, _ := filepath.Glob(path + ".*")
+		Ω(backups).Should(HaveLen(1))
+	})
+
+	It("compresses and prunes rotated files", func() {
+		w, err := NewRotatingWriter(path, RotateOptions{MaxBackups: 1, Compress: true})
+		Ω(err).ShouldNot(HaveOccurred())
+		for i := 0; i < 3; i++ {
+			w.Write([]byte("line\n"))
+			Ω(w.Rotate()).Should(Succeed())
+			w.wg.Wait() // serialize compression and pruning
+		}
+		Ω(w.Close()).Should(Succeed())
+
+		backups, _ := filepath.Glob(path + ".*")
+		Ω(backups).Should(HaveLen(1))
+		Ω(backups[0]).Should(HaveSuffix(".gz"))
+	})
+
+	It("reopens the file on the next write if a rotation fails", func() {
+		w, err := NewRotatingWriter(path, RotateOptions{})
+		Ω(err).ShouldNot(HaveOccurred())
+		w.Write([]byte("abc"))
+		w.file.Close() // make the rotation fail
+		Ω(w.Rotate()).ShouldNot(Succeed())
+		_, err = w.Write([]byte("def"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(w.Close()).Should(Succeed())
+		_, err = w.Write([]byte("ghi"))
+		Ω(err).Should(Equal(os.ErrClosed))
+
+		cur, _ := ioutil.ReadFile(path)
+		Ω(string(cur)).Should(Equal("abcdef"))
+	})
+
+	It("prunes backups in numeric order", func() {
+		w, err := NewRotatingWriter(path, RotateOptions{MaxBackups: 3})
+		Ω(err).ShouldNot(HaveOccurred())
+		defer w.Close()
+		stamp := path + ".20150102T150405.000"
+		ioutil.WriteFile(stamp+".gz", nil, 0644)
+		for i := 1; i <= 10; i++ {
+			ioutil.WriteFile(fmt.Sprintf("%s-%d", stamp, i), nil, 0644)
+		}
+		ioutil.WriteFile(stamp+".gz.tmp", nil, 0644)
+		w.prune()
+
+		backups, _ := filepath.Glob(path + ".*")
+		Ω(backups).Should(ConsistOf(stamp+"-8", stamp+"-9", stamp+"-10", stamp+".gz.tmp"))
+	})
+})
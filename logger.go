@@ -0,0 +1,99 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Logger abstraction with log15 and slog adapters
+
+package gojiutil
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Logger is the minimal logging interface used by the request logging middlewares and the
+// context logger, ctx holds alternating keys and values. A log15.Logger satisfies it as-is,
+// SlogLogger adapts the standard library's slog, and the zaplog and logruslog packages adapt
+// zap and logrus.
+type Logger interface {
+	Debug(msg string, ctx ...interface{})
+	Info(msg string, ctx ...interface{})
+	Warn(msg string, ctx ...interface{})
+	Error(msg string, ctx ...interface{})
+	Crit(msg string, ctx ...interface{})
+}
+
+// ChildLogger is implemented by Loggers that have their own mechanism to add key/value pairs
+// to every message, such as the zap and logrus adapters of the zaplog and logruslog packages
+type ChildLogger interface {
+	Logger
+	With(ctx ...interface{}) Logger
+}
+
+// LoggerWith returns a logger adding the key/value pairs in ctx to every message of l, using
+// l's own mechanism for log15 and slog loggers and ChildLoggers
+func LoggerWith(l Logger, ctx ...interface{}) Logger {
+	switch l := l.(type) {
+	case log15.Logger:
+		return l.New(ctx...)
+	case slogLogger:
+		return slogLogger{l.Logger.With(ctx...)}
+	case ChildLogger:
+		return l.With(ctx...)
+	case withLogger:
+		return withLogger{l.Logger, l.with(ctx)}
+	}
+	return withLogger{l, ctx}
+}
+
+// withLogger prepends key/value pairs to the messages of a Logger
+type withLogger struct {
+	Logger
+	ctx []interface{}
+}
+
+func (l withLogger) with(ctx []interface{}) []interface{} {
+	return append(l.ctx[:len(l.ctx):len(l.ctx)], ctx...)
+}
+
+func (l withLogger) Debug(msg string, ctx ...interface{}) { l.Logger.Debug(msg, l.with(ctx)...) }
+func (l withLogger) Info(msg string, ctx ...interface{})  { l.Logger.Info(msg, l.with(ctx)...) }
+func (l withLogger) Warn(msg string, ctx ...interface{})  { l.Logger.Warn(msg, l.with(ctx)...) }
+func (l withLogger) Error(msg string, ctx ...interface{}) { l.Logger.Error(msg, l.with(ctx)...) }
+func (l withLogger) Crit(msg string, ctx ...interface{})  { l.Logger.Crit(msg, l.with(ctx)...) }
+
+// LevelCrit is the slog level Crit messages are logged at by SlogLogger
+const LevelCrit = slog.LevelError + 4
+
+// SlogLogger adapts a *slog.Logger to Logger, Crit messages are logged at LevelCrit
+func SlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+// slogLogger gets Debug, Info, Warn, and Error from slog.Logger
+type slogLogger struct{ *slog.Logger }
+
+func (l slogLogger) Crit(msg string, ctx ...interface{}) {
+	l.Log(context.Background(), LevelCrit, msg, ctx...)
+}
+
+// LoggerSlog is the slog flavor of Logger15
+func LoggerSlog(l *slog.Logger) web.MiddlewareType {
+	return RequestLogger(SlogLogger(l))
+}
+
+// ContextLoggerWith is like ContextLogger but derives the context logger from base, which
+// lets handlers log through slog or any other Logger
+func ContextLoggerWith(base Logger) web.MiddlewareType {
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if id, ok := c.Env[middleware.RequestIDKey].(string); ok {
+				c.Env[ContextLog] = LoggerWith(base, "req", id)
+			}
+			h.ServeHTTP(rw, r)
+		})
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+// listLogger is a Logger that records messages
+type listLogger struct{ out *[]string }
+
+func (l listLogger) log(lvl, msg string, ctx []interface{}) {
+	s := fmt.Sprintln(ctx...)
+	*l.out = append(*l.out, lvl+" "+msg+" "+s[:len(s)-1])
+}
+func (l listLogger) Debug(msg string, ctx ...interface{}) { l.log("dbug", msg, ctx) }
+func (l listLogger) Info(msg string, ctx ...interface{})  { l.log("info", msg, ctx) }
+func (l listLogger) Warn(msg string, ctx ...interface{})  { l.log("warn", msg, ctx) }
+func (l listLogger) Error(msg string, ctx ...interface{}) { l.log("eror", msg, ctx) }
+func (l listLogger) Crit(msg string, ctx ...interface{})  { l.log("crit", msg, ctx) }
+
+var _ = Describe("LoggerSlog", func() {
+
+	It("logs requests and the context logger through slog", func() {
+		var buf bytes.Buffer
+		sl := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(RequestID)
+		mx.Use(ContextLoggerWith(SlogLogger(sl)))
+		mx.Use(LoggerSlog(sl))
+		mx.Use(Recoverer)
+		mx.Get("/boom", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			contextLogger(c).Info("about to fail", "n", 1)
+			panic("boom")
+		})
+		req, _ := http.NewRequest("GET", "/boom", nil)
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		id := resp.Header().Get(RequestIDHeader)
+
+		Ω(buf.String()).Should(ContainSubstring(`level=INFO msg="about to fail" req=` + id + " n=1"))
+		Ω(buf.String()).Should(MatchRegexp(`level=ERROR\+4 msg=/boom req=` + id + ` .*status=500`))
+	})
+})
+
+var _ = Describe("LoggerWith", func() {
+
+	It("adds fields to any Logger", func() {
+		var out []string
+		l := LoggerWith(LoggerWith(listLogger{&out}, "a", 1), "b", 2)
+		l.Warn("hi", "c", 3)
+		LoggerWith(l, "d", 4).Info("again")
+		Ω(out).Should(Equal([]string{"warn hi a 1 b 2 c 3", "info again a 1 b 2 d 4"}))
+	})
+})
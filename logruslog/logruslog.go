@@ -0,0 +1,54 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Package logruslog adapts github.com/sirupsen/logrus to gojiutil.Logger. It is separate from
+// gojiutil so only applications logging through logrus depend on it.
+package logruslog
+
+import (
+	"fmt"
+
+	"github.com/rightscale/gojiutil"
+	"github.com/sirupsen/logrus"
+	"github.com/zenazn/goji/web"
+)
+
+// LogrusLogger adapts a *logrus.Logger to gojiutil.Logger, the key/value pairs become logrus
+// fields. Crit messages are logged at the error level as logrus' higher levels panic or exit.
+func LogrusLogger(l *logrus.Logger) gojiutil.Logger {
+	return logrusLogger{logrus.NewEntry(l)}
+}
+
+type logrusLogger struct{ e *logrus.Entry }
+
+// fields converts alternating keys and values to logrus fields
+func fields(ctx []interface{}) logrus.Fields {
+	fields := make(logrus.Fields, (len(ctx)+1)/2)
+	for i := 0; i < len(ctx); i += 2 {
+		if i+1 == len(ctx) {
+			fields["!BADKEY"] = ctx[i]
+			break
+		}
+		fields[fmt.Sprint(ctx[i])] = ctx[i+1]
+	}
+	return fields
+}
+
+func (l logrusLogger) log(level logrus.Level, msg string, ctx []interface{}) {
+	l.e.WithFields(fields(ctx)).Log(level, msg)
+}
+
+func (l logrusLogger) Debug(msg string, ctx ...interface{}) { l.log(logrus.DebugLevel, msg, ctx) }
+func (l logrusLogger) Info(msg string, ctx ...interface{})  { l.log(logrus.InfoLevel, msg, ctx) }
+func (l logrusLogger) Warn(msg string, ctx ...interface{})  { l.log(logrus.WarnLevel, msg, ctx) }
+func (l logrusLogger) Error(msg string, ctx ...interface{}) { l.log(logrus.ErrorLevel, msg, ctx) }
+func (l logrusLogger) Crit(msg string, ctx ...interface{})  { l.log(logrus.ErrorLevel, msg, ctx) }
+
+// With implements gojiutil.ChildLogger
+func (l logrusLogger) With(ctx ...interface{}) gojiutil.Logger {
+	return logrusLogger{l.e.WithFields(fields(ctx))}
+}
+
+// LoggerLogrus is the logrus flavor of gojiutil.Logger15, with the same fields
+func LoggerLogrus(l *logrus.Logger) web.MiddlewareType {
+	return gojiutil.RequestLogger(LogrusLogger(l))
+}
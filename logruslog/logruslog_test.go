@@ -0,0 +1,52 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package logruslog
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rightscale/gojiutil"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+// serve logs a request that fails with a 404 through mw
+func serve(mw web.MiddlewareType) {
+	mx := web.New()
+	mx.Use(middleware.EnvInit)
+	mx.Use(gojiutil.RequestID)
+	mx.Use(mw)
+	mx.Get("/missing", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+		gojiutil.ErrorString(c, rw, 404, "Not here")
+	})
+	req, _ := http.NewRequest("GET", "/missing", nil)
+	mx.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+var _ = Describe("LoggerLogrus", func() {
+
+	It("logs to logrus with the usual fields", func() {
+		l, hook := logrustest.NewNullLogger()
+		serve(LoggerLogrus(l))
+		Ω(hook.Entries).Should(HaveLen(1))
+		entry := hook.LastEntry()
+		Ω(entry.Level).Should(Equal(logrus.WarnLevel))
+		Ω(entry.Message).Should(Equal("/missing"))
+		Ω(entry.Data).Should(HaveKeyWithValue("status", "404"))
+		Ω(entry.Data).Should(HaveKeyWithValue("err", "Not here"))
+		Ω(entry.Data).Should(HaveKey("req"))
+		Ω(entry.Data).Should(HaveKey("time"))
+	})
+
+	It("adds fields with logrus' own mechanism", func() {
+		l, hook := logrustest.NewNullLogger()
+		gojiutil.LoggerWith(LogrusLogger(l), "a", 1).Crit("hi", "b")
+		Ω(hook.LastEntry().Level).Should(Equal(logrus.ErrorLevel))
+		Ω(hook.LastEntry().Data).Should(Equal(logrus.Fields{"a": 1, "!BADKEY": "b"}))
+	})
+})
@@ -0,0 +1,180 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Log shipping over TCP/TLS to Logstash, Fluentd, and the like
+
+package gojiutil
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// ShipOptions configures a ShipHandler
+type ShipOptions struct {
+	Addr         string        // host:port of the log collector
+	TLS          *tls.Config   // use TLS if non-nil
+	Format       log15.Format  // record format, defaults to log15.JsonFormat()
+	BufferSize   int           // number of records buffered while disconnected, default 1000
+	DialTimeout  time.Duration // default 5s
+	WriteTimeout time.Duration // default 5s
+	MaxBackoff   time.Duration // max delay between reconnection attempts, default 30s
+}
+
+// ShipHandler is a log15.Handler that ships newline-delimited records over a TCP or TLS
+// connection. Logging never blocks: records are buffered and dropped (and counted) when the
+// buffer is full, e.g. because the collector is unreachable. The connection is re-established
+// with exponential backoff.
+type ShipHandler struct {
+	opts    ShipOptions
+	queue   chan []byte
+	done    chan struct{}
+	wg      sync.WaitGroup
+	once    sync.Once
+	sent    uint64
+	dropped uint64
+	errors  uint64
+}
+
+// NewShipHandler creates a ShipHandler and starts its background sender, use Close to
+// flush and stop it
+func NewShipHandler(opts ShipOptions) *ShipHandler {
+	if opts.Format == nil {
+		opts.Format = log15.JsonFormat()
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = 1000
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = 5 * time.Second
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+	h := &ShipHandler{
+		opts:  opts,
+		queue: make(chan []byte, opts.BufferSize),
+		done:  make(chan struct{}),
+	}
+	h.wg.Add(1)
+	go h.run()
+	return h
+}
+
+// Log implements log15.Handler, records logged after Close are dropped
+func (h *ShipHandler) Log(r *log15.Record) error {
+	select {
+	case <-h.done:
+		atomic.AddUint64(&h.dropped, 1)
+		return nil
+	default:
+	}
+	buf := h.opts.Format.Format(r)
+	select {
+	case h.queue <- buf:
+	default:
+		atomic.AddUint64(&h.dropped, 1)
+	}
+	return nil
+}
+
+// Sent returns the number of records successfully written to the collector
+func (h *ShipHandler) Sent() uint64 { return atomic.LoadUint64(&h.sent) }
+
+// Dropped returns the number of records dropped because the buffer was full or the handler
+// was closed
+func (h *ShipHandler) Dropped() uint64 { return atomic.LoadUint64(&h.dropped) }
+
+// Errors returns the number of connection and write errors encountered
+func (h *ShipHandler) Errors() uint64 { return atomic.LoadUint64(&h.errors) }
+
+// Close stops accepting records and waits up to timeout for the buffer to be flushed
+func (h *ShipHandler) Close(timeout time.Duration) {
+	h.once.Do(func() { close(h.done) })
+	ch := make(chan struct{})
+	go func() { h.wg.Wait(); close(ch) }()
+	select {
+	case <-ch:
+	case <-time.After(timeout):
+	}
+}
+
+func (h *ShipHandler) dial() (net.Conn, error) {
+	d := &net.Dialer{Timeout: h.opts.DialTimeout}
+	if h.opts.TLS != nil {
+		return tls.DialWithDialer(d, "tcp", h.opts.Addr, h.opts.TLS)
+	}
+	return d.Dial("tcp", h.opts.Addr)
+}
+
+// run is the sender loop, it holds on to a record that failed to send and retries it after
+// reconnecting so a collector restart doesn't lose the record in flight
+func (h *ShipHandler) run() {
+	defer h.wg.Done()
+	var conn net.Conn
+	var pending []byte
+	backoff := 100 * time.Millisecond
+	closing := false
+
+	for {
+		if pending == nil {
+			select {
+			case pending = <-h.queue:
+			case <-h.done:
+				closing = true
+				select {
+				case pending = <-h.queue:
+				default:
+				}
+			}
+		}
+		if pending == nil {
+			break // closing and the queue is drained
+		}
+
+		if conn == nil {
+			var err error
+			if conn, err = h.dial(); err != nil {
+				atomic.AddUint64(&h.errors, 1)
+				conn = nil
+				if closing {
+					atomic.AddUint64(&h.dropped, 1)
+					break
+				}
+				select {
+				case <-time.After(backoff):
+				case <-h.done:
+					closing = true
+				}
+				if backoff *= 2; backoff > h.opts.MaxBackoff {
+					backoff = h.opts.MaxBackoff
+				}
+				continue
+			}
+			backoff = 100 * time.Millisecond
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(h.opts.WriteTimeout))
+		if _, err := conn.Write(pending); err != nil {
+			atomic.AddUint64(&h.errors, 1)
+			conn.Close()
+			conn = nil
+			continue
+		}
+		atomic.AddUint64(&h.sent, 1)
+		pending = nil
+	}
+
+	if conn != nil {
+		conn.Close()
+	}
+	// anything left over at this point is lost
+	atomic.AddUint64(&h.dropped, uint64(len(h.queue)))
+}
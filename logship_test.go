@@ -0,0 +1,66 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"bufio"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("ShipHandler", func() {
+
+	It("ships JSON records to the collector", func() {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer ln.Close()
+		lines := make(chan string, 10)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s := bufio.NewScanner(conn)
+			for s.Scan() {
+				lines <- s.Text()
+			}
+		}()
+
+		h := NewShipHandler(ShipOptions{Addr: ln.Addr().String()})
+		log := log15.New()
+		log.SetHandler(h)
+		log.Info("/foo", "status", "200")
+		Eventually(lines).Should(Receive(ContainSubstring(`"msg":"/foo"`)))
+		h.Close(time.Second)
+		Ω(h.Sent()).Should(BeEquivalentTo(1))
+		Ω(h.Dropped()).Should(BeEquivalentTo(0))
+	})
+
+	It("drops records when the buffer is full", func() {
+		h := NewShipHandler(ShipOptions{Addr: "127.0.0.1:1", BufferSize: 1,
+			DialTimeout: 10 * time.Millisecond})
+		log := log15.New()
+		log.SetHandler(h)
+		for i := 0; i < 5; i++ {
+			log.Info("/foo")
+		}
+		h.Close(time.Second)
+		Ω(h.Sent()).Should(BeEquivalentTo(0))
+		Ω(h.Dropped()).Should(BeNumerically(">=", 3))
+	})
+
+	It("drops records logged after Close", func() {
+		h := NewShipHandler(ShipOptions{Addr: "127.0.0.1:1", DialTimeout: 10 * time.Millisecond})
+		h.Close(time.Second)
+		log := log15.New()
+		log.SetHandler(h)
+		log.Info("/foo")
+		log.Info("/bar")
+		Ω(h.Dropped()).Should(BeEquivalentTo(2))
+		Ω(h.queue).Should(BeEmpty())
+	})
+})
@@ -5,13 +5,16 @@
 package gojiutil
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
-	"runtime"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -26,20 +29,99 @@ import (
 // ContextLog is the hash key in which ContextLogger places the log15 context logger
 var ContextLog string = "log"
 
-// Add the following common middlewares: EnvInit, RealIP, RequestID
+// Add the following common middlewares: EnvInit, RealIP, RequestID, TrackInFlight
 func AddCommon(mx *web.Mux) {
 	mx.Use(middleware.EnvInit)
 	mx.Use(RequestID)
 	mx.Use(middleware.RealIP)
+	mx.Use(TrackInFlight)
 }
 
-// Add the following common middlewares: EnvInit, RealIP, RequestID, Logger15, Recoverer, FormParser
+// Add the following common middlewares: EnvInit, RealIP, RequestID, TrackInFlight, Logger15,
+// Recoverer, FormParser
 func AddCommon15(mx *web.Mux, log log15.Logger) {
+	AddCommonOpts(mx, WithLogger(log))
+}
+
+// Option customizes the middleware stack installed by AddCommonOpts
+type Option func(*commonOpts)
+
+type commonOpts struct {
+	logger       log15.Logger
+	noLogger     bool
+	noRecoverer  bool
+	noFormParser bool
+	hook         func(c web.C, err interface{}, stack []Frame)
+	excluded     []string
+}
+
+// WithLogger sets the logger used by Logger15, the default is the log15 root logger
+func WithLogger(log log15.Logger) Option {
+	return func(o *commonOpts) { o.logger = log }
+}
+
+// WithoutLogger omits ContextLogger and Logger15
+func WithoutLogger() Option {
+	return func(o *commonOpts) { o.noLogger = true }
+}
+
+// WithoutRecoverer omits Recoverer, e.g. when panics are handled further up
+func WithoutRecoverer() Option {
+	return func(o *commonOpts) { o.noRecoverer = true }
+}
+
+// WithoutFormParser omits FormParser, e.g. for services that stream request bodies
+func WithoutFormParser() Option {
+	return func(o *commonOpts) { o.noFormParser = true }
+}
+
+// WithRecovererHook calls hook with every panic caught by the Recoverer, in addition to the
+// global PanicReporter
+func WithRecovererHook(hook func(c web.C, err interface{}, stack []Frame)) Option {
+	return func(o *commonOpts) { o.hook = hook }
+}
+
+// WithExcludedPaths omits the request logging for the listed paths, e.g. health checks; a
+// path ending in "/*" excludes everything below it
+func WithExcludedPaths(paths ...string) Option {
+	return func(o *commonOpts) { o.excluded = append(o.excluded, paths...) }
+}
+
+// AddCommonOpts adds the common middlewares of AddCommon15, customized by the options:
+// EnvInit, RequestID, RealIP, TrackInFlight, ContextLogger, Logger15, Recoverer, FormParser
+func AddCommonOpts(mx *web.Mux, opts ...Option) {
+	o := commonOpts{logger: log15.Root()}
+	for _, opt := range opts {
+		opt(&o)
+	}
 	AddCommon(mx)
-	mx.Use(ContextLogger)
-	mx.Use(Logger15(log))
-	mx.Use(Recoverer)
-	mx.Use(FormParser)
+	if !o.noLogger {
+		mx.Use(ContextLogger)
+		mx.Use(RequestLoggerOpts(o.logger, Logger15Opts{SkipPaths: o.excluded}))
+	}
+	if !o.noRecoverer {
+		var hook func(web.C, *http.Request, interface{}, []Frame)
+		if o.hook != nil {
+			hook = func(c web.C, r *http.Request, err interface{}, stack []Frame) {
+				o.hook(c, err, stack)
+			}
+		}
+		mx.Use(recoverer(hook))
+	}
+	if !o.noFormParser {
+		mx.Use(FormParser)
+	}
+}
+
+// pathListed checks whether path is one of paths, a path ending in "/*" lists everything
+// below it
+func pathListed(paths []string, path string) bool {
+	for _, p := range paths {
+		if path == p || (strings.HasSuffix(p, "/*") && strings.HasPrefix(path, p[:len(p)-1])) {
+			return true
+		}
+	}
+	return false
 }
 
 // Create a simple middleware that merges a map into c.Env
@@ -59,68 +141,264 @@ func EnvAdd(m map[string]interface{}) web.MiddlewareType {
 // Prints a requestID if one is present, use goji/middleware.RequestID
 // Prints the requestor's IP address, use goji/middleware.RealIP
 func Logger15(logger log15.Logger) web.MiddlewareType {
-	// Logger15 returns a middleware (which is a function):
+	return RequestLogger(logger)
+}
+
+// RequestLogger is Logger15 for any Logger, e.g. one adapting another logging library
+func RequestLogger(logger Logger) web.MiddlewareType {
+	return RequestLoggerOpts(logger, Logger15Opts{})
+}
+
+// Logger15Opts customizes the logging of Logger15 and RequestLoggerOpts
+type Logger15Opts struct {
+	// SkipPaths are the paths whose requests aren't logged, e.g. health checks; a path
+	// ending in "/*" skips everything below it
+	SkipPaths []string
+	// SkipFunc, if set, is called for every request and skips logging it if it returns true,
+	// e.g. for metrics scrapes or static assets
+	SkipFunc func(*http.Request) bool
+	// SampleRate, if greater than 1, logs only 1 in every SampleRate successful requests,
+	// requests resulting in a 4xx or 5xx status or slower than SlowThreshold are always logged
+	SampleRate int
+	// Live, if set, takes SampleRate from the logging section of its settings instead
+	Live *LiveConfig
+	// SlowThreshold, if set, is the duration above which a request is considered slow: it's
+	// logged with slow=true and its timing breakdown (see AddTiming), and as a warning if it
+	// succeeded
+	SlowThreshold time.Duration
+	// LevelFunc, if set, chooses the level at which a request is logged from its status and
+	// duration, by default 5xx are logged as Crit, 4xx and slow requests as Warn, and the
+	// rest as Info
+	LevelFunc func(status int, d time.Duration) log15.Lvl
+	// RouteMessage logs the pattern of the matched route, e.g. "/users/:id", as the message
+	// so entries can be aggregated per route, with the raw path as the path field. Requests
+	// matching no route keep their path as the message. Like RouteLabel this requires
+	// routing to happen within the middleware stack, i.e. mx.Use(mx.Router).
+	RouteMessage bool
+	// RequestHeaders and ResponseHeaders are the headers logged as req_* and resp_* fields,
+	// e.g. User-Agent is logged as req_user_agent
+	RequestHeaders  []string
+	ResponseHeaders []string
+	// RedactHeaders are the headers whose values are logged as Redacted, the default is
+	// DefaultRedactHeaders and Set-Cookie
+	RedactHeaders []string
+
+	count uint64 // number of requests eligible for sampling
+}
+
+// skip checks whether the logging of r should be skipped
+func (o *Logger15Opts) skip(r *http.Request) bool {
+	return pathListed(o.SkipPaths, r.URL.Path) || (o.SkipFunc != nil && o.SkipFunc(r))
+}
+
+// headerFields turns the headers of h listed in names into prefix_name log fields
+func (o *Logger15Opts) headerFields(prefix string, h http.Header, names []string) []interface{} {
+	var ctx []interface{}
+	for _, name := range names {
+		v, ok := h[http.CanonicalHeaderKey(name)]
+		if !ok {
+			continue
+		}
+		val := strings.Join(v, ", ")
+		for _, k := range o.RedactHeaders {
+			if strings.EqualFold(k, name) {
+				val = Redacted
+				break
+			}
+		}
+		key := prefix + strings.Replace(strings.ToLower(name), "-", "_", -1)
+		ctx = append(ctx, key, val)
+	}
+	return ctx
+}
+
+// sampled checks whether a request that resulted in status after d should be logged
+func (o *Logger15Opts) sampled(status int, d time.Duration) bool {
+	rate := o.SampleRate
+	if o.Live != nil {
+		rate = o.Live.Get().Logging.SampleRate
+	}
+	if rate <= 1 || status >= 400 || (o.SlowThreshold > 0 && d > o.SlowThreshold) {
+		return true
+	}
+	return atomic.AddUint64(&o.count, 1)%uint64(rate) == 1
+}
+
+// RequestLoggerOpts is RequestLogger customized by opts, e.g.
+// RequestLoggerOpts(log15.Root(), Logger15Opts{SkipPaths: []string{"/ping"}})
+func RequestLoggerOpts(logger Logger, opts Logger15Opts) web.MiddlewareType {
+	o := &opts
+	if o.RedactHeaders == nil {
+		o.RedactHeaders = append(append([]string{}, DefaultRedactHeaders...), "Set-Cookie")
+	}
+	// RequestLoggerOpts returns a middleware (which is a function):
 	return func(c *web.C, h http.Handler) http.Handler {
 		// The middleware returns a function to process requests:
 		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if o.skip(r) {
+				h.ServeHTTP(rw, r)
+				return
+			}
 			ctx := make([]interface{}, 0)
 
 			// record info about the request
 			if id := middleware.GetReqID(*c); id != "" {
 				ctx = append(ctx, "req", id)
 			}
+			if ext, ok := c.Env[ContextExternalReqID].(string); ok {
+				ctx = append(ctx, "ext_req", ext)
+			}
 			ctx = append(ctx, "verb", r.Method)
 			path := r.URL.Path
 			ip := r.RemoteAddr
 			if ip != "" {
 				ctx = append(ctx, "ip", ip)
 			}
+			ctx = append(ctx, o.headerFields("req_", r.Header, o.RequestHeaders)...)
 
 			// call handler down the stack with a wrapper writer so we see what it does
 			wp := mutil.WrapWriter(rw)
 			start := time.Now()
+			var body *countingReader
+			if r.ContentLength < 0 && r.Body != nil {
+				// unknown length, e.g. chunked: count what the handler reads
+				body = &countingReader{r: r.Body}
+				r.Body = struct {
+					io.Reader
+					io.Closer
+				}{body, r.Body}
+			}
 			h.ServeHTTP(wp, r)
-			ctx = append(ctx, "time", time.Now().Sub(start).String())
-
-			// record info about the response
-			s := wp.Status()
-			ctx = append(ctx, "status", strconv.Itoa(s))
-			if e, ok := c.Env["err"].(string); ok {
-				ctx = append(ctx, "err", e)
+			if ws, ok := c.Env[ContextWebsocket].(*WebSocket); ok {
+				// the connection was upgraded: log a 101 once it closes with its lifetime as
+				// time rather than a 200 for the upgrade itself, the mux recycles c so copy it
+				cv := *c
+				go func() {
+					<-ws.Done()
+					logResult(logger, o, cv, path, ctx, start, http.StatusSwitchingProtocols)
+				}()
+				return
 			}
-
-			switch {
-			// for 500 errors be prepared to log a stack trace
-			case s >= 500:
-				switch s := c.Env["stack"].(type) {
-				case string:
-					ctx = append(ctx, "stack", s)
-				case []string:
-					// got full stack trace, then remove goroutine number
-					// and top-level (which is where runtime.Stack is called)
-					if strings.HasPrefix(s[0], "goroutine") && len(s) > 3 {
-						s = s[3:]
-					}
-					// now put top N levels into stack%d variables
-					const levels = 3 // number of stack levels to print
-					for i := 0; i < levels && 2*i+1 < len(s); i += 1 {
-						funcName := s[2*i][:strings.Index(s[2*i], "(")]
-						sourceLine := strings.TrimLeft(s[2*i+1], "\t")
-						ctx = append(ctx, fmt.Sprintf("stack%d", i), funcName+" @ "+sourceLine)
-					}
-				}
-				logger.Crit(path, ctx...)
-			// for 400 errors log a warning (debatable)
-			case s >= 400:
-				logger.Warn(path, ctx...)
-			// for everything else just log info
-			default:
-				logger.Info(path, ctx...)
+			bytesIn := r.ContentLength
+			if body != nil {
+				bytesIn = body.n
 			}
+			ctx = append(ctx, "bytes_in", bytesIn, "bytes_out", wp.BytesWritten())
+			ctx = append(ctx, o.headerFields("resp_", wp.Header(), o.ResponseHeaders)...)
+			logResult(logger, o, *c, path, ctx, start, wp.Status())
 		})
 	}
 }
 
+// logResult completes the Logger15 entry of a request with its result
+func logResult(logger Logger, o *Logger15Opts, c web.C, path string, ctx []interface{},
+	start time.Time, s int) {
+	d := time.Since(start)
+	for _, observe := range statusObservers {
+		observe(c, s, d)
+	}
+	if skip, _ := c.Env[ContextSkipLog].(bool); skip || !o.sampled(s, d) {
+		return
+	}
+	ctx = append(ctx, "time", d.String())
+	if route := GetRoute(c); route != "" {
+		if o.RouteMessage {
+			ctx = append(ctx, "path", path)
+			path = route
+		} else {
+			ctx = append(ctx, "route", route)
+		}
+	}
+	if user, ok := c.Env[ContextUser].(string); ok {
+		ctx = append(ctx, "user", user)
+	}
+
+	// record info about the response
+	ctx = append(ctx, "status", strconv.Itoa(s))
+	if e, ok := c.Env["err"].(string); ok {
+		ctx = append(ctx, "err", e)
+	}
+	if err, ok := c.Env[ContextError].(error); ok && errors.Unwrap(err) != nil {
+		ctx = append(ctx, "err_chain", errorChain(err))
+	}
+	if kvs, ok := c.Env[ContextErrKV].([]interface{}); ok {
+		ctx = append(ctx, kvs...)
+	}
+	slow := o.SlowThreshold > 0 && d > o.SlowThreshold
+	if slow {
+		ctx = append(ctx, "slow", true)
+		if t := GetTimings(c); len(t) > 0 {
+			ctx = append(ctx, "timings", timingsField(t))
+		}
+	}
+
+	// for 500 errors be prepared to log a stack trace
+	if s >= 500 {
+		switch s := c.Env["stack"].(type) {
+		case string:
+			ctx = append(ctx, "stack", s)
+		case []string:
+			ctx = append(ctx, stackFields(s)...)
+		case []Frame:
+			ctx = append(ctx, frameFields(s)...)
+		}
+	}
+
+	lvl := defaultLevel(s, slow)
+	if o.LevelFunc != nil {
+		lvl = o.LevelFunc(s, d)
+	}
+	switch lvl {
+	case log15.LvlCrit:
+		logger.Crit(path, ctx...)
+	case log15.LvlError:
+		logger.Error(path, ctx...)
+	case log15.LvlWarn:
+		logger.Warn(path, ctx...)
+	case log15.LvlInfo:
+		logger.Info(path, ctx...)
+	default:
+		logger.Debug(path, ctx...)
+	}
+}
+
+// defaultLevel is the level at which Logger15 logs requests without a LevelFunc
+func defaultLevel(s int, slow bool) log15.Lvl {
+	switch {
+	// for 500 errors log a critical error
+	case s >= 500:
+		return log15.LvlCrit
+	// for 400 errors log a warning (debatable)
+	case s >= 400, slow:
+		return log15.LvlWarn
+	// for everything else just log info
+	default:
+		return log15.LvlInfo
+	}
+}
+
+// stackFields turns the top levels of a stack trace as produced by runtime.Stack into
+// stack%d log fields
+func stackFields(s []string) []interface{} {
+	var ctx []interface{}
+	// got full stack trace, then remove goroutine number
+	// and top-level (which is where runtime.Stack is called)
+	if len(s) > 3 && strings.HasPrefix(s[0], "goroutine") {
+		s = s[3:]
+	}
+	// now put top N levels into stack%d variables
+	const levels = 3 // number of stack levels to print
+	for i := 0; i < levels && 2*i+1 < len(s); i += 1 {
+		funcName := s[2*i]
+		if p := strings.LastIndex(funcName, "("); p > 0 { // strip the arguments
+			funcName = funcName[:p]
+		}
+		sourceLine := strings.TrimLeft(s[2*i+1], "\t")
+		ctx = append(ctx, fmt.Sprintf("stack%d", i), funcName+" @ "+sourceLine)
+	}
+	return ctx
+}
+
 // ParamsLogger logs all query string / form parameters primarily for debug purposes. It logs
 // at the start of a request using log15.Debug (or c.Env[ContextLog].Debug if defined) unlike
 // the Logger15 middleware, which logs at the end. If verbose is true then
@@ -132,10 +410,7 @@ func ParamsLogger(verbose bool) web.MiddlewareType {
 			for k, v := range r.Form {
 				params = append(params, k, v[0])
 			}
-			log, ok := c.Env[ContextLog].(log15.Logger)
-			if !ok || log == nil {
-				log = log15.Root()
-			}
+			log := contextLogger(*c)
 			if verbose {
 				log.Debug("Begin "+r.Method+" "+r.URL.Path,
 					"params", fmt.Sprintf("%+v", params),
@@ -153,23 +428,42 @@ func ParamsLogger(verbose bool) web.MiddlewareType {
 // the handlers panics. Also puts the call stack into the Echo Context which causes the logger
 // middleware to log it.
 func Recoverer(c *web.C, h http.Handler) http.Handler {
-	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		// Handle panics
-		defer func() {
-			if err := recover(); err != nil {
-				// write stack backtrace into c.Env, max 64KB
-				const size = 64 << 10 // 64KB
-				buf := make([]byte, size)
-				buf = buf[:runtime.Stack(buf, false)]
-				lines := strings.Split(string(buf), "\n")
-				//log15.Warn("Panic skipping", "l0", lines[0], "l1", lines[1],
-				//	"l2", lines[2])
-				c.Env["stack"] = lines[3:]
-				Errorf(*c, rw, 500, "panic: %v", err)
-			}
-		}()
-		h.ServeHTTP(rw, r)
-	})
+	return recoverer(nil)(c, h)
+}
+
+// RecovererWithHook is like Recoverer but also calls hook with each panic before the 500
+// response is written, e.g. to forward it along with the request to Sentry, Rollbar or
+// Bugsnag. Unlike PanicReporter, which applies to all Recoverers and goroutines started
+// using Go, the hook only applies to the requests passing through this middleware.
+func RecovererWithHook(
+	hook func(c web.C, r *http.Request, panicVal interface{}, stack []Frame)) web.MiddlewareType {
+	return recoverer(hook)
+}
+
+// recoverer implements Recoverer, also calling hook with each panic
+func recoverer(hook func(c web.C, r *http.Request, panicVal interface{},
+	stack []Frame)) func(*web.C, http.Handler) http.Handler {
+
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			// Handle panics
+			defer func() {
+				if err := recover(); err != nil {
+					// write stack backtrace into c.Env, starting at the panic
+					stack := callers(1)
+					c.Env["stack"] = stack
+					if PanicReporter != nil {
+						PanicReporter(*c, err, stack)
+					}
+					if hook != nil {
+						hook(*c, r, err, stack)
+					}
+					Errorf(*c, rw, 500, "panic: %v", err)
+				}
+			}()
+			h.ServeHTTP(rw, r)
+		})
+	}
 }
 
 // FormParser simply calls Request.FormParse to get all params into the request
@@ -200,19 +494,132 @@ func init() {
 	reqPrefix = string(b64[0:10])
 }
 
+// RequestIDGenerator generates the IDs of requests that don't come with a valid one, e.g.
+// UUIDRequestID or ULIDRequestID. It must be set before serving.
+var RequestIDGenerator = CounterRequestID
+
+// CounterRequestID generates IDs made of a random per-process prefix and a counter, it's the
+// default RequestIDGenerator
+func CounterRequestID() string {
+	return fmt.Sprintf("%s-%d", reqPrefix, atomic.AddInt64(&reqID, 1))
+}
+
+// UUIDRequestID generates random (version 4) UUIDs
+func UUIDRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// ULIDRequestID generates ULIDs, which sort by creation time to the millisecond
+func ULIDRequestID() string {
+	const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	var b [16]byte
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	for i := 0; i < 6; i++ {
+		b[i] = byte(ms >> uint(40-8*i))
+	}
+	rand.Read(b[6:])
+	// encode the 128 bits as 26 base32 characters, the first one holding only 3 bits
+	id := make([]byte, 26)
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	for i := 25; i >= 0; i-- {
+		id[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(id)
+}
+
+// RequestIDOptions configures the validation of incoming request IDs by RequestIDWith
+type RequestIDOptions struct {
+	MaxLen int // max length of an incoming ID, default 64
+	// Sanitize strips disallowed characters and truncates incoming IDs instead of replacing
+	// invalid ones with a generated ID. Allowed are letters, digits, and "-_.:/+=@"
+	Sanitize bool
+	// KeepExternal always generates the request ID and records a valid incoming ID in
+	// c.Env[ContextExternalReqID], which Logger15 logs as "ext_req"
+	KeepExternal bool
+	// NoEcho omits setting RequestIDHeader on the response, which lets clients and support
+	// staff report the ID for correlation with the logs
+	NoEcho bool
+}
+
+// ContextExternalReqID is the hash key in which RequestIDWith records the incoming request ID
+// when RequestIDOptions.KeepExternal is set
+var ContextExternalReqID string = "externalReqID"
+
 // RequestID injects a request ID into the context of each request. Retrieve it using
 // goji's GetReqID(). If the incoming request has a header of RequestIDHeader then that
-// value is used, else a random value is generated
+// value is used, else one is generated using RequestIDGenerator. Incoming IDs that are too
+// long or contain anything but letters, digits and "-_.:/+=@" are replaced so they can't mess
+// up the logs. The ID is echoed back in the RequestIDHeader response header.
 func RequestID(c *web.C, h http.Handler) http.Handler {
-	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		id := r.Header.Get(RequestIDHeader)
-		if id == "" {
-			id = fmt.Sprintf("%s-%d", reqPrefix, atomic.AddInt64(&reqID, 1))
+	return requestID(RequestIDOptions{})(c, h)
+}
+
+// RequestIDWith is like RequestID but with control over the handling of incoming IDs
+func RequestIDWith(opts RequestIDOptions) web.MiddlewareType {
+	return requestID(opts)
+}
+
+func requestID(opts RequestIDOptions) func(*web.C, http.Handler) http.Handler {
+	if opts.MaxLen <= 0 {
+		opts.MaxLen = 64
+	}
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(RequestIDHeader)
+			if id != "" && (len(id) > opts.MaxLen || !validReqID(id)) {
+				if opts.Sanitize {
+					id = sanitizeReqID(id, opts.MaxLen)
+				} else {
+					id = ""
+				}
+			}
+			if opts.KeepExternal && id != "" {
+				c.Env[ContextExternalReqID] = id
+				id = ""
+			}
+			if id == "" {
+				id = RequestIDGenerator()
+			}
+			c.Env[middleware.RequestIDKey] = id
+			if !opts.NoEcho {
+				rw.Header().Set(RequestIDHeader, id)
+			}
+
+			h.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// reqIDChar reports whether b may appear in a request ID
+func reqIDChar(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' ||
+		strings.IndexByte("-_.:/+=@", b) >= 0
+}
+
+func validReqID(id string) bool {
+	for i := 0; i < len(id); i++ {
+		if !reqIDChar(id[i]) {
+			return false
 		}
-		c.Env[middleware.RequestIDKey] = id
+	}
+	return true
+}
 
-		h.ServeHTTP(rw, r)
-	})
+// sanitizeReqID strips the disallowed characters from id and truncates it
+func sanitizeReqID(id string, maxLen int) string {
+	buf := make([]byte, 0, len(id))
+	for i := 0; i < len(id) && len(buf) < maxLen; i++ {
+		if reqIDChar(id[i]) {
+			buf = append(buf, id[i])
+		}
+	}
+	return string(buf)
 }
 
 // ContextLogger injects a log15 logger that is initialized to print the request ID. It
@@ -228,12 +635,35 @@ func ContextLogger(c *web.C, h http.Handler) http.Handler {
 	})
 }
 
+// contextLogger returns the logger placed into c.Env by ContextLogger, or the root logger
+func contextLogger(c web.C) Logger {
+	if log, ok := c.Env[ContextLog].(Logger); ok && log != nil {
+		return log
+	}
+	return log15.Root()
+}
+
 // GetJSONBody is a middleware to read and parse an application/json body and store it in
-// c.Env["json"] as a map[string]interface{}, which can be easily mapped to a proper struct
-// using github.com/mitchellh/mapstructure.
+// c.Env["json"]: objects as a map[string]interface{}, which can be easily mapped to a proper
+// struct using github.com/mitchellh/mapstructure (or use BindJSON), arrays as []interface{},
+// and other values as their encoding/json type. A missing body produces a nil map.
 // This middleware is pretty permissive: it allows for having no content-length and no
 // content-type as long as either there's no body or the body parses as json.
 func GetJSONBody(c *web.C, h http.Handler) http.Handler {
+	return getJSONBody(c, h, false)
+}
+
+// ContextRawBody is the hash key in which GetJSONBodyRaw places the raw body bytes
+var ContextRawBody string = "rawBody"
+
+// GetJSONBodyRaw is like GetJSONBody but additionally stores the raw body bytes in
+// c.Env[ContextRawBody] as []byte, so handlers can verify signatures, archive the payload,
+// or decode it into an exact type. r.Body is also reset so it can be read again.
+func GetJSONBodyRaw(c *web.C, h http.Handler) http.Handler {
+	return getJSONBody(c, h, true)
+}
+
+func getJSONBody(c *web.C, h http.Handler, keepRaw bool) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		var err error
 
@@ -246,8 +676,8 @@ func GetJSONBody(c *web.C, h http.Handler) http.Handler {
 			}
 		}
 
-		// parse content-type header
-		if ct := r.Header.Get("content-type"); ct != "" && ct != "application/json" {
+		// parse content-type header, allowing parameters such as charset
+		if ct := r.Header.Get("content-type"); !isJSONContentType(ct) {
 			ErrorString(*c, rw, 400,
 				"Invalid content-type '"+ct+"', application/json expected")
 			return
@@ -262,14 +692,26 @@ func GetJSONBody(c *web.C, h http.Handler) http.Handler {
 		*/
 
 		// try to read body
-		var js map[string]interface{}
-		err = json.NewDecoder(r.Body).Decode(&js)
+		body := r.Body
+		if keepRaw {
+			raw, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				ErrorString(*c, rw, 400, "Cannot read request body: "+err.Error())
+				return
+			}
+			c.Env[ContextRawBody] = raw
+			body = ioutil.NopCloser(bytes.NewReader(raw))
+			r.Body = ioutil.NopCloser(bytes.NewReader(raw))
+		}
+		var js interface{}
+		err = json.NewDecoder(body).Decode(&js)
 		switch err {
 		case io.EOF:
 			if cl != 0 {
 				ErrorString(*c, rw, 400, "Premature EOF reading post body")
 				return
 			}
+			js = map[string]interface{}(nil) // what handlers have always been getting
 			//log.Debug("HTTP no request body")
 			// got no body, so we're OK
 		case nil:
@@ -285,3 +727,227 @@ func GetJSONBody(c *web.C, h http.Handler) http.Handler {
 		h.ServeHTTP(rw, r)
 	})
 }
+
+// CORSOptions configures the CORS middleware
+type CORSOptions struct {
+	// AllowedOrigins lists the origins allowed to make cross-origin requests, e.g.
+	// "https://app.example.com", "https://*.example.com" matches any subdomain and "*"
+	// matches any origin
+	AllowedOrigins []string
+	// AllowOriginFunc, if set, is consulted for origins not in AllowedOrigins
+	AllowOriginFunc func(origin string) bool
+	// AllowedMethods defaults to GET, HEAD, POST, PUT, PATCH, and DELETE
+	AllowedMethods []string
+	// AllowedHeaders lists the request headers allowed in preflights, nil allows any
+	// header the browser asks for
+	AllowedHeaders []string
+	// ExposedHeaders lists the response headers browsers expose to scripts
+	ExposedHeaders []string
+	// AllowCredentials allows cookies and authorization headers, the actual origin is echoed
+	// as required by browsers. Credentialed requests must be limited to explicit origins or
+	// AllowOriginFunc, CORS panics if AllowedOrigins contains "*".
+	AllowCredentials bool
+	// MaxAge is how long preflight results may be cached, 0 omits the header
+	MaxAge time.Duration
+}
+
+// CORS creates a middleware implementing cross-origin resource sharing: requests from allowed
+// origins get the Access-Control-* response headers, and preflight requests (OPTIONS with an
+// Access-Control-Request-Method header) are answered with 204 without calling the handler.
+// Requests from other origins are passed through without CORS headers, which makes browsers
+// block the response. CORS panics if "*" is combined with AllowCredentials, which would let
+// any site make requests with the user's cookies and read the responses.
+func CORS(opts CORSOptions) web.MiddlewareType {
+	if opts.AllowedMethods == nil {
+		opts.AllowedMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+	}
+	anyOrigin := false
+	for _, o := range opts.AllowedOrigins {
+		anyOrigin = anyOrigin || o == "*"
+	}
+	if anyOrigin && opts.AllowCredentials {
+		panic(`gojiutil.CORS: AllowCredentials requires explicit origins or AllowOriginFunc, ` +
+			`not "*"`)
+	}
+	methods := strings.Join(opts.AllowedMethods, ", ")
+	allowedHeaders := make(map[string]bool, len(opts.AllowedHeaders))
+	for _, h := range opts.AllowedHeaders {
+		allowedHeaders[http.CanonicalHeaderKey(h)] = true
+	}
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			hdr := rw.Header()
+			AddVary(hdr, "Origin")
+			origin := r.Header.Get("Origin")
+			if origin == "" || !corsAllowed(origin, anyOrigin, opts) {
+				h.ServeHTTP(rw, r)
+				return
+			}
+			if anyOrigin {
+				hdr.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				hdr.Set("Access-Control-Allow-Origin", origin)
+			}
+			if opts.AllowCredentials {
+				hdr.Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			reqMethod := r.Header.Get("Access-Control-Request-Method")
+			if r.Method != "OPTIONS" || reqMethod == "" {
+				if len(opts.ExposedHeaders) > 0 {
+					hdr.Set("Access-Control-Expose-Headers",
+						strings.Join(opts.ExposedHeaders, ", "))
+				}
+				h.ServeHTTP(rw, r)
+				return
+			}
+
+			// preflight
+			AddVary(hdr, "Access-Control-Request-Method", "Access-Control-Request-Headers")
+			hdr.Set("Access-Control-Allow-Methods", methods)
+			if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+				var allowed []string
+				for _, h := range strings.Split(reqHeaders, ",") {
+					h = http.CanonicalHeaderKey(strings.TrimSpace(h))
+					if h != "" && (opts.AllowedHeaders == nil || allowedHeaders[h]) {
+						allowed = append(allowed, h)
+					}
+				}
+				if len(allowed) > 0 {
+					hdr.Set("Access-Control-Allow-Headers", strings.Join(allowed, ", "))
+				}
+			}
+			if opts.MaxAge > 0 {
+				hdr.Set("Access-Control-Max-Age", strconv.Itoa(int(opts.MaxAge/time.Second)))
+			}
+			rw.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
+
+// corsAllowed checks an origin against the CORS options
+func corsAllowed(origin string, anyOrigin bool, opts CORSOptions) bool {
+	if anyOrigin {
+		return true
+	}
+	for _, o := range opts.AllowedOrigins {
+		if o == origin {
+			return true
+		}
+		if i := strings.Index(o, "://*."); i > 0 && strings.HasPrefix(origin, o[:i+3]) &&
+			strings.HasSuffix(origin, o[i+4:]) && len(origin) > len(o)-1 {
+			return true
+		}
+	}
+	return opts.AllowOriginFunc != nil && opts.AllowOriginFunc(origin)
+}
+
+// StrictJSONOptions configures GetJSONBodyStrict
+type StrictJSONOptions struct {
+	MaxBytes int64 // max body size, default 1MB, larger bodies get a 413
+	MaxDepth int   // max nesting of objects and arrays, default 32
+	// New, if set, returns a pointer to the struct the body is decoded into, fields absent
+	// from the struct are then rejected, else the body is decoded as by GetJSONBody
+	New     func() interface{}
+	KeepRaw bool // store the raw body in c.Env[ContextRawBody]
+}
+
+// GetJSONBodyStrict is a stricter GetJSONBody for public APIs where lenient parsing hides
+// client bugs: the body must be a single JSON value without trailing data, within the size
+// and nesting limits, and when decoding into a struct unknown fields are rejected. Failures
+// get a 400 Bad Request with a message pointing at the problem. The decoded value is placed
+// into c.Env["json"].
+func GetJSONBodyStrict(opts StrictJSONOptions) web.MiddlewareType {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = 1 << 20
+	}
+	if opts.MaxDepth <= 0 {
+		opts.MaxDepth = 32
+	}
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if ct := r.Header.Get("content-type"); !isJSONContentType(ct) {
+				ErrorString(*c, rw, 400,
+					"Invalid content-type '"+ct+"', application/json expected")
+				return
+			}
+			raw, err := ioutil.ReadAll(io.LimitReader(r.Body, opts.MaxBytes+1))
+			if err != nil {
+				ErrorString(*c, rw, 400, "Cannot read request body: "+err.Error())
+				return
+			}
+			if int64(len(raw)) > opts.MaxBytes {
+				Errorf(*c, rw, http.StatusRequestEntityTooLarge,
+					"Request body exceeds %d bytes", opts.MaxBytes)
+				return
+			}
+			if opts.KeepRaw {
+				c.Env[ContextRawBody] = raw
+				r.Body = ioutil.NopCloser(bytes.NewReader(raw))
+			}
+			if len(bytes.TrimSpace(raw)) == 0 {
+				c.Env["json"] = nil
+				h.ServeHTTP(rw, r)
+				return
+			}
+			if err := jsonDepth(raw, opts.MaxDepth); err != nil {
+				ErrorString(*c, rw, 400, "Cannot parse JSON request body: "+err.Error())
+				return
+			}
+			var v interface{}
+			if opts.New != nil {
+				v = opts.New()
+			} else {
+				v = new(interface{})
+			}
+			dec := json.NewDecoder(bytes.NewReader(raw))
+			dec.DisallowUnknownFields()
+			err = dec.Decode(v)
+			if err == nil {
+				if _, e := dec.Token(); e != io.EOF {
+					err = fmt.Errorf("unexpected data after the JSON value at offset %d",
+						dec.InputOffset())
+				}
+			}
+			if err != nil {
+				if se, ok := err.(*json.SyntaxError); ok {
+					err = fmt.Errorf("%s at offset %d", se, se.Offset)
+				}
+				ErrorString(*c, rw, 400, "Cannot parse JSON request body: "+err.Error())
+				return
+			}
+			if opts.New == nil {
+				v = *v.(*interface{})
+			}
+			c.Env["json"] = v
+			h.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// jsonDepth checks that JSON text doesn't nest objects and arrays deeper than max
+func jsonDepth(buf []byte, max int) error {
+	depth, inString, escaped := 0, false, false
+	for i, b := range buf {
+		switch {
+		case inString:
+			switch {
+			case escaped:
+				escaped = false
+			case b == '\\':
+				escaped = true
+			case b == '"':
+				inString = false
+			}
+		case b == '"':
+			inString = true
+		case b == '{' || b == '[':
+			if depth++; depth > max {
+				return fmt.Errorf("nesting exceeds depth %d at offset %d", max, i)
+			}
+		case b == '}' || b == ']':
+			depth--
+		}
+	}
+	return nil
+}
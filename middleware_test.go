@@ -3,14 +3,20 @@
 package gojiutil
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
 	"gopkg.in/inconshreveable/log15.v2"
 )
 
@@ -44,9 +50,382 @@ var _ = Describe("Logger15", func() {
 		Ω(resp.Code).Should(Equal(200))
 		Ω(resp.Body.String()).Should(HaveLen(13))
 		Ω(logStr).Should(HaveLen(1))
-		Ω(logStr[0]).Should(MatchRegexp(`^Lvl info, /, \[(time [0-9.]+µs ?|status 200 ?|verb POST ?){3}\]`))
+		Ω(logStr[0]).Should(MatchRegexp(`^Lvl info, /, \[(time [0-9.]+µs ?|status 200 ?|verb POST ?|bytes_in 3 ?|bytes_out 13 ?){5}\]`))
 	})
 
+	It("counts the bytes of chunked request bodies", func() {
+		mx.Handle("/upload", func(rw http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+		})
+		req, _ := http.NewRequest("PUT", "/upload", strings.NewReader("hello"))
+		req.ContentLength = -1 // as for a chunked request received by the server
+		mx.ServeHTTP(resp, req)
+		Ω(logStr[0]).Should(ContainSubstring("bytes_in 5 bytes_out 0"))
+	})
+
+	It("logs error key/values", func() {
+		mx = web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(Logger15(testLogger(&logStr)))
+		mx.Handle("/", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			ErrorKV(c, rw, 404, "Account not found", "account", 42)
+		})
+		mx.ServeHTTP(resp, req)
+		Ω(resp.Body.String()).Should(Equal("Account not found\n"))
+		Ω(logStr).Should(HaveLen(1))
+		Ω(logStr[0]).Should(HaveSuffix("err Account not found account 42]\n"))
+	})
+
+	It("keeps wrapped errors and logs their chain", func() {
+		var got error
+		mx = web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(Logger15(testLogger(&logStr)))
+		mx.Handle("/", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			_, err := os.Open("/does/not/exist")
+			Errorf(c, rw, 404, "Cannot load config: %w", err)
+			got = GetError(c)
+		})
+		mx.ServeHTTP(resp, req)
+		Ω(resp.Body.String()).Should(HavePrefix("Cannot load config: open /does/not/exist"))
+		Ω(errors.Is(got, os.ErrNotExist)).Should(BeTrue())
+		Ω(logStr[0]).Should(ContainSubstring(
+			"err_chain *fmt.wrapError > *fs.PathError > syscall.Errno"))
+	})
+
+	It("skips the requests selected by the options", func() {
+		mx = web.New()
+		mx.Use(RequestLoggerOpts(testLogger(&logStr), Logger15Opts{
+			SkipPaths: []string{"/ping", "/static/*"},
+			SkipFunc:  func(r *http.Request) bool { return r.URL.Path == "/metrics" },
+		}))
+		mx.Handle("/*", func(rw http.ResponseWriter, r *http.Request) { called = true })
+		for _, path := range []string{"/ping", "/static/app.js", "/metrics", "/widgets"} {
+			req, _ := http.NewRequest("GET", path, nil)
+			mx.ServeHTTP(httptest.NewRecorder(), req)
+			Ω(called).Should(BeTrue())
+		}
+		Ω(logStr).Should(HaveLen(1))
+		Ω(logStr[0]).Should(HavePrefix("Lvl info, /widgets"))
+	})
+
+	It("samples successful requests", func() {
+		mx = web.New()
+		mx.Use(RequestLoggerOpts(testLogger(&logStr), Logger15Opts{SampleRate: 10,
+			SlowThreshold: 20 * time.Millisecond}))
+		mx.Get("/ok", func(rw http.ResponseWriter, r *http.Request) {})
+		mx.Get("/slow", func(rw http.ResponseWriter, r *http.Request) {
+			time.Sleep(30 * time.Millisecond)
+		})
+		mx.Get("/bad", func(rw http.ResponseWriter, r *http.Request) { rw.WriteHeader(400) })
+		serve := func(path string, n int) {
+			for i := 0; i < n; i++ {
+				req, _ := http.NewRequest("GET", path, nil)
+				mx.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		}
+		serve("/ok", 30)
+		serve("/bad", 2)
+		serve("/slow", 1)
+		Ω(logStr).Should(HaveLen(6))
+		Ω(logStr[0]).Should(HavePrefix("Lvl info, /ok"))
+		Ω(logStr[3]).Should(HavePrefix("Lvl warn, /bad"))
+		Ω(logStr[5]).Should(HavePrefix("Lvl warn, /slow"))
+	})
+
+	It("maps statuses to levels using LevelFunc", func() {
+		mx = web.New()
+		mx.Use(RequestLoggerOpts(testLogger(&logStr), Logger15Opts{
+			LevelFunc: func(status int, d time.Duration) log15.Lvl {
+				switch {
+				case status >= 500:
+					return log15.LvlError
+				case status == 404:
+					return log15.LvlInfo
+				}
+				return log15.LvlDebug
+			}}))
+		mx.Get("/*", func(rw http.ResponseWriter, r *http.Request) {
+			code, _ := strconv.Atoi(r.URL.Path[1:])
+			rw.WriteHeader(code)
+		})
+		for _, path := range []string{"/503", "/404", "/200"} {
+			req, _ := http.NewRequest("GET", path, nil)
+			mx.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		Ω(logStr).Should(HaveLen(3))
+		Ω(logStr[0]).Should(HavePrefix("Lvl eror, /503"))
+		Ω(logStr[1]).Should(HavePrefix("Lvl info, /404"))
+		Ω(logStr[2]).Should(HavePrefix("Lvl dbug, /200"))
+	})
+
+	It("logs the selected headers with redaction", func() {
+		mx = web.New()
+		mx.Use(RequestLoggerOpts(testLogger(&logStr), Logger15Opts{
+			RequestHeaders:  []string{"User-Agent", "authorization", "X-Missing"},
+			ResponseHeaders: []string{"Content-Type", "Set-Cookie"},
+		}))
+		mx.Get("/", func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Content-Type", "text/plain")
+			rw.Header().Set("Set-Cookie", "session=s3cr3t")
+		})
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("User-Agent", "curl/8.0")
+		req.Header.Set("Authorization", "Bearer s3cr3t")
+		mx.ServeHTTP(httptest.NewRecorder(), req)
+		Ω(logStr[0]).Should(ContainSubstring("req_user_agent curl/8.0 req_authorization REDACTED"))
+		Ω(logStr[0]).Should(ContainSubstring("resp_content_type text/plain resp_set_cookie REDACTED"))
+		Ω(logStr[0]).ShouldNot(ContainSubstring("s3cr3t"))
+		Ω(logStr[0]).ShouldNot(ContainSubstring("x_missing"))
+	})
+
+	It("flags slow requests with their timing breakdown", func() {
+		mx = web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(RequestLoggerOpts(testLogger(&logStr), Logger15Opts{
+			SlowThreshold: 20 * time.Millisecond}))
+		mx.Get("/slow", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			AddTiming(c, "auth", time.Millisecond)
+			defer StartTiming(c, "db")()
+			time.Sleep(30 * time.Millisecond)
+		})
+		mx.Get("/fast", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			AddTiming(c, "db", time.Millisecond)
+		})
+		for _, path := range []string{"/slow", "/fast"} {
+			req, _ := http.NewRequest("GET", path, nil)
+			mx.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		Ω(logStr).Should(HaveLen(2))
+		Ω(logStr[0]).Should(MatchRegexp(`^Lvl warn, /slow, .* slow true timings auth=1ms,db=[0-9.]+ms\]`))
+		Ω(logStr[1]).Should(HavePrefix("Lvl info, /fast"))
+		Ω(logStr[1]).ShouldNot(ContainSubstring("slow"))
+	})
+
+})
+
+var _ = Describe("AddCommonOpts", func() {
+
+	It("customizes the stack", func() {
+		var logStr []string
+		var hooked interface{}
+		mx := web.New()
+		AddCommonOpts(mx, WithLogger(testLogger(&logStr)), WithExcludedPaths("/health"),
+			WithRecovererHook(func(c web.C, err interface{}, stack []Frame) { hooked = err }))
+		mx.Get("/health", func(rw http.ResponseWriter, r *http.Request) {})
+		mx.Get("/boom", func(rw http.ResponseWriter, r *http.Request) { panic("boom") })
+
+		for _, path := range []string{"/health", "/boom"} {
+			req, _ := http.NewRequest("GET", path, nil)
+			mx.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		Ω(hooked).Should(Equal("boom"))
+		Ω(logStr).Should(HaveLen(1))
+		Ω(logStr[0]).Should(HavePrefix("Lvl crit, /boom"))
+	})
+})
+
+var _ = Describe("RequestID", func() {
+
+	reqID := func(mw interface{}, id string) web.C {
+		var env web.C
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(mw)
+		mx.Get("/", func(c web.C, rw http.ResponseWriter, r *http.Request) { env = c })
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set(RequestIDHeader, id)
+		mx.ServeHTTP(httptest.NewRecorder(), req)
+		return env
+	}
+
+	It("validates incoming IDs", func() {
+		Ω(middleware.GetReqID(reqID(RequestID, "abc-123"))).Should(Equal("abc-123"))
+		Ω(middleware.GetReqID(reqID(RequestID, "abc\x1b[31m"))).Should(HavePrefix(reqPrefix))
+		Ω(middleware.GetReqID(reqID(RequestIDWith(RequestIDOptions{Sanitize: true, MaxLen: 5}),
+			"a b\x00cdefg"))).Should(Equal("abcde"))
+	})
+
+	It("keeps external IDs separately", func() {
+		c := reqID(RequestIDWith(RequestIDOptions{KeepExternal: true}), "abc")
+		Ω(middleware.GetReqID(c)).Should(HavePrefix(reqPrefix))
+		Ω(c.Env[ContextExternalReqID]).Should(Equal("abc"))
+	})
+
+	It("uses the configured generator", func() {
+		defer func() { RequestIDGenerator = CounterRequestID }()
+		RequestIDGenerator = UUIDRequestID
+		Ω(middleware.GetReqID(reqID(RequestID, ""))).Should(MatchRegexp(
+			`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`))
+		RequestIDGenerator = ULIDRequestID
+		id := middleware.GetReqID(reqID(RequestID, ""))
+		Ω(id).Should(MatchRegexp(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`))
+		time.Sleep(2 * time.Millisecond)
+		Ω(ULIDRequestID() > id).Should(BeTrue()) // sorts by time
+	})
+
+	It("echoes the ID in the response", func() {
+		for _, noEcho := range []bool{false, true} {
+			mx := web.New()
+			mx.Use(middleware.EnvInit)
+			mx.Use(RequestIDWith(RequestIDOptions{NoEcho: noEcho}))
+			mx.Get("/", func(c web.C, rw http.ResponseWriter, r *http.Request) {})
+			req, _ := http.NewRequest("GET", "/", nil)
+			resp := httptest.NewRecorder()
+			mx.ServeHTTP(resp, req)
+			if noEcho {
+				Ω(resp.Header().Get(RequestIDHeader)).Should(BeEmpty())
+			} else {
+				Ω(resp.Header().Get(RequestIDHeader)).Should(HavePrefix(reqPrefix))
+			}
+		}
+	})
+})
+
+var _ = Describe("GetJSONBody", func() {
+	var mx *web.Mux
+	var env map[interface{}]interface{}
+
+	BeforeEach(func() {
+		env = nil
+		mx = web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Post("/", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			env = c.Env
+		})
+	})
+
+	It("parses the body", func() {
+		mx.Use(GetJSONBody)
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(`{"a":1}`))
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		Ω(resp.Code).Should(Equal(200))
+		Ω(env["json"]).Should(Equal(map[string]interface{}{"a": 1.0}))
+		Ω(env).ShouldNot(HaveKey(ContextRawBody))
+	})
+
+	It("keeps the raw body", func() {
+		mx.Use(GetJSONBodyRaw)
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(`{"a":1}`))
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		Ω(resp.Code).Should(Equal(200))
+		Ω(env["json"]).Should(Equal(map[string]interface{}{"a": 1.0}))
+		Ω(env[ContextRawBody]).Should(Equal([]byte(`{"a":1}`)))
+	})
+
+	It("rejects bad JSON", func() {
+		mx.Use(GetJSONBody)
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(`{"a":`))
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		Ω(resp.Code).Should(Equal(400))
+		Ω(env).Should(BeNil())
+	})
+	It("accepts content-type parameters and arrays", func() {
+		mx.Use(GetJSONBody)
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(`[1,"b"]`))
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		Ω(resp.Code).Should(Equal(200))
+		Ω(env["json"]).Should(Equal([]interface{}{1.0, "b"}))
+	})
+})
+
+var _ = Describe("GetJSONBodyStrict", func() {
+
+	type item struct {
+		Name string `json:"name"`
+	}
+
+	var env map[interface{}]interface{}
+	post := func(opts StrictJSONOptions, body string) *httptest.ResponseRecorder {
+		env = nil
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(GetJSONBodyStrict(opts))
+		mx.Post("/", func(c web.C, rw http.ResponseWriter, r *http.Request) { env = c.Env })
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		return resp
+	}
+	newItem := func() interface{} { return &item{} }
+
+	It("decodes into the struct", func() {
+		Ω(post(StrictJSONOptions{New: newItem}, `{"name":"x"}`).Code).Should(Equal(200))
+		Ω(env["json"]).Should(Equal(&item{"x"}))
+	})
+
+	It("rejects unknown fields and trailing data", func() {
+		resp := post(StrictJSONOptions{New: newItem}, `{"name":"x","size":1}`)
+		Ω(resp.Code).Should(Equal(400))
+		Ω(resp.Body.String()).Should(ContainSubstring(`unknown field "size"`))
+		resp = post(StrictJSONOptions{}, `{"name":"x"} {}`)
+		Ω(resp.Code).Should(Equal(400))
+		Ω(resp.Body.String()).Should(ContainSubstring("unexpected data"))
+	})
+
+	It("enforces the limits", func() {
+		Ω(post(StrictJSONOptions{MaxBytes: 8}, `{"name":"x"}`).Code).Should(Equal(413))
+		resp := post(StrictJSONOptions{MaxDepth: 2}, `{"a":[{"b":"[[["}]}`)
+		Ω(resp.Code).Should(Equal(400))
+		Ω(resp.Body.String()).Should(ContainSubstring("depth 2 at offset 6"))
+		Ω(post(StrictJSONOptions{MaxDepth: 3}, `{"a":[{"b":"[[["}]}`).Code).Should(Equal(200))
+	})
+})
+
+var _ = Describe("CORS", func() {
+
+	var mx *web.Mux
+	var called bool
+
+	BeforeEach(func() {
+		called = false
+		mx = web.New()
+		mx.Use(CORS(CORSOptions{AllowedOrigins: []string{"https://*.example.com"},
+			AllowedHeaders: []string{"Content-Type"}, AllowCredentials: true,
+			MaxAge: time.Hour}))
+		mx.Handle("/", func(rw http.ResponseWriter, r *http.Request) { called = true })
+	})
+
+	It("answers preflights from allowed origins", func() {
+		req, _ := http.NewRequest("OPTIONS", "/", nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		req.Header.Set("Access-Control-Request-Method", "PUT")
+		req.Header.Set("Access-Control-Request-Headers", "content-type, x-secret")
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		Ω(resp.Code).Should(Equal(204))
+		Ω(called).Should(BeFalse())
+		Ω(resp.Header().Get("Access-Control-Allow-Origin")).
+			Should(Equal("https://app.example.com"))
+		Ω(resp.Header().Get("Access-Control-Allow-Credentials")).Should(Equal("true"))
+		Ω(resp.Header().Get("Access-Control-Allow-Headers")).Should(Equal("Content-Type"))
+		Ω(resp.Header().Get("Access-Control-Max-Age")).Should(Equal("3600"))
+	})
+
+	It("ignores other origins", func() {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Origin", "https://example.org")
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		Ω(called).Should(BeTrue())
+		Ω(resp.Header().Get("Access-Control-Allow-Origin")).Should(BeEmpty())
+		Ω(resp.Header().Get("Vary")).Should(Equal("Origin"))
+	})
+
+	It("refuses credentials for any origin", func() {
+		Ω(func() {
+			CORS(CORSOptions{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+		}).Should(Panic())
+		Ω(func() {
+			CORS(CORSOptions{AllowOriginFunc: func(string) bool { return true },
+				AllowCredentials: true})
+		}).ShouldNot(Panic())
+	})
 })
 
 // Dummy logger that keeps logged messages
@@ -0,0 +1,506 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// MessagePack request and response bodies
+
+package gojiutil
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// ApplicationMsgpack is the media type of MessagePack bodies
+var ApplicationMsgpack = "application/msgpack"
+
+// GetMsgpackBody is a middleware to read and parse an application/msgpack (or
+// application/x-msgpack) body and store it in c.Env["json"] as the same generic structure
+// GetJSONBody produces, except that integers are int64 (or uint64 when too large) and binary
+// data is []byte, so handlers can accept both encodings. Requests with another content-type
+// are rejected with a 400 and requests without a body get a nil value.
+func GetMsgpackBody(c *web.C, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ct := r.Header.Get("content-type")
+		if mt, _, err := mime.ParseMediaType(ct); ct != "" &&
+			(err != nil || (mt != ApplicationMsgpack && mt != "application/x-msgpack")) {
+			ErrorString(*c, rw, 400,
+				"Invalid content-type '"+ct+"', "+ApplicationMsgpack+" expected")
+			return
+		}
+		buf, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			ErrorString(*c, rw, 400, "Cannot read request body: "+err.Error())
+			return
+		}
+		var v interface{}
+		if len(buf) > 0 {
+			if v, err = UnmarshalMsgpack(buf); err != nil {
+				ErrorString(*c, rw, 400, "Cannot parse msgpack request body: "+err.Error())
+				return
+			}
+		}
+		c.Env["json"] = v
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// WriteMsgpack is the MessagePack flavor of WriteJSON, it encodes obj the way encoding/json
+// would, honoring json struct tags, and produces an internal error if obj can't be encoded
+func WriteMsgpack(c web.C, rw http.ResponseWriter, code int, obj interface{}) {
+	buf, err := MarshalMsgpack(obj)
+	if err != nil {
+		ErrorInternal(c, rw, err)
+		return
+	}
+	rw.Header().Set("Content-Type", ApplicationMsgpack)
+	rw.WriteHeader(code)
+	rw.Write(buf)
+}
+
+//===== encoding
+
+// MarshalMsgpack encodes v in MessagePack, structs are encoded as maps following the json
+// struct tags, time.Time as a timestamp extension
+func MarshalMsgpack(v interface{}) ([]byte, error) {
+	e := &msgpackEncoder{}
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+type msgpackEncoder struct {
+	buf []byte
+}
+
+var timeReflectType = reflect.TypeOf(time.Time{})
+
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf = append(e.buf, 0xc0)
+		return nil
+	}
+	if v.Type() == timeReflectType {
+		e.encodeTime(v.Interface().(time.Time))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		return e.encode(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, 0xc3)
+		} else {
+			e.buf = append(e.buf, 0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Uintptr:
+		e.encodeUint(v.Uint())
+	case reflect.Float32:
+		e.buf = append(e.buf, 0xca)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		e.buf = append(e.buf, 0xcb)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, math.Float64bits(v.Float()))
+	case reflect.String:
+		e.encodeString(v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			e.encodeHeader(len(b), 0, 0xc4, 0xc5, 0xc6)
+			e.buf = append(e.buf, b...)
+			return nil
+		}
+		e.encodeHeader(v.Len(), 0x90, 0, 0xdc, 0xdd)
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		keys := v.MapKeys()
+		if v.Type().Key().Kind() == reflect.String { // deterministic output like encoding/json
+			sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		}
+		e.encodeHeader(len(keys), 0x80, 0, 0xde, 0xdf)
+		for _, k := range keys {
+			if err := e.encode(k); err != nil {
+				return err
+			}
+			if err := e.encode(v.MapIndex(k)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		fields := jsonFields(v.Type())
+		var present []jsonField
+		for _, f := range fields {
+			fv, ok := fieldByIndex(v, f.index)
+			if ok && !(f.omitEmpty && fv.IsZero()) {
+				present = append(present, f)
+			}
+		}
+		e.encodeHeader(len(present), 0x80, 0, 0xde, 0xdf)
+		for _, f := range present {
+			fv, _ := fieldByIndex(v, f.index)
+			e.encodeString(f.name)
+			if err := e.encode(fv); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// encodeHeader writes the length header of a string, binary, array, or map: fix is the
+// fixed-size type (0 if none), b8/b16/b32 the types with 8, 16, and 32 bit lengths
+func (e *msgpackEncoder) encodeHeader(n int, fix, b8, b16, b32 byte) {
+	switch {
+	case fix != 0 && (n < 16 || (fix == 0xa0 && n < 32)):
+		e.buf = append(e.buf, fix|byte(n))
+	case b8 != 0 && n < 256:
+		e.buf = append(e.buf, b8, byte(n))
+	case n < 65536:
+		e.buf = append(e.buf, b16)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, b32)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	}
+}
+
+func (e *msgpackEncoder) encodeString(s string) {
+	e.encodeHeader(len(s), 0xa0, 0xd9, 0xda, 0xdb)
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) encodeInt(i int64) {
+	switch {
+	case i >= 0:
+		e.encodeUint(uint64(i))
+	case i >= -32:
+		e.buf = append(e.buf, byte(i))
+	case i >= math.MinInt8:
+		e.buf = append(e.buf, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		e.buf = append(e.buf, 0xd1)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(i))
+	case i >= math.MinInt32:
+		e.buf = append(e.buf, 0xd2)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(i))
+	default:
+		e.buf = append(e.buf, 0xd3)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(i))
+	}
+}
+
+func (e *msgpackEncoder) encodeUint(u uint64) {
+	switch {
+	case u < 128:
+		e.buf = append(e.buf, byte(u))
+	case u <= math.MaxUint8:
+		e.buf = append(e.buf, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		e.buf = append(e.buf, 0xcd)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(u))
+	case u <= math.MaxUint32:
+		e.buf = append(e.buf, 0xce)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(u))
+	default:
+		e.buf = append(e.buf, 0xcf)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, u)
+	}
+}
+
+// encodeTime writes the timestamp extension (type -1) in its 96-bit form
+func (e *msgpackEncoder) encodeTime(t time.Time) {
+	e.buf = append(e.buf, 0xc7, 12, 0xff)
+	e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(t.Nanosecond()))
+	e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(t.Unix()))
+}
+
+// jsonField is a struct field as seen by encoding/json
+type jsonField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var jsonFieldCache sync.Map // reflect.Type -> []jsonField
+
+// jsonFields lists the fields encoding/json would encode, embedded structs are flattened
+// (without encoding/json's handling of conflicting names)
+func jsonFields(t reflect.Type) []jsonField {
+	if f, ok := jsonFieldCache.Load(t); ok {
+		return f.([]jsonField)
+	}
+	var fields []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		if tag[0] == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && tag[0] == "" && ft.Kind() == reflect.Struct {
+			for _, ef := range jsonFields(ft) {
+				ef.index = append([]int{i}, ef.index...)
+				fields = append(fields, ef)
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		jf := jsonField{name: tag[0], index: []int{i}}
+		if jf.name == "" {
+			jf.name = f.Name
+		}
+		for _, o := range tag[1:] {
+			jf.omitEmpty = jf.omitEmpty || o == "omitempty"
+		}
+		fields = append(fields, jf)
+	}
+	jsonFieldCache.Store(t, fields)
+	return fields
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex but reports nil embedded pointers
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 {
+			if v.Kind() == reflect.Ptr {
+				if v.IsNil() {
+					return v, false
+				}
+				v = v.Elem()
+			}
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+//===== decoding
+
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+// UnmarshalMsgpack decodes a MessagePack value into generic Go values: nil, bool, int64,
+// uint64 (for values beyond int64), float64, string, []byte, time.Time, []interface{}, and
+// map[string]interface{} (non-string keys are formatted with fmt)
+func UnmarshalMsgpack(buf []byte) (interface{}, error) {
+	d := &msgpackDecoder{buf: buf}
+	v, err := d.decode(0)
+	if err == nil && d.pos != len(buf) {
+		err = fmt.Errorf("msgpack: unexpected data at offset %d", d.pos)
+	}
+	return v, err
+}
+
+type msgpackDecoder struct {
+	buf []byte
+	pos int
+}
+
+// maxMsgpackDepth bounds the nesting of decoded arrays and maps
+const maxMsgpackDepth = 100
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.buf)-d.pos < n {
+		return nil, errMsgpackShort
+	}
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// uint reads a big-endian unsigned integer of n bytes
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+func (d *msgpackDecoder) decode(depth int) (interface{}, error) {
+	if depth > maxMsgpackDepth {
+		return nil, errors.New("msgpack: nesting too deep")
+	}
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	t := b[0]
+	switch {
+	case t <= 0x7f:
+		return int64(t), nil
+	case t >= 0xe0:
+		return int64(int8(t)), nil
+	case t&0xe0 == 0xa0:
+		return d.str(int(t & 0x1f))
+	case t&0xf0 == 0x90:
+		return d.array(int(t&0x0f), depth)
+	case t&0xf0 == 0x80:
+		return d.dict(int(t&0x0f), depth)
+	}
+	switch t {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.uint(1 << (t - 0xcc))
+		if err != nil || u > math.MaxInt64 {
+			return u, err
+		}
+		return int64(u), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		n := 1 << (t - 0xd0)
+		u, err := d.uint(n)
+		shift := uint(64 - 8*n) // sign-extend
+		return int64(u<<shift) >> shift, err
+	case 0xca:
+		u, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := d.uint(8)
+		return math.Float64frombits(u), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (t - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (t - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.next(int(n))
+		return append([]byte(nil), b...), err
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (t - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(int(n), depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (t - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.dict(int(n), depth)
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.ext(1 << (t - 0xd4))
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.uint(1 << (t - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.ext(int(n))
+	}
+	return nil, fmt.Errorf("msgpack: invalid type byte 0x%x at offset %d", t, d.pos-1)
+}
+
+func (d *msgpackDecoder) str(n int) (interface{}, error) {
+	b, err := d.next(n)
+	return string(b), err
+}
+
+func (d *msgpackDecoder) array(n, depth int) (interface{}, error) {
+	if n > len(d.buf)-d.pos { // each element takes at least a byte
+		return nil, errMsgpackShort
+	}
+	a := make([]interface{}, n)
+	for i := range a {
+		var err error
+		if a[i], err = d.decode(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (d *msgpackDecoder) dict(n, depth int) (interface{}, error) {
+	if 2*n > len(d.buf)-d.pos {
+		return nil, errMsgpackShort
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := k.(string); ok {
+			m[s] = v
+		} else {
+			m[fmt.Sprint(k)] = v
+		}
+	}
+	return m, nil
+}
+
+// ext decodes an extension with n bytes of data, only timestamps are supported
+func (d *msgpackDecoder) ext(n int) (interface{}, error) {
+	b, err := d.next(1 + n)
+	if err != nil {
+		return nil, err
+	}
+	if int8(b[0]) != -1 {
+		return nil, fmt.Errorf("msgpack: unsupported extension type %d", int8(b[0]))
+	}
+	data := b[1:]
+	switch n {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(data)), 0), nil
+	case 8:
+		u := binary.BigEndian.Uint64(data)
+		return time.Unix(int64(u&(1<<34-1)), int64(u>>34)), nil
+	case 12:
+		return time.Unix(int64(binary.BigEndian.Uint64(data[4:])),
+			int64(binary.BigEndian.Uint32(data))), nil
+	}
+	return nil, fmt.Errorf("msgpack: invalid timestamp length %d", n)
+}
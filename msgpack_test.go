@@ -0,0 +1,80 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("Msgpack", func() {
+
+	type inner struct {
+		Tags []string `json:"tags"`
+	}
+	type doc struct {
+		inner
+		Name    string    `json:"name"`
+		Count   int       `json:"count"`
+		Neg     int64     `json:"neg"`
+		Ratio   float64   `json:"ratio"`
+		Skip    string    `json:"-"`
+		Empty   string    `json:"empty,omitempty"`
+		Blob    []byte    `json:"blob"`
+		When    time.Time `json:"when"`
+		Nothing *int      `json:"nothing"`
+	}
+
+	It("round-trips values", func() {
+		when := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+		buf, err := MarshalMsgpack(doc{inner: inner{[]string{"a"}}, Name: strings.Repeat("x", 40),
+			Count: 300, Neg: -70000, Ratio: 0.5, Skip: "s", Blob: []byte{1, 2}, When: when})
+		Ω(err).ShouldNot(HaveOccurred())
+		v, err := UnmarshalMsgpack(buf)
+		Ω(err).ShouldNot(HaveOccurred())
+		m := v.(map[string]interface{})
+		Ω(m).Should(HaveLen(8))
+		Ω(m["tags"]).Should(Equal([]interface{}{"a"}))
+		Ω(m["name"]).Should(HaveLen(40))
+		Ω(m["count"]).Should(Equal(int64(300)))
+		Ω(m["neg"]).Should(Equal(int64(-70000)))
+		Ω(m["ratio"]).Should(Equal(0.5))
+		Ω(m["blob"]).Should(Equal([]byte{1, 2}))
+		Ω(m["when"].(time.Time).Equal(when)).Should(BeTrue())
+		Ω(m["nothing"]).Should(BeNil())
+	})
+
+	It("rejects truncated data", func() {
+		buf, _ := MarshalMsgpack(map[string]interface{}{"a": []int{1, 2, 3}})
+		_, err := UnmarshalMsgpack(buf[:len(buf)-1])
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("parses bodies and writes responses", func() {
+		var env map[interface{}]interface{}
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(GetMsgpackBody)
+		mx.Post("/", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			env = c.Env
+			WriteMsgpack(c, rw, 201, c.Env["json"])
+		})
+		body, _ := MarshalMsgpack(map[string]int{"a": 1})
+		req, _ := http.NewRequest("POST", "/", bytes.NewReader(body))
+		req.Header.Set("Content-Type", ApplicationMsgpack)
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		Ω(resp.Code).Should(Equal(201))
+		Ω(env["json"]).Should(Equal(map[string]interface{}{"a": int64(1)}))
+		Ω(resp.Header().Get("Content-Type")).Should(Equal(ApplicationMsgpack))
+		Ω(resp.Body.Bytes()).Should(Equal(body))
+	})
+})
@@ -0,0 +1,171 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Accept header parsing and content negotiation
+
+package gojiutil
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+)
+
+// MediaRange is one element of an Accept header
+type MediaRange struct {
+	Type    string // e.g. "text" or "*"
+	Subtype string // e.g. "html" or "*"
+	Params  map[string]string
+	Q       float64
+}
+
+// String returns the media range without parameters, e.g. "text/*"
+func (m MediaRange) String() string {
+	return m.Type + "/" + m.Subtype
+}
+
+// specificity ranks */* < type/* < type/subtype < type/subtype;params
+func (m MediaRange) specificity() int {
+	switch {
+	case m.Type == "*":
+		return 0
+	case m.Subtype == "*":
+		return 1
+	}
+	return 2 + len(m.Params)
+}
+
+// Match reports whether the media range matches a media type such as "text/html"
+func (m MediaRange) Match(mediaType string) bool {
+	mt, params := parseMediaRange(mediaType)
+	if (m.Type != "*" && m.Type != mt.Type) || (m.Subtype != "*" && m.Subtype != mt.Subtype) {
+		return false
+	}
+	for k, v := range m.Params {
+		if params[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseAccept parses an Accept header into its media ranges, sorted by decreasing q-value and
+// then by decreasing specificity. Ranges with q=0 are kept since they explicitly refuse a type.
+// Malformed elements are skipped.
+func ParseAccept(header string) []MediaRange {
+	var ranges []MediaRange
+	for _, part := range strings.Split(header, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		m, _ := parseMediaRange(part)
+		if m.Type == "" || m.Subtype == "" || (m.Type == "*" && m.Subtype != "*") {
+			continue
+		}
+		ranges = append(ranges, m)
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		if ranges[i].Q != ranges[j].Q {
+			return ranges[i].Q > ranges[j].Q
+		}
+		return ranges[i].specificity() > ranges[j].specificity()
+	})
+	return ranges
+}
+
+// parseMediaRange parses "type/subtype;k=v;q=0.5", it also returns the parameters as a map
+// that is never nil
+func parseMediaRange(s string) (MediaRange, map[string]string) {
+	f := strings.Split(s, ";")
+	m := MediaRange{Q: 1}
+	if ts := strings.SplitN(strings.ToLower(strings.TrimSpace(f[0])), "/", 2); len(ts) == 2 {
+		m.Type, m.Subtype = strings.TrimSpace(ts[0]), strings.TrimSpace(ts[1])
+	}
+	params := map[string]string{}
+	for _, p := range f[1:] {
+		kv := strings.SplitN(p, "=", 2)
+		k := strings.ToLower(strings.TrimSpace(kv[0]))
+		v := ""
+		if len(kv) == 2 {
+			v = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+		}
+		if k == "q" {
+			if q, err := strconv.ParseFloat(v, 64); err == nil && q >= 0 && q <= 1 {
+				m.Q = q
+			}
+			break // the rest are accept-extensions
+		}
+		if k != "" {
+			params[k] = v
+		}
+	}
+	if len(params) > 0 {
+		m.Params = params
+	}
+	return m, params
+}
+
+// Negotiate picks the offered media type the client prefers according to its Accept header.
+// Each offer takes the q-value of the most specific range matching it, the highest q wins and
+// ties go to the earlier offer. An empty header accepts the first offer, and "" is returned
+// if nothing is acceptable (the caller would typically respond 406 Not Acceptable).
+func Negotiate(accept string, offered ...string) string {
+	if len(offered) == 0 {
+		return ""
+	}
+	if strings.TrimSpace(accept) == "" {
+		return offered[0]
+	}
+	ranges := ParseAccept(accept)
+	best, bestQ := "", 0.0
+	for _, o := range offered {
+		q, spec := 0.0, -1
+		for _, m := range ranges {
+			if s := m.specificity(); s > spec && m.Match(o) {
+				q, spec = m.Q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = o, q
+		}
+	}
+	return best
+}
+
+// NegotiateRequest is Negotiate applied to the request's Accept header
+func NegotiateRequest(r *http.Request, offered ...string) string {
+	return Negotiate(r.Header.Get("Accept"), offered...)
+}
+
+// ApplicationXML is the media type of XML bodies
+var ApplicationXML = "application/xml"
+
+// negotiatedTypes are the media types WriteNegotiated can render, in order of preference
+var negotiatedTypes = []string{ApplicationJSON, ApplicationXML, "text/xml", ApplicationMsgpack}
+
+// WriteNegotiated renders obj as JSON, XML, or MessagePack depending on the request's Accept
+// header, preferring JSON. Successful responses get a 406 Not Acceptable if the client accepts
+// none of these, error responses fall back to JSON since clients need to see the error.
+func WriteNegotiated(c web.C, rw http.ResponseWriter, r *http.Request, code int,
+	obj interface{}) {
+	AddVary(rw.Header(), "Accept")
+	mt := NegotiateRequest(r, negotiatedTypes...)
+	switch mt {
+	case ApplicationXML, "text/xml":
+		writeXML(c, rw, code, obj, mt)
+	case ApplicationMsgpack:
+		WriteMsgpack(c, rw, code, obj)
+	case "":
+		if code < 400 {
+			ErrorString(c, rw, http.StatusNotAcceptable,
+				"None of the acceptable media types can be produced, try: "+
+					strings.Join(negotiatedTypes, ", "))
+			return
+		}
+		fallthrough
+	default:
+		WriteJSON(c, rw, code, obj)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+)
+
+var _ = Describe("Negotiate", func() {
+
+	It("parses and orders Accept headers", func() {
+		ranges := ParseAccept("text/*;q=0.5, */*;q=0.1, application/json, text/html;level=1;q=0.5, bad")
+		var types []string
+		for _, m := range ranges {
+			types = append(types, m.String())
+		}
+		Ω(types).Should(Equal([]string{"application/json", "text/html", "text/*", "*/*"}))
+		Ω(ranges[1].Params).Should(Equal(map[string]string{"level": "1"}))
+	})
+
+	It("picks the preferred offer", func() {
+		Ω(Negotiate("", "application/json", "text/html")).Should(Equal("application/json"))
+		Ω(Negotiate("text/html, application/json;q=0.9", "application/json", "text/html")).
+			Should(Equal("text/html"))
+		Ω(Negotiate("text/*, text/csv;q=0", "text/csv", "text/plain")).Should(Equal("text/plain"))
+		Ω(Negotiate("image/png", "application/json")).Should(BeEmpty())
+	})
+})
+
+var _ = Describe("WriteNegotiated", func() {
+
+	type point struct {
+		X int `json:"x" xml:"x"`
+	}
+
+	write := func(accept string, code int) *httptest.ResponseRecorder {
+		c := web.C{Env: map[interface{}]interface{}{}}
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", accept)
+		rw := httptest.NewRecorder()
+		WriteNegotiated(c, rw, req, code, point{1})
+		return rw
+	}
+
+	It("renders the preferred media type", func() {
+		rw := write("application/xml, application/json;q=0.5", 200)
+		Ω(rw.Header().Get("Content-Type")).Should(HavePrefix(ApplicationXML))
+		Ω(rw.Body.String()).Should(Equal(xml.Header + "<point><x>1</x></point>"))
+		Ω(rw.Header().Get("Vary")).Should(Equal("Accept"))
+		rw = write("*/*", 200)
+		Ω(rw.Body.String()).Should(Equal(`{"x":1}`))
+		rw = write("application/msgpack", 200)
+		Ω(rw.Body.Bytes()).Should(Equal([]byte{0x81, 0xa1, 'x', 1}))
+	})
+
+	It("responds 406 unless producing an error", func() {
+		Ω(write("image/png", 200).Code).Should(Equal(406))
+		rw := write("image/png", 404)
+		Ω(rw.Code).Should(Equal(404))
+		Ω(rw.Body.String()).Should(Equal(`{"x":1}`))
+	})
+})
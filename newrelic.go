@@ -0,0 +1,75 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// New Relic transaction instrumentation
+
+package gojiutil
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+	"github.com/zenazn/goji/web/mutil"
+)
+
+// ContextNewRelic is the hash key in which the NewRelic middleware places the transaction
+var ContextNewRelic string = "newrelic"
+
+// NewRelicTxn is the subset of newrelic.Transaction (github.com/newrelic/go-agent) used by
+// the NewRelic middleware. The agent's transaction wraps the ResponseWriter to record the
+// response status. Declaring the subset here avoids a hard dependency on the agent.
+type NewRelicTxn interface {
+	http.ResponseWriter
+	End() error
+	NoticeError(err error) error
+	AddAttribute(key string, value interface{}) error
+}
+
+// NewRelicStarter starts a transaction, with the agent this is typically:
+//
+//	func(name string, rw http.ResponseWriter, r *http.Request) gojiutil.NewRelicTxn {
+//	        return app.StartTransaction(name, rw, r)
+//	}
+type NewRelicStarter func(name string, rw http.ResponseWriter, r *http.Request) NewRelicTxn
+
+// NewRelic creates a middleware that runs each request in a New Relic transaction named
+// after the matched route pattern (so use mx.Use(mx.Router) before it), or after the path if
+// no route has been matched yet. Errors recorded by ErrorString on 5xx responses, which
+// includes panics caught by Recoverer, are reported as noticed errors. The transaction is
+// available to handlers in c.Env[ContextNewRelic] to add attributes and segments.
+func NewRelic(start NewRelicStarter) web.MiddlewareType {
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			txn := start(r.Method+" "+routeName(*c, r), rw, r)
+			defer txn.End()
+			c.Env[ContextNewRelic] = txn
+			if id := middleware.GetReqID(*c); id != "" {
+				txn.AddAttribute("request_id", id)
+			}
+
+			defer func() {
+				// a panic that no Recoverer caught is noticed and propagated
+				if p := recover(); p != nil {
+					txn.NoticeError(fmt.Errorf("panic: %v", p))
+					panic(p)
+				}
+			}()
+			wp := mutil.WrapWriter(txn)
+			h.ServeHTTP(wp, r)
+
+			if wp.Status() >= 500 {
+				if e, ok := c.Env["err"].(string); ok {
+					txn.NoticeError(errors.New(e))
+				}
+			}
+		})
+	}
+}
+
+// GetNewRelicTxn returns the request's New Relic transaction or nil
+func GetNewRelicTxn(c web.C) NewRelicTxn {
+	txn, _ := c.Env[ContextNewRelic].(NewRelicTxn)
+	return txn
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+// fakeTxn records what the NewRelic middleware does with a transaction
+type fakeTxn struct {
+	http.ResponseWriter
+	name   string
+	ended  bool
+	errs   []string
+	attrs  map[string]interface{}
+	status int
+}
+
+func (t *fakeTxn) WriteHeader(code int) {
+	t.status = code
+	t.ResponseWriter.WriteHeader(code)
+}
+func (t *fakeTxn) End() error { t.ended = true; return nil }
+func (t *fakeTxn) NoticeError(err error) error {
+	t.errs = append(t.errs, err.Error())
+	return nil
+}
+func (t *fakeTxn) AddAttribute(key string, value interface{}) error {
+	t.attrs[key] = value
+	return nil
+}
+
+var _ = Describe("NewRelic", func() {
+
+	var txn *fakeTxn
+
+	serve := func(handler web.HandlerFunc) *httptest.ResponseRecorder {
+		txn = nil
+		start := func(name string, rw http.ResponseWriter, r *http.Request) NewRelicTxn {
+			txn = &fakeTxn{ResponseWriter: rw, name: name, attrs: map[string]interface{}{}}
+			return txn
+		}
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(middleware.RequestID)
+		mx.Use(mx.Router)
+		mx.Use(NewRelic(start))
+		mx.Get("/items/:id", handler)
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/items/42", nil)
+		mx.ServeHTTP(rw, req)
+		return rw
+	}
+
+	It("names the transaction after the route", func() {
+		rw := serve(func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			GetNewRelicTxn(c).AddAttribute("items", 1)
+			rw.WriteHeader(201)
+		})
+		Ω(rw.Code).Should(Equal(201))
+		Ω(txn.name).Should(Equal("GET /items/:id"))
+		Ω(txn.status).Should(Equal(201))
+		Ω(txn.ended).Should(BeTrue())
+		Ω(txn.errs).Should(BeEmpty())
+		Ω(txn.attrs).Should(HaveKey("request_id"))
+		Ω(txn.attrs).Should(HaveKeyWithValue("items", 1))
+	})
+
+	It("notices the error of 5xx responses", func() {
+		serve(func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			Errorf(c, rw, 500, "db down")
+		})
+		Ω(txn.errs).Should(Equal([]string{"db down"}))
+		Ω(txn.ended).Should(BeTrue())
+
+		serve(func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			Errorf(c, rw, 404, "not here")
+		})
+		Ω(txn.errs).Should(BeEmpty())
+	})
+
+	It("notices and re-raises panics", func() {
+		Ω(func() {
+			serve(func(c web.C, rw http.ResponseWriter, r *http.Request) {
+				panic("boom")
+			})
+		}).Should(PanicWith("boom"))
+		Ω(txn.errs).Should(Equal([]string{"panic: boom"}))
+		Ω(txn.ended).Should(BeTrue())
+	})
+})
@@ -0,0 +1,417 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// OpenAPI 3 specification generation from documented routes
+
+package gojiutil
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// Operation documents a route registered through an API. Query, Body, and Response are
+// sample values (typically zero structs) whose types describe the query parameters, the JSON
+// request body, and the JSON response body. Query parameters come from the fields tagged
+// `query:"name"` or `query:"name,required"`; body fields follow encoding/json's rules, fields
+// without omitempty that aren't pointers are required, and a `doc:"..."` tag describes them.
+type Operation struct {
+	ID          string // operationId, optional
+	Summary     string
+	Description string
+	Tags        []string
+	Query       interface{}
+	Body        interface{}
+	Response    interface{}
+	Status      int   // success status, default 200
+	Errors      []int // error statuses the handler produces, 400 is implied by Query or Body
+}
+
+// API registers routes on a goji mux while recording their documentation, goji itself
+// doesn't allow the registered routes to be listed. Only string patterns can be documented.
+type API struct {
+	Title   string
+	Version string
+	mx      *web.Mux
+	mu      sync.Mutex
+	routes  []apiRoute
+}
+
+type apiRoute struct {
+	method, pattern string
+	op              Operation
+}
+
+// NewAPI creates an API registering its routes on mx
+func NewAPI(mx *web.Mux, title, version string) *API {
+	return &API{Title: title, Version: version, mx: mx}
+}
+
+// Handle registers h for the method and pattern on the mux and documents it
+func (a *API) Handle(method, pattern string, h web.HandlerType, op Operation) {
+	switch method = strings.ToUpper(method); method {
+	case "GET":
+		a.mx.Get(pattern, h)
+	case "POST":
+		a.mx.Post(pattern, h)
+	case "PUT":
+		a.mx.Put(pattern, h)
+	case "PATCH":
+		a.mx.Patch(pattern, h)
+	case "DELETE":
+		a.mx.Delete(pattern, h)
+	case "HEAD":
+		a.mx.Head(pattern, h)
+	case "OPTIONS":
+		a.mx.Options(pattern, h)
+	default:
+		panic("gojiutil.API: unsupported method " + method)
+	}
+	a.mu.Lock()
+	a.routes = append(a.routes, apiRoute{method, pattern, op})
+	a.mu.Unlock()
+}
+
+// Get registers and documents a GET route
+func (a *API) Get(pattern string, h web.HandlerType, op Operation) {
+	a.Handle("GET", pattern, h, op)
+}
+
+// Post registers and documents a POST route
+func (a *API) Post(pattern string, h web.HandlerType, op Operation) {
+	a.Handle("POST", pattern, h, op)
+}
+
+// Put registers and documents a PUT route
+func (a *API) Put(pattern string, h web.HandlerType, op Operation) {
+	a.Handle("PUT", pattern, h, op)
+}
+
+// Patch registers and documents a PATCH route
+func (a *API) Patch(pattern string, h web.HandlerType, op Operation) {
+	a.Handle("PATCH", pattern, h, op)
+}
+
+// Delete registers and documents a DELETE route
+func (a *API) Delete(pattern string, h web.HandlerType, op Operation) {
+	a.Handle("DELETE", pattern, h, op)
+}
+
+// ServeSpec registers a handler serving the specification as JSON at path, typically
+// "/openapi.json"
+func (a *API) ServeSpec(path string) {
+	a.mx.Get(path, func(c web.C, rw http.ResponseWriter, r *http.Request) {
+		WriteJSON(c, rw, 200, a.Spec())
+	})
+}
+
+//===== OpenAPI document
+
+// OpenAPISpec is an OpenAPI 3 document, limited to what Spec produces
+type OpenAPISpec struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       OpenAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*OpenAPIOperation `json:"paths"`
+	Components OpenAPIComponents                       `json:"components"`
+}
+
+// OpenAPIInfo describes the API
+type OpenAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+// OpenAPIComponents holds the schemas of the named types, referenced by "$ref"
+type OpenAPIComponents struct {
+	Schemas map[string]*OpenAPISchema `json:"schemas,omitempty"`
+}
+
+// OpenAPIOperation describes an operation on a path
+type OpenAPIOperation struct {
+	OperationID string                     `json:"operationId,omitempty"`
+	Summary     string                     `json:"summary,omitempty"`
+	Description string                     `json:"description,omitempty"`
+	Tags        []string                   `json:"tags,omitempty"`
+	Parameters  []OpenAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *OpenAPIBody               `json:"requestBody,omitempty"`
+	Responses   map[string]OpenAPIResponse `json:"responses"`
+}
+
+// OpenAPIParameter describes a path or query parameter
+type OpenAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Required    bool           `json:"required,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Schema      *OpenAPISchema `json:"schema"`
+}
+
+// OpenAPIBody describes a request body
+type OpenAPIBody struct {
+	Required bool                    `json:"required"`
+	Content  map[string]OpenAPIMedia `json:"content"`
+}
+
+// OpenAPIResponse describes a response
+type OpenAPIResponse struct {
+	Description string                  `json:"description"`
+	Content     map[string]OpenAPIMedia `json:"content,omitempty"`
+}
+
+// OpenAPIMedia describes the content of a body
+type OpenAPIMedia struct {
+	Schema *OpenAPISchema `json:"schema"`
+}
+
+// OpenAPISchema is the subset of JSON schema used to describe Go types
+type OpenAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Description          string                    `json:"description,omitempty"`
+	Nullable             bool                      `json:"nullable,omitempty"`
+	Items                *OpenAPISchema            `json:"items,omitempty"`
+	Properties           map[string]*OpenAPISchema `json:"properties,omitempty"`
+	AdditionalProperties *OpenAPISchema            `json:"additionalProperties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+}
+
+// problemSchema describes the RFC 7807 problem details produced with ProblemErrors
+var problemSchema = &OpenAPISchema{Type: "object", Required: []string{"type", "title", "status"},
+	Properties: map[string]*OpenAPISchema{
+		"type":       {Type: "string", Format: "uri"},
+		"title":      {Type: "string"},
+		"status":     {Type: "integer", Format: "int32"},
+		"detail":     {Type: "string"},
+		"instance":   {Type: "string", Format: "uri"},
+		"code":       {Type: "string", Description: "APIError code"},
+		"request_id": {Type: "string"},
+	},
+	AdditionalProperties: &OpenAPISchema{}}
+
+// errorMedia describes the error responses produced by ErrorString and friends in the format
+// they're configured to use, there's no content for ErrorRenderer as it's up to it
+func errorMedia(schemas *schemaSet) map[string]OpenAPIMedia {
+	switch {
+	case ErrorRenderer != nil:
+		return nil
+	case ProblemErrors:
+		return map[string]OpenAPIMedia{ApplicationProblemJSON: {problemSchema}}
+	case JSONErrors:
+		return map[string]OpenAPIMedia{
+			ApplicationJSON: {schemaOf(reflect.TypeOf(ErrorBody{}), schemas)}}
+	}
+	return map[string]OpenAPIMedia{
+		"text/plain": {&OpenAPISchema{Type: "string", Description: "error message"}}}
+}
+
+// schemaSet holds the component schemas of the named struct types and the names given to
+// them. Types are named after their Go name, qualified by their package path if the name is
+// already taken by another type.
+type schemaSet struct {
+	byName map[string]*OpenAPISchema
+	names  map[reflect.Type]string
+}
+
+// invalidSchemaChars matches the characters not allowed in component names
+var invalidSchemaChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// name returns the component name of t and whether it's new
+func (ss *schemaSet) name(t reflect.Type) (string, bool) {
+	if name, ok := ss.names[t]; ok {
+		return name, false
+	}
+	name := invalidSchemaChars.ReplaceAllString(t.Name(), "_")
+	if _, taken := ss.byName[name]; taken {
+		name = invalidSchemaChars.ReplaceAllString(
+			strings.Replace(t.PkgPath(), "/", ".", -1)+"."+t.Name(), "_")
+		// types declared in functions share the package path
+		for i, base := 2, name; ; i++ {
+			if _, taken := ss.byName[name]; !taken {
+				break
+			}
+			name = base + "_" + strconv.Itoa(i)
+		}
+	}
+	ss.names[t] = name
+	ss.byName[name] = &OpenAPISchema{} // placeholder for recursive types
+	return name, true
+}
+
+// pathParam matches the named parameters of goji string patterns
+var pathParam = regexp.MustCompile(`:([^/]+)`)
+
+// Spec generates the OpenAPI document of the routes registered so far, the error responses
+// are described in the format selected by ErrorRenderer, ProblemErrors, or JSONErrors
+func (a *API) Spec() *OpenAPISpec {
+	spec := &OpenAPISpec{OpenAPI: "3.0.3", Info: OpenAPIInfo{a.Title, a.Version},
+		Paths: map[string]map[string]*OpenAPIOperation{}}
+	schemas := &schemaSet{byName: map[string]*OpenAPISchema{}, names: map[reflect.Type]string{}}
+	var errMedia map[string]OpenAPIMedia
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, rt := range a.routes {
+		path := strings.TrimSuffix(strings.TrimSuffix(rt.pattern, "*"), "/")
+		if path == "" {
+			path = "/"
+		}
+		path = pathParam.ReplaceAllString(path, "{$1}")
+		op := &OpenAPIOperation{OperationID: rt.op.ID, Summary: rt.op.Summary,
+			Description: rt.op.Description, Tags: rt.op.Tags,
+			Responses: map[string]OpenAPIResponse{}}
+		for _, m := range pathParam.FindAllStringSubmatch(rt.pattern, -1) {
+			op.Parameters = append(op.Parameters, OpenAPIParameter{Name: m[1], In: "path",
+				Required: true, Schema: &OpenAPISchema{Type: "string"}})
+		}
+		errors := rt.op.Errors
+		if rt.op.Query != nil {
+			op.Parameters = append(op.Parameters, queryParams(rt.op.Query, schemas)...)
+			errors = append([]int{400}, errors...)
+		}
+		if rt.op.Body != nil {
+			op.RequestBody = &OpenAPIBody{Required: true, Content: map[string]OpenAPIMedia{
+				ApplicationJSON: {schemaOf(reflect.TypeOf(rt.op.Body), schemas)}}}
+			errors = append([]int{400}, errors...)
+		}
+		status := rt.op.Status
+		if status == 0 {
+			status = 200
+		}
+		resp := OpenAPIResponse{Description: http.StatusText(status)}
+		if rt.op.Response != nil {
+			resp.Content = map[string]OpenAPIMedia{
+				ApplicationJSON: {schemaOf(reflect.TypeOf(rt.op.Response), schemas)}}
+		}
+		op.Responses[strconv.Itoa(status)] = resp
+		if len(errors) > 0 && errMedia == nil {
+			errMedia = errorMedia(schemas)
+		}
+		for _, code := range errors {
+			op.Responses[strconv.Itoa(code)] = OpenAPIResponse{
+				Description: http.StatusText(code), Content: errMedia}
+		}
+		if spec.Paths[path] == nil {
+			spec.Paths[path] = map[string]*OpenAPIOperation{}
+		}
+		spec.Paths[path][strings.ToLower(rt.method)] = op
+	}
+	if len(schemas.byName) > 0 {
+		spec.Components.Schemas = schemas.byName
+	}
+	return spec
+}
+
+// queryParams describes the fields of a struct tagged with `query:"name[,required]"`
+func queryParams(v interface{}, schemas *schemaSet) []OpenAPIParameter {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	var params []OpenAPIParameter
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("query"), ",")
+		if tag[0] == "" || tag[0] == "-" {
+			continue
+		}
+		params = append(params, OpenAPIParameter{Name: tag[0], In: "query",
+			Required:    len(tag) > 1 && tag[1] == "required",
+			Description: f.Tag.Get("doc"), Schema: schemaOf(f.Type, schemas)})
+	}
+	return params
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf describes a Go type as it's marshaled by encoding/json, named struct types are
+// placed into schemas and referenced
+func schemaOf(t reflect.Type, schemas *schemaSet) *OpenAPISchema {
+	if t.Kind() == reflect.Ptr {
+		s := *schemaOf(t.Elem(), schemas)
+		if s.Ref == "" {
+			s.Nullable = true
+		}
+		return &s
+	}
+	switch {
+	case t == timeType:
+		return &OpenAPISchema{Type: "string", Format: "date-time"}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return &OpenAPISchema{Type: "string", Format: "byte"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &OpenAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8,
+		reflect.Uint16, reflect.Uint32:
+		return &OpenAPISchema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &OpenAPISchema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &OpenAPISchema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &OpenAPISchema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &OpenAPISchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &OpenAPISchema{Type: "array", Items: schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return &OpenAPISchema{Type: "object", AdditionalProperties: schemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, schemas)
+		}
+		name, isNew := schemas.name(t)
+		if isNew {
+			*schemas.byName[name] = *structSchema(t, schemas)
+		}
+		return &OpenAPISchema{Ref: "#/components/schemas/" + name}
+	}
+	return &OpenAPISchema{} // any value
+}
+
+// structSchema describes the fields of a struct, embedded structs are flattened
+func structSchema(t reflect.Type, schemas *schemaSet) *OpenAPISchema {
+	s := &OpenAPISchema{Type: "object", Properties: map[string]*OpenAPISchema{}}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		if tag[0] == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			continue
+		}
+		if f.Anonymous && tag[0] == "" && f.Type.Kind() == reflect.Struct {
+			e := structSchema(f.Type, schemas)
+			for name, p := range e.Properties {
+				s.Properties[name] = p
+			}
+			s.Required = append(s.Required, e.Required...)
+			continue
+		}
+		name := tag[0]
+		if name == "" {
+			name = f.Name
+		}
+		p := schemaOf(f.Type, schemas)
+		if doc := f.Tag.Get("doc"); doc != "" && p.Ref == "" { // $ref siblings are ignored
+			p.Description = doc
+		}
+		s.Properties[name] = p
+		omit := false
+		for _, o := range tag[1:] {
+			omit = omit || o == "omitempty"
+		}
+		if !omit && f.Type.Kind() != reflect.Ptr {
+			s.Required = append(s.Required, name)
+		}
+	}
+	return s
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"encoding/json"
+	"image/gif"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+)
+
+type apiUser struct {
+	ID       int64     `json:"id"`
+	Name     string    `json:"name" doc:"full name"`
+	Email    *string   `json:"email,omitempty"`
+	Created  time.Time `json:"created"`
+	Manager  *apiUser  `json:"manager,omitempty"`
+	internal int
+}
+
+type apiUserQuery struct {
+	Fields string `query:"fields" doc:"comma-separated fields"`
+	Limit  int    `query:"limit,required"`
+}
+
+var _ = Describe("API", func() {
+
+	It("serves an OpenAPI document of the documented routes", func() {
+		mx := web.New()
+		api := NewAPI(mx, "users", "1.0")
+		h := func(rw http.ResponseWriter, r *http.Request) {}
+		api.Get("/users/:id", h, Operation{Summary: "Show user", Query: apiUserQuery{},
+			Response: apiUser{}, Errors: []int{404}})
+		api.Post("/users", h, Operation{Body: apiUser{}, Response: apiUser{}, Status: 201})
+		api.ServeSpec("/openapi.json")
+
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/openapi.json", nil)
+		mx.ServeHTTP(rr, req)
+		Ω(rr.Code).Should(Equal(200))
+		var spec OpenAPISpec
+		Ω(json.Unmarshal(rr.Body.Bytes(), &spec)).Should(Succeed())
+
+		get := spec.Paths["/users/{id}"]["get"]
+		Ω(get).ShouldNot(BeNil())
+		Ω(get.Summary).Should(Equal("Show user"))
+		Ω(get.Parameters).Should(HaveLen(3))
+		Ω(get.Parameters[0]).Should(Equal(OpenAPIParameter{Name: "id", In: "path",
+			Required: true, Schema: &OpenAPISchema{Type: "string"}}))
+		Ω(get.Parameters[2].Name).Should(Equal("limit"))
+		Ω(get.Parameters[2].Required).Should(BeTrue())
+		Ω(get.Responses).Should(HaveKey("200"))
+		Ω(get.Responses).Should(HaveKey("400"))
+		Ω(get.Responses).Should(HaveKey("404"))
+		Ω(get.Responses["200"].Content[ApplicationJSON].Schema.Ref).
+			Should(Equal("#/components/schemas/apiUser"))
+
+		post := spec.Paths["/users"]["post"]
+		Ω(post.RequestBody.Required).Should(BeTrue())
+		Ω(post.Responses).Should(HaveKey("201"))
+
+		user := spec.Components.Schemas["apiUser"]
+		Ω(user.Properties).Should(HaveLen(5))
+		Ω(user.Properties["name"].Description).Should(Equal("full name"))
+		Ω(user.Properties["created"].Format).Should(Equal("date-time"))
+		Ω(user.Properties["email"].Nullable).Should(BeTrue())
+		Ω(user.Properties["manager"].Ref).Should(Equal("#/components/schemas/apiUser"))
+		Ω(user.Required).Should(Equal([]string{"id", "name", "created"}))
+		Ω(get.Responses["404"].Content).Should(HaveKey("text/plain"))
+	})
+
+	It("names the schemas of types sharing a name apart", func() {
+		type apiUser struct {
+			Login string `json:"login"`
+		}
+		api := NewAPI(web.New(), "users", "1.0")
+		h := func(rw http.ResponseWriter, r *http.Request) {}
+		api.Get("/a", h, Operation{Response: apiUser{}})
+		api.Get("/b", h, Operation{Response: jpeg.Options{}})
+		api.Get("/c", h, Operation{Response: gif.Options{}})
+		api.Get("/d", h, Operation{Response: apiUser{}})
+		spec := api.Spec()
+
+		Ω(spec.Components.Schemas).Should(HaveLen(3))
+		ref := func(path string) string {
+			return spec.Paths[path]["get"].Responses["200"].Content[ApplicationJSON].Schema.Ref
+		}
+		Ω(ref("/a")).Should(Equal("#/components/schemas/apiUser"))
+		Ω(ref("/b")).Should(Equal("#/components/schemas/Options"))
+		Ω(ref("/c")).Should(Equal("#/components/schemas/image.gif.Options"))
+		Ω(ref("/d")).Should(Equal("#/components/schemas/apiUser"))
+		Ω(spec.Components.Schemas["Options"].Properties).Should(HaveKey("Quality"))
+		Ω(spec.Components.Schemas["image.gif.Options"].Properties).Should(HaveKey("NumColors"))
+
+		api.Get("/e", h, Operation{Response: apiUserOutside()})
+		Ω(api.Spec().Paths["/e"]["get"].Responses["200"].Content[ApplicationJSON].Schema.Ref).
+			Should(Equal("#/components/schemas/github.com.rightscale.gojiutil.apiUser"))
+	})
+
+	It("describes errors in the configured format", func() {
+		api := NewAPI(web.New(), "users", "1.0")
+		h := func(rw http.ResponseWriter, r *http.Request) {}
+		api.Get("/users/:id", h, Operation{Response: apiUser{}, Errors: []int{404}})
+		content := func() map[string]OpenAPIMedia {
+			return api.Spec().Paths["/users/{id}"]["get"].Responses["404"].Content
+		}
+
+		JSONErrors = true
+		defer func() { JSONErrors = false }()
+		Ω(content()).Should(HaveKey(ApplicationJSON))
+		Ω(content()[ApplicationJSON].Schema.Ref).Should(Equal("#/components/schemas/ErrorBody"))
+		Ω(api.Spec().Components.Schemas["ErrorBody"].Required).
+			Should(Equal([]string{"code", "message"}))
+
+		ProblemErrors = true
+		defer func() { ProblemErrors = false }()
+		Ω(content()).Should(HaveKey(ApplicationProblemJSON))
+
+		ErrorRenderer = func(c web.C, rw http.ResponseWriter, code int, msg string) {}
+		defer func() { ErrorRenderer = nil }()
+		Ω(content()).Should(BeEmpty())
+	})
+})
+
+// apiUserOutside returns a value of a type named like apiUser declared in a function
+func apiUserOutside() interface{} {
+	type apiUser struct {
+		Nick string `json:"nick"`
+	}
+	return apiUser{}
+}
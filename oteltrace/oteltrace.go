@@ -0,0 +1,106 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Package oteltrace adapts OpenTelemetry to gojiutil.Tracer and gojiutil.Span. It is separate
+// from gojiutil so only applications tracing through OpenTelemetry depend on its SDK.
+package oteltrace
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/rightscale/gojiutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer adapts an OpenTelemetry tracer to gojiutil.Tracer. Trace context is extracted from
+// and injected into headers with prop, or with the global propagator if prop is nil. Spans
+// continuing a carrier, as started by gojiutil.Trace, are server spans, the others, as
+// started by gojiutil.Proxy, are client spans: OpenTelemetry fixes the kind at the start so
+// the "span.kind" tag is ignored.
+func Tracer(t trace.Tracer, prop propagation.TextMapPropagator) gojiutil.Tracer {
+	return tracer{t, prop}
+}
+
+type tracer struct {
+	t    trace.Tracer
+	prop propagation.TextMapPropagator
+}
+
+func (t tracer) propagator() propagation.TextMapPropagator {
+	if t.prop != nil {
+		return t.prop
+	}
+	return otel.GetTextMapPropagator()
+}
+
+func (t tracer) StartSpan(name string, parent gojiutil.Span, carrier http.Header) gojiutil.Span {
+	ctx := context.Background()
+	kind := trace.SpanKindClient
+	if p, ok := parent.(*span); ok {
+		ctx = trace.ContextWithSpan(ctx, p.s)
+	} else if carrier != nil {
+		ctx = t.propagator().Extract(ctx, propagation.HeaderCarrier(carrier))
+		kind = trace.SpanKindServer
+	}
+	ctx, s := t.t.Start(ctx, name, trace.WithSpanKind(kind))
+	return &span{s: s, ctx: ctx, prop: t.propagator()}
+}
+
+// span is the gojiutil.Span produced by Tracer
+type span struct {
+	s    trace.Span
+	ctx  context.Context
+	prop propagation.TextMapPropagator
+}
+
+func (s *span) SetTag(key string, value interface{}) {
+	if key == "span.kind" {
+		return
+	}
+	s.s.SetAttributes(attr(key, value))
+}
+
+func (s *span) Inject(h http.Header) {
+	s.prop.Inject(s.ctx, propagation.HeaderCarrier(h))
+}
+
+func (s *span) Finish(err error) {
+	if err != nil {
+		s.s.RecordError(err)
+		s.s.SetStatus(codes.Error, err.Error())
+	}
+	s.s.End()
+}
+
+// attr converts a tag to an attribute, values of other types than the attribute ones are
+// formatted with fmt
+func attr(key string, value interface{}) attribute.KeyValue {
+	switch v := value.(type) {
+	case string:
+		return attribute.String(key, v)
+	case bool:
+		return attribute.Bool(key, v)
+	case int:
+		return attribute.Int(key, v)
+	case int64:
+		return attribute.Int64(key, v)
+	case float64:
+		return attribute.Float64(key, v)
+	}
+	return attribute.String(key, fmt.Sprint(value))
+}
+
+// ContextWithSpan returns a copy of ctx carrying the OpenTelemetry span behind s, e.g. the
+// request's span from gojiutil.GetSpan, so instrumented libraries create child spans. It
+// returns ctx as-is if s wasn't produced by Tracer.
+func ContextWithSpan(ctx context.Context, s gojiutil.Span) context.Context {
+	if sp, ok := s.(*span); ok {
+		return trace.ContextWithSpan(ctx, sp.s)
+	}
+	return ctx
+}
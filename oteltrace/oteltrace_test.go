@@ -0,0 +1,87 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package oteltrace
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rightscale/gojiutil"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var _ = Describe("Tracer", func() {
+
+	const incoming = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+	var rec *tracetest.SpanRecorder
+	var tracer gojiutil.Tracer
+
+	BeforeEach(func() {
+		rec = tracetest.NewSpanRecorder()
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+		tracer = Tracer(tp.Tracer("test"), propagation.TraceContext{})
+	})
+
+	serve := func(handler web.HandlerFunc) {
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(mx.Router)
+		mx.Use(gojiutil.Trace(tracer))
+		mx.Get("/items/:id", handler)
+		req, _ := http.NewRequest("GET", "/items/42", nil)
+		req.Header.Set("Traceparent", incoming)
+		mx.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	It("continues the incoming trace and propagates it downstream", func() {
+		downstream := http.Header{}
+		var ctx context.Context
+		serve(func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			child := tracer.StartSpan("proxy upstream", gojiutil.GetSpan(c), nil)
+			child.Inject(downstream)
+			child.Finish(nil)
+			ctx = ContextWithSpan(context.Background(), gojiutil.GetSpan(c))
+			rw.WriteHeader(204)
+		})
+
+		spans := rec.Ended()
+		Ω(spans).Should(HaveLen(2))
+		child, server := spans[0], spans[1]
+		Ω(server.Name()).Should(Equal("GET /items/:id"))
+		Ω(server.SpanKind()).Should(Equal(trace.SpanKindServer))
+		Ω(server.SpanContext().TraceID().String()).Should(Equal("0af7651916cd43dd8448eb211c80319c"))
+		Ω(server.Parent().SpanID().String()).Should(Equal("b7ad6b7169203331"))
+		Ω(server.Attributes()).Should(ContainElement(attribute.String("http.method", "GET")))
+		Ω(server.Attributes()).Should(ContainElement(attribute.String("http.status_code", "204")))
+		Ω(server.Status().Code).Should(Equal(codes.Unset))
+
+		Ω(child.SpanKind()).Should(Equal(trace.SpanKindClient))
+		Ω(child.Parent().SpanID()).Should(Equal(server.SpanContext().SpanID()))
+		Ω(downstream.Get("Traceparent")).Should(Equal("00-0af7651916cd43dd8448eb211c80319c-" +
+			child.SpanContext().SpanID().String() + "-01"))
+
+		Ω(trace.SpanContextFromContext(ctx)).Should(Equal(server.SpanContext()))
+	})
+
+	It("records the error of 5xx responses", func() {
+		serve(func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			gojiutil.Errorf(c, rw, 503, "db down")
+		})
+		spans := rec.Ended()
+		Ω(spans).Should(HaveLen(1))
+		Ω(spans[0].Status().Code).Should(Equal(codes.Error))
+		Ω(spans[0].Status().Description).Should(Equal("db down"))
+		Ω(spans[0].Events()).Should(HaveLen(1))
+	})
+})
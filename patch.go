@@ -0,0 +1,501 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// JSON Patch (RFC 6902) and JSON Merge Patch (RFC 7386) support for PATCH endpoints
+
+package gojiutil
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Patch media types
+const (
+	JSONPatchType  = "application/json-patch+json"
+	MergePatchType = "application/merge-patch+json"
+)
+
+// Patch is a parsed JSON Patch or Merge Patch document that can be applied to a generic JSON
+// value (as produced by json.Unmarshal into an interface{})
+type Patch interface {
+	Apply(doc interface{}) (interface{}, error)
+}
+
+// PatchError reports a patch that is malformed (400), that conflicts with the current state
+// of the resource (409), or that cannot be applied to it (422). It implements StatusCoder so
+// it can be rendered with WriteError.
+type PatchError struct {
+	Status int
+	Msg    string
+}
+
+func (e *PatchError) Error() string   { return e.Msg }
+func (e *PatchError) StatusCode() int { return e.Status }
+
+func patchErrorf(status int, format string, args ...interface{}) *PatchError {
+	return &PatchError{Status: status, Msg: fmt.Sprintf(format, args...)}
+}
+
+// ParsePatch reads a PATCH request body according to its content type, which must be
+// application/json-patch+json or application/merge-patch+json (else a 415 PatchError results)
+func ParsePatch(r *http.Request) (Patch, error) {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		mt = ""
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	switch mt {
+	case JSONPatchType:
+		var p JSONPatch
+		if err := dec.Decode(&p); err != nil {
+			return nil, patchErrorf(400, "Cannot parse JSON patch: %s", err)
+		}
+		for i, op := range p {
+			if err := op.validate(); err != nil {
+				return nil, patchErrorf(400, "Invalid JSON patch operation %d: %s", i, err)
+			}
+		}
+		return p, nil
+	case MergePatchType:
+		var p MergePatch
+		if err := dec.Decode(&p.Doc); err != nil {
+			return nil, patchErrorf(400, "Cannot parse merge patch: %s", err)
+		}
+		return p, nil
+	}
+	return nil, patchErrorf(http.StatusUnsupportedMediaType,
+		"Unsupported patch content-type '%s', %s or %s expected",
+		r.Header.Get("Content-Type"), JSONPatchType, MergePatchType)
+}
+
+// ApplyPatchTo applies the patch to a Go value v (a pointer, typically to a struct) by
+// round-tripping it through its JSON representation. Fields that don't take part in the JSON
+// representation, i.e. unexported fields and those tagged json:"-", keep their value while
+// fields removed by the patch are zeroed.
+func ApplyPatchTo(p Patch, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return err
+	}
+	if doc, err = p.Apply(doc); err != nil {
+		return err
+	}
+	if buf, err = json.Marshal(doc); err != nil {
+		return err
+	}
+	// decode into a fresh value so removed fields end up zeroed, then carry the fields JSON
+	// doesn't see over from the existing value
+	rv := reflect.ValueOf(v).Elem()
+	fresh := reflect.New(rv.Type())
+	if err := json.Unmarshal(buf, fresh.Interface()); err != nil {
+		return patchErrorf(422, "Patched document is invalid: %s", err)
+	}
+	patched := reflect.New(rv.Type()).Elem()
+	patched.Set(rv)
+	overlayJSON(patched, fresh.Elem())
+	rv.Set(patched)
+	return nil
+}
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// overlayJSON sets what takes part in the JSON representation of dst to the value in src,
+// recursing into structs so their unexported and json:"-" fields are left as they are
+func overlayJSON(dst, src reflect.Value) {
+	pt := reflect.PtrTo(dst.Type())
+	if dst.Kind() != reflect.Struct || pt.Implements(jsonUnmarshalerType) ||
+		pt.Implements(textUnmarshalerType) {
+		dst.Set(src) // opaque to JSON, e.g. time.Time
+		return
+	}
+	t := dst.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		promoted := f.Anonymous && strings.Split(tag, ",")[0] == ""
+		if tag == "-" || (!f.IsExported() && !promoted) {
+			continue
+		}
+		df, sf := dst.Field(i), src.Field(i)
+		switch {
+		case f.Type.Kind() == reflect.Struct:
+			overlayJSON(df, sf)
+		case f.Type.Kind() == reflect.Ptr && f.Type.Elem().Kind() == reflect.Struct:
+			overlayJSONPtr(df, sf)
+		case df.CanSet():
+			df.Set(sf)
+		}
+	}
+}
+
+// overlayJSONPtr is overlayJSON for pointers to structs, it doesn't modify what dst points to
+func overlayJSONPtr(dst, src reflect.Value) {
+	switch {
+	case !dst.CanSet():
+		// unexported embedded pointer, JSON can only have filled in what it points to
+		if !dst.IsNil() && !src.IsNil() {
+			overlayJSON(dst.Elem(), src.Elem())
+		}
+	case dst.IsNil() || src.IsNil():
+		dst.Set(src)
+	default:
+		p := reflect.New(dst.Type().Elem())
+		p.Elem().Set(dst.Elem())
+		overlayJSON(p.Elem(), src.Elem())
+		dst.Set(p)
+	}
+}
+
+//===== Merge Patch
+
+// MergePatch is an RFC 7386 merge patch
+type MergePatch struct {
+	Doc interface{}
+}
+
+// Apply implements Patch
+func (p MergePatch) Apply(doc interface{}) (interface{}, error) {
+	return mergePatch(doc, p.Doc), nil
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	pm, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	tm, ok := target.(map[string]interface{})
+	if !ok {
+		tm = make(map[string]interface{})
+	} else {
+		tm = copyMap(tm)
+	}
+	for k, v := range pm {
+		if v == nil {
+			delete(tm, k)
+		} else {
+			tm[k] = mergePatch(tm[k], v)
+		}
+	}
+	return tm
+}
+
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	m2 := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		m2[k] = v
+	}
+	return m2
+}
+
+//===== JSON Patch
+
+// PatchOp is a single RFC 6902 operation
+type PatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// JSONPatch is an RFC 6902 JSON patch, a sequence of operations applied atomically
+type JSONPatch []PatchOp
+
+func (op PatchOp) validate() error {
+	switch op.Op {
+	case "add", "replace", "test":
+		if len(op.Value) == 0 {
+			return fmt.Errorf("'%s' requires a value", op.Op)
+		}
+	case "remove":
+	case "move", "copy":
+		if _, err := parsePointer(op.From); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown op '%s'", op.Op)
+	}
+	_, err := parsePointer(op.Path)
+	return err
+}
+
+// Apply implements Patch, doc is not modified
+func (p JSONPatch) Apply(doc interface{}) (interface{}, error) {
+	doc = deepCopy(doc)
+	var err error
+	for i, op := range p {
+		path, _ := parsePointer(op.Path)
+		var value interface{}
+		if len(op.Value) > 0 {
+			dec := json.NewDecoder(bytes.NewReader(op.Value))
+			dec.UseNumber()
+			dec.Decode(&value)
+		}
+		switch op.Op {
+		case "add":
+			doc, err = ptrAdd(doc, path, value)
+		case "remove":
+			doc, _, err = ptrRemove(doc, path)
+		case "replace":
+			if doc, _, err = ptrRemove(doc, path); err == nil {
+				doc, err = ptrAdd(doc, path, value)
+			}
+		case "move":
+			from, _ := parsePointer(op.From)
+			if isPrefix(from, path) && len(from) < len(path) {
+				err = fmt.Errorf("cannot move '%s' into itself", op.From)
+				break
+			}
+			var v interface{}
+			if doc, v, err = ptrRemove(doc, from); err == nil {
+				doc, err = ptrAdd(doc, path, v)
+			}
+		case "copy":
+			from, _ := parsePointer(op.From)
+			var v interface{}
+			if v, err = ptrGet(doc, from); err == nil {
+				doc, err = ptrAdd(doc, path, deepCopy(v))
+			}
+		case "test":
+			var v interface{}
+			if v, err = ptrGet(doc, path); err == nil && !jsonEqual(v, value) {
+				return nil, patchErrorf(http.StatusConflict,
+					"JSON patch test failed at operation %d: '%s'", i, op.Path)
+			}
+		default:
+			err = fmt.Errorf("unknown op '%s'", op.Op)
+		}
+		if err != nil {
+			return nil, patchErrorf(422, "Cannot apply JSON patch operation %d: %s", i, err)
+		}
+	}
+	return doc, nil
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into unescaped reference tokens
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return []string{}, nil
+	}
+	if p[0] != '/' {
+		return nil, fmt.Errorf("invalid JSON pointer '%s'", p)
+	}
+	toks := strings.Split(p[1:], "/")
+	for i, t := range toks {
+		toks[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return toks, nil
+}
+
+func isPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// arrayIndex parses an array index token, allowing "-" (one past the end) if allowEnd
+func arrayIndex(tok string, length int, allowEnd bool) (int, error) {
+	if allowEnd && tok == "-" {
+		return length, nil
+	}
+	i, err := strconv.Atoi(tok)
+	if err != nil || i < 0 || (tok != "0" && tok[0] == '0') {
+		return 0, fmt.Errorf("invalid array index '%s'", tok)
+	}
+	max := length - 1
+	if allowEnd {
+		max = length
+	}
+	if i > max {
+		return 0, fmt.Errorf("array index %d out of bounds", i)
+	}
+	return i, nil
+}
+
+func ptrGet(doc interface{}, path []string) (interface{}, error) {
+	for _, tok := range path {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			v, ok := d[tok]
+			if !ok {
+				return nil, fmt.Errorf("path '%s' not found", tok)
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(tok, len(d), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[i]
+		default:
+			return nil, fmt.Errorf("path '%s' not found", tok)
+		}
+	}
+	return doc, nil
+}
+
+// ptrAdd adds val at path and returns the new document (arrays may be reallocated)
+func ptrAdd(doc interface{}, path []string, val interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return val, nil
+	}
+	parent, err := ptrGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		p[last] = val
+		return doc, nil
+	case []interface{}:
+		i, err := arrayIndex(last, len(p), true)
+		if err != nil {
+			return nil, err
+		}
+		p = append(p, nil)
+		copy(p[i+1:], p[i:])
+		p[i] = val
+		return ptrSet(doc, path[:len(path)-1], p)
+	}
+	return nil, fmt.Errorf("cannot add to a scalar at '%s'", last)
+}
+
+// ptrRemove removes the value at path and returns the new document and the removed value
+func ptrRemove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+	parent, err := ptrGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	last := path[len(path)-1]
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		v, ok := p[last]
+		if !ok {
+			return nil, nil, fmt.Errorf("path '%s' not found", last)
+		}
+		delete(p, last)
+		return doc, v, nil
+	case []interface{}:
+		i, err := arrayIndex(last, len(p), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		v := p[i]
+		p = append(p[:i:i], p[i+1:]...)
+		doc, err = ptrSet(doc, path[:len(path)-1], p)
+		return doc, v, err
+	}
+	return nil, nil, fmt.Errorf("path '%s' not found", last)
+}
+
+// ptrSet replaces the value at an existing path
+func ptrSet(doc interface{}, path []string, val interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return val, nil
+	}
+	parent, err := ptrGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		p[last] = val
+	case []interface{}:
+		i, err := arrayIndex(last, len(p), false)
+		if err != nil {
+			return nil, err
+		}
+		p[i] = val
+	}
+	return doc, nil
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[k] = deepCopy(e)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(t))
+		for i, e := range t {
+			a[i] = deepCopy(e)
+		}
+		return a
+	}
+	return v
+}
+
+// jsonEqual compares generic JSON values, treating numbers by value
+func jsonEqual(a, b interface{}) bool {
+	na, aok := jsonNumber(a)
+	nb, bok := jsonNumber(b)
+	if aok || bok {
+		return aok && bok && na == nb
+	}
+	switch ta := a.(type) {
+	case map[string]interface{}:
+		tb, ok := b.(map[string]interface{})
+		if !ok || len(ta) != len(tb) {
+			return false
+		}
+		for k, v := range ta {
+			if w, ok := tb[k]; !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		tb, ok := b.([]interface{})
+		if !ok || len(ta) != len(tb) {
+			return false
+		}
+		for i := range ta {
+			if !jsonEqual(ta[i], tb[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+func jsonNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Patch", func() {
+
+	parse := func(ct, body string) (Patch, error) {
+		req, _ := http.NewRequest("PATCH", "/", strings.NewReader(body))
+		req.Header.Set("Content-Type", ct)
+		return ParsePatch(req)
+	}
+	doc := func(s string) interface{} {
+		var d interface{}
+		json.Unmarshal([]byte(s), &d)
+		return d
+	}
+	apply := func(p Patch, s string) (string, error) {
+		out, err := p.Apply(doc(s))
+		buf, _ := json.Marshal(out)
+		return string(buf), err
+	}
+
+	It("applies merge patches", func() {
+		p, err := parse(MergePatchType, `{"a":"z","c":{"f":null}}`)
+		Ω(err).ShouldNot(HaveOccurred())
+		out, err := apply(p, `{"a":"b","c":{"d":"e","f":"g"}}`)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(out).Should(MatchJSON(`{"a":"z","c":{"d":"e"}}`))
+	})
+
+	It("applies JSON patches", func() {
+		p, err := parse(JSONPatchType+"; charset=utf-8", `[
+			{"op":"test","path":"/a","value":1},
+			{"op":"add","path":"/b/1","value":"x"},
+			{"op":"remove","path":"/b/0"},
+			{"op":"replace","path":"/a","value":2},
+			{"op":"move","from":"/a","path":"/c"},
+			{"op":"copy","from":"/c","path":"/d~1e"}
+		]`)
+		Ω(err).ShouldNot(HaveOccurred())
+		out, err := apply(p, `{"a":1,"b":["y","z"]}`)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(out).Should(MatchJSON(`{"b":["x","z"],"c":2,"d/e":2}`))
+	})
+
+	It("maps failures to status codes", func() {
+		_, err := parse("application/json", `{}`)
+		Ω(err.(*PatchError).StatusCode()).Should(Equal(415))
+
+		_, err = parse(JSONPatchType, `[{"op":"frob","path":"/a"}]`)
+		Ω(err.(*PatchError).StatusCode()).Should(Equal(400))
+
+		p, _ := parse(JSONPatchType, `[{"op":"test","path":"/a","value":2}]`)
+		_, err = apply(p, `{"a":1}`)
+		Ω(err.(*PatchError).StatusCode()).Should(Equal(409))
+
+		p, _ = parse(JSONPatchType, `[{"op":"remove","path":"/x"}]`)
+		_, err = apply(p, `{"a":1}`)
+		Ω(err.(*PatchError).StatusCode()).Should(Equal(422))
+	})
+
+	It("patches structs", func() {
+		type res struct {
+			Name string `json:"name"`
+			Size int    `json:"size"`
+		}
+		v := res{Name: "foo", Size: 3}
+		p, _ := parse(MergePatchType, `{"size":5}`)
+		Ω(ApplyPatchTo(p, &v)).Should(Succeed())
+		Ω(v).Should(Equal(res{Name: "foo", Size: 5}))
+	})
+
+	It("keeps the struct fields that aren't part of the JSON", func() {
+		type owner struct {
+			Login string `json:"login"`
+			token string
+		}
+		type user struct {
+			Name  string    `json:"name"`
+			Email string    `json:"email,omitempty"`
+			Hash  string    `json:"-"`
+			Owner *owner    `json:"owner"`
+			Seen  time.Time `json:"seen"`
+			n     int
+		}
+		orig := &owner{Login: "root", token: "t"}
+		seen := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+		v := user{Name: "a", Email: "a@x", Hash: "secret", Owner: orig, n: 7}
+		p, _ := parse(MergePatchType, `{"name":"b","email":null,"owner":{"login":"adm"},`+
+			`"seen":"2015-06-01T00:00:00Z"}`)
+		Ω(ApplyPatchTo(p, &v)).Should(Succeed())
+		Ω(v).Should(Equal(user{Name: "b", Hash: "secret", Owner: &owner{Login: "adm", token: "t"},
+			Seen: seen, n: 7}))
+		Ω(orig.Login).Should(Equal("root"))
+	})
+})
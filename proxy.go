@@ -0,0 +1,307 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Reverse proxy handler with optional request hedging
+
+package gojiutil
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+// ProxyOptions configures the Proxy handler
+type ProxyOptions struct {
+	Transport     http.RoundTripper // defaults to http.DefaultTransport
+	Tracer        Tracer            // if set, each upstream call runs in a child span
+	FlushInterval time.Duration     // see httputil.ReverseProxy
+	Hedge         *HedgeOptions     // enables hedged requests if non-nil
+}
+
+// HedgeOptions controls request hedging: if the upstream hasn't responded after a delay
+// derived from the recent latency distribution a second attempt is issued and whichever
+// response arrives first is used. Only requests that can be safely repeated are hedged,
+// i.e. GET, HEAD, and OPTIONS without a body.
+type HedgeOptions struct {
+	Percentile float64       // latency percentile used as hedge delay, default 0.95
+	MinDelay   time.Duration // lower bound of the hedge delay, default 10ms
+	MaxDelay   time.Duration // upper bound of the delay, used until enough samples, default 1s
+	MaxRatio   float64       // max fraction of requests that get hedged, default 0.1
+	Window     int           // number of recent latencies considered, default 1000
+}
+
+// proxyState is passed from the Proxy handler to its transport via the request context
+type proxyState struct {
+	c      *web.C
+	hedged int32
+}
+
+type proxyStateKey struct{}
+
+// Proxy returns a handler that reverse-proxies requests to target. The request ID is
+// forwarded in the RequestIDHeader, upstream failures produce a 502 through ErrorString, and
+// hedged requests are logged via the context logger.
+func Proxy(target *url.URL, opts ProxyOptions) web.HandlerFunc {
+	transport := opts.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if opts.Hedge != nil {
+		transport = newHedgeTransport(transport, *opts.Hedge)
+	}
+
+	rp := httputil.NewSingleHostReverseProxy(target)
+	rp.Transport = transport
+	rp.FlushInterval = opts.FlushInterval
+	rp.ErrorHandler = func(rw http.ResponseWriter, r *http.Request, err error) {
+		if st, ok := r.Context().Value(proxyStateKey{}).(*proxyState); ok {
+			ErrorString(*st.c, rw, http.StatusBadGateway, "proxy: "+err.Error())
+		} else {
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+		}
+	}
+
+	return func(c web.C, rw http.ResponseWriter, r *http.Request) {
+		st := &proxyState{c: &c}
+		out := r.WithContext(context.WithValue(r.Context(), proxyStateKey{}, st))
+		out.Header = cloneHeader(r.Header)
+		if id := middleware.GetReqID(c); id != "" {
+			out.Header.Set(RequestIDHeader, id)
+		}
+
+		var span Span
+		if opts.Tracer != nil {
+			span = opts.Tracer.StartSpan("proxy "+target.Host, GetSpan(c), nil)
+			span.SetTag("span.kind", "client")
+			span.SetTag("peer.hostname", target.Host)
+			span.Inject(out.Header)
+		}
+
+		wp := &proxyWriter{ResponseWriter: rw}
+		rp.ServeHTTP(wp, out)
+
+		if span != nil {
+			span.SetTag("http.status_code", strconv.Itoa(wp.status))
+			var err error
+			if wp.status >= 500 {
+				err = errorFromEnv(c, wp.status)
+			}
+			span.Finish(err)
+		}
+		if n := atomic.LoadInt32(&st.hedged); n > 0 {
+			c.Env["hedged"] = n
+			contextLogger(c).Info("proxy request hedged", "upstream", target.Host,
+				"path", r.URL.Path)
+		}
+	}
+}
+
+// proxyWriter records the upstream status, httputil.ReverseProxy reaches the underlying
+// writer for flushing and upgrades through Unwrap
+type proxyWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *proxyWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *proxyWriter) Write(buf []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(buf)
+}
+
+func (w *proxyWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func cloneHeader(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	for k, v := range h {
+		h2[k] = append([]string(nil), v...)
+	}
+	return h2
+}
+
+//===== hedging transport
+
+type hedgeTransport struct {
+	next   http.RoundTripper
+	opts   HedgeOptions
+	mu     sync.Mutex
+	lat    []time.Duration // ring buffer of recent latencies
+	pos    int
+	total  uint64 // hedgeable requests seen
+	hedged uint64 // hedges issued
+}
+
+func newHedgeTransport(next http.RoundTripper, opts HedgeOptions) *hedgeTransport {
+	if opts.Percentile <= 0 || opts.Percentile >= 1 {
+		opts.Percentile = 0.95
+	}
+	if opts.MinDelay <= 0 {
+		opts.MinDelay = 10 * time.Millisecond
+	}
+	if opts.MaxDelay <= 0 {
+		opts.MaxDelay = time.Second
+	}
+	if opts.MaxRatio <= 0 {
+		opts.MaxRatio = 0.1
+	}
+	if opts.Window <= 0 {
+		opts.Window = 1000
+	}
+	return &hedgeTransport{next: next, opts: opts, lat: make([]time.Duration, 0, opts.Window)}
+}
+
+// record adds a latency sample to the ring buffer
+func (t *hedgeTransport) record(d time.Duration) {
+	t.mu.Lock()
+	if len(t.lat) < t.opts.Window {
+		t.lat = append(t.lat, d)
+	} else {
+		t.lat[t.pos] = d
+		t.pos = (t.pos + 1) % t.opts.Window
+	}
+	t.mu.Unlock()
+}
+
+// delay computes the current hedge delay, it's MaxDelay until we have enough samples
+func (t *hedgeTransport) delay() time.Duration {
+	t.mu.Lock()
+	if len(t.lat) < 20 {
+		t.mu.Unlock()
+		return t.opts.MaxDelay
+	}
+	s := append([]time.Duration(nil), t.lat...)
+	t.mu.Unlock()
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	d := s[int(float64(len(s)-1)*t.opts.Percentile)]
+	if d < t.opts.MinDelay {
+		d = t.opts.MinDelay
+	} else if d > t.opts.MaxDelay {
+		d = t.opts.MaxDelay
+	}
+	return d
+}
+
+// allowHedge enforces MaxRatio, the compare-and-swap keeps concurrent requests from
+// exceeding it
+func (t *hedgeTransport) allowHedge() bool {
+	for {
+		total := atomic.LoadUint64(&t.total)
+		hedged := atomic.LoadUint64(&t.hedged)
+		if float64(hedged+1) > t.opts.MaxRatio*float64(total) {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&t.hedged, hedged, hedged+1) {
+			return true
+		}
+	}
+}
+
+func hedgeable(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0
+	}
+	return false
+}
+
+type hedgeResult struct {
+	resp    *http.Response
+	err     error
+	attempt int
+}
+
+func (t *hedgeTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !hedgeable(r) {
+		return t.next.RoundTrip(r)
+	}
+	atomic.AddUint64(&t.total, 1)
+
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	launch := func() {
+		ctx, cancel := context.WithCancel(r.Context())
+		req := r.Clone(ctx)
+		attempt := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			start := time.Now()
+			resp, err := t.next.RoundTrip(req)
+			if err == nil {
+				t.record(time.Since(start))
+			}
+			results <- hedgeResult{resp, err, attempt}
+		}()
+	}
+
+	launch()
+	inflight := 1
+	timer := time.NewTimer(t.delay())
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if inflight == 1 && t.allowHedge() {
+				if st, ok := r.Context().Value(proxyStateKey{}).(*proxyState); ok {
+					atomic.AddInt32(&st.hedged, 1)
+				}
+				launch()
+				inflight++
+			}
+		case res := <-results:
+			inflight--
+			if res.err != nil && inflight > 0 {
+				cancels[res.attempt]()
+				continue // the other attempt may still succeed
+			}
+			// abort the loser right away so it frees its backend connection
+			for i, cancel := range cancels {
+				if i != res.attempt {
+					cancel()
+				}
+			}
+			if inflight > 0 {
+				go func() {
+					if loser := <-results; loser.resp != nil {
+						loser.resp.Body.Close()
+					}
+				}()
+			}
+			if res.err != nil {
+				cancels[res.attempt]()
+				return nil, res.err
+			}
+			res.resp.Body = &cancelBody{ReadCloser: res.resp.Body, cancel: cancels[res.attempt]}
+			return res.resp, nil
+		}
+	}
+}
+
+// cancelBody releases the attempt's context once the body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("Proxy", func() {
+	var upstream *httptest.Server
+	var calls int32
+	var mx *web.Mux
+
+	BeforeEach(func() {
+		calls = 0
+		upstream = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			// the first call is a straggler
+			if atomic.AddInt32(&calls, 1) == 1 {
+				time.Sleep(300 * time.Millisecond)
+			}
+			rw.Write([]byte(r.Header.Get(RequestIDHeader)))
+		}))
+		mx = web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(RequestID)
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+	})
+
+	It("hedges slow requests", func() {
+		target, _ := url.Parse(upstream.URL)
+		mx.Get("/*", Proxy(target, ProxyOptions{
+			Hedge: &HedgeOptions{MaxDelay: 20 * time.Millisecond, MaxRatio: 1},
+		}))
+		req, _ := http.NewRequest("GET", "/foo", nil)
+		req.Header.Set(RequestIDHeader, "abc")
+		resp := httptest.NewRecorder()
+		start := time.Now()
+		mx.ServeHTTP(resp, req)
+		Ω(time.Since(start)).Should(BeNumerically("<", 250*time.Millisecond))
+		Ω(resp.Code).Should(Equal(200))
+		Ω(resp.Body.String()).Should(Equal("abc"))
+		Ω(atomic.LoadInt32(&calls)).Should(BeEquivalentTo(2))
+	})
+
+	It("responds 502 when the upstream is down", func() {
+		target, _ := url.Parse(upstream.URL)
+		upstream.Close()
+		mx.Get("/*", Proxy(target, ProxyOptions{}))
+		req, _ := http.NewRequest("GET", "/foo", nil)
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		Ω(resp.Code).Should(Equal(502))
+	})
+
+	It("aborts the losing attempt as soon as the other one wins", func() {
+		cancelled := make(chan struct{})
+		var n int32
+		t := newHedgeTransport(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			if atomic.AddInt32(&n, 1) == 1 {
+				<-r.Context().Done() // the straggler only ends when aborted
+				close(cancelled)
+				return nil, r.Context().Err()
+			}
+			return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+		}), HedgeOptions{MaxDelay: 10 * time.Millisecond, MaxRatio: 1})
+		req, _ := http.NewRequest("GET", "http://upstream/foo", nil)
+		resp, err := t.RoundTrip(req)
+		Ω(err).ShouldNot(HaveOccurred())
+		Eventually(cancelled).Should(BeClosed())
+		resp.Body.Close()
+	})
+
+	It("doesn't exceed the hedge budget under concurrency", func() {
+		t := newHedgeTransport(nil, HedgeOptions{MaxRatio: 0.1})
+		t.total = 10
+		var allowed int32
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if t.allowHedge() {
+					atomic.AddInt32(&allowed, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		Ω(allowed).Should(BeEquivalentTo(1))
+	})
+})
+
+// roundTripFunc adapts a function to http.RoundTripper
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
@@ -0,0 +1,206 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// PROXY protocol listener
+
+package gojiutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyProtoOptions configures the PROXY protocol listener
+type ProxyProtoOptions struct {
+	// Trusted are the ranges (CIDR notation or single addresses) of the load balancers whose
+	// PROXY headers are believed, by default all peers are trusted. Connections from other
+	// peers are passed through untouched.
+	Trusted []string
+	// Optional accepts connections from trusted peers without a PROXY header, otherwise
+	// they're closed
+	Optional bool
+	// HeaderTimeout is the max time to receive the header, default 5s
+	HeaderTimeout time.Duration
+}
+
+// proxyV2Sig is the signature starting PROXY protocol version 2 headers
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrNoProxyHeader is returned when reading from a connection lacking a required PROXY
+// protocol header
+var ErrNoProxyHeader = errors.New("PROXY protocol header missing")
+
+type proxyListener struct {
+	net.Listener
+	opts    ProxyProtoOptions
+	trusted []*net.IPNet
+}
+
+// NewProxyProtoListener wraps a listener accepting connections from a load balancer speaking
+// the PROXY protocol (version 1 or 2), such as an AWS NLB or HAProxy in TCP mode, so the
+// RemoteAddr of the connections, and thus of the requests, is that of the original client.
+// The header is read on the connection's first use rather than in Accept, so slow clients
+// don't hold up others. Also see Server.ProxyProtocol.
+func NewProxyProtoListener(l net.Listener, opts ProxyProtoOptions) (net.Listener, error) {
+	trusted, err := parseCIDRs(opts.Trusted)
+	if err != nil {
+		return nil, err
+	}
+	if opts.HeaderTimeout <= 0 {
+		opts.HeaderTimeout = 5 * time.Second
+	}
+	return &proxyListener{Listener: l, opts: opts, trusted: trusted}, nil
+}
+
+// Accept implements net.Listener
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if len(l.trusted) > 0 {
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if ip := net.ParseIP(host); ip == nil || !ipInNets(ip, l.trusted) {
+			return conn, nil
+		}
+	}
+	return &proxyConn{Conn: conn, l: l, r: bufio.NewReader(conn)}, nil
+}
+
+// File returns the underlying socket so Server.Restart can pass it on
+func (l *proxyListener) File() (*os.File, error) {
+	fl, ok := l.Listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("listener %s cannot be passed on", l.Addr())
+	}
+	return fl.File()
+}
+
+// proxyConn is a connection starting with a PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	l      *proxyListener
+	r      *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+// init reads the header, the first time the connection is used
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.l.opts.HeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.r, c.l.opts.Optional)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the address of the original client, or of the peer if the header
+// doesn't convey one, e.g. for health checks of the load balancer
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.init(); c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a version 1 or 2 PROXY protocol header, it returns a nil address for
+// headers without addresses (UNKNOWN or LOCAL) and if the header is optional and missing
+func readProxyHeader(r *bufio.Reader, optional bool) (net.Addr, error) {
+	start, err := r.Peek(len(proxyV2Sig))
+	switch {
+	case bytes.Equal(start, proxyV2Sig):
+		return readProxyV2(r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyV1(r)
+	case err != nil && (len(start) == 0 || !optional):
+		return nil, err
+	case optional:
+		return nil, nil
+	}
+	return nil, ErrNoProxyHeader
+}
+
+// readProxyV1 reads e.g. "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 { // the max length of a v1 header
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("invalid PROXY protocol v1 header")
+	}
+	f := strings.Fields(string(line))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(f[2])
+	port, err := strconv.Atoi(f[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 source %s:%s", f[2], f[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 reads the binary header: signature, version and command, address family and
+// protocol, length, then the addresses and TLVs, which are ignored
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, errors.New("invalid PROXY protocol v2 version")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if hdr[12]&0xf == 0 { // LOCAL, e.g. health checks of the proxy itself
+		return nil, nil
+	}
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET
+		if len(body) >= 12 {
+			return &net.TCPAddr{IP: net.IP(body[0:4]),
+				Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+		}
+	case 2: // AF_INET6
+		if len(body) >= 36 {
+			return &net.TCPAddr{IP: net.IP(body[0:16]),
+				Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+		}
+	default: // AF_UNSPEC or AF_UNIX
+		return nil, nil
+	}
+	return nil, errors.New("invalid PROXY protocol v2 addresses")
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PROXY protocol listener", func() {
+
+	var closers []io.Closer
+
+	AfterEach(func() {
+		for _, c := range closers {
+			c.Close()
+		}
+		closers = nil
+	})
+
+	// accept sends data on a new connection to a PROXY protocol listener and returns the
+	// accepted connection
+	accept := func(opts ProxyProtoOptions, data []byte) net.Conn {
+		raw, err := net.Listen("tcp", "127.0.0.1:0")
+		Ω(err).ShouldNot(HaveOccurred())
+		closers = append(closers, raw)
+		l, err := NewProxyProtoListener(raw, opts)
+		Ω(err).ShouldNot(HaveOccurred())
+		client, err := net.Dial("tcp", raw.Addr().String())
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = client.Write(data)
+		Ω(err).ShouldNot(HaveOccurred())
+		client.(*net.TCPConn).CloseWrite()
+		closers = append(closers, client)
+		conn, err := l.Accept()
+		Ω(err).ShouldNot(HaveOccurred())
+		closers = append(closers, conn)
+		return conn
+	}
+
+	It("reads v1 headers", func() {
+		conn := accept(ProxyProtoOptions{},
+			[]byte("PROXY TCP4 192.0.2.1 192.0.2.2 5000 80\r\nGET / HTTP/1.1\r\n"))
+		Ω(conn.RemoteAddr().String()).Should(Equal("192.0.2.1:5000"))
+		Ω(ioutil.ReadAll(conn)).Should(Equal([]byte("GET / HTTP/1.1\r\n")))
+	})
+
+	It("reads v2 headers", func() {
+		hdr := append([]byte{}, proxyV2Sig...)
+		hdr = append(hdr, 0x21, 0x21, 0, 36) // PROXY, TCP over IPv6
+		hdr = append(hdr, net.ParseIP("2001:db8::1")...)
+		hdr = append(hdr, net.ParseIP("2001:db8::2")...)
+		hdr = binary.BigEndian.AppendUint16(hdr, 5000)
+		hdr = binary.BigEndian.AppendUint16(hdr, 443)
+		conn := accept(ProxyProtoOptions{}, append(hdr, "hello"...))
+		Ω(conn.RemoteAddr().String()).Should(Equal("[2001:db8::1]:5000"))
+		Ω(ioutil.ReadAll(conn)).Should(Equal([]byte("hello")))
+	})
+
+	It("keeps the peer address for LOCAL and UNKNOWN headers", func() {
+		hdr := append(append([]byte{}, proxyV2Sig...), 0x20, 0, 0, 0)
+		conn := accept(ProxyProtoOptions{}, append(hdr, "hello"...))
+		Ω(conn.RemoteAddr().String()).Should(HavePrefix("127.0.0.1:"))
+		Ω(ioutil.ReadAll(conn)).Should(Equal([]byte("hello")))
+
+		conn = accept(ProxyProtoOptions{}, []byte("PROXY UNKNOWN\r\nhello"))
+		Ω(conn.RemoteAddr().String()).Should(HavePrefix("127.0.0.1:"))
+	})
+
+	It("rejects connections without a header unless optional", func() {
+		conn := accept(ProxyProtoOptions{}, []byte("GET / HTTP/1.1\r\n"))
+		_, err := conn.Read(make([]byte, 10))
+		Ω(err).Should(Equal(ErrNoProxyHeader))
+
+		conn = accept(ProxyProtoOptions{Optional: true}, []byte("GET / HTTP/1.1\r\n"))
+		Ω(conn.RemoteAddr().String()).Should(HavePrefix("127.0.0.1:"))
+		Ω(ioutil.ReadAll(conn)).Should(Equal([]byte("GET / HTTP/1.1\r\n")))
+	})
+
+	It("ignores headers from untrusted peers", func() {
+		conn := accept(ProxyProtoOptions{Trusted: []string{"10.0.0.0/8"}},
+			[]byte("PROXY TCP4 192.0.2.1 192.0.2.2 5000 80\r\n"))
+		Ω(conn.RemoteAddr().String()).Should(HavePrefix("127.0.0.1:"))
+		Ω(ioutil.ReadAll(conn)).Should(HavePrefix("PROXY"))
+	})
+
+	It("times out waiting for the header", func() {
+		raw, err := net.Listen("tcp", "127.0.0.1:0")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer raw.Close()
+		l, _ := NewProxyProtoListener(raw,
+			ProxyProtoOptions{HeaderTimeout: 50 * time.Millisecond})
+		client, err := net.Dial("tcp", raw.Addr().String())
+		Ω(err).ShouldNot(HaveOccurred())
+		defer client.Close()
+		conn, err := l.Accept()
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = conn.Read(make([]byte, 10))
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("rejects invalid trusted ranges", func() {
+		_, err := NewProxyProtoListener(nil, ProxyProtoOptions{Trusted: []string{"nope"}})
+		Ω(err).Should(HaveOccurred())
+	})
+})
@@ -0,0 +1,149 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Token-bucket rate limiting
+
+package gojiutil
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// RateLimitStore keeps the token buckets, implement it on top of a shared store such as Redis
+// for all instances of a service to enforce a common limit
+type RateLimitStore interface {
+	// Take removes a token from the bucket of key, which holds up to burst tokens and refills
+	// at rate tokens per second. If the bucket is empty it returns false along with the time
+	// until a token becomes available.
+	Take(key string, rate float64, burst int) (ok bool, retryAfter time.Duration, err error)
+}
+
+// RateLimitOptions configures the RateLimit middleware
+type RateLimitOptions struct {
+	Rate  float64 // requests per second
+	Burst int     // requests allowed in a burst, default 1
+	// Key returns the key requests are limited by, default the client IP, which requires
+	// the RealIP middleware behind proxies. Requests with an empty key are not limited.
+	Key   func(c web.C, r *http.Request) string
+	Store RateLimitStore // default a MemoryRateLimitStore
+	// Live, if set, takes Rate and Burst from the rate limit named Name in its settings when
+	// that is present, so they can be tuned without a restart
+	Live *LiveConfig
+	Name string
+}
+
+// RateLimit creates a middleware limiting the request rate of each client using a token
+// bucket, requests over the limit get a 429 Too Many Requests with a Retry-After header. If
+// the store fails the request is let through and the error is logged.
+func RateLimit(opts RateLimitOptions) web.MiddlewareType {
+	if opts.Burst < 1 {
+		opts.Burst = 1
+	}
+	if opts.Key == nil {
+		opts.Key = clientIP
+	}
+	if opts.Store == nil {
+		opts.Store = NewMemoryRateLimitStore()
+	}
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			key := opts.Key(*c, r)
+			if key == "" {
+				h.ServeHTTP(rw, r)
+				return
+			}
+			rate, burst := opts.Rate, opts.Burst
+			if opts.Live != nil {
+				if s, ok := opts.Live.Get().RateLimits[opts.Name]; ok {
+					rate, burst = s.Rate, s.Burst
+					if burst < 1 {
+						burst = 1
+					}
+				}
+			}
+			ok, retryAfter, err := opts.Store.Take(key, rate, burst)
+			if err != nil {
+				contextLogger(*c).Error("rate limit store failed", "err", err)
+				ok = true
+			}
+			if !ok {
+				secs := int(math.Ceil(retryAfter.Seconds()))
+				if secs < 1 {
+					secs = 1
+				}
+				rw.Header().Set("Retry-After", strconv.Itoa(secs))
+				ErrorString(*c, rw, http.StatusTooManyRequests, "Rate limit exceeded")
+				return
+			}
+			h.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// clientIP returns the IP address of the client without the port
+func clientIP(c web.C, r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// MemoryRateLimitStore is a RateLimitStore local to the process
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	sweep   time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewMemoryRateLimitStore creates an empty in-memory store
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: make(map[string]*tokenBucket), sweep: time.Now()}
+}
+
+// Take implements RateLimitStore
+func (s *MemoryRateLimitStore) Take(key string, rate float64, burst int) (bool, time.Duration,
+	error) {
+	ok, retryAfter := s.take(time.Now(), key, rate, burst)
+	return ok, retryAfter, nil
+}
+
+func (s *MemoryRateLimitStore) take(now time.Time, key string, rate float64,
+	burst int) (bool, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.sweep) > time.Minute {
+		// forget the buckets that have refilled completely, they're the same as new ones
+		for k, b := range s.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*rate >= float64(burst) {
+				delete(s.buckets, k)
+			}
+		}
+		s.sweep = now
+	}
+	b := s.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if rate <= 0 {
+		return false, time.Hour // never refills
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
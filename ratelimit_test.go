@@ -0,0 +1,49 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("RateLimit", func() {
+
+	It("limits each client", func() {
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(RateLimit(RateLimitOptions{Rate: 0.5, Burst: 2}))
+		mx.Get("/", func(rw http.ResponseWriter, r *http.Request) {})
+		get := func(ip string) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.RemoteAddr = ip + ":1234"
+			resp := httptest.NewRecorder()
+			mx.ServeHTTP(resp, req)
+			return resp
+		}
+		Ω(get("10.0.0.1").Code).Should(Equal(200))
+		Ω(get("10.0.0.1").Code).Should(Equal(200))
+		resp := get("10.0.0.1")
+		Ω(resp.Code).Should(Equal(429))
+		Ω(resp.Header().Get("Retry-After")).Should(Equal("2"))
+		Ω(get("10.0.0.2").Code).Should(Equal(200))
+	})
+
+	It("refills buckets over time", func() {
+		s := NewMemoryRateLimitStore()
+		now := time.Now()
+		ok, _ := s.take(now, "k", 10, 1)
+		Ω(ok).Should(BeTrue())
+		ok, retry := s.take(now, "k", 10, 1)
+		Ω(ok).Should(BeFalse())
+		Ω(retry).Should(Equal(100 * time.Millisecond))
+		ok, _ = s.take(now.Add(100*time.Millisecond), "k", 10, 1)
+		Ω(ok).Should(BeTrue())
+	})
+})
@@ -0,0 +1,109 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Client IP addresses from the forwarding headers of trusted proxies
+
+package gojiutil
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+)
+
+// Forwarding headers understood by RealIPFrom
+const (
+	ForwardedHeader     = "Forwarded" // RFC 7239
+	XForwardedForHeader = "X-Forwarded-For"
+	XRealIPHeader       = "X-Real-Ip"
+)
+
+// RealIPFrom creates a middleware that, unlike goji's RealIP, only believes the forwarding
+// headers of requests coming from the trusted proxy ranges (CIDR notation or single
+// addresses) so clients can't spoof their IP. It walks the proxy chain of the header from the
+// nearest hop and places the first address that isn't a trusted proxy into r.RemoteAddr (as
+// RealIP does, without port). header is one of ForwardedHeader, XForwardedForHeader or
+// XRealIPHeader, or "" to use the first of them present. It panics if a range doesn't parse.
+func RealIPFrom(trustedCIDRs []string, header string) web.MiddlewareType {
+	trusted, err := parseCIDRs(trustedCIDRs)
+	if err != nil {
+		panic("gojiutil.RealIPFrom: " + err.Error())
+	}
+	headers := []string{ForwardedHeader, XForwardedForHeader, XRealIPHeader}
+	if header != "" {
+		headers = []string{http.CanonicalHeaderKey(header)}
+	}
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			peer := net.ParseIP(clientIP(*c, r))
+			if peer != nil && ipInNets(peer, trusted) {
+				for _, hdr := range headers {
+					if hops := forwardedHops(r.Header, hdr); len(hops) > 0 {
+						if ip := firstUntrusted(hops, trusted); ip != "" {
+							r.RemoteAddr = ip
+						}
+						break
+					}
+				}
+			}
+			h.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// forwardedHops returns the addresses listed in a forwarding header, from the client to the
+// nearest proxy
+func forwardedHops(hdr http.Header, name string) []string {
+	var hops []string
+	for _, v := range hdr[name] {
+		for _, elem := range strings.Split(v, ",") {
+			elem = strings.TrimSpace(elem)
+			if name == ForwardedHeader {
+				elem = forwardedFor(elem)
+			}
+			if elem != "" {
+				hops = append(hops, elem)
+			}
+		}
+	}
+	return hops
+}
+
+// forwardedFor extracts the node of the for parameter of an RFC 7239 forwarded-element, e.g.
+// for="[2001:db8:cafe::17]:4711";proto=https gives [2001:db8:cafe::17]:4711
+func forwardedFor(elem string) string {
+	for _, pair := range strings.Split(elem, ";") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+			return strings.Trim(kv[1], `"`)
+		}
+	}
+	return "unknown"
+}
+
+// parseHop parses an address of a forwarding header, which may have a port and brackets
+func parseHop(hop string) net.IP {
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	return net.ParseIP(strings.Trim(hop, "[]"))
+}
+
+// firstUntrusted walks hops from the nearest proxy and returns the first address that isn't
+// a trusted proxy, or the farthest valid one if they all are. Walking stops at an invalid
+// address, e.g. "unknown" or obfuscated, as nothing beyond it can be believed.
+func firstUntrusted(hops []string, trusted []*net.IPNet) string {
+	found := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHop(hops[i])
+		if ip == nil {
+			break
+		}
+		found = ip.String()
+		if !ipInNets(ip, trusted) {
+			break
+		}
+	}
+	return found
+}
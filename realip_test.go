@@ -0,0 +1,55 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+)
+
+var _ = Describe("RealIPFrom", func() {
+
+	remoteAddr := func(mw web.MiddlewareType, peer string, hdr http.Header) string {
+		var got string
+		mx := web.New()
+		mx.Use(mw)
+		mx.Get("/", func(rw http.ResponseWriter, r *http.Request) { got = r.RemoteAddr })
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = peer
+		req.Header = hdr
+		mx.ServeHTTP(httptest.NewRecorder(), req)
+		return got
+	}
+
+	trusted := []string{"10.0.0.0/8", "fd00::/8"}
+
+	It("walks X-Forwarded-For chains from trusted proxies", func() {
+		mw := RealIPFrom(trusted, XForwardedForHeader)
+		hdr := http.Header{XForwardedForHeader: {"6.6.6.6, 198.51.100.7", "10.0.0.2"}}
+		Ω(remoteAddr(mw, "10.0.0.1:4000", hdr)).Should(Equal("198.51.100.7"))
+		Ω(remoteAddr(mw, "203.0.113.1:4000", hdr)).Should(Equal("203.0.113.1:4000"))
+		hdr = http.Header{XForwardedForHeader: {"10.0.0.3, 10.0.0.2"}}
+		Ω(remoteAddr(mw, "10.0.0.1:4000", hdr)).Should(Equal("10.0.0.3"))
+	})
+
+	It("parses the Forwarded header", func() {
+		mw := RealIPFrom(trusted, "")
+		hdr := http.Header{ForwardedHeader: {
+			`for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711";by=fd00::1`}}
+		Ω(remoteAddr(mw, "[fd00::2]:4000", hdr)).Should(Equal("2001:db8:cafe::17"))
+		hdr = http.Header{ForwardedHeader: {`for=unknown, for=10.0.0.9`}}
+		Ω(remoteAddr(mw, "10.0.0.1:4000", hdr)).Should(Equal("10.0.0.9"))
+	})
+
+	It("uses X-Real-IP", func() {
+		mw := RealIPFrom(trusted, "")
+		hdr := http.Header{XRealIPHeader: {"198.51.100.7"}}
+		Ω(remoteAddr(mw, "10.0.0.1:4000", hdr)).Should(Equal("198.51.100.7"))
+		hdr = http.Header{XRealIPHeader: {"not an ip"}}
+		Ω(remoteAddr(mw, "10.0.0.1:4000", hdr)).Should(Equal("10.0.0.1:4000"))
+	})
+})
@@ -0,0 +1,337 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Request recording and replay
+
+package gojiutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+// Redacted replaces secret header and query parameter values in recordings and logs
+const Redacted = "REDACTED"
+
+// DefaultRedactHeaders are the request headers whose values are never recorded
+var DefaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie",
+	"X-Api-Key", DebugTokenHeader}
+
+// DefaultRedactParams are the query parameters, and the fields of form and JSON bodies,
+// whose values are never recorded
+var DefaultRedactParams = []string{"password", "token", "access_token", "api_key", "secret"}
+
+// RecordOptions configures the Record middleware
+type RecordOptions struct {
+	Dir           string   // directory where recordings are written, must exist
+	Sample        float64  // fraction of requests recorded, 0..1
+	MaxBody       int64    // max body bytes recorded, default 1MB, longer bodies are truncated
+	RedactHeaders []string // default DefaultRedactHeaders
+	RedactParams  []string // also redacted in form and JSON bodies, default DefaultRedactParams
+}
+
+// RecordedRequest is the replayable format of a recorded request, stored as a JSON file
+type RecordedRequest struct {
+	Time      time.Time   `json:"time"`
+	RequestID string      `json:"request_id,omitempty"`
+	Method    string      `json:"method"`
+	URL       string      `json:"url"` // path and query
+	Host      string      `json:"host"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body,omitempty"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+// Record creates a middleware that writes a sample of the requests, with their headers and
+// body, to files in opts.Dir that Replay can re-issue, e.g. to reproduce a bug seen in
+// production within a test. Secret headers, query parameters, and fields of form and JSON
+// bodies are redacted, which means requests that need credentials will need them added back
+// before replaying. JSON bodies that don't parse, e.g. because they were truncated, are
+// dropped, other bodies are recorded verbatim so review them before sharing recordings.
+func Record(opts RecordOptions) web.MiddlewareType {
+	if opts.MaxBody <= 0 {
+		opts.MaxBody = 1 << 20
+	}
+	if opts.RedactHeaders == nil {
+		opts.RedactHeaders = DefaultRedactHeaders
+	}
+	if opts.RedactParams == nil {
+		opts.RedactParams = DefaultRedactParams
+	}
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if opts.Sample <= 0 || rand.Float64() >= opts.Sample {
+				h.ServeHTTP(rw, r)
+				return
+			}
+			rec, err := recordRequest(r, middleware.GetReqID(*c), opts)
+			if err == nil {
+				err = rec.save(opts.Dir)
+			}
+			if err != nil {
+				contextLogger(*c).Warn("cannot record request", "err", err)
+			}
+			h.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// recordRequest captures r, buffering up to opts.MaxBody of its body and putting it back so
+// the handler still sees the complete body
+func recordRequest(r *http.Request, reqID string, opts RecordOptions) (*RecordedRequest, error) {
+	rec := &RecordedRequest{Time: time.Now(), RequestID: reqID, Method: r.Method,
+		Host: r.Host, Header: cloneHeader(r.Header)}
+	for _, k := range opts.RedactHeaders {
+		if _, ok := rec.Header[http.CanonicalHeaderKey(k)]; ok {
+			rec.Header.Set(k, Redacted)
+		}
+	}
+	u := *r.URL
+	if q := u.Query(); len(q) > 0 {
+		redacted := false
+		for _, k := range opts.RedactParams {
+			if _, ok := q[k]; ok {
+				q.Set(k, Redacted)
+				redacted = true
+			}
+		}
+		if redacted {
+			u.RawQuery = q.Encode()
+		}
+	}
+	rec.URL = u.RequestURI()
+	if r.Body != nil {
+		buf, err := ioutil.ReadAll(io.LimitReader(r.Body, opts.MaxBody+1))
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(buf)) > opts.MaxBody {
+			buf, rec.Truncated = buf[:opts.MaxBody], true
+		}
+		rec.Body = redactBody(r.Header.Get("Content-Type"), buf, opts.RedactParams)
+	}
+	return rec, nil
+}
+
+// redactBody redacts the params in form and JSON bodies, bodies in which nothing was
+// redacted are returned as-is and JSON bodies that don't parse are dropped
+func redactBody(contentType string, body []byte, params []string) []byte {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case len(body) == 0 || len(params) == 0:
+	case mt == "application/x-www-form-urlencoded":
+		form, _ := url.ParseQuery(string(body))
+		redacted := false
+		for _, k := range params {
+			if _, ok := form[k]; ok {
+				form.Set(k, Redacted)
+				redacted = true
+			}
+		}
+		if redacted {
+			return []byte(form.Encode())
+		}
+	case mt == "application/json" || strings.HasSuffix(mt, "+json"):
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return nil
+		}
+		if redactJSON(v, params) {
+			var buf bytes.Buffer
+			enc := json.NewEncoder(&buf)
+			enc.SetEscapeHTML(false)
+			if enc.Encode(v) != nil {
+				return nil
+			}
+			return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+		}
+	}
+	return body
+}
+
+// redactJSON redacts the params in the objects of v, at any depth, and reports whether it did
+func redactJSON(v interface{}, params []string) bool {
+	redacted := false
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if stringListed(params, k) {
+				v[k] = Redacted
+				redacted = true
+			} else if redactJSON(e, params) {
+				redacted = true
+			}
+		}
+	case []interface{}:
+		for _, e := range v {
+			if redactJSON(e, params) {
+				redacted = true
+			}
+		}
+	}
+	return redacted
+}
+
+// stringListed reports whether s is in list
+func stringListed(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// readCloser reads from a reader but closes the original body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// save writes the recording to a new file in dir, named so files sort chronologically
+func (rec *RecordedRequest) save(dir string) error {
+	buf, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, rec.Time.UTC().Format("20060102T150405.000000000-")+"*.json")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	return f.Close()
+}
+
+// LoadRecording reads a recorded request from a file
+func LoadRecording(path string) (*RecordedRequest, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rec RecordedRequest
+	if err := json.Unmarshal(buf, &rec); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return &rec, nil
+}
+
+// NewRequest recreates the recorded request, with base (e.g. "http://localhost:8080") as
+// scheme and host, or with the recorded host if base is empty
+func (rec *RecordedRequest) NewRequest(base string) (*http.Request, error) {
+	target := "http://" + rec.Host + rec.URL
+	if base != "" {
+		target = strings.TrimRight(base, "/") + rec.URL
+	}
+	r, err := http.NewRequest(rec.Method, target, bytes.NewReader(rec.Body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header = cloneHeader(rec.Header)
+	r.Header.Del("Content-Length")
+	if base == "" {
+		r.Host = rec.Host
+	}
+	return r, nil
+}
+
+// ReplayResult is the outcome of re-issuing one recorded request
+type ReplayResult struct {
+	File    string
+	Request *RecordedRequest
+	Status  int
+	Err     error
+}
+
+// Replay re-issues the requests recorded in dir, in chronological order, against target,
+// which is either an http.Handler such as a goji mux (called in-process) or a base URL
+// string. Individual failures are reported in the results, an error is returned only if the
+// recordings cannot be listed or the target is invalid.
+func Replay(dir string, target interface{}) ([]ReplayResult, error) {
+	var handler http.Handler
+	var base string
+	switch t := target.(type) {
+	case http.Handler:
+		handler = t
+	case string:
+		if _, err := url.Parse(t); err != nil {
+			return nil, err
+		}
+		base = t
+	default:
+		return nil, fmt.Errorf("replay target must be an http.Handler or a URL, not %T", target)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	results := make([]ReplayResult, 0, len(files))
+	for _, file := range files {
+		res := ReplayResult{File: file}
+		res.Request, res.Err = LoadRecording(file)
+		var r *http.Request
+		if res.Err == nil {
+			r, res.Err = res.Request.NewRequest(base)
+		}
+		switch {
+		case res.Err != nil:
+		case handler != nil:
+			rw := &replayWriter{header: http.Header{}}
+			handler.ServeHTTP(rw, r)
+			res.Status = rw.status
+			if res.Status == 0 {
+				res.Status = http.StatusOK
+			}
+		default:
+			var resp *http.Response
+			if resp, res.Err = http.DefaultClient.Do(r); res.Err == nil {
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+				res.Status = resp.StatusCode
+			}
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// replayWriter is the http.ResponseWriter handed to in-process replay targets, it keeps the
+// status and discards the body
+type replayWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *replayWriter) Header() http.Header { return w.header }
+
+func (w *replayWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *replayWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return len(p), nil
+}
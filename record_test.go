@@ -0,0 +1,90 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+)
+
+var _ = Describe("Record", func() {
+
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "record")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("records redacted requests that can be replayed", func() {
+		var bodies []string
+		mx := web.New()
+		mx.Use(Record(RecordOptions{Dir: dir, Sample: 1}))
+		mx.Post("/items", func(rw http.ResponseWriter, r *http.Request) {
+			buf, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(buf))
+			rw.WriteHeader(201)
+		})
+
+		req, _ := http.NewRequest("POST", "/items?token=abc&page=2",
+			strings.NewReader(`{"name":"x"}`))
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Content-Type", "application/json")
+		mx.ServeHTTP(httptest.NewRecorder(), req)
+		Ω(bodies).Should(Equal([]string{`{"name":"x"}`}))
+
+		results, err := Replay(dir, mx)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(results).Should(HaveLen(1))
+		Ω(results[0].Err).ShouldNot(HaveOccurred())
+		Ω(results[0].Status).Should(Equal(201))
+		rec := results[0].Request
+		Ω(rec.Header.Get("Authorization")).Should(Equal(Redacted))
+		Ω(rec.Header.Get("Content-Type")).Should(Equal("application/json"))
+		Ω(rec.URL).Should(Equal("/items?page=2&token=REDACTED"))
+		Ω(bodies).Should(Equal([]string{`{"name":"x"}`, `{"name":"x"}`}))
+	})
+
+	It("redacts form and JSON bodies", func() {
+		record := func(contentType, body string, maxBody int64) string {
+			req, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+			req.Header.Set("Content-Type", contentType)
+			rec, err := recordRequest(req, "", RecordOptions{MaxBody: maxBody,
+				RedactParams: DefaultRedactParams})
+			Ω(err).ShouldNot(HaveOccurred())
+			return string(rec.Body)
+		}
+		Ω(record("application/x-www-form-urlencoded", "user=bob&password=hunter2", 100)).
+			Should(Equal("password=REDACTED&user=bob"))
+		Ω(record("application/json; charset=utf-8",
+			`{"user":"<bob>","n":1.50,"auth":[{"token":{"id":1}}]}`, 100)).
+			Should(MatchJSON(`{"user":"<bob>","n":1.50,"auth":[{"token":"REDACTED"}]}`))
+		Ω(record("application/json", `{"user":"bob",  "n":1.50}`, 100)).
+			Should(Equal(`{"user":"bob",  "n":1.50}`))
+		Ω(record("application/json", `{"user":"bob","password":"hunter2"}`, 20)).
+			Should(BeEmpty())
+		Ω(record("text/plain", "password=hunter2", 100)).Should(Equal("password=hunter2"))
+	})
+
+	It("truncates long bodies", func() {
+		req, _ := http.NewRequest("PUT", "/", strings.NewReader("0123456789"))
+		rec, err := recordRequest(req, "", RecordOptions{MaxBody: 4})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(rec.Body)).Should(Equal("0123"))
+		Ω(rec.Truncated).Should(BeTrue())
+		buf, _ := ioutil.ReadAll(req.Body)
+		Ω(string(buf)).Should(Equal("0123456789"))
+	})
+})
@@ -3,3 +3,77 @@
 // Utilities on http.Request
 
 package gojiutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/zenazn/goji/web"
+)
+
+// BindError is returned by the Bind helpers when the request can't be decoded, it maps to a
+// 400 Bad Request when passed to WriteError
+type BindError struct {
+	Err error
+}
+
+func (e *BindError) Error() string { return e.Err.Error() }
+
+// Unwrap returns the underlying error
+func (e *BindError) Unwrap() error { return e.Err }
+
+// StatusCode implements StatusCoder
+func (e *BindError) StatusCode() int { return http.StatusBadRequest }
+
+// BindJSON decodes the JSON request body into dst, typically a pointer to a struct, without
+// going through the generic map of GetJSONBody, thereby preserving number types. The body is
+// read from c.Env[ContextRawBody] if GetJSONBodyRaw ran, else from r.Body. Errors are
+// *BindError so handlers can simply:
+//
+//	if err := gojiutil.BindJSON(c, r, &req); err != nil {
+//	        gojiutil.WriteError(c, rw, err)
+//	        return
+//	}
+func BindJSON(c web.C, r *http.Request, dst interface{}) error {
+	if ct := r.Header.Get("Content-Type"); !isJSONContentType(ct) {
+		return &BindError{fmt.Errorf("Invalid content-type '%s', application/json expected", ct)}
+	}
+	var body io.Reader = r.Body
+	if raw, ok := c.Env[ContextRawBody].([]byte); ok {
+		body = bytes.NewReader(raw)
+	}
+	if body == nil {
+		return &BindError{errors.New("Missing request body")}
+	}
+	switch err := json.NewDecoder(body).Decode(dst); err {
+	case nil:
+		return nil
+	case io.EOF:
+		return &BindError{errors.New("Missing request body")}
+	default:
+		return &BindError{fmt.Errorf("Cannot parse JSON request body: %s", err)}
+	}
+}
+
+// DecodeJSONBody is the generic flavor of BindJSON, e.g.
+// req, err := gojiutil.DecodeJSONBody[CreateUser](c, r)
+func DecodeJSONBody[T any](c web.C, r *http.Request) (T, error) {
+	var v T
+	err := BindJSON(c, r, &v)
+	return v, err
+}
+
+// isJSONContentType accepts application/json with parameters such as charset, as well as
+// a missing content-type
+func isJSONContentType(ct string) bool {
+	if ct == "" {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	return err == nil && mt == "application/json"
+}
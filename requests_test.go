@@ -0,0 +1,56 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+)
+
+type bindTarget struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+var _ = Describe("BindJSON", func() {
+
+	var c web.C
+
+	BeforeEach(func() {
+		c = web.C{Env: map[interface{}]interface{}{}}
+	})
+
+	It("decodes into structs", func() {
+		req, _ := http.NewRequest("POST", "/",
+			strings.NewReader(`{"name":"a","count":9007199254740993}`))
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		v, err := DecodeJSONBody[bindTarget](c, req)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(v).Should(Equal(bindTarget{"a", 9007199254740993}))
+	})
+
+	It("uses the raw body kept by GetJSONBodyRaw", func() {
+		c.Env[ContextRawBody] = []byte(`{"name":"raw"}`)
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+		var v bindTarget
+		Ω(BindJSON(c, req, &v)).Should(Succeed())
+		Ω(v.Name).Should(Equal("raw"))
+	})
+
+	It("returns errors producing 400s", func() {
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(`{"name":`))
+		var v bindTarget
+		err := BindJSON(c, req, &v)
+		var be *BindError
+		Ω(errors.As(err, &be)).Should(BeTrue())
+		rw := httptest.NewRecorder()
+		WriteError(c, rw, err)
+		Ω(rw.Code).Should(Equal(400))
+	})
+})
@@ -4,10 +4,14 @@ package gojiutil
 
 import (
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"net/http"
-	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/zenazn/goji/web"
 	"github.com/zenazn/goji/web/middleware"
@@ -23,7 +27,7 @@ func WriteString(rw http.ResponseWriter, code int, str string) {
 }
 
 func Printf(rw http.ResponseWriter, code int, message string, args ...interface{}) {
-	str := fmt.Sprintf(message, args)
+	str := fmt.Sprintf(message, args...)
 	WriteString(rw, code, str)
 }
 
@@ -43,37 +47,394 @@ func WriteJSON(c web.C, rw http.ResponseWriter, code int, obj interface{}) {
 	}
 }
 
+// NoContent responds 204 No Content, e.g. to a successful DELETE
+func NoContent(rw http.ResponseWriter) {
+	rw.Header().Del("Content-Type")
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// Created responds 201 Created with the Location of the new resource and its representation
+// obj written as JSON
+func Created(c web.C, rw http.ResponseWriter, location string, obj interface{}) {
+	rw.Header().Set("Location", location)
+	WriteJSON(c, rw, http.StatusCreated, obj)
+}
+
+// Accepted responds 202 Accepted to a request whose processing happens asynchronously, the
+// Location header and the status_url JSON field point to where the client can poll for its
+// progress. An empty statusURL produces an empty response.
+func Accepted(c web.C, rw http.ResponseWriter, statusURL string) {
+	if statusURL == "" {
+		rw.WriteHeader(http.StatusAccepted)
+		return
+	}
+	rw.Header().Set("Location", statusURL)
+	WriteJSON(c, rw, http.StatusAccepted, map[string]string{"status_url": statusURL})
+}
+
+// RedirectTo redirects the client to url, which may be relative to the request path, using
+// http.Redirect. Codes that aren't redirections are replaced by 302 Found.
+func RedirectTo(rw http.ResponseWriter, r *http.Request, code int, url string) {
+	if code < 300 || code > 308 {
+		code = http.StatusFound
+	}
+	http.Redirect(rw, r, url, code)
+}
+
+// WriteXML is the XML flavor of WriteJSON: it marshals obj using encoding/xml into a buffer,
+// prefixed by the XML declaration, and only then writes the response, producing an internal
+// error instead if obj can't be marshaled
+func WriteXML(c web.C, rw http.ResponseWriter, code int, obj interface{}) {
+	writeXML(c, rw, code, obj, ApplicationXML)
+}
+
+func writeXML(c web.C, rw http.ResponseWriter, code int, obj interface{}, contentType string) {
+	buf, err := xml.Marshal(obj)
+	if err != nil {
+		ErrorInternal(c, rw, err)
+		return
+	}
+	rw.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	rw.WriteHeader(code)
+	rw.Write([]byte(xml.Header))
+	rw.Write(buf)
+}
+
 // Produce a text/plain error response into the responseWriter and also sets the context to
 // reflect the error in a way that the logger groks properly.
-// For 500 errors a generic error is returned and the details are only logged.
+// For 5xx errors a generic error is returned and the details are only logged, except for 503
+// Service Unavailable whose messages, e.g. the maintenance message, are meant for clients.
+// The message is translated using ErrorCatalog if the Locale middleware is in use, in which
+// case Content-Language reflects whether a translation was found.
 func ErrorString(c web.C, rw http.ResponseWriter, code int, str string) {
+	msg, lang := translate(c, str, str)
+	errorString(c, rw, code, str, msg, lang, nil)
+}
+
+// error body formats
+const (
+	errText = iota
+	errJSON
+	errProblem
+	errRenderer
+)
+
+// ErrorRenderer, if set, renders the error responses of ErrorString, Errorf, Recoverer, and
+// the helpers built on them instead of JSONErrors and ProblemErrors, e.g. to produce HTML
+// error pages. It's called with the client-facing message, which for 5xx errors other than
+// 503 is the generic "Internal Error (request ID: ...)", the details being only logged.
+var ErrorRenderer func(c web.C, rw http.ResponseWriter, code int, msg string)
+
+// errorString logs str and responds with the client-facing msg in language lang, as text,
+// as JSON if JSONErrors is set, as problem details if ProblemErrors is set, or using
+// ErrorRenderer if set, ae optionally provides the error code and details of an APIError
+func errorString(c web.C, rw http.ResponseWriter, code int, str, msg, lang string,
+	ae *APIError) {
+	format := errText
+	switch {
+	case ErrorRenderer != nil:
+		format = errRenderer
+	case ProblemErrors:
+		format = errProblem
+	case JSONErrors:
+		format = errJSON
+	}
+	writeError(c, rw, code, str, msg, lang, format, ae)
+}
+
+func writeError(c web.C, rw http.ResponseWriter, code int, str, msg, lang string, format int,
+	ae *APIError) {
 	c.Env["err"] = str
-	if code >= 500 {
-		errStr := fmt.Sprintf("Internal Error (request ID: %s)", middleware.GetReqID(c))
-		http.Error(rw, errStr, code)
-	} else {
-		http.Error(rw, str, code)
+	var errCode string
+	var details map[string]interface{}
+	if ae != nil {
+		errCode, details = ae.Code, ae.Details
+		// details are logged but only sent to the client if it's at fault
+		if len(details) > 0 {
+			keys := make([]string, 0, len(details))
+			for k := range details {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			prev, _ := c.Env[ContextErrKV].([]interface{})
+			for _, k := range keys {
+				prev = append(prev, k, details[k])
+			}
+			c.Env[ContextErrKV] = prev
+		}
+	}
+	if code >= 500 && code != http.StatusServiceUnavailable {
+		details = nil
+		const generic = "Internal Error (request ID: %s)"
+		var format string
+		format, lang = translate(c, generic, generic)
+		msg = fmt.Sprintf(format, middleware.GetReqID(c))
 	}
+	if GetLocale(c) != "" {
+		SetContentLanguage(c, rw, lang)
+	}
+	switch format {
+	case errText:
+		http.Error(rw, msg, code)
+		return
+	case errRenderer:
+		ErrorRenderer(c, rw, code, msg)
+		return
+	case errProblem:
+		p := &Problem{Status: code, Detail: msg, Extensions: map[string]interface{}{}}
+		for k, v := range details {
+			p.Extensions[k] = v
+		}
+		if errCode != "" {
+			p.Extensions["code"] = errCode
+		}
+		if id := middleware.GetReqID(c); id != "" {
+			p.Extensions["request_id"] = id
+		}
+		writeProblem(rw, p)
+		return
+	}
+	buf, _ := json.Marshal(ErrorBody{Code: code, Message: msg, RequestID: middleware.GetReqID(c),
+		ErrorCode: errCode, Details: details})
+	rw.Header().Set("Content-Type", ApplicationJSON+"; charset=utf-8")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(code)
+	rw.Write(buf)
 }
 
-// Convenience function to call ErrorString with a format string
+// JSONErrors makes ErrorString, Errorf, and the helpers built on them produce JSON error
+// bodies like ErrorJSON does instead of text/plain ones
+var JSONErrors = false
+
+// ErrorBody is the JSON body of the error responses produced by ErrorJSON
+type ErrorBody struct {
+	Code      int                    `json:"code"`
+	Message   string                 `json:"message"`
+	RequestID string                 `json:"request_id,omitempty"`
+	ErrorCode string                 `json:"error_code,omitempty"` // APIError.Code
+	Details   map[string]interface{} `json:"details,omitempty"`    // APIError.Details
+}
+
+// ErrorJSON is like ErrorString but produces an application/json body holding an ErrorBody,
+// e.g. {"code":404,"message":"Account not found","request_id":"..."}, so API clients don't
+// have to parse plain text errors
+func ErrorJSON(c web.C, rw http.ResponseWriter, code int, msg string) {
+	tmsg, lang := translate(c, msg, msg)
+	writeError(c, rw, code, msg, tmsg, lang, errJSON, nil)
+}
+
+// ApplicationProblemJSON is the media type of RFC 7807 problem details
+var ApplicationProblemJSON = "application/problem+json"
+
+// ProblemErrors makes ErrorString, Errorf, ErrorInternal, and the helpers built on them produce
+// RFC 7807 problem details instead of text/plain bodies, it takes precedence over JSONErrors
+var ProblemErrors = false
+
+// Problem holds RFC 7807 problem details, Extensions are marshaled as additional members
+type Problem struct {
+	Type       string // URI identifying the problem type, "about:blank" if empty
+	Title      string // short summary of the problem type, the status text if empty
+	Status     int
+	Detail     string // explanation specific to this occurrence
+	Instance   string // URI identifying this occurrence
+	Extensions map[string]interface{}
+}
+
+// MarshalJSON produces the problem+json representation
+func (p Problem) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, len(p.Extensions)+5)
+	for k, v := range p.Extensions {
+		m[k] = v
+	}
+	m["type"] = p.Type
+	if p.Type == "" {
+		m["type"] = "about:blank"
+	}
+	m["title"] = p.Title
+	if p.Title == "" {
+		m["title"] = http.StatusText(p.Status)
+	}
+	m["status"] = p.Status
+	if p.Detail != "" {
+		m["detail"] = p.Detail
+	}
+	if p.Instance != "" {
+		m["instance"] = p.Instance
+	}
+	return json.Marshal(m)
+}
+
+// WriteProblem produces an application/problem+json response for p and sets the context to
+// reflect the error for the logger like ErrorString does. Unlike ErrorString, the detail of
+// 5xx problems is sent as-is so it must not leak internals.
+func WriteProblem(c web.C, rw http.ResponseWriter, p *Problem) {
+	if p.Status == 0 {
+		p.Status = 500
+	}
+	c.Env["err"] = p.Detail
+	if p.Detail == "" {
+		c.Env["err"] = p.Title
+	}
+	writeProblem(rw, p)
+}
+
+func writeProblem(rw http.ResponseWriter, p *Problem) {
+	buf, err := json.Marshal(p)
+	if err != nil { // unmarshalable extension
+		buf, _ = json.Marshal(Problem{Type: p.Type, Title: p.Title, Status: p.Status,
+			Detail: p.Detail, Instance: p.Instance})
+	}
+	rw.Header().Set("Content-Type", ApplicationProblemJSON)
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(p.Status)
+	rw.Write(buf)
+}
+
+// Convenience function to call ErrorString with a format string, it's the format string
+// that is translated using ErrorCatalog. The format is interpreted by fmt.Errorf so %w can be
+// used to wrap an error argument, if there's any the resulting error is placed into
+// c.Env[ContextError].
 func Errorf(c web.C, rw http.ResponseWriter, code int, message string, args ...interface{}) {
-	str := fmt.Sprintf(message, args...)
-	ErrorString(c, rw, code, str)
+	err := fmt.Errorf(message, args...)
+	for _, a := range args {
+		if _, ok := a.(error); ok {
+			c.Env[ContextError] = err
+			break
+		}
+	}
+	format, lang := translate(c, message, message)
+	errorString(c, rw, code, err.Error(), fmt.Errorf(format, args...).Error(), lang, nil)
+}
+
+// ContextError is the hash key in which Errorf, ErrorInternal, and WriteError place the
+// original error value so downstream middleware, e.g. error reporters, can inspect it, while
+// c.Env["err"] only holds its message. Logger15 logs the types along its chain.
+var ContextError string = "error"
+
+// GetError returns the error placed into c.Env by the error helpers or nil
+func GetError(c web.C) error {
+	err, _ := c.Env[ContextError].(error)
+	return err
+}
+
+// errorChain returns the types of the errors along err's chain, outermost first
+func errorChain(err error) string {
+	var types []string
+	for ; err != nil; err = errors.Unwrap(err) {
+		types = append(types, fmt.Sprintf("%T", err))
+	}
+	return strings.Join(types, " > ")
+}
+
+// ContextErrKV is the hash key in which ErrorKV places the error's key/value pairs
+var ContextErrKV string = "errKV"
+
+// ErrorKV is like ErrorString but also attaches key/value pairs describing the error to the
+// context, Logger15 then logs them as separate fields next to the "err" message, e.g.
+// ErrorKV(c, rw, 404, "Account not found", "account", id, "shard", shard)
+func ErrorKV(c web.C, rw http.ResponseWriter, code int, msg string, kvs ...interface{}) {
+	prev, _ := c.Env[ContextErrKV].([]interface{})
+	c.Env[ContextErrKV] = append(prev, kvs...)
+	ErrorString(c, rw, code, msg)
 }
 
 // Convenience function to produce an internal error based on the err argument
 func ErrorInternal(c web.C, rw http.ResponseWriter, err error) {
-	// produce stack backtrace, max 64KB
-	const size = 64 << 10 // 64KB
-	buf := make([]byte, size)
-	buf = buf[:runtime.Stack(buf, false)]
-	lines := strings.Split(string(buf), "\n")
-	c.Env["stack"] = lines[3:]
+	// produce stack backtrace, starting at our caller
+	c.Env["stack"] = callers(1)
 
 	if err != nil {
+		c.Env[ContextError] = err
 		ErrorString(c, rw, 500, err.Error())
 	} else {
 		ErrorString(c, rw, 500, "nil err passed into gojiutil.ErrorInternal")
 	}
 }
+
+// StatusCoder is implemented by errors that know which HTTP status they map to
+type StatusCoder interface {
+	StatusCode() int
+}
+
+// APIError is an error carrying everything needed to produce its response, so handlers can
+// bail out with WriteError(c, rw, err) instead of choosing statuses inline. Code is an
+// application error code, used to translate Message using ErrorCatalog and sent to the client
+// along with Details in JSON and problem details error bodies. Details are also logged.
+type APIError struct {
+	Code    string
+	Status  int // default 500
+	Message string
+	Details map[string]interface{}
+}
+
+// Error implements error
+func (e *APIError) Error() string { return e.Message }
+
+// StatusCode implements StatusCoder
+func (e *APIError) StatusCode() int {
+	if e.Status == 0 {
+		return http.StatusInternalServerError
+	}
+	return e.Status
+}
+
+// ErrorCode implements ErrorCoder
+func (e *APIError) ErrorCode() string { return e.Code }
+
+// errorMappers are the functions registered using RegisterErrorMapper
+var errorMappers []func(error) (int, bool)
+
+// RegisterErrorMapper registers a function WriteError uses to map errors that don't implement
+// StatusCoder to a status, typically errors of other packages, e.g. sql.ErrNoRows to 404 using
+// errors.Is. Mappers are tried in the order they were registered, the first one returning true
+// wins. They must be registered before serving.
+func RegisterErrorMapper(mapper func(err error) (status int, ok bool)) {
+	errorMappers = append(errorMappers, mapper)
+}
+
+// WriteError produces an error response for err: errors implementing StatusCoder anywhere in
+// their chain produce their status code, other errors are mapped using the functions
+// registered with RegisterErrorMapper, and anything else is an internal error. Errors that
+// carry a RetryAfter duration (such as *CircuitOpenError) also set the Retry-After header.
+// Errors implementing ErrorCoder are translated using ErrorCatalog by their code. For an
+// *APIError the client gets its Message, code, and details, the log gets the full err.
+func WriteError(c web.C, rw http.ResponseWriter, err error) {
+	if err == nil {
+		ErrorInternal(c, rw, err)
+		return
+	}
+	c.Env[ContextError] = err
+	status := 0
+	var sc StatusCoder
+	if errors.As(err, &sc) {
+		status = sc.StatusCode()
+	} else {
+		for _, mapper := range errorMappers {
+			if s, ok := mapper(err); ok {
+				status = s
+				break
+			}
+		}
+	}
+	if status == 0 {
+		ErrorInternal(c, rw, err)
+		return
+	}
+	var coe *CircuitOpenError
+	if errors.As(err, &coe) && coe.RetryAfter > 0 {
+		secs := int((coe.RetryAfter + time.Second - 1) / time.Second)
+		rw.Header().Set("Retry-After", strconv.Itoa(secs))
+	}
+	str, msg := err.Error(), err.Error()
+	var ae *APIError
+	if errors.As(err, &ae) {
+		msg = ae.Message
+	}
+	key := msg
+	var ec ErrorCoder
+	if errors.As(err, &ec) && ec.ErrorCode() != "" {
+		key = ec.ErrorCode()
+	}
+	tmsg, lang := translate(c, key, msg)
+	errorString(c, rw, status, str, tmsg, lang, ae)
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("ErrorJSON", func() {
+
+	var c web.C
+
+	BeforeEach(func() {
+		c = web.C{Env: map[interface{}]interface{}{middleware.RequestIDKey: "abc-1"}}
+	})
+
+	It("writes a JSON error body", func() {
+		rw := httptest.NewRecorder()
+		ErrorJSON(c, rw, 404, "Account not found")
+		Ω(rw.Code).Should(Equal(404))
+		Ω(rw.Header().Get("Content-Type")).Should(HavePrefix(ApplicationJSON))
+		var body ErrorBody
+		Ω(json.Unmarshal(rw.Body.Bytes(), &body)).Should(Succeed())
+		Ω(body).Should(Equal(ErrorBody{Code: 404, Message: "Account not found", RequestID: "abc-1"}))
+		Ω(c.Env["err"]).Should(Equal("Account not found"))
+	})
+
+	It("hides the details of internal errors", func() {
+		rw := httptest.NewRecorder()
+		ErrorJSON(c, rw, 500, "db is down")
+		var body ErrorBody
+		Ω(json.Unmarshal(rw.Body.Bytes(), &body)).Should(Succeed())
+		Ω(body.Message).Should(Equal("Internal Error (request ID: abc-1)"))
+		Ω(c.Env["err"]).Should(Equal("db is down"))
+	})
+
+	It("is used by Errorf with JSONErrors", func() {
+		JSONErrors = true
+		defer func() { JSONErrors = false }()
+		rw := httptest.NewRecorder()
+		Errorf(c, rw, http.StatusBadRequest, "bad id %d", 3)
+		var body ErrorBody
+		Ω(json.Unmarshal(rw.Body.Bytes(), &body)).Should(Succeed())
+		Ω(body.Message).Should(Equal("bad id 3"))
+	})
+})
+
+var _ = Describe("WriteProblem", func() {
+
+	It("writes problem details with extensions", func() {
+		c := web.C{Env: map[interface{}]interface{}{}}
+		rw := httptest.NewRecorder()
+		WriteProblem(c, rw, &Problem{Type: "https://example.com/probs/credit", Status: 403,
+			Detail: "Balance is 30", Extensions: map[string]interface{}{"balance": 30}})
+		Ω(rw.Code).Should(Equal(403))
+		Ω(rw.Header().Get("Content-Type")).Should(Equal(ApplicationProblemJSON))
+		Ω(rw.Body.String()).Should(MatchJSON(`{"type":"https://example.com/probs/credit",
+			"title":"Forbidden","status":403,"detail":"Balance is 30","balance":30}`))
+		Ω(c.Env["err"]).Should(Equal("Balance is 30"))
+	})
+
+	It("is used by ErrorInternal with ProblemErrors", func() {
+		ProblemErrors = true
+		defer func() { ProblemErrors = false }()
+		c := web.C{Env: map[interface{}]interface{}{middleware.RequestIDKey: "abc-2"}}
+		rw := httptest.NewRecorder()
+		ErrorInternal(c, rw, errors.New("boom"))
+		Ω(rw.Body.String()).Should(MatchJSON(`{"type":"about:blank",
+			"title":"Internal Server Error","status":500,
+			"detail":"Internal Error (request ID: abc-2)","request_id":"abc-2"}`))
+	})
+})
+
+var _ = Describe("WriteXML", func() {
+
+	It("writes XML or an internal error", func() {
+		c := web.C{Env: map[interface{}]interface{}{}}
+		rw := httptest.NewRecorder()
+		WriteXML(c, rw, 200, struct {
+			XMLName struct{} `xml:"ok"`
+		}{})
+		Ω(rw.Header().Get("Content-Type")).Should(Equal("application/xml; charset=utf-8"))
+		Ω(rw.Body.String()).Should(Equal(xml.Header + "<ok></ok>"))
+		rw = httptest.NewRecorder()
+		WriteXML(c, rw, 200, map[string]int{"a": 1}) // maps can't be marshaled
+		Ω(rw.Code).Should(Equal(500))
+	})
+})
+
+var _ = Describe("status responders", func() {
+
+	c := web.C{Env: map[interface{}]interface{}{}}
+
+	It("writes 204 and 201", func() {
+		rw := httptest.NewRecorder()
+		NoContent(rw)
+		Ω(rw.Code).Should(Equal(204))
+		Ω(rw.Body.Len()).Should(Equal(0))
+
+		rw = httptest.NewRecorder()
+		Created(c, rw, "/widgets/7", map[string]int{"id": 7})
+		Ω(rw.Code).Should(Equal(201))
+		Ω(rw.Header().Get("Location")).Should(Equal("/widgets/7"))
+		Ω(rw.Body.String()).Should(MatchJSON(`{"id":7}`))
+	})
+
+	It("writes 202 with the status URL", func() {
+		rw := httptest.NewRecorder()
+		Accepted(c, rw, "/jobs/3")
+		Ω(rw.Code).Should(Equal(202))
+		Ω(rw.Header().Get("Location")).Should(Equal("/jobs/3"))
+		Ω(rw.Body.String()).Should(MatchJSON(`{"status_url":"/jobs/3"}`))
+	})
+
+	It("redirects", func() {
+		r, _ := http.NewRequest("GET", "/a/b", nil)
+		rw := httptest.NewRecorder()
+		RedirectTo(rw, r, 301, "c")
+		Ω(rw.Code).Should(Equal(301))
+		Ω(rw.Header().Get("Location")).Should(Equal("/a/c"))
+
+		rw = httptest.NewRecorder()
+		RedirectTo(rw, r, 200, "/x")
+		Ω(rw.Code).Should(Equal(302))
+	})
+})
+
+var _ = Describe("APIError", func() {
+
+	var c web.C
+
+	BeforeEach(func() {
+		c = web.C{Env: map[interface{}]interface{}{middleware.RequestIDKey: "abc-1"}}
+	})
+
+	AfterEach(func() { JSONErrors = false })
+
+	It("produces its status, code and details", func() {
+		JSONErrors = true
+		rw := httptest.NewRecorder()
+		err := fmt.Errorf("creating widget: %w", &APIError{Code: "quota_exceeded", Status: 409,
+			Message: "Widget quota exceeded", Details: map[string]interface{}{"quota": 10}})
+		WriteError(c, rw, err)
+		Ω(rw.Code).Should(Equal(409))
+		Ω(rw.Body.String()).Should(MatchJSON(`{"code":409,"message":"Widget quota exceeded",
+			"request_id":"abc-1","error_code":"quota_exceeded","details":{"quota":10}}`))
+		Ω(c.Env["err"]).Should(Equal("creating widget: Widget quota exceeded"))
+		Ω(c.Env[ContextErrKV]).Should(Equal([]interface{}{"quota", 10}))
+	})
+
+	It("hides the details of internal errors", func() {
+		JSONErrors = true
+		rw := httptest.NewRecorder()
+		WriteError(c, rw, &APIError{Message: "db down", Details: map[string]interface{}{"h": 1}})
+		Ω(rw.Code).Should(Equal(500))
+		Ω(rw.Body.String()).ShouldNot(ContainSubstring("db down"))
+		Ω(rw.Body.String()).ShouldNot(ContainSubstring("details"))
+	})
+
+	It("maps errors using the registered mappers", func() {
+		errGone := errors.New("gone")
+		prev := errorMappers
+		defer func() { errorMappers = prev }()
+		RegisterErrorMapper(func(err error) (int, bool) {
+			return 410, errors.Is(err, errGone)
+		})
+		rw := httptest.NewRecorder()
+		WriteError(c, rw, fmt.Errorf("widget 7: %w", errGone))
+		Ω(rw.Code).Should(Equal(410))
+		Ω(rw.Body.String()).Should(ContainSubstring("widget 7: gone"))
+
+		rw = httptest.NewRecorder()
+		WriteError(c, rw, errors.New("other"))
+		Ω(rw.Code).Should(Equal(500))
+	})
+})
+
+var _ = Describe("ErrorRenderer", func() {
+
+	AfterEach(func() { ErrorRenderer = nil })
+
+	It("renders errors and panics", func() {
+		ErrorRenderer = func(c web.C, rw http.ResponseWriter, code int, msg string) {
+			rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+			rw.WriteHeader(code)
+			rw.Write([]byte("<h1>" + msg + "</h1>"))
+		}
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(Recoverer)
+		mx.Get("/missing", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			ErrorString(c, rw, 404, "Not here")
+		})
+		mx.Get("/boom", func(rw http.ResponseWriter, r *http.Request) { panic("secret") })
+
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/missing", nil)
+		mx.ServeHTTP(rw, req)
+		Ω(rw.Code).Should(Equal(404))
+		Ω(rw.Body.String()).Should(Equal("<h1>Not here</h1>"))
+
+		rw = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/boom", nil)
+		mx.ServeHTTP(rw, req)
+		Ω(rw.Code).Should(Equal(500))
+		Ω(rw.Header().Get("Content-Type")).Should(HavePrefix("text/html"))
+		Ω(rw.Body.String()).Should(HavePrefix("<h1>Internal Error (request ID: "))
+		Ω(rw.Body.String()).ShouldNot(ContainSubstring("secret"))
+	})
+})
@@ -0,0 +1,166 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Zero-downtime restarts by passing the listening sockets to a new process
+
+package gojiutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Environment variables used to pass the listeners to the child process, and those of
+// systemd socket activation
+const (
+	listenFDsEnv = "GOJIUTIL_LISTEN_FDS" // number of listeners, starting at fd 3
+	readyFDEnv   = "GOJIUTIL_READY_FD"   // fd closed by the child once it serves
+
+	systemdFDsEnv = "LISTEN_FDS" // number of listeners, starting at fd 3
+	systemdPIDEnv = "LISTEN_PID" // the process the listeners are meant for
+)
+
+// firstListenFD is the first inherited listener, a variable so tests can pass their own
+var firstListenFD = 3
+
+// inheritedListeners returns the listeners passed by the parent process or by systemd socket
+// activation, if any
+func inheritedListeners() ([]net.Listener, error) {
+	n, _ := strconv.Atoi(os.Getenv(listenFDsEnv))
+	if pid, _ := strconv.Atoi(os.Getenv(systemdPIDEnv)); n <= 0 && pid == os.Getpid() {
+		n, _ = strconv.Atoi(os.Getenv(systemdFDsEnv))
+	}
+	// don't pass them on to our own children
+	for _, env := range []string{listenFDsEnv, systemdFDsEnv, systemdPIDEnv, "LISTEN_FDNAMES"} {
+		os.Unsetenv(env)
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	var ls []net.Listener
+	for fd := firstListenFD; fd < firstListenFD+n; fd++ {
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("listener%d", fd))
+		l, err := net.FileListener(f)
+		f.Close() // FileListener dups the fd
+		if err != nil {
+			return nil, fmt.Errorf("inherited listener fd %d: %s", fd, err)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// signalReady tells the parent process that we're serving, if we have one
+func signalReady() {
+	fd, _ := strconv.Atoi(os.Getenv(readyFDEnv))
+	if fd <= 0 {
+		return
+	}
+	os.Unsetenv(readyFDEnv)
+	os.NewFile(uintptr(fd), "ready").Close()
+}
+
+// Restart re-executes the running binary with the same arguments, passing it the server's
+// listening sockets. The new process picks them up in Listen, so no connection is refused,
+// and signals when it serves. Restart waits for that, or fails after timeout killing the
+// child. The caller then drains and exits using Shutdown, which completes the handover.
+func (s *Server) Restart(timeout time.Duration) (*os.Process, error) {
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range s.listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("listener %s cannot be passed on", l.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer ready.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		readyW.Close()
+		return nil, err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", listenFDsEnv, len(files)),
+		fmt.Sprintf("%s=%d", readyFDEnv, 3+len(files)))
+	err = cmd.Start()
+	readyW.Close() // the child has its copy
+	if err != nil {
+		return nil, err
+	}
+
+	// the read returns EOF once the child closes its end, or exits
+	done := make(chan struct{})
+	go func() {
+		ready.Read(make([]byte, 1))
+		close(done)
+	}()
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		return nil, errors.New("restart: new process did not become ready in time")
+	}
+	select {
+	case err := <-exited:
+		return nil, fmt.Errorf("restart: new process exited: %v", err)
+	case <-time.After(100 * time.Millisecond):
+		// still running, assume it's serving
+	}
+	return cmd.Process, nil
+}
+
+// RestartOnSignal restarts the server whenever sig (typically SIGUSR2 or SIGHUP) is received:
+// once the new process serves, this one drains for up to drain and Serve returns. If the
+// restart fails this process carries on serving.
+func (s *Server) RestartOnSignal(sig os.Signal, drain time.Duration, log Logger) {
+	if log == nil {
+		log = log15.Root()
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig)
+	go func() {
+		for range ch {
+			p, err := s.Restart(30 * time.Second)
+			if err != nil {
+				log.Error("restart failed", "err", err)
+				continue
+			}
+			log.Info("restarted, draining", "pid", p.Pid)
+			signal.Stop(ch)
+			ctx, cancel := context.WithTimeout(context.Background(), drain)
+			err = s.Shutdown(ctx)
+			cancel()
+			if err != nil {
+				log.Warn("drain incomplete", "err", err)
+			}
+			return
+		}
+	}()
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Inherited listeners", func() {
+	var orig net.Listener
+
+	// inherit passes a duplicate of orig's socket as if it were fd 3 of this process
+	inherit := func() {
+		var err error
+		orig, err = net.Listen("tcp", "127.0.0.1:0")
+		Ω(err).ShouldNot(HaveOccurred())
+		f, err := orig.(*net.TCPListener).File()
+		Ω(err).ShouldNot(HaveOccurred())
+		defer f.Close()
+		fd, err := syscall.Dup(int(f.Fd()))
+		Ω(err).ShouldNot(HaveOccurred())
+		firstListenFD = fd
+	}
+
+	AfterEach(func() {
+		firstListenFD = 3
+		orig.Close()
+		for _, env := range []string{listenFDsEnv, systemdFDsEnv, systemdPIDEnv} {
+			os.Unsetenv(env)
+		}
+	})
+
+	It("takes over systemd's sockets", func() {
+		inherit()
+		os.Setenv("LISTEN_FDS", "1")
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		s := NewServer("127.0.0.1:0", nil)
+		Ω(s.Listen()).Should(Succeed())
+		Ω(s.Listeners()).Should(HaveLen(1))
+		defer s.Listeners()[0].Close()
+		Ω(s.Listeners()[0].Addr().String()).Should(Equal(orig.Addr().String()))
+		Ω(os.Getenv("LISTEN_FDS")).Should(BeEmpty())
+		Ω(os.Getenv("LISTEN_PID")).Should(BeEmpty())
+	})
+
+	It("takes over the sockets of the parent process", func() {
+		inherit()
+		os.Setenv(listenFDsEnv, "1")
+		ls, err := inheritedListeners()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ls).Should(HaveLen(1))
+		defer ls[0].Close()
+		Ω(ls[0].Addr().String()).Should(Equal(orig.Addr().String()))
+		Ω(os.Getenv(listenFDsEnv)).Should(BeEmpty())
+	})
+
+	It("ignores sockets meant for another process", func() {
+		inherit()
+		syscall.Close(firstListenFD)
+		os.Setenv("LISTEN_FDS", "1")
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+		ls, err := inheritedListeners()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ls).Should(BeEmpty())
+		Ω(os.Getenv("LISTEN_FDS")).Should(BeEmpty())
+	})
+})
@@ -0,0 +1,224 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Retrying outbound transport
+
+package gojiutil
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// IdempotencyKeyHeader marks a non-idempotent request as safe to retry
+var IdempotencyKeyHeader = "Idempotency-Key"
+
+// RetryOptions configures a RetryTransport
+type RetryOptions struct {
+	MaxAttempts int           // total attempts including the first, default 3
+	BaseDelay   time.Duration // backoff before the first retry, doubling after, default 100ms
+	MaxDelay    time.Duration // cap on the backoff, a longer Retry-After stops retrying, default 5s
+	BudgetRatio float64       // retries earned per request, default 0.1 (i.e. 10% extra load)
+	BudgetMax   float64       // max retries that can be banked, default 10
+	// RetryOn decides whether an attempt should be retried, the default retries transport
+	// errors and 429, 502, 503, 504 responses
+	RetryOn func(resp *http.Response, err error) bool
+	Logger  Logger // used if the request carries no logger, see WithRequestLogger
+}
+
+// RetryTransport is an http.RoundTripper that retries failed attempts with exponential
+// backoff and jitter. Only idempotent methods are retried, unless the request carries an
+// Idempotency-Key header, and requests with a body must be replayable (have GetBody). An
+// overall retry budget ensures retries can't amplify an outage: each request earns
+// BudgetRatio retries and each retry spends one.
+type RetryTransport struct {
+	Next   http.RoundTripper // defaults to http.DefaultTransport
+	opts   RetryOptions
+	mu     sync.Mutex
+	tokens float64
+}
+
+// NewRetryTransport creates a RetryTransport wrapping next
+func NewRetryTransport(next http.RoundTripper, opts RetryOptions) *RetryTransport {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 3
+	}
+	if opts.BaseDelay <= 0 {
+		opts.BaseDelay = 100 * time.Millisecond
+	}
+	if opts.MaxDelay <= 0 {
+		opts.MaxDelay = 5 * time.Second
+	}
+	if opts.BudgetRatio <= 0 {
+		opts.BudgetRatio = 0.1
+	}
+	if opts.BudgetMax <= 0 {
+		opts.BudgetMax = 10
+	}
+	if opts.RetryOn == nil {
+		opts.RetryOn = defaultRetryOn
+	}
+	if opts.Logger == nil {
+		opts.Logger = log15.Root()
+	}
+	return &RetryTransport{Next: next, opts: opts, tokens: opts.BudgetMax}
+}
+
+func defaultRetryOn(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryable returns whether r may be sent more than once
+func retryable(r *http.Request) bool {
+	if r.Body != nil && r.Body != http.NoBody && r.GetBody == nil {
+		return false
+	}
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return r.Header.Get(IdempotencyKeyHeader) != ""
+}
+
+// earn deposits the per-request share into the budget, spend withdraws one retry
+func (t *RetryTransport) earn() {
+	t.mu.Lock()
+	if t.tokens += t.opts.BudgetRatio; t.tokens > t.opts.BudgetMax {
+		t.tokens = t.opts.BudgetMax
+	}
+	t.mu.Unlock()
+}
+
+func (t *RetryTransport) spend() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tokens < 1 {
+		return false
+	}
+	t.tokens--
+	return true
+}
+
+// backoff returns the delay before retry n (n >= 1) with full jitter, or the server's
+// Retry-After. It returns false if the server asks to wait longer than MaxDelay, retrying
+// sooner would hit a server that asked clients to back off.
+func (t *RetryTransport) backoff(n int, resp *http.Response) (time.Duration, bool) {
+	if d, ok := retryAfter(resp); ok {
+		return d, d <= t.opts.MaxDelay
+	}
+	d := t.opts.BaseDelay << uint(n-1)
+	if d > t.opts.MaxDelay || d <= 0 {
+		d = t.opts.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(d)) + 1), true
+}
+
+// retryAfter parses the Retry-After header of resp, in seconds or as an HTTP date
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	v := resp.Header.Get("Retry-After")
+	if s, err := strconv.Atoi(v); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *RetryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	next := t.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	t.earn()
+	if !retryable(r) {
+		return next.RoundTrip(r)
+	}
+	log := loggerFromRequest(r, t.opts.Logger)
+
+	for attempt := 1; ; attempt++ {
+		req := r
+		if attempt > 1 && r.GetBody != nil {
+			body, err := r.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = r.Clone(r.Context())
+			req.Body = body
+		}
+		start := time.Now()
+		resp, err := next.RoundTrip(req)
+
+		if attempt >= t.opts.MaxAttempts || !t.opts.RetryOn(resp, err) {
+			return resp, err
+		}
+		delay, ok := t.backoff(attempt, resp)
+		if !ok {
+			log.Info("outbound request not retried, server asked to back off", "url",
+				r.URL.String(), "attempt", attempt, "retry_after", delay.String())
+			return resp, err
+		}
+		if !t.spend() {
+			log.Warn("outbound retry budget exhausted", "url", r.URL.String(),
+				"attempt", attempt)
+			return resp, err
+		}
+
+		ctx := []interface{}{"verb", r.Method, "url", r.URL.String(), "attempt", attempt,
+			"time", time.Since(start).String(), "retry_in", delay.String()}
+		if err != nil {
+			ctx = append(ctx, "err", err.Error())
+		} else {
+			ctx = append(ctx, "status", strconv.Itoa(resp.StatusCode))
+			// drain a little so the connection can be reused
+			io.CopyN(ioutil.Discard, resp.Body, 4096)
+			resp.Body.Close()
+		}
+		log.Info("outbound request retry", ctx...)
+
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	}
+}
+
+//===== logger propagation to outbound requests
+
+type loggerKey struct{}
+
+// WithRequestLogger returns a shallow copy of the outbound request r carrying the context
+// logger of the incoming request c, transports such as RetryTransport log through it
+func WithRequestLogger(c web.C, r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), loggerKey{}, contextLogger(c)))
+}
+
+// loggerFromRequest returns the logger attached by WithRequestLogger, the context logger of
+// the request bridged by BridgeContext, or fallback
+func loggerFromRequest(r *http.Request, fallback Logger) Logger {
+	return loggerFromContext(r.Context(), fallback)
+}
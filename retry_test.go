@@ -0,0 +1,72 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RetryTransport", func() {
+	var upstream *httptest.Server
+	var calls int
+	var client *http.Client
+
+	BeforeEach(func() {
+		calls = 0
+		upstream = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			calls++
+			if calls < 3 {
+				rw.WriteHeader(503)
+			}
+		}))
+		var logStr []string
+		client = &http.Client{Transport: NewRetryTransport(nil, RetryOptions{
+			BaseDelay: time.Millisecond, Logger: testLogger(&logStr)})}
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+	})
+
+	It("retries idempotent requests", func() {
+		resp, err := client.Get(upstream.URL)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(resp.StatusCode).Should(Equal(200))
+		Ω(calls).Should(Equal(3))
+	})
+
+	It("doesn't retry POSTs without an idempotency key", func() {
+		resp, err := client.Post(upstream.URL, "text/plain", strings.NewReader("x"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(resp.StatusCode).Should(Equal(503))
+		Ω(calls).Should(Equal(1))
+	})
+
+	It("retries POSTs with an idempotency key", func() {
+		req, _ := http.NewRequest("POST", upstream.URL, strings.NewReader("x"))
+		req.Header.Set(IdempotencyKeyHeader, "k1")
+		resp, err := client.Do(req)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(resp.StatusCode).Should(Equal(200))
+		Ω(calls).Should(Equal(3))
+	})
+
+	It("doesn't retry when asked to back off longer than MaxDelay", func() {
+		backoff := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			calls++
+			rw.Header().Set("Retry-After", "120")
+			rw.WriteHeader(503)
+		}))
+		defer backoff.Close()
+		resp, err := client.Get(backoff.URL)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(resp.StatusCode).Should(Equal(503))
+		Ω(calls).Should(Equal(1))
+	})
+})
@@ -0,0 +1,23 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+//go:build !mips && !mipsle && !mips64 && !mips64le
+// +build !mips,!mipsle,!mips64,!mips64le
+
+package gojiutil
+
+import "syscall"
+
+// soReusePort is SO_REUSEPORT, which the syscall package doesn't define on all architectures
+const soReusePort = 0xf
+
+// reusePortControl sets SO_REUSEPORT on a listening socket
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,16 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+//go:build !linux || mips || mipsle || mips64 || mips64le
+// +build !linux mips mipsle mips64 mips64le
+
+package gojiutil
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePortControl fails since SO_REUSEPORT support is limited to Linux
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
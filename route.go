@@ -0,0 +1,95 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Route patterns as low-cardinality labels
+
+package gojiutil
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+)
+
+// ContextRoute is the hash key in which RouteLabel places the pattern of the matched route
+var ContextRoute string = "route"
+
+// RouteLabel is a middleware that resolves the pattern of the route matched by goji, e.g.
+// "/users/:id" rather than "/users/12345", and places it into c.Env[ContextRoute] so
+// Logger15, metrics, and tracing can label requests with it without exploding cardinality.
+// It must be installed after mx.Router, which performs the routing within the middleware
+// stack. Requests that match no route get no label.
+func RouteLabel(c *web.C, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if p := matchedPattern(*c); p != "" {
+			c.Env[ContextRoute] = p
+		}
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// GetRoute returns the pattern of the matched route, either placed into c.Env by RouteLabel
+// or from goji's match, or "" if routing hasn't happened or nothing matched
+func GetRoute(c web.C) string {
+	if p, ok := c.Env[ContextRoute].(string); ok {
+		return p
+	}
+	return matchedPattern(c)
+}
+
+// matchedPattern returns the raw pattern of the route matched by goji
+func matchedPattern(c web.C) string {
+	switch p := web.GetMatch(c).RawPattern().(type) {
+	case string:
+		return p
+	case *regexp.Regexp:
+		return p.String()
+	}
+	return ""
+}
+
+// routeName returns the route pattern, or the request path if routing hasn't happened yet
+func routeName(c web.C, r *http.Request) string {
+	if p := GetRoute(c); p != "" {
+		return p
+	}
+	return r.URL.Path
+}
+
+// uuidRe matches UUIDs in any of the usual letter cases
+var uuidRe = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-` +
+	`[0-9a-fA-F]{12}$`)
+
+// NormalizePath replaces the path segments that look like identifiers with placeholders to
+// get a low-cardinality label when no route pattern is available: UUIDs become ":uuid",
+// numbers ":id", and hex strings of 16 characters or more, e.g. hashes or object IDs, ":hash".
+// For example /users/12345/keys/9f86d081884c7d65 becomes /users/:id/keys/:hash.
+func NormalizePath(path string) string {
+	segs := strings.Split(path, "/")
+	for i, seg := range segs {
+		switch {
+		case seg == "":
+		case uuidRe.MatchString(seg):
+			segs[i] = ":uuid"
+		case strings.Trim(seg, "0123456789") == "":
+			segs[i] = ":id"
+		case len(seg) >= 16 && isHex(strings.ToLower(seg)):
+			segs[i] = ":hash"
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+// NormalizedRoute is a middleware that labels requests whose route pattern isn't known with
+// their normalized path (see NormalizePath) in c.Env[ContextRoute], so Logger15 and metrics
+// get a usable label when routing doesn't happen within the middleware stack or nothing
+// matched. Install it after RouteLabel when using both so patterns take precedence.
+func NormalizedRoute(c *web.C, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if _, ok := c.Env[ContextRoute].(string); !ok {
+			c.Env[ContextRoute] = NormalizePath(r.URL.Path)
+		}
+		h.ServeHTTP(rw, r)
+	})
+}
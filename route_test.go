@@ -0,0 +1,87 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("RouteLabel", func() {
+
+	It("labels requests with the route pattern", func() {
+		var logStr []string
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(Logger15(testLogger(&logStr)))
+		mx.Use(mx.Router)
+		mx.Use(RouteLabel)
+		mx.Get("/users/:id", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			Ω(GetRoute(c)).Should(Equal("/users/:id"))
+		})
+		req, _ := http.NewRequest("GET", "/users/12345", nil)
+		mx.ServeHTTP(httptest.NewRecorder(), req)
+		Ω(logStr).Should(HaveLen(1))
+		Ω(logStr[0]).Should(ContainSubstring("route /users/:id"))
+	})
+
+	It("logs the route pattern as the message", func() {
+		var logStr []string
+		var observed string
+		AddStatusObserver(func(c web.C, status int, d time.Duration) { observed = GetRoute(c) })
+		defer func() { statusObservers = statusObservers[:len(statusObservers)-1] }()
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(RequestLoggerOpts(testLogger(&logStr), Logger15Opts{RouteMessage: true}))
+		mx.Use(mx.Router)
+		mx.Get("/users/:id", func(rw http.ResponseWriter, r *http.Request) {})
+		for _, path := range []string{"/users/12345", "/nowhere"} {
+			req, _ := http.NewRequest("GET", path, nil)
+			mx.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		Ω(logStr).Should(HaveLen(2))
+		Ω(logStr[0]).Should(HavePrefix("Lvl info, /users/:id, "))
+		Ω(logStr[0]).Should(ContainSubstring("path /users/12345"))
+		Ω(logStr[1]).Should(HavePrefix("Lvl warn, /nowhere, "))
+		Ω(observed).Should(Equal(""))
+
+		req, _ := http.NewRequest("GET", "/users/7", nil)
+		mx.ServeHTTP(httptest.NewRecorder(), req)
+		Ω(observed).Should(Equal("/users/:id"))
+	})
+})
+
+var _ = Describe("NormalizePath", func() {
+
+	It("replaces identifiers with placeholders", func() {
+		Ω(NormalizePath("/users/12345/keys/9f86d081884c7d65")).Should(
+			Equal("/users/:id/keys/:hash"))
+		Ω(NormalizePath("/orgs/3F2504E0-4F89-11D3-9A0C-0305E82C3301/v2/")).Should(
+			Equal("/orgs/:uuid/v2/"))
+		Ω(NormalizePath("/blobs/507f1f77bcf86cd799439011")).Should(Equal("/blobs/:hash"))
+		Ω(NormalizePath("/static/app.js")).Should(Equal("/static/app.js"))
+	})
+
+	It("labels requests without a route pattern", func() {
+		var logStr []string
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(Logger15(testLogger(&logStr)))
+		mx.Use(mx.Router)
+		mx.Use(RouteLabel)
+		mx.Use(NormalizedRoute)
+		mx.Get("/users/:id", func(rw http.ResponseWriter, r *http.Request) {})
+		for _, path := range []string{"/users/42", "/files/42/raw"} {
+			req, _ := http.NewRequest("GET", path, nil)
+			mx.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		Ω(logStr[0]).Should(ContainSubstring("route /users/:id"))
+		Ω(logStr[1]).Should(ContainSubstring("route /files/:id/raw"))
+	})
+})
@@ -0,0 +1,172 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Input sanitization of form and JSON values
+
+package gojiutil
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/zenazn/goji/web"
+)
+
+// SanitizeOptions configures Sanitize
+type SanitizeOptions struct {
+	// Strip removes offending bytes and patterns instead of rejecting the request with a 400
+	Strip bool
+	// Patterns are additional dangerous patterns, e.g. regexp.MustCompile(`(?i)<script`)
+	Patterns []*regexp.Regexp
+	// Exempt lists fields that are not sanitized, e.g. binary-ish fields holding base64 or
+	// signatures. Form fields are named as-is, JSON values by their dotted path such as
+	// "user.avatar", elements of arrays sharing the array's path.
+	Exempt []string
+}
+
+// Sanitize creates an opt-in middleware that checks the form fields in r.Form and r.PostForm
+// and the keys and string values of the JSON body in c.Env["json"] for invalid UTF-8, NUL
+// bytes, and the configured patterns. It must therefore be installed after FormParser and/or
+// GetJSONBody. As encoding/json replaces invalid UTF-8 with U+FFFD while decoding, invalid
+// UTF-8 in JSON bodies is only detected in the raw body, i.e. with GetJSONBodyRaw or
+// StrictJSONOptions.KeepRaw, Strip mode then removes it from the raw body.
+func Sanitize(opts SanitizeOptions) web.MiddlewareType {
+	exempt := make(map[string]bool, len(opts.Exempt))
+	for _, f := range opts.Exempt {
+		exempt[f] = true
+	}
+	s := &sanitizer{opts: opts, exempt: exempt}
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			err := s.raw(c.Env)
+			if err == nil {
+				err = s.form(r.Form)
+			}
+			if err == nil {
+				err = s.form(r.PostForm)
+			}
+			if js, ok := c.Env["json"]; ok && js != nil && err == nil {
+				c.Env["json"], err = s.json("", js)
+			}
+			if err != nil {
+				contextLogger(*c).Info("rejecting unsanitary input", "err", err)
+				ErrorString(*c, rw, http.StatusBadRequest, "Invalid input: "+err.Error())
+				return
+			}
+			h.ServeHTTP(rw, r)
+		})
+	}
+}
+
+type sanitizer struct {
+	opts   SanitizeOptions
+	exempt map[string]bool
+}
+
+// value checks or strips one string value
+func (s *sanitizer) value(field, v string) (string, error) {
+	if !utf8.ValidString(v) {
+		if !s.opts.Strip {
+			return v, fmt.Errorf("%s is not valid UTF-8", field)
+		}
+		v = strings.ToValidUTF8(v, "")
+	}
+	if strings.IndexByte(v, 0) >= 0 {
+		if !s.opts.Strip {
+			return v, fmt.Errorf("%s contains a NUL byte", field)
+		}
+		v = strings.Replace(v, "\x00", "", -1)
+	}
+	// stripping a pattern can produce another match, e.g. <scr<script>ipt>, so strip until
+	// nothing changes
+	for changed := true; changed; {
+		changed = false
+		for _, re := range s.opts.Patterns {
+			if !re.MatchString(v) {
+				continue
+			}
+			if !s.opts.Strip {
+				return v, fmt.Errorf("%s contains a forbidden pattern", field)
+			}
+			if stripped := re.ReplaceAllString(v, ""); stripped != v {
+				v, changed = stripped, true
+			}
+		}
+	}
+	return v, nil
+}
+
+// raw checks or strips invalid UTF-8 in the raw body kept by GetJSONBodyRaw
+func (s *sanitizer) raw(env map[interface{}]interface{}) error {
+	raw, ok := env[ContextRawBody].([]byte)
+	if !ok || utf8.Valid(raw) {
+		return nil
+	}
+	if !s.opts.Strip {
+		return fmt.Errorf("body is not valid UTF-8")
+	}
+	env[ContextRawBody] = bytes.ToValidUTF8(raw, nil)
+	return nil
+}
+
+func (s *sanitizer) form(f url.Values) error {
+	for field, values := range f {
+		if s.exempt[field] {
+			continue
+		}
+		for i, v := range values {
+			var err error
+			if values[i], err = s.value(field, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// json walks a decoded JSON value, returning it with its strings sanitized
+func (s *sanitizer) json(path string, v interface{}) (interface{}, error) {
+	if s.exempt[path] {
+		return v, nil
+	}
+	var err error
+	switch v := v.(type) {
+	case string:
+		return s.value(path, v)
+	case map[string]interface{}:
+		for k, e := range v {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			if s.exempt[p] {
+				continue
+			}
+			kf := "a key"
+			if path != "" {
+				kf = "a key of " + path
+			}
+			key, err := s.value(kf, k)
+			if err != nil {
+				return nil, err
+			}
+			if key != k {
+				delete(v, k)
+			}
+			if v[key], err = s.json(p, e); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			if v[i], err = s.json(path, e); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
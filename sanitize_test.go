@@ -0,0 +1,81 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("Sanitize", func() {
+	script := regexp.MustCompile(`(?i)<script`)
+
+	It("rejects bad JSON strings", func() {
+		s := &sanitizer{opts: SanitizeOptions{Patterns: []*regexp.Regexp{script}},
+			exempt: map[string]bool{"sig": true}}
+		_, err := s.json("", map[string]interface{}{"sig": "\x00\xff",
+			"user": map[string]interface{}{"tags": []interface{}{"ok", "a\x00"}}})
+		Ω(err).Should(MatchError("user.tags contains a NUL byte"))
+		_, err = s.json("", map[string]interface{}{"bio": "<SCRIPT>"})
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("strips when configured to", func() {
+		s := &sanitizer{opts: SanitizeOptions{Strip: true, Patterns: []*regexp.Regexp{script}}}
+		out, err := s.json("", map[string]interface{}{"a": []interface{}{"x\x00y\xff<script>"}})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(out).Should(Equal(map[string]interface{}{"a": []interface{}{"xy>"}}))
+	})
+
+	It("strips patterns until none is left", func() {
+		tag := regexp.MustCompile(`(?i)<script>`)
+		s := &sanitizer{opts: SanitizeOptions{Strip: true, Patterns: []*regexp.Regexp{tag}}}
+		out, err := s.json("", map[string]interface{}{"bio": "<scr<script>ipt>alert(1)"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(out).Should(Equal(map[string]interface{}{"bio": "alert(1)"}))
+	})
+
+	It("checks JSON object keys", func() {
+		s := &sanitizer{opts: SanitizeOptions{Patterns: []*regexp.Regexp{script}}}
+		_, err := s.json("", map[string]interface{}{"user": map[string]interface{}{"a\x00": 1}})
+		Ω(err).Should(MatchError("a key of user contains a NUL byte"))
+		_, err = s.json("", map[string]interface{}{"<script>": 1})
+		Ω(err).Should(MatchError("a key contains a forbidden pattern"))
+
+		s.opts.Strip = true
+		out, err := s.json("", map[string]interface{}{"a\x00b": "c", "<script>x": 1})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(out).Should(Equal(map[string]interface{}{"ab": "c", ">x": 1}))
+	})
+
+	It("rejects JSON bodies that aren't valid UTF-8", func() {
+		serve := func(opts SanitizeOptions) (*httptest.ResponseRecorder, []byte) {
+			var raw []byte
+			mx := web.New()
+			mx.Use(middleware.EnvInit)
+			mx.Use(GetJSONBodyRaw)
+			mx.Use(Sanitize(opts))
+			mx.Post("/", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+				raw = c.Env[ContextRawBody].([]byte)
+			})
+			req, _ := http.NewRequest("POST", "/", strings.NewReader("{\"name\":\"a\xffb\"}"))
+			req.Header.Set("Content-Type", "application/json")
+			resp := httptest.NewRecorder()
+			mx.ServeHTTP(resp, req)
+			return resp, raw
+		}
+		resp, _ := serve(SanitizeOptions{})
+		Ω(resp.Code).Should(Equal(400))
+		Ω(resp.Body.String()).Should(ContainSubstring("body is not valid UTF-8"))
+		resp, raw := serve(SanitizeOptions{Strip: true})
+		Ω(resp.Code).Should(Equal(200))
+		Ω(string(raw)).Should(Equal(`{"name":"ab"}`))
+	})
+})
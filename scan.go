@@ -0,0 +1,212 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Upload scanning hooks
+
+package gojiutil
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScanInfo describes the file being scanned
+type ScanInfo struct {
+	Field       string
+	Filename    string
+	ContentType string // sniffed from the content
+}
+
+// UploadScanner inspects uploaded files as they are streamed to the blob store. Scan reads as
+// much of r as it needs (a scanner that only looks at the header may return early) and
+// returns a non-nil error to veto the file, in which case the stored object is deleted and the
+// upload fails with a 422 detailing each vetoed file. Scanners should fail closed, i.e. an
+// inability to scan is a veto.
+type UploadScanner interface {
+	Scan(ctx context.Context, info ScanInfo, r io.Reader) error
+}
+
+// ScannerFunc adapts a function to the UploadScanner interface
+type ScannerFunc func(ctx context.Context, info ScanInfo, r io.Reader) error
+
+// Scan implements UploadScanner
+func (f ScannerFunc) Scan(ctx context.Context, info ScanInfo, r io.Reader) error {
+	return f(ctx, info, r)
+}
+
+// vetoError wraps the error of a scanner that vetoed a file
+type vetoError struct{ err error }
+
+func (e *vetoError) Error() string { return e.err.Error() }
+
+// errScanDone is used to unblock the writer when a scanner returns early
+var errScanDone = errors.New("scan done")
+
+// scanSet fans the content of a file out to the scanners, each running in its goroutine and
+// reading from a pipe. It is an io.Writer that never fails so it can't disrupt the upload.
+type scanSet struct {
+	pipes []*io.PipeWriter
+	errs  []error
+	wg    sync.WaitGroup
+}
+
+func startScanners(ctx context.Context, scanners []UploadScanner, info ScanInfo) *scanSet {
+	if len(scanners) == 0 {
+		return nil
+	}
+	ss := &scanSet{errs: make([]error, len(scanners))}
+	for i, s := range scanners {
+		pr, pw := io.Pipe()
+		ss.pipes = append(ss.pipes, pw)
+		ss.wg.Add(1)
+		go func(i int, s UploadScanner) {
+			defer ss.wg.Done()
+			ss.errs[i] = s.Scan(ctx, info, pr)
+			pr.CloseWithError(errScanDone)
+		}(i, s)
+	}
+	return ss
+}
+
+func (ss *scanSet) Write(p []byte) (int, error) {
+	for i, pw := range ss.pipes {
+		if pw == nil {
+			continue
+		}
+		if _, err := pw.Write(p); err != nil {
+			ss.pipes[i] = nil // the scanner is done reading
+		}
+	}
+	return len(p), nil
+}
+
+// finish signals the end of the content and waits for the scanners, it returns the first
+// veto. If the content is incomplete the scanners' verdicts are irrelevant.
+func (ss *scanSet) finish(complete bool) error {
+	for _, pw := range ss.pipes {
+		if pw == nil {
+			continue
+		}
+		if complete {
+			pw.Close()
+		} else {
+			pw.CloseWithError(io.ErrUnexpectedEOF)
+		}
+	}
+	ss.wg.Wait()
+	if !complete {
+		return nil
+	}
+	for _, err := range ss.errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExtensionScanner vetoes files whose sniffed content type contradicts their file extension,
+// e.g. an executable named picture.png. Extensions unknown to the mime package are allowed.
+func ExtensionScanner() UploadScanner {
+	return ScannerFunc(func(ctx context.Context, info ScanInfo, r io.Reader) error {
+		ext := strings.ToLower(filepath.Ext(info.Filename))
+		byExt := mime.TypeByExtension(ext)
+		if ext == "" || byExt == "" {
+			return nil
+		}
+		mt1, _, _ := mime.ParseMediaType(byExt)
+		mt2, _, _ := mime.ParseMediaType(info.ContentType)
+		if mt1 == mt2 || mt2 == "application/octet-stream" || mt2 == "text/plain" {
+			return nil // sniffing is inconclusive for these
+		}
+		if strings.SplitN(mt1, "/", 2)[0] == strings.SplitN(mt2, "/", 2)[0] {
+			return nil // e.g. image/jpeg named .png is sloppy but harmless
+		}
+		return fmt.Errorf("content is %s but extension %s implies %s", mt2, ext, mt1)
+	})
+}
+
+// ImageScanner vetoes images whose dimensions exceed the limits (0 means no limit) or that
+// cannot be decoded, non-image files are ignored. Only the image header is read. The
+// application chooses the accepted formats by registering their decoders, e.g. with
+// import _ "image/png", images in other formats are vetoed.
+func ImageScanner(maxWidth, maxHeight int) UploadScanner {
+	return ScannerFunc(func(ctx context.Context, info ScanInfo, r io.Reader) error {
+		if !strings.HasPrefix(info.ContentType, "image/") {
+			return nil
+		}
+		cfg, _, err := image.DecodeConfig(r)
+		if err != nil {
+			return fmt.Errorf("invalid image: %s", err)
+		}
+		if (maxWidth > 0 && cfg.Width > maxWidth) || (maxHeight > 0 && cfg.Height > maxHeight) {
+			return fmt.Errorf("image is %dx%d, max is %dx%d", cfg.Width, cfg.Height,
+				maxWidth, maxHeight)
+		}
+		return nil
+	})
+}
+
+// ClamdScanner streams files to a ClamAV daemon at addr (host:port) using the INSTREAM
+// command and vetoes those it finds infected. Errors talking to clamd also veto the file.
+func ClamdScanner(addr string, timeout time.Duration) UploadScanner {
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	return ScannerFunc(func(ctx context.Context, info ScanInfo, r io.Reader) error {
+		d := net.Dialer{Timeout: timeout}
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return fmt.Errorf("cannot scan for malware: %s", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(timeout))
+
+		if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+			return fmt.Errorf("cannot scan for malware: %s", err)
+		}
+		buf := make([]byte, 32<<10)
+		for {
+			n, rerr := r.Read(buf)
+			if n > 0 {
+				var size [4]byte
+				binary.BigEndian.PutUint32(size[:], uint32(n))
+				if _, err := conn.Write(append(size[:], buf[:n]...)); err != nil {
+					return fmt.Errorf("cannot scan for malware: %s", err)
+				}
+			}
+			if rerr == io.EOF {
+				break
+			}
+			if rerr != nil {
+				return rerr
+			}
+		}
+		if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+			return fmt.Errorf("cannot scan for malware: %s", err)
+		}
+		reply, err := ioutil.ReadAll(conn)
+		if err != nil {
+			return fmt.Errorf("cannot scan for malware: %s", err)
+		}
+		res := strings.TrimRight(string(reply), "\x00\n")
+		switch {
+		case strings.HasSuffix(res, " OK"):
+			return nil
+		case strings.HasSuffix(res, " FOUND"):
+			sig := strings.TrimSuffix(strings.TrimPrefix(res, "stream: "), " FOUND")
+			return fmt.Errorf("malware detected: %s", sig)
+		}
+		return fmt.Errorf("malware scan failed: %s", res)
+	})
+}
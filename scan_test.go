@@ -0,0 +1,109 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ClamdScanner", func() {
+	var ln net.Listener
+	var received chan string
+
+	// clamd starts a fake clamd answering each INSTREAM with reply
+	clamd := func(reply string) {
+		var err error
+		ln, err = net.Listen("tcp", "127.0.0.1:0")
+		Ω(err).ShouldNot(HaveOccurred())
+		received = make(chan string, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			cmd := make([]byte, len("zINSTREAM\x00"))
+			if _, err := io.ReadFull(conn, cmd); err != nil || string(cmd) != "zINSTREAM\x00" {
+				return
+			}
+			var content bytes.Buffer
+			for {
+				var size [4]byte
+				if _, err := io.ReadFull(conn, size[:]); err != nil {
+					return
+				}
+				n := binary.BigEndian.Uint32(size[:])
+				if n == 0 {
+					break
+				}
+				if _, err := io.CopyN(&content, conn, int64(n)); err != nil {
+					return
+				}
+			}
+			received <- content.String()
+			conn.Write([]byte(reply + "\x00"))
+		}()
+	}
+
+	AfterEach(func() { ln.Close() })
+
+	scan := func() error {
+		content := strings.Repeat("x", 40<<10) // spans two chunks
+		err := ClamdScanner(ln.Addr().String(), time.Second).Scan(context.Background(),
+			ScanInfo{Filename: "a.txt"}, strings.NewReader(content))
+		Eventually(received).Should(Receive(Equal(content)))
+		return err
+	}
+
+	It("allows clean files", func() {
+		clamd("stream: OK")
+		Ω(scan()).Should(Succeed())
+	})
+
+	It("vetoes infected files", func() {
+		clamd("stream: Eicar-Test-Signature FOUND")
+		Ω(scan()).Should(MatchError("malware detected: Eicar-Test-Signature"))
+	})
+
+	It("vetoes files it failed to scan", func() {
+		clamd("INSTREAM size limit exceeded. ERROR")
+		Ω(scan()).Should(MatchError("malware scan failed: INSTREAM size limit exceeded. ERROR"))
+
+		clamd("")
+		ln.Close()
+		err := ClamdScanner(ln.Addr().String(), time.Second).Scan(context.Background(),
+			ScanInfo{}, strings.NewReader("x"))
+		Ω(err).Should(MatchError(HavePrefix("cannot scan for malware: ")))
+	})
+})
+
+var _ = Describe("ExtensionScanner", func() {
+
+	scan := func(filename, contentType string) error {
+		return ExtensionScanner().Scan(context.Background(),
+			ScanInfo{Filename: filename, ContentType: contentType}, strings.NewReader(""))
+	}
+
+	It("vetoes files whose content contradicts their extension", func() {
+		Ω(scan("picture.png", "application/x-msdownload")).Should(MatchError(
+			"content is application/x-msdownload but extension .png implies image/png"))
+		Ω(scan("notes.html", "image/gif")).Should(HaveOccurred())
+	})
+
+	It("allows matching, inconclusive, and unknown types", func() {
+		Ω(scan("picture.PNG", "image/png")).Should(Succeed())
+		Ω(scan("picture.png", "image/jpeg")).Should(Succeed())
+		Ω(scan("picture.png", "application/octet-stream")).Should(Succeed())
+		Ω(scan("data.unknownext", "application/pdf")).Should(Succeed())
+		Ω(scan("README", "application/pdf")).Should(Succeed())
+	})
+})
@@ -0,0 +1,42 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Utilities to handle secrets safely
+
+package gojiutil
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// SecureCompare compares two secrets, e.g. a presented token with the expected one, in
+// constant time so the comparison doesn't leak how much of the secret was guessed right.
+// The inputs are hashed first so their lengths aren't leaked either.
+func SecureCompare(given, expected string) bool {
+	g := sha256.Sum256([]byte(given))
+	e := sha256.Sum256([]byte(expected))
+	return subtle.ConstantTimeCompare(g[:], e[:]) == 1
+}
+
+// RandomToken returns n cryptographically random bytes encoded as unpadded URL-safe base64,
+// suitable for session IDs, CSRF tokens, API keys, and the like. It panics if the system's
+// random source fails, which is not something to carry on from.
+func RandomToken(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic("gojiutil: crypto/rand failed: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// HashAPIKey returns the hex SHA-256 of an API key for storage, keys are then verified by
+// hashing the presented key and looking up or SecureCompare-ing the hash. A fast hash is
+// appropriate only because API keys are high-entropy random tokens (see RandomToken), use a
+// password hash such as bcrypt for user-chosen secrets.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
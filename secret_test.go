@@ -0,0 +1,23 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Secrets", func() {
+
+	It("compares and generates secrets", func() {
+		Ω(SecureCompare("abc", "abc")).Should(BeTrue())
+		Ω(SecureCompare("abc", "abd")).Should(BeFalse())
+		Ω(SecureCompare("abc", "abcd")).Should(BeFalse())
+		t := RandomToken(32)
+		Ω(t).Should(HaveLen(43))
+		Ω(t).Should(MatchRegexp(`^[A-Za-z0-9_-]+$`))
+		Ω(RandomToken(32)).ShouldNot(Equal(t))
+		Ω(HashAPIKey(t)).Should(HaveLen(64))
+		Ω(SecureCompare(HashAPIKey(t), HashAPIKey(t))).Should(BeTrue())
+	})
+})
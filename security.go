@@ -0,0 +1,138 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Security headers and CSP nonces
+
+package gojiutil
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+)
+
+// ContextCSPNonce is the hash key in which CSPNonce places the request's nonce
+var ContextCSPNonce string = "cspNonce"
+
+// SecurityOptions configures SecurityHeaders, empty fields omit the corresponding header
+type SecurityOptions struct {
+	// CSP is the Content-Security-Policy, e.g. "default-src 'self'; img-src *"
+	CSP string
+	// NonceDirectives lists the CSP directives that receive the request's nonce when CSPNonce
+	// is in use, default script-src and style-src. A directive absent from CSP is added with
+	// the default-src sources so the nonce doesn't tighten the policy unexpectedly.
+	NonceDirectives []string
+	HSTSMaxAge      int    // seconds, sets Strict-Transport-Security on TLS requests
+	FrameOptions    string // e.g. "DENY" or "SAMEORIGIN"
+	ReferrerPolicy  string // e.g. "strict-origin-when-cross-origin"
+	NoSniff         bool   // sets X-Content-Type-Options: nosniff
+}
+
+// SecurityHeaders creates a middleware that adds the usual security-related response headers.
+// If CSPNonce runs before it, the request's nonce is added to the CSP's script and style
+// directives so inline elements carrying the nonce attribute are allowed.
+func SecurityHeaders(opts SecurityOptions) web.MiddlewareType {
+	if opts.NonceDirectives == nil {
+		opts.NonceDirectives = []string{"script-src", "style-src"}
+	}
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			hdr := rw.Header()
+			if opts.CSP != "" {
+				csp := opts.CSP
+				if nonce := GetCSPNonce(*c); nonce != "" {
+					csp = addCSPNonce(csp, nonce, opts.NonceDirectives)
+				}
+				hdr.Set("Content-Security-Policy", csp)
+			}
+			if opts.HSTSMaxAge > 0 && r.TLS != nil {
+				hdr.Set("Strict-Transport-Security",
+					fmt.Sprintf("max-age=%d; includeSubDomains", opts.HSTSMaxAge))
+			}
+			if opts.FrameOptions != "" {
+				hdr.Set("X-Frame-Options", opts.FrameOptions)
+			}
+			if opts.ReferrerPolicy != "" {
+				hdr.Set("Referrer-Policy", opts.ReferrerPolicy)
+			}
+			if opts.NoSniff {
+				hdr.Set("X-Content-Type-Options", "nosniff")
+			}
+			h.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// addCSPNonce adds 'nonce-<nonce>' to the given directives of a policy
+func addCSPNonce(csp, nonce string, directives []string) string {
+	src := "'nonce-" + nonce + "'"
+	parts := strings.Split(csp, ";")
+	var defaultSrc string
+	found := make(map[string]bool)
+	for i, p := range parts {
+		f := strings.Fields(p)
+		if len(f) == 0 {
+			continue
+		}
+		name := strings.ToLower(f[0])
+		if name == "default-src" {
+			defaultSrc = strings.Join(f[1:], " ")
+		}
+		for _, d := range directives {
+			if name == d {
+				found[d] = true
+				parts[i] = strings.Join(append(f, src), " ")
+			}
+		}
+	}
+	out := make([]string, 0, len(parts)+len(directives))
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	for _, d := range directives {
+		if !found[d] {
+			out = append(out, strings.TrimSpace(d+" "+defaultSrc+" "+src))
+		}
+	}
+	return strings.Join(out, "; ")
+}
+
+// CSPNonce is a middleware that generates a cryptographically random nonce for each request
+// and places it into c.Env[ContextCSPNonce]. Install it before SecurityHeaders, which adds the
+// nonce to the Content-Security-Policy, and emit it in templates using CSPNonceFuncs.
+func CSPNonce(c *web.C, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var buf [16]byte
+		if _, err := rand.Read(buf[:]); err != nil {
+			ErrorInternal(*c, rw, err)
+			return
+		}
+		c.Env[ContextCSPNonce] = base64.StdEncoding.EncodeToString(buf[:])
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// GetCSPNonce returns the request's nonce placed into c.Env by CSPNonce, or ""
+func GetCSPNonce(c web.C) string {
+	nonce, _ := c.Env[ContextCSPNonce].(string)
+	return nonce
+}
+
+// CSPNonceFuncs returns template functions to emit the request's nonce: cspNonce returns the
+// bare value and cspNonceAttr a complete nonce="..." attribute, e.g.
+// <script {{cspNonceAttr}}>...</script>
+func CSPNonceFuncs(c web.C) template.FuncMap {
+	nonce := GetCSPNonce(c)
+	return template.FuncMap{
+		"cspNonce": func() string { return nonce },
+		"cspNonceAttr": func() template.HTMLAttr {
+			return template.HTMLAttr(`nonce="` + nonce + `"`)
+		},
+	}
+}
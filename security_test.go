@@ -0,0 +1,36 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("SecurityHeaders", func() {
+
+	It("adds the nonce to the CSP", func() {
+		var nonce string
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(CSPNonce)
+		mx.Use(SecurityHeaders(SecurityOptions{
+			CSP: "default-src 'self'; script-src 'self'", NoSniff: true}))
+		mx.Get("/", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			nonce = GetCSPNonce(c)
+		})
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		Ω(nonce).Should(HaveLen(24))
+		Ω(resp.Header().Get("Content-Security-Policy")).Should(Equal(
+			"default-src 'self'; script-src 'self' 'nonce-" + nonce +
+				"'; style-src 'self' 'nonce-" + nonce + "'"))
+		Ω(resp.Header().Get("X-Content-Type-Options")).Should(Equal("nosniff"))
+	})
+})
@@ -0,0 +1,241 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// HTTP server helper
+
+package gojiutil
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Server serves a handler, typically a goji mux, on one or more listeners
+type Server struct {
+	Addr    string
+	Handler http.Handler
+	// ReusePort opens this many listeners on Addr using SO_REUSEPORT so the kernel spreads
+	// incoming connections across them, which improves the accept throughput of services with
+	// high connection rates. -1 opens one per CPU, 0 a single regular listener. Only supported
+	// on Linux, elsewhere ListenAndServe fails if it is set.
+	ReusePort    int
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// TLS, if set, serves HTTPS using this configuration, see NewTLSServer
+	TLS *tls.Config
+	// ProxyProtocol, if set, expects connections to start with a PROXY protocol header, see
+	// NewProxyProtoListener
+	ProxyProtocol *ProxyProtoOptions
+
+	once       sync.Once
+	srv        *http.Server
+	listeners  []net.Listener
+	closeConns int32 // set to respond with Connection: close while draining
+}
+
+// NewServer creates a server for the handler listening on addr
+func NewServer(addr string, h http.Handler) *Server {
+	return &Server{Addr: addr, Handler: h}
+}
+
+// Listen opens the server's listeners, or takes over those passed by the parent process if
+// this process was started by Restart or by systemd socket activation
+func (s *Server) Listen() error {
+	if err := s.listen(); err != nil {
+		return err
+	}
+	if s.ProxyProtocol == nil {
+		return nil
+	}
+	for i, l := range s.listeners {
+		pl, err := NewProxyProtoListener(l, *s.ProxyProtocol)
+		if err != nil {
+			for _, l := range s.listeners {
+				l.Close()
+			}
+			s.listeners = nil
+			return err
+		}
+		s.listeners[i] = pl
+	}
+	return nil
+}
+
+// listen opens or inherits the raw listeners
+func (s *Server) listen() error {
+	inherited, err := inheritedListeners()
+	if err != nil {
+		return err
+	}
+	if len(inherited) > 0 {
+		s.listeners = inherited
+		return nil
+	}
+	n := s.ReusePort
+	if n < 0 {
+		n = runtime.NumCPU()
+	}
+	if n == 0 {
+		l, err := net.Listen("tcp", s.Addr)
+		if err != nil {
+			return err
+		}
+		s.listeners = []net.Listener{l}
+		return nil
+	}
+	lc := net.ListenConfig{Control: reusePortControl}
+	for i := 0; i < n; i++ {
+		l, err := lc.Listen(context.Background(), "tcp", s.Addr)
+		if err != nil {
+			for _, l := range s.listeners {
+				l.Close()
+			}
+			s.listeners = nil
+			return err
+		}
+		s.listeners = append(s.listeners, l)
+	}
+	return nil
+}
+
+// Listeners returns the open listeners, e.g. to find the port when listening on ":0"
+func (s *Server) Listeners() []net.Listener {
+	return s.listeners
+}
+
+// Serve serves on the open listeners until Shutdown, it returns the first error of a listener
+// other than http.ErrServerClosed
+func (s *Server) Serve() error {
+	srv := s.httpServer()
+	var wg sync.WaitGroup
+	errs := make(chan error, len(s.listeners))
+	for _, l := range s.listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			var err error
+			if s.TLS != nil {
+				err = srv.ServeTLS(l, "", "")
+			} else {
+				err = srv.Serve(l)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				errs <- err
+			}
+		}(l)
+	}
+	signalReady()
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// ListenAndServe opens the listeners and serves on them
+func (s *Server) ListenAndServe() error {
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+// Shutdown stops the listeners and waits for the active connections to become idle or ctx
+// to be done, see http.Server.Shutdown
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer().Shutdown(ctx)
+}
+
+// httpServer returns the underlying http.Server, creating it on first use
+func (s *Server) httpServer() *http.Server {
+	s.once.Do(func() {
+		h := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(&s.closeConns) != 0 {
+				rw.Header().Set("Connection", "close")
+			}
+			s.Handler.ServeHTTP(rw, r)
+		})
+		s.srv = &http.Server{Handler: h, ReadTimeout: s.ReadTimeout,
+			WriteTimeout: s.WriteTimeout, IdleTimeout: s.IdleTimeout, TLSConfig: s.TLS}
+	})
+	return s.srv
+}
+
+// DrainOptions configures Server.Drain
+type DrainOptions struct {
+	// Window is how long the server keeps accepting requests after Drain is called, while
+	// e.g. the load balancer deregisters it, before it stops listening
+	Window time.Duration
+	// Deadline is the hard limit for the in-flight requests to complete after the listeners
+	// are closed, their connections are then closed forcibly. Default 30s.
+	Deadline time.Duration
+	// CloseConnections responds with Connection: close from the start of the drain so clients
+	// move their keep-alive connections elsewhere
+	CloseConnections bool
+	// LogInterval is the interval at which the in-flight requests are logged, default 5s
+	LogInterval time.Duration
+	Log         Logger
+}
+
+// Drain gracefully shuts the server down: it begins the shutdown (see Draining), optionally
+// keeps serving with Connection: close for the drain window, then closes the listeners and
+// waits for the in-flight requests to complete, logging their number and the age of the
+// oldest one periodically. Once the deadline passes the remaining connections are closed and
+// the requests that were still in flight are returned. Finally the OnShutdown hooks are run
+// with the same deadline. The requests are tracked by TrackInFlight, see AddCommon.
+func (s *Server) Drain(opts DrainOptions) []InFlightRequest {
+	if opts.Deadline <= 0 {
+		opts.Deadline = 30 * time.Second
+	}
+	if opts.LogInterval <= 0 {
+		opts.LogInterval = 5 * time.Second
+	}
+	if opts.Log == nil {
+		opts.Log = log15.Root()
+	}
+	BeginShutdown()
+	if opts.CloseConnections {
+		atomic.StoreInt32(&s.closeConns, 1)
+	}
+	time.Sleep(opts.Window)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), opts.Deadline)
+		defer cancel()
+		if err := RunShutdownHooks(ctx); err != nil {
+			opts.Log.Warn("shutdown hooks failed", "err", err)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Deadline)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(ctx) }()
+	tick := time.NewTicker(opts.LogInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case err := <-done:
+			if err == nil {
+				opts.Log.Info("drain complete")
+				return nil
+			}
+			remaining := InFlight()
+			opts.Log.Warn("drain deadline exceeded, closing connections",
+				"in_flight", len(remaining))
+			s.httpServer().Close()
+			return remaining
+		case <-tick.C:
+			reqs := InFlight()
+			if len(reqs) > 0 {
+				opts.Log.Info("draining", "in_flight", len(reqs),
+					"oldest", reqs[0].Method+" "+reqs[0].Path, "age", reqs[0].Age().String())
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+)
+
+var _ = Describe("Server", func() {
+
+	It("serves on SO_REUSEPORT listeners", func() {
+		if runtime.GOOS != "linux" {
+			Skip("SO_REUSEPORT is only supported on Linux")
+		}
+		s := NewServer("127.0.0.1:0", http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte("ok"))
+		}))
+		Ω(s.Listen()).Should(Succeed())
+		// open more listeners on the now known port
+		addr := s.Listeners()[0].Addr().String()
+		s.Listeners()[0].Close()
+		s = NewServer(addr, s.Handler)
+		s.ReusePort = 3
+		Ω(s.Listen()).Should(Succeed())
+		Ω(s.Listeners()).Should(HaveLen(3))
+		done := make(chan error)
+		go func() { done <- s.Serve() }()
+
+		resp, err := http.Get("http://" + addr)
+		Ω(err).ShouldNot(HaveOccurred())
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		Ω(string(body)).Should(Equal("ok"))
+		Ω(s.Shutdown(context.Background())).Should(Succeed())
+		Eventually(done).Should(Receive(BeNil()))
+	})
+	It("drains reporting in-flight requests", func() {
+		var logStr []string
+		mx := web.New()
+		AddCommonOpts(mx, WithoutLogger())
+		block := make(chan struct{})
+		mx.Get("/slow", func(rw http.ResponseWriter, r *http.Request) { <-block })
+		s := NewServer("127.0.0.1:0", mx)
+		Ω(s.Listen()).Should(Succeed())
+		go s.Serve()
+		go http.Get("http://" + s.Listeners()[0].Addr().String() + "/slow")
+		Eventually(InFlight).Should(HaveLen(1))
+
+		hooked := false
+		OnShutdown(func(ctx context.Context) error { hooked = true; return nil })
+		defer atomic.StoreInt32(&shutdown.started, 0)
+		remaining := s.Drain(DrainOptions{Deadline: 50 * time.Millisecond,
+			Log: testLogger(&logStr)})
+		Ω(hooked).Should(BeTrue())
+		Ω(remaining).Should(HaveLen(1))
+		Ω(remaining[0].Path).Should(Equal("/slow"))
+		close(block)
+		Eventually(InFlight).Should(BeEmpty())
+	})
+})
@@ -0,0 +1,77 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Shutdown hooks and connection draining
+
+package gojiutil
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/zenazn/goji/web"
+)
+
+var shutdown struct {
+	mu      sync.Mutex
+	hooks   []func(context.Context) error
+	started int32
+}
+
+// OnShutdown registers fn to be called by RunShutdownHooks, e.g. to flush buffers or close
+// database connections once the in-flight requests completed. Hooks run in the reverse order
+// of their registration, like deferred calls.
+func OnShutdown(fn func(context.Context) error) {
+	shutdown.mu.Lock()
+	shutdown.hooks = append(shutdown.hooks, fn)
+	shutdown.mu.Unlock()
+}
+
+// BeginShutdown marks the process as shutting down, from then on the Draining middleware
+// rejects requests. Server.Drain calls it.
+func BeginShutdown() {
+	atomic.StoreInt32(&shutdown.started, 1)
+}
+
+// ShuttingDown returns whether BeginShutdown was called
+func ShuttingDown() bool {
+	return atomic.LoadInt32(&shutdown.started) != 0
+}
+
+// RunShutdownHooks calls the hooks registered using OnShutdown, once, and returns their
+// errors joined. It calls BeginShutdown if that hasn't happened yet. Server.Drain calls it
+// once the in-flight requests completed.
+func RunShutdownHooks(ctx context.Context) error {
+	BeginShutdown()
+	shutdown.mu.Lock()
+	hooks := shutdown.hooks
+	shutdown.hooks = nil
+	shutdown.mu.Unlock()
+	var errs []error
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i](ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Draining creates a middleware that responds with a 503 and Connection: close once shutdown
+// began, so load balancers stop sending traffic and clients move their keep-alive
+// connections elsewhere while the in-flight requests complete. Install it early in the
+// stack but after Logger15 so the rejected requests are logged.
+func Draining() web.MiddlewareType {
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if ShuttingDown() {
+				rw.Header().Set("Connection", "close")
+				ErrorString(*c, rw, http.StatusServiceUnavailable,
+					"Service shutting down, please retry")
+				return
+			}
+			h.ServeHTTP(rw, r)
+		})
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("Shutdown", func() {
+
+	AfterEach(func() {
+		atomic.StoreInt32(&shutdown.started, 0)
+		shutdown.hooks = nil
+	})
+
+	It("runs the hooks once in reverse order", func() {
+		var order []string
+		OnShutdown(func(ctx context.Context) error {
+			order = append(order, "db")
+			return errors.New("db close failed")
+		})
+		OnShutdown(func(ctx context.Context) error {
+			order = append(order, "flush")
+			return nil
+		})
+		err := RunShutdownHooks(context.Background())
+		Ω(err).Should(MatchError("db close failed"))
+		Ω(order).Should(Equal([]string{"flush", "db"}))
+		Ω(ShuttingDown()).Should(BeTrue())
+		Ω(RunShutdownHooks(context.Background())).Should(Succeed())
+		Ω(order).Should(HaveLen(2))
+	})
+
+	It("rejects requests once shutdown began", func() {
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(Draining())
+		mx.Get("/", func(rw http.ResponseWriter, r *http.Request) {})
+		serve := func() *httptest.ResponseRecorder {
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/", nil)
+			mx.ServeHTTP(rw, req)
+			return rw
+		}
+		Ω(serve().Code).Should(Equal(200))
+		BeginShutdown()
+		rw := serve()
+		Ω(rw.Code).Should(Equal(503))
+		Ω(rw.Header().Get("Connection")).Should(Equal("close"))
+		Ω(rw.Body.String()).Should(Equal("Service shutting down, please retry\n"))
+		Ω(NewHealth().Ready(context.Background()).Status).Should(Equal("fail"))
+	})
+})
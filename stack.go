@@ -0,0 +1,75 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Structured call stacks
+
+package gojiutil
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// Frame is one level of a call stack
+type Frame struct {
+	Func string // fully qualified function name, e.g. github.com/acme/svc.(*Store).Get
+	File string
+	Line int
+}
+
+// String formats the frame the way Logger15 logs it
+func (f Frame) String() string {
+	return fmt.Sprintf("%s @ %s:%d", f.Func, f.File, f.Line)
+}
+
+// StackDepth is the number of frames Logger15 logs as stack0, stack1, ... fields
+var StackDepth = 3
+
+// StackFilters are the function name prefixes of the frames Logger15 omits from the logged
+// stack, so the first field points to the code that failed rather than to the runtime or
+// the middlewares in between
+var StackFilters = []string{"runtime.", "github.com/zenazn/goji/"}
+
+// maxFrames is the maximum number of frames captured by callers
+const maxFrames = 64
+
+// callers captures the call stack of its caller, skipping skip additional levels, frames are
+// resolved using runtime.CallersFrames so inlined calls are accounted for
+func callers(skip int) []Frame {
+	pcs := make([]uintptr, maxFrames)
+	pcs = pcs[:runtime.Callers(skip+2, pcs)]
+	frames := runtime.CallersFrames(pcs)
+	stack := make([]Frame, 0, len(pcs))
+	for {
+		f, more := frames.Next()
+		stack = append(stack, Frame{Func: f.Function, File: f.File, Line: f.Line})
+		if !more {
+			return stack
+		}
+	}
+}
+
+// frameFields turns the top StackDepth frames that aren't filtered out into stack%d log
+// fields
+func frameFields(stack []Frame) []interface{} {
+	var ctx []interface{}
+	for _, f := range stack {
+		if len(ctx) == 2*StackDepth {
+			break
+		}
+		if stackFiltered(f.Func) {
+			continue
+		}
+		ctx = append(ctx, fmt.Sprintf("stack%d", len(ctx)/2), f.String())
+	}
+	return ctx
+}
+
+func stackFiltered(fn string) bool {
+	for _, p := range StackFilters {
+		if strings.HasPrefix(fn, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("Frames", func() {
+
+	It("captures typed frames", func() {
+		stack := callers(0)
+		Ω(len(stack)).Should(BeNumerically(">", 2))
+		Ω(stack[0].Func).Should(HavePrefix("github.com/rightscale/gojiutil."))
+		Ω(stack[0].File).Should(HaveSuffix("stack_test.go"))
+		Ω(stack[0].Line).Should(BeNumerically(">", 0))
+	})
+
+	It("logs the configured depth without filtered frames", func() {
+		stack := []Frame{{"runtime.gopanic", "panic.go", 1}, {"main.a", "a.go", 2},
+			{"github.com/zenazn/goji/web.(*C).x", "c.go", 3}, {"main.b", "b.go", 4},
+			{"main.c", "c.go", 5}}
+		defer func(d int) { StackDepth = d }(StackDepth)
+		StackDepth = 2
+		Ω(frameFields(stack)).Should(Equal([]interface{}{"stack0", "main.a @ a.go:2",
+			"stack1", "main.b @ b.go:4"}))
+	})
+
+	It("is passed to the hook and logged from the panicking function", func() {
+		var logStr []string
+		var hooked []Frame
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(Logger15(testLogger(&logStr)))
+		mx.Use(RecovererWithHook(func(c web.C, r *http.Request, v interface{}, stack []Frame) {
+			Ω(r.URL.Path).Should(Equal("/"))
+			Ω(v).Should(Equal("boom"))
+			hooked = stack
+		}))
+		mx.Get("/", func(rw http.ResponseWriter, r *http.Request) { panic("boom") })
+		req, _ := http.NewRequest("GET", "/", nil)
+		mx.ServeHTTP(httptest.NewRecorder(), req)
+		Ω(hooked).ShouldNot(BeEmpty())
+		Ω(logStr[0]).Should(MatchRegexp(`stack0 github.com/rightscale/gojiutil\.[^ ]+ @ .*stack_test.go:\d+`))
+	})
+})
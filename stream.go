@@ -0,0 +1,147 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Streaming responses with integrity trailers
+
+package gojiutil
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+// ContentDigestTrailer is the trailer carrying the SHA-256 of a streamed body, in the
+// RFC 9530 format sha-256=:<base64>:
+const ContentDigestTrailer = "Content-Digest"
+
+// StreamOptions configures NewStream
+type StreamOptions struct {
+	// Checksum emits the SHA-256 of the body in the Content-Digest trailer so clients can
+	// verify they received the complete and uncorrupted output
+	Checksum bool
+	// Trailers declares additional trailers to be set using Stream.SetTrailer
+	Trailers []string
+	// Status is the response status, default 200
+	Status int
+}
+
+// Stream writes a streamed response, e.g. NDJSON or CSV, flushing as it goes and emitting
+// HTTP trailers at the end. A client that does not see the Content-Digest trailer knows the
+// stream was cut short.
+type Stream struct {
+	rw      http.ResponseWriter
+	flusher http.Flusher
+	sum     hash.Hash
+	json    *json.Encoder
+}
+
+// NewStream declares the trailers and writes the header with the content type, the response
+// is then written using the Stream and completed with Close
+func NewStream(rw http.ResponseWriter, contentType string, opts StreamOptions) *Stream {
+	s := &Stream{rw: rw}
+	s.flusher, _ = rw.(http.Flusher)
+	trailers := opts.Trailers
+	if opts.Checksum {
+		s.sum = sha256.New()
+		trailers = append([]string{ContentDigestTrailer}, trailers...)
+	}
+	if len(trailers) > 0 {
+		rw.Header().Set("Trailer", strings.Join(trailers, ", "))
+	}
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	if opts.Status == 0 {
+		opts.Status = http.StatusOK
+	}
+	rw.WriteHeader(opts.Status)
+	return s
+}
+
+// Write implements io.Writer, e.g. for use with encoding/csv
+func (s *Stream) Write(p []byte) (int, error) {
+	n, err := s.rw.Write(p)
+	if s.sum != nil {
+		s.sum.Write(p[:n])
+	}
+	return n, err
+}
+
+// WriteJSON writes v as one line of NDJSON and flushes it
+func (s *Stream) WriteJSON(v interface{}) error {
+	if s.json == nil {
+		s.json = json.NewEncoder(s)
+	}
+	if err := s.json.Encode(v); err != nil {
+		return err
+	}
+	s.Flush()
+	return nil
+}
+
+// Flush sends what has been written so far to the client
+func (s *Stream) Flush() {
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
+
+// SetTrailer sets the value of a trailer declared in StreamOptions.Trailers
+func (s *Stream) SetTrailer(name, value string) {
+	s.rw.Header().Set(name, value)
+}
+
+// Close completes the stream, setting the Content-Digest trailer if requested. Trailers are
+// sent by net/http once the handler returns.
+func (s *Stream) Close() error {
+	if s.sum != nil {
+		s.rw.Header().Set(ContentDigestTrailer,
+			"sha-256=:"+base64.StdEncoding.EncodeToString(s.sum.Sum(nil))+":")
+	}
+	return nil
+}
+
+// StreamErrorTrailer is the trailer WriteJSONStream sets when encoding fails midway
+const StreamErrorTrailer = "X-Stream-Error"
+
+// WriteJSONStream is the streaming flavor of WriteJSON for large collections: the response is
+// a JSON array whose elements are the values iter encodes using enc, sent as they're produced
+// using chunked encoding rather than buffered. Since the status has been sent by then, an
+// error returned by iter is recorded in c.Env["err"] for the logger and signaled to the client
+// by the StreamErrorTrailer trailer, the array also being left unterminated.
+func WriteJSONStream(c web.C, rw http.ResponseWriter, code int,
+	iter func(enc *json.Encoder) error) {
+	s := NewStream(rw, ApplicationJSON+"; charset=utf-8",
+		StreamOptions{Status: code, Trailers: []string{StreamErrorTrailer}})
+	s.Write([]byte("["))
+	if err := iter(json.NewEncoder(&arrayWriter{w: s})); err != nil {
+		c.Env["err"] = "JSON stream failed: " + err.Error()
+		s.SetTrailer(StreamErrorTrailer,
+			"incomplete response (request ID: "+middleware.GetReqID(c)+")")
+	} else {
+		s.Write([]byte("]\n"))
+	}
+	s.Close()
+}
+
+// arrayWriter separates the values written by a json.Encoder, which writes each value in a
+// single call, with commas
+type arrayWriter struct {
+	w io.Writer
+	n int
+}
+
+func (aw *arrayWriter) Write(p []byte) (int, error) {
+	if aw.n++; aw.n > 1 {
+		if _, err := aw.w.Write([]byte(",")); err != nil {
+			return 0, err
+		}
+	}
+	return aw.w.Write(p)
+}
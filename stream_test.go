@@ -0,0 +1,72 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+)
+
+var _ = Describe("Stream", func() {
+
+	It("emits a checksum trailer", func() {
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			s := NewStream(rw, "application/x-ndjson", StreamOptions{Checksum: true,
+				Trailers: []string{"X-Count"}})
+			s.WriteJSON(map[string]int{"a": 1})
+			s.WriteJSON(map[string]int{"a": 2})
+			s.SetTrailer("X-Count", "2")
+			s.Close()
+		}))
+		defer srv.Close()
+
+		resp, err := http.Get(srv.URL)
+		Ω(err).ShouldNot(HaveOccurred())
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		Ω(string(body)).Should(Equal("{\"a\":1}\n{\"a\":2}\n"))
+		sum := sha256.Sum256(body)
+		Ω(resp.Trailer.Get("Content-Digest")).Should(Equal(
+			"sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"))
+		Ω(resp.Trailer.Get("X-Count")).Should(Equal("2"))
+	})
+})
+
+var _ = Describe("WriteJSONStream", func() {
+
+	It("streams a JSON array", func() {
+		c := web.C{Env: map[interface{}]interface{}{}}
+		rw := httptest.NewRecorder()
+		WriteJSONStream(c, rw, 200, func(enc *json.Encoder) error {
+			for i := 0; i < 3; i++ {
+				if err := enc.Encode(map[string]int{"i": i}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		Ω(rw.Body.String()).Should(MatchJSON(`[{"i":0},{"i":1},{"i":2}]`))
+		Ω(c.Env).ShouldNot(HaveKey("err"))
+	})
+
+	It("reports errors midway", func() {
+		c := web.C{Env: map[interface{}]interface{}{}}
+		rw := httptest.NewRecorder()
+		WriteJSONStream(c, rw, 200, func(enc *json.Encoder) error {
+			enc.Encode(1)
+			return errors.New("db cursor died")
+		})
+		Ω(rw.Body.String()).Should(Equal("[1\n"))
+		Ω(rw.Header().Get(StreamErrorTrailer)).Should(HavePrefix("incomplete response"))
+		Ω(c.Env["err"]).Should(Equal("JSON stream failed: db cursor died"))
+	})
+})
@@ -0,0 +1,126 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Request-scoped background tasks
+
+package gojiutil
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+// ContextTasks is the hash key in which BackgroundTasks places the request's *Tasks
+var ContextTasks string = "tasks"
+
+// ErrDraining is returned by Tasks.Run once the TaskManager is draining
+var ErrDraining = errors.New("shutting down, background task not started")
+
+// TaskManager tracks the background tasks started by requests so they can be drained on
+// graceful shutdown
+type TaskManager struct {
+	Timeout time.Duration // max run time of each task, default 30s
+
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	draining bool
+	ctx      context.Context // canceled when draining times out
+	cancel   context.CancelFunc
+}
+
+// NewTaskManager creates a TaskManager whose tasks run for at most timeout
+func NewTaskManager(timeout time.Duration) *TaskManager {
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &TaskManager{Timeout: timeout, ctx: ctx, cancel: cancel}
+}
+
+// Drain stops new tasks from starting and waits for the outstanding ones to complete. If ctx
+// is done first the outstanding tasks are canceled and ctx's error is returned.
+func (m *TaskManager) Drain(ctx context.Context) error {
+	m.mu.Lock()
+	m.draining = true
+	m.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		m.cancel()
+		return ctx.Err()
+	}
+}
+
+// BackgroundTasks creates a middleware that places a *Tasks into c.Env[ContextTasks] for
+// handlers to start background jobs that continue after the response is sent
+func BackgroundTasks(m *TaskManager) web.MiddlewareType {
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			c.Env[ContextTasks] = &Tasks{m: m, c: *c}
+			h.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// GetTasks returns the *Tasks placed into c.Env by BackgroundTasks, or nil
+func GetTasks(c web.C) *Tasks {
+	t, _ := c.Env[ContextTasks].(*Tasks)
+	return t
+}
+
+// Tasks starts background jobs on behalf of a request
+type Tasks struct {
+	m *TaskManager
+	c web.C
+}
+
+// Run starts fn in the background, its context is independent of the request's and is
+// canceled after the manager's timeout or when draining times out. Panics are recovered and
+// reported like in Go, and the completion is logged with the request's ID.
+func (t *Tasks) Run(name string, fn func(ctx context.Context) error) error {
+	t.m.mu.Lock()
+	if t.m.draining {
+		t.m.mu.Unlock()
+		return ErrDraining
+	}
+	t.m.wg.Add(1)
+	t.m.mu.Unlock()
+
+	log := LoggerWith(contextLogger(t.c), "task", name)
+	if _, ok := t.c.Env[ContextLog]; !ok {
+		if id := middleware.GetReqID(t.c); id != "" {
+			log = LoggerWith(log, "req", id)
+		}
+	}
+	go func() {
+		defer t.m.wg.Done()
+		ctx, cancel := context.WithTimeout(t.m.ctx, t.m.Timeout)
+		defer cancel()
+		start := time.Now()
+		defer func() {
+			if err := recover(); err != nil {
+				reportPanic(t.c, log, "background task panicked", err,
+					"time", time.Since(start).String())
+			}
+		}()
+		err := fn(ctx)
+		if err != nil {
+			log.Error("background task failed", "time", time.Since(start).String(),
+				"err", err)
+		} else {
+			log.Info("background task done", "time", time.Since(start).String())
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("BackgroundTasks", func() {
+
+	It("runs tasks after the response and drains them", func() {
+		m := NewTaskManager(time.Second)
+		release := make(chan struct{})
+		finished := false
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(BackgroundTasks(m))
+		mx.Get("/", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			GetTasks(c).Run("slow", func(ctx context.Context) error {
+				<-release
+				finished = true
+				return nil
+			})
+			GetTasks(c).Run("panicky", func(ctx context.Context) error { panic("boom") })
+		})
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		Ω(resp.Code).Should(Equal(200))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		Ω(m.Drain(ctx)).Should(Equal(context.DeadlineExceeded))
+		close(release)
+		Ω(m.Drain(context.Background())).Should(Succeed())
+		Ω(finished).Should(BeTrue())
+
+		t := &Tasks{m: m, c: web.C{Env: map[interface{}]interface{}{}}}
+		Ω(t.Run("late", func(ctx context.Context) error { return nil })).Should(Equal(ErrDraining))
+	})
+})
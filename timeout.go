@@ -0,0 +1,131 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Per-request timeouts
+
+package gojiutil
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// Timeout creates a middleware that gives the handler d to produce its response. The request's
+// context carries the deadline so handlers and the clients they call can give up early. If the
+// deadline passes first, a 503 Service Unavailable is sent right away through ErrorString, so
+// the logger reports it, and whatever the handler writes afterwards is discarded with
+// http.ErrHandlerTimeout. The handler's output is buffered, hence Timeout does not suit
+// streaming responses. A panic in the handler is re-raised on the request's goroutine for
+// Recoverer to handle. As the handler shares the request's web.C with the middlewares, Timeout
+// returns only once the handler has, so handlers should give up when the context is done.
+func Timeout(d time.Duration) web.MiddlewareType {
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			r = r.WithContext(ctx)
+
+			// private copy of c to respond with while the handler still runs
+			own := web.C{URLParams: c.URLParams, Env: make(map[interface{}]interface{})}
+			for k, v := range c.Env {
+				own.Env[k] = v
+			}
+			tw := &timeoutWriter{h: make(http.Header)}
+			done := make(chan struct{})
+			var panicked interface{}
+			go func() {
+				defer func() {
+					panicked = recover()
+					close(done)
+				}()
+				h.ServeHTTP(tw, r)
+			}()
+
+			select {
+			case <-done:
+				if panicked != nil {
+					panic(panicked)
+				}
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				tw.writeTo(rw)
+				return
+			case <-ctx.Done():
+			}
+
+			tw.mu.Lock()
+			tw.timedOut = true
+			tw.mu.Unlock()
+			timedOut := ctx.Err() == context.DeadlineExceeded
+			if timedOut {
+				ew := &timeoutWriter{h: make(http.Header)}
+				Errorf(own, ew, http.StatusServiceUnavailable, "Request timed out after %s", d)
+				// with a length the client doesn't wait for the handler to complete
+				ew.h.Set("Content-Length", strconv.Itoa(ew.buf.Len()))
+				ew.writeTo(rw)
+				if f, ok := rw.(http.Flusher); ok {
+					f.Flush()
+				}
+			}
+			// otherwise the client went away and there's no-one to respond to
+
+			<-done
+			if timedOut && c.Env != nil {
+				c.Env["err"] = own.Env["err"]
+			}
+			if panicked != nil {
+				panic(panicked)
+			}
+		})
+	}
+}
+
+// timeoutWriter buffers the handler's response until it completes or times out
+type timeoutWriter struct {
+	mu       sync.Mutex
+	h        http.Header
+	buf      bytes.Buffer
+	status   int
+	timedOut bool
+}
+
+// Header returns the buffered header, which must not be used after a time-out
+func (tw *timeoutWriter) Header() http.Header { return tw.h }
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.status == 0 && !tw.timedOut {
+		tw.status = code
+	}
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	return tw.buf.Write(p)
+}
+
+// writeTo writes the buffered response to rw
+func (tw *timeoutWriter) writeTo(rw http.ResponseWriter) {
+	hdr := rw.Header()
+	for k, v := range tw.h {
+		hdr[k] = v
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	rw.WriteHeader(tw.status)
+	rw.Write(tw.buf.Bytes())
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("Timeout", func() {
+
+	var mx *web.Mux
+	var env map[interface{}]interface{}
+
+	BeforeEach(func() {
+		mx = web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(func(c *web.C, h http.Handler) http.Handler {
+			return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				env = c.Env
+				h.ServeHTTP(rw, r)
+			})
+		})
+		mx.Use(Timeout(20 * time.Millisecond))
+	})
+
+	It("passes fast responses through", func() {
+		mx.Get("/", func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("X-Foo", "bar")
+			rw.WriteHeader(201)
+			rw.Write([]byte("done"))
+		})
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		Ω(resp.Code).Should(Equal(201))
+		Ω(resp.Header().Get("X-Foo")).Should(Equal("bar"))
+		Ω(resp.Body.String()).Should(Equal("done"))
+	})
+
+	It("responds 503 to slow handlers and cancels their context", func() {
+		cancelled := make(chan struct{})
+		mx.Get("/", func(rw http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+			close(cancelled)
+		})
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		Ω(resp.Code).Should(Equal(503))
+		Ω(env["err"]).Should(Equal("Request timed out after 20ms"))
+		Eventually(cancelled).Should(BeClosed())
+	})
+
+	It("responds on time while the handler still uses the request's state", func() {
+		logged := make(chan interface{}, 1)
+		mx = web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(func(c *web.C, h http.Handler) http.Handler {
+			return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				h.ServeHTTP(rw, r)
+				logged <- c.Env["err"]
+			})
+		})
+		mx.Use(Timeout(20 * time.Millisecond))
+		release := make(chan struct{})
+		mx.Get("/items/:id", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			<-release // ignores the context
+			c.Env["item"] = c.URLParams["id"]
+			rw.Write([]byte("too late"))
+		})
+		srv := httptest.NewServer(mx)
+		defer srv.Close()
+		defer close(release)
+
+		resp, err := http.Get(srv.URL + "/items/42")
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(resp.StatusCode).Should(Equal(503))
+		Consistently(logged).ShouldNot(Receive())
+
+		release <- struct{}{}
+		Eventually(logged).Should(Receive(Equal("Request timed out after 20ms")))
+	})
+
+	It("re-raises panics", func() {
+		mx.Get("/", func(rw http.ResponseWriter, r *http.Request) { panic("boom") })
+		req, _ := http.NewRequest("GET", "/", nil)
+		Ω(func() { mx.ServeHTTP(httptest.NewRecorder(), req) }).Should(Panic())
+	})
+})
@@ -0,0 +1,71 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Per-request timing breakdown
+
+package gojiutil
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// ContextTimings is the hash key in which AddTiming records the timing breakdown of a request
+var ContextTimings string = "timings"
+
+// Timing is the time spent in one phase of a request
+type Timing struct {
+	Name     string
+	Duration time.Duration
+}
+
+type timings struct {
+	sync.Mutex
+	list []Timing
+}
+
+// AddTiming records that the request spent d in the phase name, e.g. a database query. The
+// request logger logs the breakdown with requests slower than Logger15Opts.SlowThreshold.
+// It does nothing if c.Env isn't allocated.
+func AddTiming(c web.C, name string, d time.Duration) {
+	if c.Env == nil {
+		return
+	}
+	t, ok := c.Env[ContextTimings].(*timings)
+	if !ok {
+		t = &timings{}
+		c.Env[ContextTimings] = t
+	}
+	t.Lock()
+	t.list = append(t.list, Timing{name, d})
+	t.Unlock()
+}
+
+// StartTiming starts timing the phase name and returns the function that ends it, e.g.
+// defer gojiutil.StartTiming(c, "db")()
+func StartTiming(c web.C, name string) func() {
+	start := time.Now()
+	return func() { AddTiming(c, name, time.Since(start)) }
+}
+
+// GetTimings returns the timing breakdown recorded for the request, in order
+func GetTimings(c web.C) []Timing {
+	t, ok := c.Env[ContextTimings].(*timings)
+	if !ok {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+	return append([]Timing(nil), t.list...)
+}
+
+// timingsField formats the timing breakdown of a request as name=duration pairs
+func timingsField(list []Timing) string {
+	parts := make([]string, len(list))
+	for i, t := range list {
+		parts[i] = t.Name + "=" + t.Duration.String()
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// TLS serving with modern defaults and ACME certificates
+
+package gojiutil
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+)
+
+// CertManager is the subset of golang.org/x/crypto/acme/autocert's *Manager used by
+// ServeTLS, declaring it here avoids a hard dependency on x/crypto
+type CertManager interface {
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+	// HTTPHandler answers the ACME HTTP-01 challenges and passes other requests to fallback,
+	// or redirects them to HTTPS if fallback is nil
+	HTTPHandler(fallback http.Handler) http.Handler
+}
+
+// TLSOptions configures ServeTLS, either CertFile and KeyFile or Autocert must be set
+type TLSOptions struct {
+	Addr     string // HTTPS address, default ":443"
+	CertFile string // PEM certificate chain
+	KeyFile  string // PEM private key
+	// Autocert obtains and renews certificates, typically from Let's Encrypt, e.g.
+	// &autocert.Manager{Prompt: autocert.AcceptTOS, HostPolicy: autocert.HostWhitelist(..),
+	// Cache: autocert.DirCache(..)}
+	Autocert CertManager
+	// HTTPAddr, if set, e.g. to ":80", serves plain HTTP there, redirecting to HTTPS and
+	// answering the ACME HTTP-01 challenges when using Autocert
+	HTTPAddr string
+}
+
+// ModernTLSConfig returns a TLS configuration limited to TLS 1.2 and later with forward
+// secret AEAD cipher suites, which all current clients support
+func ModernTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		CipherSuites: []uint16{ // TLS 1.3 suites aren't configurable and are all fine
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	}
+}
+
+// NewTLSServer creates a Server serving mx over TLS with ModernTLSConfig and the certificates
+// of opts. With Autocert the HTTP-01 challenge handler is also mounted onto mx, so challenges
+// are answered when mx is reached over plain HTTP, e.g. through a load balancer.
+func NewTLSServer(mx *web.Mux, opts TLSOptions) (*Server, error) {
+	cfg := ModernTLSConfig()
+	switch {
+	case opts.Autocert != nil:
+		cfg.GetCertificate = opts.Autocert.GetCertificate
+		cfg.NextProtos = []string{"h2", "http/1.1", "acme-tls/1"}
+		mx.Handle("/.well-known/acme-challenge/*", opts.Autocert.HTTPHandler(nil))
+	case opts.CertFile != "" && opts.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	default:
+		return nil, errors.New("gojiutil: TLS requires CertFile and KeyFile or Autocert")
+	}
+	if opts.Addr == "" {
+		opts.Addr = ":443"
+	}
+	s := NewServer(opts.Addr, mx)
+	s.TLS = cfg
+	return s, nil
+}
+
+// ServeTLS serves mx over TLS as configured by opts, see NewTLSServer, and over plain HTTP at
+// opts.HTTPAddr if set. It returns the first serving error.
+func ServeTLS(mx *web.Mux, opts TLSOptions) error {
+	s, err := NewTLSServer(mx, opts)
+	if err != nil {
+		return err
+	}
+	errs := make(chan error, 2)
+	if opts.HTTPAddr != "" {
+		h := redirectHTTPS(s.Addr)
+		if opts.Autocert != nil {
+			h = opts.Autocert.HTTPHandler(h)
+		}
+		go func() { errs <- NewServer(opts.HTTPAddr, h).ListenAndServe() }()
+	}
+	go func() { errs <- s.ListenAndServe() }()
+	return <-errs
+}
+
+// redirectHTTPS returns a handler redirecting plain HTTP requests to the same URL over HTTPS
+// at tlsAddr's port, permanently. Other methods than GET and HEAD get a 308 so clients don't
+// turn them into GETs.
+func redirectHTTPS(tlsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]" // IPv6 literal
+		}
+		u := *r.URL
+		u.Scheme, u.Host = "https", host
+		code := http.StatusMovedPermanently
+		if r.Method != "GET" && r.Method != "HEAD" {
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(rw, r, u.String(), code)
+	})
+}
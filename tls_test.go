@@ -0,0 +1,123 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+)
+
+// fakeCertManager answers every challenge with "token"
+type fakeCertManager struct{}
+
+func (fakeCertManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return nil, nil
+}
+
+func (fakeCertManager) HTTPHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("token"))
+	})
+}
+
+var _ = Describe("TLS", func() {
+
+	// writeCert writes a self-signed certificate for 127.0.0.1 to dir
+	writeCert := func(dir string) (certFile, keyFile string) {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Ω(err).ShouldNot(HaveOccurred())
+		tmpl := &x509.Certificate{SerialNumber: big.NewInt(1),
+			Subject:     pkix.Name{CommonName: "127.0.0.1"},
+			IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+			NotBefore:   time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+		Ω(err).ShouldNot(HaveOccurred())
+		key, err := x509.MarshalECPrivateKey(priv)
+		Ω(err).ShouldNot(HaveOccurred())
+		certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+		Ω(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+			Bytes: der}), 0600)).Should(Succeed())
+		Ω(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY",
+			Bytes: key}), 0600)).Should(Succeed())
+		return
+	}
+
+	It("serves HTTPS with static certificates", func() {
+		dir, err := ioutil.TempDir("", "gojiutil")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		certFile, keyFile := writeCert(dir)
+
+		mx := web.New()
+		mx.Get("/", func(rw http.ResponseWriter, r *http.Request) { rw.Write([]byte("ok")) })
+		s, err := NewTLSServer(mx, TLSOptions{Addr: "127.0.0.1:0", CertFile: certFile,
+			KeyFile: keyFile})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(s.Listen()).Should(Succeed())
+		go s.Serve()
+		defer s.Shutdown(context.Background())
+
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+		resp, err := client.Get("https://" + s.Listeners()[0].Addr().String() + "/")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		Ω(string(body)).Should(Equal("ok"))
+		Ω(resp.TLS.Version).Should(BeNumerically(">=", tls.VersionTLS12))
+	})
+
+	It("mounts the ACME challenge handler with autocert", func() {
+		mx := web.New()
+		_, err := NewTLSServer(mx, TLSOptions{Autocert: fakeCertManager{}})
+		Ω(err).ShouldNot(HaveOccurred())
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/.well-known/acme-challenge/abc", nil)
+		mx.ServeHTTP(rw, req)
+		Ω(rw.Body.String()).Should(Equal("token"))
+	})
+
+	It("redirects plain HTTP to the HTTPS port", func() {
+		redirect := func(tlsAddr, method, url string) *httptest.ResponseRecorder {
+			rw := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, url, nil)
+			redirectHTTPS(tlsAddr).ServeHTTP(rw, req)
+			return rw
+		}
+		rw := redirect(":443", "GET", "http://example.com:8080/a?b=c")
+		Ω(rw.Code).Should(Equal(301))
+		Ω(rw.Header().Get("Location")).Should(Equal("https://example.com/a?b=c"))
+		rw = redirect(":8443", "GET", "http://example.com:8080/a")
+		Ω(rw.Header().Get("Location")).Should(Equal("https://example.com:8443/a"))
+		rw = redirect("127.0.0.1:8443", "POST", "http://example.com/a")
+		Ω(rw.Code).Should(Equal(308))
+		Ω(rw.Header().Get("Location")).Should(Equal("https://example.com:8443/a"))
+		rw = redirect(":8443", "GET", "http://[::1]:8080/a")
+		Ω(rw.Header().Get("Location")).Should(Equal("https://[::1]:8443/a"))
+		rw = redirect(":443", "GET", "http://[::1]:8080/a")
+		Ω(rw.Header().Get("Location")).Should(Equal("https://[::1]/a"))
+	})
+
+	It("requires certificates", func() {
+		_, err := NewTLSServer(web.New(), TLSOptions{})
+		Ω(err).Should(HaveOccurred())
+	})
+})
@@ -0,0 +1,162 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// W3C Trace Context propagation
+
+package gojiutil
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+)
+
+// ContextTrace is the hash key in which the TraceContext middleware places the request's
+// SpanContext
+var ContextTrace string = "trace"
+
+// W3C Trace Context and AWS X-Ray headers
+const (
+	TraceparentHeader = "Traceparent"
+	TracestateHeader  = "Tracestate"
+	AmznTraceIDHeader = "X-Amzn-Trace-Id"
+)
+
+// SpanContext identifies the span representing a request within a distributed trace, IDs are
+// lower-hex strings of 32 characters for the trace and 16 for spans
+type SpanContext struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string // span of the caller, empty if the trace started here
+	Sampled      bool
+	State        string // vendor-specific tracestate, propagated as-is
+}
+
+// TraceContextOptions configures the TraceContext middleware
+type TraceContextOptions struct {
+	B3   bool // join B3 traces when there's no traceparent header
+	Amzn bool // join AWS X-Ray traces (X-Amzn-Trace-Id) when there's no other trace header
+}
+
+// ExtractTraceparent parses the traceparent and tracestate headers, it returns false if no
+// valid trace context is present
+func ExtractTraceparent(h http.Header) (SpanContext, bool) {
+	v := strings.ToLower(strings.TrimSpace(h.Get(TraceparentHeader)))
+	// later versions may append fields, which we ignore as the spec requires
+	if len(v) < 55 || (len(v) > 55 && (v[:2] == "00" || v[55] != '-')) || v[:2] == "ff" {
+		return SpanContext{}, false
+	}
+	parts := strings.Split(v[:55], "-")
+	if len(parts) != 4 || !isHex(parts[0]) || len(parts[3]) != 2 || !isHex(parts[3]) ||
+		!validW3CID(parts[1], 32) || !validW3CID(parts[2], 16) {
+		return SpanContext{}, false
+	}
+	sc := SpanContext{TraceID: parts[1], SpanID: parts[2], Sampled: parts[3][1]&1 == 1}
+	if state := strings.Join(h[TracestateHeader], ","); len(state) <= 512 {
+		sc.State = state
+	}
+	return sc, true
+}
+
+// validW3CID checks for an n character lower-hex ID that's not all zeroes
+func validW3CID(id string, n int) bool {
+	return len(id) == n && isHex(id) && strings.Trim(id, "0") != ""
+}
+
+// InjectTraceparent sets the traceparent and tracestate headers for sc
+func InjectTraceparent(h http.Header, sc SpanContext) {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	h.Set(TraceparentHeader, "00-"+sc.TraceID+"-"+sc.SpanID+"-"+flags)
+	if sc.State != "" {
+		h.Set(TracestateHeader, sc.State)
+	} else {
+		h.Del(TracestateHeader)
+	}
+}
+
+// extractAmzn parses Root=1-{8 hex time}-{24 hex};Parent={16 hex};Sampled={0|1}
+func extractAmzn(h http.Header) (SpanContext, bool) {
+	var sc SpanContext
+	for _, f := range strings.Split(h.Get(AmznTraceIDHeader), ";") {
+		kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "Root":
+			root := strings.ToLower(kv[1])
+			if len(root) == 35 && root[:2] == "1-" && root[10] == '-' {
+				sc.TraceID = root[2:10] + root[11:]
+			}
+		case "Parent":
+			sc.SpanID = strings.ToLower(kv[1])
+		case "Sampled":
+			sc.Sampled = kv[1] == "1"
+		}
+	}
+	if !validW3CID(sc.TraceID, 32) {
+		return SpanContext{}, false
+	}
+	if !validW3CID(sc.SpanID, 16) {
+		sc.SpanID = ""
+	}
+	return sc, true
+}
+
+// TraceContext creates a middleware that joins the incoming W3C trace, or the B3 or X-Ray
+// trace if enabled, or starts a new one. The context of the span representing the request is
+// placed into c.Env[ContextTrace] and the trace_id and span_id are added to the context
+// logger (so use it after ContextLogger). Use TraceContextHeaders to propagate the trace to
+// downstream calls. This lets services participate in distributed tracing without a tracing
+// SDK, use the Trace middleware to also report spans.
+func TraceContext(opts TraceContextOptions) web.MiddlewareType {
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			sc, ok := ExtractTraceparent(r.Header)
+			if !ok && opts.B3 {
+				var b3 B3Context
+				if b3, ok = ExtractB3(r.Header); ok {
+					sc = SpanContext{TraceID: b3.TraceID, SpanID: b3.SpanID,
+						Sampled: b3.Debug || b3.Sampled != nil && *b3.Sampled}
+					if len(sc.TraceID) == 16 {
+						sc.TraceID = strings.Repeat("0", 16) + sc.TraceID
+					}
+				}
+			}
+			if !ok && opts.Amzn {
+				sc, ok = extractAmzn(r.Header)
+			}
+			if ok {
+				// we're a child of the caller's span
+				sc.ParentSpanID = sc.SpanID
+			} else {
+				sc = SpanContext{TraceID: randomHex(16), Sampled: true}
+			}
+			sc.SpanID = randomHex(8)
+			c.Env[ContextTrace] = sc
+			c.Env[ContextLog] = LoggerWith(contextLogger(*c), "trace_id", sc.TraceID,
+				"span_id", sc.SpanID)
+
+			h.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// GetTraceContext returns the request's span context, ok is false if the TraceContext
+// middleware isn't installed
+func GetTraceContext(c web.C) (sc SpanContext, ok bool) {
+	sc, ok = c.Env[ContextTrace].(SpanContext)
+	return
+}
+
+// TraceContextHeaders injects the request's trace context into the headers of a downstream
+// request, whose span becomes a child of the request's span. It does nothing if the
+// TraceContext middleware isn't installed.
+func TraceContextHeaders(c web.C, h http.Header) {
+	if sc, ok := GetTraceContext(c); ok {
+		InjectTraceparent(h, sc)
+	}
+}
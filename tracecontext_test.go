@@ -0,0 +1,87 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("TraceContext", func() {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const spanID = "00f067aa0ba902b7"
+
+	serve := func(opts TraceContextOptions, hdr map[string]string) (sc SpanContext, logs []string) {
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(EnvAdd(map[string]interface{}{ContextLog: testLogger(&logs)}))
+		mx.Use(TraceContext(opts))
+		mx.Get("/", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			sc, _ = GetTraceContext(c)
+			contextLogger(c).Info("hello")
+		})
+		req, _ := http.NewRequest("GET", "/", nil)
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		mx.ServeHTTP(httptest.NewRecorder(), req)
+		return
+	}
+
+	It("parses traceparent and tracestate", func() {
+		h := http.Header{}
+		h.Set("traceparent", "00-"+traceID+"-"+spanID+"-01")
+		h.Set("tracestate", "congo=t61rcWkgMzE")
+		sc, ok := ExtractTraceparent(h)
+		Ω(ok).Should(BeTrue())
+		Ω(sc).Should(Equal(SpanContext{TraceID: traceID, SpanID: spanID, Sampled: true,
+			State: "congo=t61rcWkgMzE"}))
+
+		for _, bad := range []string{"00-" + traceID + "-" + spanID + "-01-x",
+			"ff-" + traceID + "-" + spanID + "-01", "00-" + traceID + "-0000000000000000-01",
+			"00-" + traceID[1:] + "-" + spanID + "-01", "garbage"} {
+			h.Set("traceparent", bad)
+			_, ok = ExtractTraceparent(h)
+			Ω(ok).Should(BeFalse(), bad)
+		}
+		h.Set("traceparent", "01-"+traceID+"-"+spanID+"-00-future")
+		sc, ok = ExtractTraceparent(h)
+		Ω(ok).Should(BeTrue())
+		Ω(sc.Sampled).Should(BeFalse())
+	})
+
+	It("joins the incoming trace and logs its IDs", func() {
+		sc, logs := serve(TraceContextOptions{},
+			map[string]string{"traceparent": "00-" + traceID + "-" + spanID + "-01"})
+		Ω(sc.TraceID).Should(Equal(traceID))
+		Ω(sc.ParentSpanID).Should(Equal(spanID))
+		Ω(sc.SpanID).Should(MatchRegexp(`^[0-9a-f]{16}$`))
+		Ω(logs).Should(HaveLen(1))
+		Ω(logs[0]).Should(ContainSubstring("trace_id " + traceID + " span_id " + sc.SpanID))
+
+		h := http.Header{}
+		TraceContextHeaders(web.C{Env: map[interface{}]interface{}{ContextTrace: sc}}, h)
+		Ω(h.Get("traceparent")).Should(Equal("00-" + traceID + "-" + sc.SpanID + "-01"))
+	})
+
+	It("starts a new trace or joins B3 and X-Ray traces if enabled", func() {
+		sc, _ := serve(TraceContextOptions{}, map[string]string{"b3": spanID + "-" + spanID})
+		Ω(sc.TraceID).Should(MatchRegexp(`^[0-9a-f]{32}$`))
+		Ω(sc.ParentSpanID).Should(BeEmpty())
+
+		sc, _ = serve(TraceContextOptions{B3: true},
+			map[string]string{"b3": spanID + "-" + spanID})
+		Ω(sc.TraceID).Should(Equal("0000000000000000" + spanID))
+		Ω(sc.ParentSpanID).Should(Equal(spanID))
+
+		sc, _ = serve(TraceContextOptions{Amzn: true}, map[string]string{"X-Amzn-Trace-Id": "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1"})
+		Ω(sc.TraceID).Should(Equal("5759e988bd862e3fe1be46a994272793"))
+		Ω(sc.ParentSpanID).Should(Equal("53995c3f42cd8ad8"))
+		Ω(sc.Sampled).Should(BeTrue())
+	})
+})
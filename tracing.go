@@ -0,0 +1,105 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Vendor-neutral tracing
+
+package gojiutil
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+	"github.com/zenazn/goji/web/mutil"
+)
+
+// ContextSpan is the hash key in which the Trace middleware places the request's Span
+var ContextSpan string = "span"
+
+// Tracer is the minimal interface through which the request middleware, the proxy handler,
+// and outgoing HTTP transports create spans. Adapters are provided for Datadog and Zipkin B3,
+// and for OpenTelemetry by the oteltrace package, which keeps this package free of any
+// tracing SDK dependency. Other SDKs plug in by implementing Tracer and Span.
+type Tracer interface {
+	// StartSpan starts a span called name. If parent is non-nil the span is its child,
+	// else the span continues the trace propagated in the carrier headers, if any. The
+	// carrier may be nil.
+	StartSpan(name string, parent Span, carrier http.Header) Span
+}
+
+// Span is a unit of traced work
+type Span interface {
+	SetTag(key string, value interface{})
+	// Inject propagates the span to a downstream request's headers
+	Inject(h http.Header)
+	// Finish ends the span, err is nil if the work succeeded
+	Finish(err error)
+}
+
+// Trace creates a middleware that runs each request in a span named after the method and the
+// matched route pattern (so use mx.Use(mx.Router) before it). The span is tagged with the
+// request ID and HTTP details and placed into c.Env[ContextSpan]. 5xx responses finish the
+// span with the error recorded by ErrorString, panics finish it with the panic, which is then
+// propagated.
+func Trace(tracer Tracer) web.MiddlewareType {
+	return func(c *web.C, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			span := tracer.StartSpan(r.Method+" "+routeName(*c, r), nil, r.Header)
+			span.SetTag("span.kind", "server")
+			span.SetTag("http.method", r.Method)
+			span.SetTag("http.url", r.URL.Path)
+			if id := middleware.GetReqID(*c); id != "" {
+				span.SetTag("request_id", id)
+			}
+			c.Env[ContextSpan] = span
+
+			wp := mutil.WrapWriter(rw)
+			defer func() {
+				p := recover()
+				s := wp.Status()
+				var err error
+				if p != nil {
+					// an outer Recoverer responds with a 500
+					s, err = 500, fmt.Errorf("panic: %v", p)
+				} else if s >= 500 {
+					err = errorFromEnv(*c, s)
+				}
+				span.SetTag("http.status_code", strconv.Itoa(s))
+				span.Finish(err)
+				if p != nil {
+					panic(p)
+				}
+			}()
+			h.ServeHTTP(wp, r)
+		})
+	}
+}
+
+// GetSpan returns the request's span, or nil if the Trace middleware isn't installed
+func GetSpan(c web.C) Span {
+	span, _ := c.Env[ContextSpan].(Span)
+	return span
+}
+
+// TraceHeaders propagates the request's span into the headers of a downstream request, it
+// does nothing if the Trace middleware isn't installed
+func TraceHeaders(c web.C, h http.Header) {
+	if span := GetSpan(c); span != nil {
+		span.Inject(h)
+	}
+}
+
+// errorFromEnv produces an error out of c.Env["err"] as recorded by ErrorString, or out of
+// the status code
+func errorFromEnv(c web.C, status int) error {
+	if e, ok := c.Env["err"].(string); ok {
+		return envError(e)
+	}
+	return envError(http.StatusText(status))
+}
+
+// envError is the error produced by errorFromEnv
+type envError string
+
+func (e envError) Error() string { return string(e) }
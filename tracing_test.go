@@ -0,0 +1,107 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+// fakeTracer records the spans it starts
+type fakeTracer struct{ spans []*fakeSpan }
+
+type fakeSpan struct {
+	name     string
+	carrier  http.Header
+	tags     map[string]interface{}
+	finished bool
+	err      error
+}
+
+func (t *fakeTracer) StartSpan(name string, parent Span, carrier http.Header) Span {
+	s := &fakeSpan{name: name, carrier: carrier, tags: map[string]interface{}{}}
+	t.spans = append(t.spans, s)
+	return s
+}
+
+func (s *fakeSpan) SetTag(key string, value interface{}) { s.tags[key] = value }
+func (s *fakeSpan) Inject(h http.Header)                 { h.Set("X-Span", s.name) }
+func (s *fakeSpan) Finish(err error)                     { s.finished, s.err = true, err }
+
+var _ = Describe("Trace", func() {
+
+	var tracer *fakeTracer
+
+	serve := func(handler web.HandlerFunc) {
+		tracer = &fakeTracer{}
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(middleware.RequestID)
+		mx.Use(mx.Router)
+		mx.Use(Trace(tracer))
+		mx.Get("/items/:id", handler)
+		req, _ := http.NewRequest("GET", "/items/42", nil)
+		req.Header.Set("Traceparent", "incoming")
+		mx.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	It("runs requests in a span named after the route", func() {
+		downstream := http.Header{}
+		serve(func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			Ω(GetSpan(c)).ShouldNot(BeNil())
+			TraceHeaders(c, downstream)
+			rw.WriteHeader(204)
+		})
+		Ω(tracer.spans).Should(HaveLen(1))
+		s := tracer.spans[0]
+		Ω(s.name).Should(Equal("GET /items/:id"))
+		Ω(s.carrier.Get("Traceparent")).Should(Equal("incoming"))
+		Ω(s.tags).Should(HaveKeyWithValue("http.method", "GET"))
+		Ω(s.tags).Should(HaveKeyWithValue("http.url", "/items/42"))
+		Ω(s.tags).Should(HaveKeyWithValue("http.status_code", "204"))
+		Ω(s.tags).Should(HaveKey("request_id"))
+		Ω(s.finished).Should(BeTrue())
+		Ω(s.err).ShouldNot(HaveOccurred())
+		Ω(downstream.Get("X-Span")).Should(Equal("GET /items/:id"))
+	})
+
+	It("finishes spans of 5xx responses with the error", func() {
+		serve(func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			Errorf(c, rw, 503, "db down")
+		})
+		Ω(tracer.spans[0].err).Should(MatchError("db down"))
+
+		serve(func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(500)
+		})
+		Ω(tracer.spans[0].err).Should(MatchError("Internal Server Error"))
+
+		serve(func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			Errorf(c, rw, 404, "not here")
+		})
+		Ω(tracer.spans[0].err).ShouldNot(HaveOccurred())
+	})
+
+	It("finishes the span of a panicking handler and propagates the panic", func() {
+		Ω(func() {
+			serve(func(c web.C, rw http.ResponseWriter, r *http.Request) {
+				panic("boom")
+			})
+		}).Should(PanicWith("boom"))
+		s := tracer.spans[0]
+		Ω(s.finished).Should(BeTrue())
+		Ω(s.err).Should(MatchError("panic: boom"))
+		Ω(s.tags).Should(HaveKeyWithValue("http.status_code", "500"))
+	})
+
+	It("does nothing without the middleware", func() {
+		h := http.Header{}
+		TraceHeaders(web.C{}, h)
+		Ω(h).Should(BeEmpty())
+	})
+})
@@ -0,0 +1,329 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Streaming multipart uploads to pluggable blob storage
+
+package gojiutil
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+)
+
+// BlobStore is where uploaded files are streamed to, implementations exist trivially for
+// S3, GCS, and the local filesystem (see DirStore)
+type BlobStore interface {
+	// Put stores the content read from r under key
+	Put(ctx context.Context, key, contentType string, r io.Reader) error
+	// Delete removes a stored object, it is used to clean up after a failed upload
+	Delete(ctx context.Context, key string) error
+}
+
+// DirStore is a BlobStore that writes into a local directory, keys may contain slashes to
+// store into sub-directories but keys that could escape the directory are rejected
+type DirStore struct {
+	Dir string
+}
+
+// path maps a key to a file under the store's directory
+func (d DirStore) path(key string) (string, error) {
+	if strings.ContainsAny(key, "\\\x00") {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	for _, seg := range strings.Split(key, "/") {
+		if seg == "" || seg == "." || seg == ".." || filepath.VolumeName(seg) != "" {
+			return "", fmt.Errorf("invalid blob key %q", key)
+		}
+	}
+	return filepath.Join(d.Dir, filepath.FromSlash(key)), nil
+}
+
+// Put implements BlobStore, the file is written to a temp name and renamed when complete
+func (d DirStore) Put(ctx context.Context, key, contentType string, r io.Reader) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".upload")
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Delete implements BlobStore
+func (d DirStore) Delete(ctx context.Context, key string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// UploadOptions configures StreamUpload
+type UploadOptions struct {
+	Store        BlobStore
+	MaxFileSize  int64    // per-file limit in bytes, default 32MB
+	MaxFiles     int      // default 10
+	MaxFormSize  int64    // total size of the non-file fields, default 1MB
+	AllowedTypes []string // sniffed content types allowed, e.g. "image/png" or "image/*", default any
+	// KeyFunc names the stored object, the default is a random ID followed by the file's
+	// extension
+	KeyFunc func(c web.C, field, filename string) string
+	// Scanners inspect each file while it's stored and can veto it, see UploadScanner
+	Scanners []UploadScanner
+}
+
+// StoredFile describes an uploaded file that was stored successfully
+type StoredFile struct {
+	Field       string `json:"field"`
+	Filename    string `json:"filename"`
+	Key         string `json:"key"`
+	ContentType string `json:"content_type"` // sniffed from the content, not client-supplied
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+}
+
+// UploadError reports a rejected upload, it implements StatusCoder for use with WriteError.
+// When scanners veto files the status is 422 and Files details each vetoed file.
+type UploadError struct {
+	Status int
+	Field  string
+	Msg    string
+	Files  []FileError
+}
+
+// FileError is the reason a scanner vetoed a file
+type FileError struct {
+	Field    string `json:"field"`
+	Filename string `json:"filename"`
+	Error    string `json:"error"`
+}
+
+func (e *UploadError) Error() string {
+	msg := e.Msg
+	if e.Field != "" {
+		msg = e.Field + ": " + msg
+	}
+	for _, f := range e.Files {
+		msg += fmt.Sprintf("; %s (%s): %s", f.Filename, f.Field, f.Error)
+	}
+	return msg
+}
+
+// StatusCode implements StatusCoder
+func (e *UploadError) StatusCode() int { return e.Status }
+
+// StreamUpload reads a multipart/form-data request part by part, streaming each file straight
+// into the blob store without buffering it in memory or on disk. It enforces the size, count,
+// and type limits, runs the scanners, and returns the stored files plus the regular form
+// fields. If any part is rejected, files stored so far are deleted and an *UploadError is
+// returned. Scanner vetoes don't stop processing so the error can report on every file.
+func StreamUpload(c web.C, r *http.Request, opts UploadOptions) ([]StoredFile, url.Values, error) {
+	if opts.MaxFileSize <= 0 {
+		opts.MaxFileSize = 32 << 20
+	}
+	if opts.MaxFiles <= 0 {
+		opts.MaxFiles = 10
+	}
+	if opts.MaxFormSize <= 0 {
+		opts.MaxFormSize = 1 << 20
+	}
+	if opts.KeyFunc == nil {
+		opts.KeyFunc = randomKey
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, &UploadError{Status: 400, Msg: err.Error()}
+	}
+	ctx := r.Context()
+	var files []StoredFile
+	var vetoed []FileError
+	form := url.Values{}
+	formSize := int64(0)
+	fail := func(err error) ([]StoredFile, url.Values, error) {
+		for _, f := range files {
+			opts.Store.Delete(ctx, f.Key)
+		}
+		return nil, nil, err
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(&UploadError{Status: 400, Msg: err.Error()})
+		}
+		field := part.FormName()
+
+		// regular form field
+		if part.FileName() == "" {
+			buf, err := ioutil.ReadAll(io.LimitReader(part, opts.MaxFormSize-formSize+1))
+			if err != nil {
+				return fail(&UploadError{Status: 400, Field: field, Msg: err.Error()})
+			}
+			if formSize += int64(len(buf)); formSize > opts.MaxFormSize {
+				return fail(&UploadError{Status: http.StatusRequestEntityTooLarge,
+					Field: field, Msg: "form fields too large"})
+			}
+			form.Add(field, string(buf))
+			continue
+		}
+
+		if len(files) >= opts.MaxFiles {
+			return fail(&UploadError{Status: http.StatusRequestEntityTooLarge, Field: field,
+				Msg: fmt.Sprintf("too many files, at most %d allowed", opts.MaxFiles)})
+		}
+		f, err := storePart(c, ctx, part, opts)
+		if ve, ok := err.(*vetoError); ok {
+			vetoed = append(vetoed, FileError{Field: f.Field, Filename: f.Filename,
+				Error: ve.err.Error()})
+			continue
+		}
+		if err != nil {
+			return fail(err)
+		}
+		files = append(files, *f)
+	}
+	if len(vetoed) > 0 {
+		return fail(&UploadError{Status: http.StatusUnprocessableEntity,
+			Msg: "uploaded files rejected", Files: vetoed})
+	}
+	return files, form, nil
+}
+
+// storePart streams one file part into the store
+func storePart(c web.C, ctx context.Context, part *multipart.Part,
+	opts UploadOptions) (*StoredFile, error) {
+
+	field, filename := part.FormName(), part.FileName()
+
+	// sniff the content type from the first bytes
+	br := bufio.NewReaderSize(part, 512)
+	head, _ := br.Peek(512)
+	ct := http.DetectContentType(head)
+	if !typeAllowed(ct, opts.AllowedTypes) {
+		return nil, &UploadError{Status: http.StatusUnsupportedMediaType, Field: field,
+			Msg: fmt.Sprintf("content type %s not allowed", ct)}
+	}
+
+	f := &StoredFile{Field: field, Filename: filename, ContentType: ct,
+		Key: opts.KeyFunc(c, field, filename)}
+	lr := &limitedReader{r: br, n: opts.MaxFileSize}
+	h := sha256.New()
+	var content io.Reader = io.TeeReader(lr, h)
+	scan := startScanners(ctx, opts.Scanners, ScanInfo{Field: field, Filename: filename,
+		ContentType: ct})
+	if scan != nil {
+		content = io.TeeReader(content, scan)
+	}
+	cr := &countingReader{r: content}
+	err := opts.Store.Put(ctx, f.Key, ct, cr)
+	var veto error
+	if scan != nil {
+		veto = scan.finish(err == nil)
+	}
+	if err != nil {
+		opts.Store.Delete(ctx, f.Key)
+		if lr.exceeded {
+			return nil, &UploadError{Status: http.StatusRequestEntityTooLarge, Field: field,
+				Msg: fmt.Sprintf("file exceeds %d bytes", opts.MaxFileSize)}
+		}
+		return nil, err
+	}
+	f.Size = cr.n
+	f.SHA256 = hex.EncodeToString(h.Sum(nil))
+	if veto != nil {
+		opts.Store.Delete(ctx, f.Key)
+		return f, &vetoError{veto}
+	}
+	return f, nil
+}
+
+// typeAllowed matches a content type against a list supporting type/* wildcards
+func typeAllowed(ct string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	for _, a := range allowed {
+		if a == mt || a == "*/*" ||
+			(strings.HasSuffix(a, "/*") && strings.HasPrefix(mt, a[:len(a)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// randomKey is the default UploadOptions.KeyFunc
+func randomKey(c web.C, field, filename string) string {
+	var buf [16]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:]) + strings.ToLower(filepath.Ext(filename))
+}
+
+// errTooLarge is returned by limitedReader once the limit is exceeded
+var errTooLarge = errors.New("upload too large")
+
+// limitedReader fails, rather than silently truncating, when more than n bytes are read
+type limitedReader struct {
+	r        io.Reader
+	n        int64
+	exceeded bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	if l.n -= int64(n); l.n < 0 {
+		l.exceeded = true
+		return 0, errTooLarge
+	}
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
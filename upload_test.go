@@ -0,0 +1,123 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+)
+
+var _ = Describe("StreamUpload", func() {
+	var dir string
+	var c web.C
+
+	BeforeEach(func() {
+		dir, _ = ioutil.TempDir("", "gojiutil")
+		c = web.C{Env: map[interface{}]interface{}{}}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	upload := func(content string) *http.Request {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		mw.WriteField("title", "hello")
+		fw, _ := mw.CreateFormFile("file", "notes.txt")
+		fw.Write([]byte(content))
+		mw.Close()
+		req, _ := http.NewRequest("POST", "/", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		return req
+	}
+
+	It("streams files into the store", func() {
+		files, form, err := StreamUpload(c, upload("some text"), UploadOptions{
+			Store: DirStore{Dir: dir}})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(form.Get("title")).Should(Equal("hello"))
+		Ω(files).Should(HaveLen(1))
+		Ω(files[0].Filename).Should(Equal("notes.txt"))
+		Ω(files[0].Size).Should(BeEquivalentTo(9))
+		Ω(files[0].ContentType).Should(HavePrefix("text/plain"))
+		stored, _ := ioutil.ReadFile(filepath.Join(dir, files[0].Key))
+		Ω(string(stored)).Should(Equal("some text"))
+	})
+
+	It("keeps keys inside the store's directory", func() {
+		store := DirStore{Dir: filepath.Join(dir, "store")}
+		ctx := context.Background()
+		Ω(store.Put(ctx, "a/b.txt", "text/plain", bytes.NewBufferString("x"))).Should(Succeed())
+		Ω(filepath.Join(dir, "store", "a", "b.txt")).Should(BeAnExistingFile())
+		for _, key := range []string{"", "../x", "a/../../x", "/etc/x", "a//b", `..\x`, "."} {
+			Ω(store.Put(ctx, key, "text/plain", bytes.NewBufferString("x"))).
+				ShouldNot(Succeed(), key)
+			Ω(store.Delete(ctx, key)).ShouldNot(Succeed(), key)
+		}
+		Ω(filepath.Join(dir, "x")).ShouldNot(BeAnExistingFile())
+	})
+
+	It("enforces the size limit", func() {
+		_, _, err := StreamUpload(c, upload("some text"), UploadOptions{
+			Store: DirStore{Dir: dir}, MaxFileSize: 4})
+		Ω(err).Should(HaveOccurred())
+		Ω(err.(*UploadError).StatusCode()).Should(Equal(413))
+		left, _ := ioutil.ReadDir(dir)
+		Ω(left).Should(BeEmpty())
+	})
+
+	It("enforces the allowed types", func() {
+		_, _, err := StreamUpload(c, upload("some text"), UploadOptions{
+			Store: DirStore{Dir: dir}, AllowedTypes: []string{"image/*"}})
+		Ω(err).Should(HaveOccurred())
+		Ω(err.(*UploadError).StatusCode()).Should(Equal(415))
+	})
+
+	It("vetoes images that are too large or in formats not registered", func() {
+		png10 := &bytes.Buffer{}
+		png.Encode(png10, image.NewGray(image.Rect(0, 0, 10, 10)))
+		info := ScanInfo{ContentType: "image/png"}
+		ctx := context.Background()
+		Ω(ImageScanner(10, 10).Scan(ctx, info, bytes.NewReader(png10.Bytes()))).Should(Succeed())
+		Ω(ImageScanner(8, 0).Scan(ctx, info, bytes.NewReader(png10.Bytes()))).
+			Should(MatchError("image is 10x10, max is 8x0"))
+		// the GIF decoder isn't registered
+		Ω(ImageScanner(0, 0).Scan(ctx, ScanInfo{ContentType: "image/gif"},
+			bytes.NewBufferString("GIF89a\x01\x00\x01\x00"))).Should(HaveOccurred())
+		Ω(ImageScanner(0, 0).Scan(ctx, ScanInfo{ContentType: "text/plain"},
+			bytes.NewBufferString("GIF89a"))).Should(Succeed())
+	})
+
+	It("deletes files vetoed by scanners", func() {
+		veto := ScannerFunc(func(ctx context.Context, info ScanInfo, r io.Reader) error {
+			buf, _ := ioutil.ReadAll(r)
+			if bytes.Contains(buf, []byte("EICAR")) {
+				return errors.New("infected")
+			}
+			return nil
+		})
+		_, _, err := StreamUpload(c, upload("some EICAR text"), UploadOptions{
+			Store: DirStore{Dir: dir}, Scanners: []UploadScanner{veto, ImageScanner(10, 10)}})
+		Ω(err).Should(HaveOccurred())
+		ue := err.(*UploadError)
+		Ω(ue.StatusCode()).Should(Equal(422))
+		Ω(ue.Files).Should(Equal([]FileError{{Field: "file", Filename: "notes.txt",
+			Error: "infected"}}))
+		left, _ := ioutil.ReadDir(dir)
+		Ω(left).Should(BeEmpty())
+	})
+})
@@ -0,0 +1,73 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Vary header management and cache keys
+
+package gojiutil
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// AddVary appends request header names to the Vary header of a response without introducing
+// duplicates. Every middleware or helper whose output depends on a request header must call
+// it, else shared caches may serve one client's variant to another. A Vary of "*" absorbs
+// everything else.
+func AddVary(h http.Header, fields ...string) {
+	existing := varyFields(h)
+	if len(existing) == 1 && existing[0] == "*" {
+		return
+	}
+	seen := make(map[string]bool, len(existing))
+	for _, f := range existing {
+		seen[f] = true
+	}
+	for _, f := range fields {
+		f = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(f))
+		if f == "*" {
+			h.Set("Vary", "*")
+			return
+		}
+		if f != "" && !seen[f] {
+			seen[f] = true
+			existing = append(existing, f)
+		}
+	}
+	if len(existing) > 0 {
+		h.Set("Vary", strings.Join(existing, ", "))
+	}
+}
+
+// varyFields returns the canonicalized field names in the Vary headers of h
+func varyFields(h http.Header) []string {
+	var fields []string
+	for _, v := range h["Vary"] {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				fields = append(fields, textproto.CanonicalMIMEHeaderKey(f))
+			}
+		}
+	}
+	return fields
+}
+
+// VaryKey computes the key under which a cache must store a response: it covers the method,
+// the URL, and the request's values of each header named in the response's Vary header. The
+// second result is false if the response must not be cached because it varies on "*".
+func VaryKey(r *http.Request, resp http.Header) (string, bool) {
+	fields := varyFields(resp)
+	sort.Strings(fields)
+	sum := sha256.New()
+	sum.Write([]byte(r.Method + " " + r.URL.String()))
+	for _, f := range fields {
+		if f == "*" {
+			return "", false
+		}
+		sum.Write([]byte("\n" + f + ":" + strings.Join(r.Header[f], ",")))
+	}
+	return hex.EncodeToString(sum.Sum(nil)), true
+}
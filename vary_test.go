@@ -0,0 +1,39 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Vary", func() {
+
+	It("adds fields without duplicates", func() {
+		h := http.Header{"Vary": {"accept-encoding"}}
+		AddVary(h, "Accept-Language", "Accept-Encoding")
+		AddVary(h, "accept-language")
+		Ω(h.Get("Vary")).Should(Equal("Accept-Encoding, Accept-Language"))
+		AddVary(h, "*")
+		AddVary(h, "Cookie")
+		Ω(h.Get("Vary")).Should(Equal("*"))
+	})
+
+	It("keys on the varying request headers", func() {
+		resp := http.Header{"Vary": {"Accept-Language"}}
+		r1, _ := http.NewRequest("GET", "/foo", nil)
+		r1.Header.Set("Accept-Language", "fr")
+		r1.Header.Set("User-Agent", "a")
+		r2, _ := http.NewRequest("GET", "/foo", nil)
+		r2.Header.Set("Accept-Language", "en")
+		r2.Header.Set("User-Agent", "b")
+		k1, _ := VaryKey(r1, resp)
+		k2, _ := VaryKey(r2, resp)
+		Ω(k1).ShouldNot(Equal(k2))
+		r2.Header.Set("Accept-Language", "fr")
+		k2, _ = VaryKey(r2, resp)
+		Ω(k1).Should(Equal(k2))
+	})
+})
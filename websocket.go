@@ -0,0 +1,293 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// WebSocket upgrades
+
+package gojiutil
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+// ContextWebsocket is the hash key in which UpgradeWebsocket places the *WebSocket, Logger15
+// then logs the request as a 101 once the connection closes, with its lifetime as time
+var ContextWebsocket string = "websocket"
+
+// WebSocket message types
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+	closeMessage  = 8
+	pingMessage   = 9
+	pongMessage   = 10
+)
+
+// WebsocketOptions configures UpgradeWebsocket
+type WebsocketOptions struct {
+	// Subprotocols supported by the server in order of preference
+	Subprotocols []string
+	// CheckOrigin returns whether to accept the request's Origin, by default only requests
+	// without Origin or from the same host are accepted, to prevent cross-site hijacking
+	CheckOrigin func(r *http.Request) bool
+	// MaxMessageSize is the max size of incoming messages, default 1MB
+	MaxMessageSize int64
+}
+
+// WebSocket is a minimal server-side RFC 6455 connection: it reads and writes complete
+// messages, answers pings, and completes the closing handshake. Reads must happen on a single
+// goroutine, writes may happen concurrently.
+type WebSocket struct {
+	RequestID   string // ID of the request that was upgraded
+	Subprotocol string // negotiated subprotocol, if any
+	conn        net.Conn
+	br          *bufio.Reader
+	max         int64
+	wmu         sync.Mutex
+	closeOnce   sync.Once
+	closed      chan struct{}
+}
+
+// UpgradeWebsocket validates a WebSocket handshake request, hijacks the connection and writes
+// the 101 Switching Protocols response. On failure a 400 (or 403 for a rejected origin) is
+// produced through ErrorString and an error is returned. The connection is tagged with the
+// request ID and placed into c.Env[ContextWebsocket] so Logger15 records it properly.
+func UpgradeWebsocket(c web.C, rw http.ResponseWriter, r *http.Request,
+	opts WebsocketOptions) (*WebSocket, error) {
+	if r.Method != "GET" || !headerHasToken(r.Header, "Connection", "upgrade") ||
+		!headerHasToken(r.Header, "Upgrade", "websocket") {
+		ErrorString(c, rw, 400, "Not a websocket handshake")
+		return nil, errors.New("websocket: not a websocket handshake")
+	}
+	if r.Header.Get("Sec-Websocket-Version") != "13" {
+		rw.Header().Set("Sec-Websocket-Version", "13")
+		ErrorString(c, rw, 400, "Unsupported websocket version")
+		return nil, errors.New("websocket: unsupported version")
+	}
+	key := r.Header.Get("Sec-Websocket-Key")
+	if k, err := base64.StdEncoding.DecodeString(key); err != nil || len(k) != 16 {
+		ErrorString(c, rw, 400, "Invalid Sec-WebSocket-Key")
+		return nil, errors.New("websocket: invalid key")
+	}
+	checkOrigin := opts.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(r) {
+		ErrorString(c, rw, 403, "Origin not allowed")
+		return nil, errors.New("websocket: origin not allowed")
+	}
+	ws := &WebSocket{RequestID: middleware.GetReqID(c), max: opts.MaxMessageSize,
+		closed: make(chan struct{})}
+	if ws.max <= 0 {
+		ws.max = 1 << 20
+	}
+	offered := strings.Split(r.Header.Get("Sec-Websocket-Protocol"), ",")
+	for _, p := range opts.Subprotocols {
+		for _, o := range offered {
+			if ws.Subprotocol == "" && strings.TrimSpace(o) == p {
+				ws.Subprotocol = p
+			}
+		}
+	}
+
+	// the response controller finds the Hijacker under middlewares' writers that Unwrap
+	conn, brw, err := http.NewResponseController(rw).Hijack()
+	if errors.Is(err, http.ErrNotSupported) {
+		ErrorString(c, rw, 500, "websocket: response writer cannot be hijacked")
+		return nil, errors.New("websocket: response writer cannot be hijacked")
+	} else if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	resp := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n" +
+		"Connection: Upgrade\r\nSec-WebSocket-Accept: " +
+		base64.StdEncoding.EncodeToString(sum[:]) + "\r\n"
+	if ws.Subprotocol != "" {
+		resp += "Sec-WebSocket-Protocol: " + ws.Subprotocol + "\r\n"
+	}
+	if _, err := conn.Write([]byte(resp + "\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ws.conn, ws.br = conn, brw.Reader
+	c.Env[ContextWebsocket] = ws
+	return ws, nil
+}
+
+// upgraded tells whether UpgradeWebsocket took the request's connection over, middlewares
+// that complete the response after the handler must then leave it alone
+func upgraded(c *web.C) bool {
+	_, ok := c.Env[ContextWebsocket]
+	return ok
+}
+
+// headerHasToken checks whether a comma-separated header contains a token
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameOrigin accepts requests without Origin or whose Origin has the request's host
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// ReadMessage returns the next complete text or binary message, control frames are handled
+// internally. It returns io.EOF once the peer closes the connection.
+func (ws *WebSocket) ReadMessage() (messageType int, data []byte, err error) {
+	for {
+		fin, op, payload, err := ws.readFrame()
+		if err != nil {
+			ws.Close()
+			return 0, nil, err
+		}
+		switch op {
+		case pingMessage:
+			ws.writeFrame(pongMessage, payload)
+			continue
+		case pongMessage:
+			continue
+		case closeMessage:
+			ws.writeFrame(closeMessage, payload) // echo the status code
+			ws.Close()
+			return 0, nil, io.EOF
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				ws.Close()
+				return 0, nil, errors.New("websocket: unexpected new message in fragments")
+			}
+			messageType = op
+		case 0: // continuation
+			if messageType == 0 {
+				ws.Close()
+				return 0, nil, errors.New("websocket: unexpected continuation frame")
+			}
+		default:
+			ws.Close()
+			return 0, nil, fmt.Errorf("websocket: unknown opcode %d", op)
+		}
+		if int64(len(data)+len(payload)) > ws.max {
+			ws.WriteClose(1009, "message too big")
+			ws.Close()
+			return 0, nil, errors.New("websocket: message too big")
+		}
+		data = append(data, payload...)
+		if fin {
+			return messageType, data, nil
+		}
+	}
+}
+
+// readFrame reads one frame, unmasking its payload
+func (ws *WebSocket) readFrame() (fin bool, op int, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(ws.br, hdr[:]); err != nil {
+		return
+	}
+	fin, op = hdr[0]&0x80 != 0, int(hdr[0]&0x0f)
+	if hdr[1]&0x80 == 0 {
+		return fin, op, nil, errors.New("websocket: client frame not masked")
+	}
+	n := int64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(ws.br, ext[:]); err != nil {
+			return
+		}
+		n = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(ws.br, ext[:]); err != nil {
+			return
+		}
+		n = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+	if n < 0 || n > ws.max {
+		return fin, op, nil, errors.New("websocket: frame too big")
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(ws.br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(ws.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// WriteMessage sends a complete text or binary message
+func (ws *WebSocket) WriteMessage(messageType int, data []byte) error {
+	return ws.writeFrame(messageType, data)
+}
+
+// WriteClose starts the closing handshake with a status code and reason
+func (ws *WebSocket) WriteClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	return ws.writeFrame(closeMessage, append(payload, reason...))
+}
+
+func (ws *WebSocket) writeFrame(op int, payload []byte) error {
+	hdr := []byte{0x80 | byte(op)}
+	switch n := len(payload); {
+	case n < 126:
+		hdr = append(hdr, byte(n))
+	case n < 65536:
+		hdr = append(hdr, 126)
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr = append(hdr, 127)
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	ws.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := ws.conn.Write(hdr); err != nil {
+		return err
+	}
+	_, err := ws.conn.Write(payload)
+	return err
+}
+
+// Close closes the underlying connection without a closing handshake
+func (ws *WebSocket) Close() error {
+	var err error
+	ws.closeOnce.Do(func() {
+		err = ws.conn.Close()
+		close(ws.closed)
+	})
+	return err
+}
+
+// Done returns a channel that's closed once the connection is closed
+func (ws *WebSocket) Done() <-chan struct{} { return ws.closed }
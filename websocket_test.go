@@ -0,0 +1,179 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	stdlog "log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("UpgradeWebsocket", func() {
+
+	var srv *httptest.Server
+	var mu sync.Mutex
+	var logged []string
+
+	echo := func(c web.C, rw http.ResponseWriter, r *http.Request) {
+		ws, err := UpgradeWebsocket(c, rw, r, WebsocketOptions{Subprotocols: []string{"echo"}})
+		if err != nil {
+			return
+		}
+		go func() { // echo messages until the client closes
+			for {
+				t, msg, err := ws.ReadMessage()
+				if err != nil {
+					return
+				}
+				ws.WriteMessage(t, append([]byte(ws.RequestID+":"), msg...))
+			}
+		}()
+	}
+
+	BeforeEach(func() {
+		logged = nil
+		l := log15.New()
+		l.SetHandler(log15.FuncHandler(func(r *log15.Record) error {
+			mu.Lock()
+			defer mu.Unlock()
+			logged = append(logged, fmt.Sprintf("%s %+v", r.Msg, r.Ctx))
+			return nil
+		}))
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(middleware.RequestID)
+		mx.Use(Logger15(l))
+		mx.Get("/ws", echo)
+		srv = httptest.NewServer(mx)
+	})
+
+	AfterEach(func() { srv.Close() })
+
+	logs := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return strings.Join(logged, "\n")
+	}
+
+	// writeFrame sends a masked client frame
+	writeFrame := func(conn net.Conn, op byte, payload string) {
+		mask := []byte{1, 2, 3, 4}
+		frame := []byte{0x80 | op, 0x80 | byte(len(payload))}
+		frame = append(frame, mask...)
+		for i := range payload {
+			frame = append(frame, payload[i]^mask[i%4])
+		}
+		conn.Write(frame)
+	}
+
+	// upgrade sends the upgrade request and reads the response
+	upgrade := func(srv *httptest.Server) (net.Conn, *bufio.Reader, *http.Response) {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		Ω(err).ShouldNot(HaveOccurred())
+		fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\n"+
+			"Upgrade: websocket\r\nSec-WebSocket-Version: 13\r\n"+
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+			"Sec-WebSocket-Protocol: chat, echo\r\n\r\n", srv.Listener.Addr())
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		return conn, br, resp
+	}
+
+	It("upgrades, echoes and logs a 101", func() {
+		conn, br, resp := upgrade(srv)
+		defer conn.Close()
+		Ω(resp.StatusCode).Should(Equal(101))
+		Ω(resp.Header.Get("Sec-WebSocket-Accept")).Should(Equal("s3pPLMBiTxaQ9kYGzzhZRbK+xOo="))
+		Ω(resp.Header.Get("Sec-WebSocket-Protocol")).Should(Equal("echo"))
+
+		writeFrame(conn, TextMessage, "hello")
+		hdr := make([]byte, 2)
+		_, err := io.ReadFull(br, hdr)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(hdr[0]).Should(Equal(byte(0x81)))
+		msg := make([]byte, hdr[1])
+		_, err = io.ReadFull(br, msg)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(msg)).Should(HaveSuffix(":hello"))
+		Ω(string(msg)).ShouldNot(HavePrefix(":")) // tagged with the request ID
+		Ω(logs()).Should(BeEmpty())               // not logged until closed
+
+		writeFrame(conn, closeMessage, "\x03\xe8")
+		Eventually(logs).Should(ContainSubstring("status 101"))
+		Ω(logs()).Should(ContainSubstring("/ws"))
+	})
+
+	It("upgrades behind middlewares wrapping the response writer", func() {
+		var errLog syncBuffer
+		mx := web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Use(CacheControl(CacheRule{Pattern: "/*", Policy: CachePolicy{NoStore: true}}))
+		mx.Use(ETag(1024))
+		mx.Get("/ws", echo)
+		srv := httptest.NewUnstartedServer(mx)
+		srv.Config.ErrorLog = stdlog.New(&errLog, "", 0)
+		srv.Start()
+		defer srv.Close()
+
+		conn, br, resp := upgrade(srv)
+		defer conn.Close()
+		Ω(resp.StatusCode).Should(Equal(101))
+		writeFrame(conn, TextMessage, "hi")
+		hdr := make([]byte, 2)
+		_, err := io.ReadFull(br, hdr)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(hdr[0]).Should(Equal(byte(0x81)))
+		Consistently(errLog.String).Should(BeEmpty())
+	})
+
+	It("rejects plain requests", func() {
+		resp, err := http.Get(srv.URL + "/ws")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(resp.StatusCode).Should(Equal(400))
+		Eventually(logs).Should(ContainSubstring("status 400"))
+	})
+
+	It("rejects cross-origin requests", func() {
+		req, _ := http.NewRequest("GET", srv.URL+"/ws", nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		req.Header.Set("Origin", "https://evil.example.com")
+		resp, err := http.DefaultClient.Do(req)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(resp.StatusCode).Should(Equal(403))
+	})
+})
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
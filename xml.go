@@ -0,0 +1,109 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// XML request bodies
+
+package gojiutil
+
+import (
+	"encoding/xml"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+)
+
+// ContextXML is the hash key in which GetXMLBody places the decoded body
+var ContextXML string = "xml"
+
+// XMLNode is the generic representation of an XML element used by GetXMLBody
+type XMLNode struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Content  string     `xml:",chardata"`
+	Children []XMLNode  `xml:",any"`
+}
+
+// Child returns the first child element with the local name, or nil
+func (n *XMLNode) Child(name string) *XMLNode {
+	for i := range n.Children {
+		if n.Children[i].XMLName.Local == name {
+			return &n.Children[i]
+		}
+	}
+	return nil
+}
+
+// Attr returns the value of the attribute with the local name, or ""
+func (n *XMLNode) Attr(name string) string {
+	for _, a := range n.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// GetXMLBody is a middleware to read and parse an XML body and store it in c.Env[ContextXML]
+// as an *XMLNode. Like GetJSONBody it allows for having no content-type as long as either
+// there's no body or the body parses as XML, in which case c.Env[ContextXML] is nil.
+func GetXMLBody(c *web.C, h http.Handler) http.Handler {
+	return getXMLBody(c, h, func() interface{} { return &XMLNode{} })
+}
+
+// GetXMLBodyInto creates a middleware like GetXMLBody that decodes the body into the value
+// returned by factory, typically a pointer to a struct with xml tags
+func GetXMLBodyInto(factory func() interface{}) web.MiddlewareType {
+	return func(c *web.C, h http.Handler) http.Handler {
+		return getXMLBody(c, h, factory)
+	}
+}
+
+func getXMLBody(c *web.C, h http.Handler, factory func() interface{}) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		cl := 0
+		if clh := r.Header.Get("content-length"); clh != "" {
+			var err error
+			if cl, err = strconv.Atoi(clh); err != nil {
+				ErrorString(*c, rw, 400, "Invalid content-length: "+err.Error())
+				return
+			}
+		}
+		if ct := r.Header.Get("content-type"); !isXMLContentType(ct) {
+			ErrorString(*c, rw, 400,
+				"Invalid content-type '"+ct+"', application/xml expected")
+			return
+		}
+
+		v := factory()
+		err := xml.NewDecoder(r.Body).Decode(v)
+		switch err {
+		case io.EOF:
+			if cl != 0 {
+				ErrorString(*c, rw, 400, "Premature EOF reading post body")
+				return
+			}
+			v = nil // got no body, so we're OK
+		case nil:
+		default:
+			ErrorString(*c, rw, 400, "Cannot parse XML request body: "+err.Error())
+			return
+		}
+
+		c.Env[ContextXML] = v
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// isXMLContentType accepts application/xml, text/xml, and the +xml types such as
+// application/soap+xml, with parameters, as well as a missing content-type
+func isXMLContentType(ct string) bool {
+	if ct == "" {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	return err == nil &&
+		(mt == "application/xml" || mt == "text/xml" || strings.HasSuffix(mt, "+xml"))
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package gojiutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+var _ = Describe("GetXMLBody", func() {
+
+	var mx *web.Mux
+	var env map[interface{}]interface{}
+
+	BeforeEach(func() {
+		env = nil
+		mx = web.New()
+		mx.Use(middleware.EnvInit)
+		mx.Post("/", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+			env = c.Env
+		})
+	})
+
+	post := func(ct, body string) int {
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+		req.Header.Set("Content-Type", ct)
+		resp := httptest.NewRecorder()
+		mx.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	It("parses into generic nodes", func() {
+		mx.Use(GetXMLBody)
+		Ω(post("application/soap+xml; charset=utf-8",
+			`<order id="7"><item>book</item></order>`)).Should(Equal(200))
+		n := env[ContextXML].(*XMLNode)
+		Ω(n.XMLName.Local).Should(Equal("order"))
+		Ω(n.Attr("id")).Should(Equal("7"))
+		Ω(n.Child("item").Content).Should(Equal("book"))
+	})
+
+	It("parses into structs", func() {
+		type order struct {
+			ID string `xml:"id,attr"`
+		}
+		mx.Use(GetXMLBodyInto(func() interface{} { return &order{} }))
+		Ω(post("text/xml", `<order id="7"/>`)).Should(Equal(200))
+		Ω(env[ContextXML]).Should(Equal(&order{"7"}))
+	})
+
+	It("rejects bad content", func() {
+		mx.Use(GetXMLBody)
+		Ω(post("application/json", `{}`)).Should(Equal(400))
+		Ω(post("text/xml", `<order>`)).Should(Equal(400))
+		Ω(env).Should(BeNil())
+	})
+})
@@ -0,0 +1,36 @@
+// Copyright (c) 2015 RightScale, Inc., see LICENSE
+
+// Package zaplog adapts go.uber.org/zap to gojiutil.Logger. It is separate from gojiutil so
+// only applications logging through zap depend on it.
+package zaplog
+
+import (
+	"github.com/rightscale/gojiutil"
+	"github.com/zenazn/goji/web"
+	"go.uber.org/zap"
+)
+
+// ZapLogger adapts a *zap.Logger to gojiutil.Logger, logging through its sugared flavor so the
+// key/value pairs are the same as with log15. Crit messages are logged at the error level as
+// zap's higher levels panic or exit.
+func ZapLogger(l *zap.Logger) gojiutil.Logger {
+	return zapLogger{l.Sugar()}
+}
+
+type zapLogger struct{ s *zap.SugaredLogger }
+
+func (l zapLogger) Debug(msg string, ctx ...interface{}) { l.s.Debugw(msg, ctx...) }
+func (l zapLogger) Info(msg string, ctx ...interface{})  { l.s.Infow(msg, ctx...) }
+func (l zapLogger) Warn(msg string, ctx ...interface{})  { l.s.Warnw(msg, ctx...) }
+func (l zapLogger) Error(msg string, ctx ...interface{}) { l.s.Errorw(msg, ctx...) }
+func (l zapLogger) Crit(msg string, ctx ...interface{})  { l.s.Errorw(msg, ctx...) }
+
+// With implements gojiutil.ChildLogger
+func (l zapLogger) With(ctx ...interface{}) gojiutil.Logger {
+	return zapLogger{l.s.With(ctx...)}
+}
+
+// LoggerZap is the zap flavor of gojiutil.Logger15, with the same fields
+func LoggerZap(l *zap.Logger) web.MiddlewareType {
+	return gojiutil.RequestLogger(ZapLogger(l))
+}
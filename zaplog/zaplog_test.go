@@ -0,0 +1,52 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package zaplog
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rightscale/gojiutil"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// serve logs a request that fails with a 404 through mw
+func serve(mw web.MiddlewareType) {
+	mx := web.New()
+	mx.Use(middleware.EnvInit)
+	mx.Use(gojiutil.RequestID)
+	mx.Use(mw)
+	mx.Get("/missing", func(c web.C, rw http.ResponseWriter, r *http.Request) {
+		gojiutil.ErrorString(c, rw, 404, "Not here")
+	})
+	req, _ := http.NewRequest("GET", "/missing", nil)
+	mx.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+var _ = Describe("LoggerZap", func() {
+
+	It("logs to zap with the usual fields", func() {
+		core, logs := observer.New(zap.DebugLevel)
+		serve(LoggerZap(zap.New(core)))
+		Ω(logs.Len()).Should(Equal(1))
+		entry := logs.All()[0]
+		Ω(entry.Level).Should(Equal(zap.WarnLevel))
+		Ω(entry.Message).Should(Equal("/missing"))
+		fields := entry.ContextMap()
+		Ω(fields).Should(HaveKeyWithValue("status", "404"))
+		Ω(fields).Should(HaveKeyWithValue("err", "Not here"))
+		Ω(fields).Should(HaveKey("req"))
+	})
+
+	It("adds fields with zap's own mechanism", func() {
+		core, logs := observer.New(zap.DebugLevel)
+		gojiutil.LoggerWith(ZapLogger(zap.New(core)), "a", 1).Info("hi", "b", 2)
+		Ω(logs.All()[0].ContextMap()).Should(Equal(map[string]interface{}{"a": int64(1),
+			"b": int64(2)}))
+	})
+})